@@ -0,0 +1,30 @@
+package libcore
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+
+	"libcore/comm"
+)
+
+// SetPacketAffinity dedicates a thread to each tun reader and packet
+// dispatch loop started afterwards, kept apart from the goroutines of v2ray,
+// and pins those threads to the comma separated cpu indexes, like the big
+// cores of a big.LITTLE cpu. Empty cpus lets the scheduler place them again.
+// Pinning is only supported on Linux and Android.
+func SetPacketAffinity(cpus string) error {
+	var indexes []int
+	for _, cpu := range strings.Split(cpus, ",") {
+		if cpu = strings.TrimSpace(cpu); cpu == "" {
+			continue
+		}
+		index, err := strconv.Atoi(cpu)
+		if err != nil || index < 0 || index >= runtime.NumCPU() {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid cpu ", cpu))
+		}
+		indexes = append(indexes, index)
+	}
+	comm.SetPacketCpus(indexes)
+	return nil
+}
@@ -1,7 +1,6 @@
 package libcore
 
 import (
-	"errors"
 	"net"
 	"strings"
 	"sync"
@@ -38,7 +37,7 @@ func (i *ApiInstance) Start() (err error) {
 	defer i.access.Unlock()
 
 	if i.started {
-		return errors.New("already started")
+		return withCode(ErrorCodeInvalidState, newError("api already started"))
 	}
 
 	i.conn, err = net.ListenUDP("udp4", &net.UDPAddr{
@@ -46,7 +45,7 @@ func (i *ApiInstance) Start() (err error) {
 		Port: 11451,
 	})
 	if err != nil {
-		return err
+		return exportError(newError("listen api").Base(err))
 	}
 
 	i.started = true
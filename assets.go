@@ -45,6 +45,9 @@ type BoolFunc interface {
 }
 
 func InitializeV2Ray(internalAssets string, externalAssets string, prefix string, useOfficial BoolFunc, useSystemCerts BoolFunc) error {
+	if useOfficial == nil || useSystemCerts == nil {
+		return withCode(ErrorCodeInvalidArgument, newError("missing asset callbacks"))
+	}
 	assetsAccess = new(sync.Mutex)
 	assetsAccess.Lock()
 	extracted = make(map[string]bool)
@@ -83,7 +86,9 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 
 		err = extractAssetName(fileName, false)
 		if err != nil {
-			return nil, err
+			if fallbackErr := extractFallbackAsset(fileName); fallbackErr != nil {
+				return nil, err
+			}
 		}
 
 		for _, path = range paths {
@@ -107,6 +112,9 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 		err := extractAssetName(name, false)
 		if err != nil {
 			logrus.Warnf("Extract %s failed: %v", geoipDat, err)
+			if extractFallbackAsset(name) == nil {
+				extracted[name] = true
+			}
 		} else {
 			extracted[name] = true
 		}
@@ -132,6 +140,18 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 	return nil
 }
 
+func assetVersionFile(name string) string {
+	switch name {
+	case geoipDat:
+		return geoipVersion
+	case geositeDat:
+		return geositeVersion
+	case browserForwarder:
+		return coreVersion
+	}
+	return ""
+}
+
 func extractAssetName(name string, force bool) error {
 	var dir string
 	if name == browserForwarder {
@@ -139,15 +159,7 @@ func extractAssetName(name string, force bool) error {
 	} else {
 		dir = externalAssetsPath
 	}
-	var version string
-	switch name {
-	case geoipDat:
-		version = geoipVersion
-	case geositeDat:
-		version = geositeVersion
-	case browserForwarder:
-		version = coreVersion
-	}
+	version := assetVersionFile(name)
 
 	var localVersion string
 	var assetVersion string
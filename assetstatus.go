@@ -0,0 +1,73 @@
+package libcore
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type AssetStatus struct {
+	Name    string
+	Path    string
+	Version string
+	// ModifiedAt is in unix seconds.
+	ModifiedAt int64
+	Size       int64
+	Sha256     string
+}
+
+// GetAssetStatus returns the installed version of an asset like geoip.dat,
+// looked up the same way v2ray opens it. Size and hash are empty if the asset
+// is not extracted yet, computing the hash reads the whole file.
+func GetAssetStatus(name string, withHash bool) (*AssetStatus, error) {
+	versionFile := assetVersionFile(name)
+	if versionFile == "" {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("unknown asset ", name))
+	}
+	status := &AssetStatus{Name: name}
+	for _, dir := range []string{internalAssetsPath, externalAssetsPath} {
+		info, err := os.Stat(dir + name)
+		if err != nil {
+			continue
+		}
+		status.Path = dir + name
+		status.Size = info.Size()
+		status.ModifiedAt = info.ModTime().Unix()
+		if version, err := ioutil.ReadFile(dir + versionFile); err == nil {
+			status.Version = strings.TrimSpace(string(version))
+		}
+		break
+	}
+	if status.Path != "" && withHash {
+		sum, err := Sha256File(status.Path, nil)
+		if err != nil {
+			return nil, err
+		}
+		status.Sha256 = sum
+	}
+	return status, nil
+}
+
+// NeedsUpdate returns whether remoteVersion is newer than the installed
+// version of asset name, versions are compared as numbers when possible.
+func NeedsUpdate(name string, remoteVersion string) (bool, error) {
+	status, err := GetAssetStatus(name, false)
+	if err != nil {
+		return false, err
+	}
+	return isNewerAssetVersion(status.Version, remoteVersion), nil
+}
+
+func isNewerAssetVersion(local string, remote string) bool {
+	remote = strings.TrimSpace(remote)
+	if local == "" {
+		return remote != ""
+	}
+	remoteVersion, err := strconv.ParseUint(remote, 10, 64)
+	if err != nil {
+		return remote != local
+	}
+	localVersion, err := strconv.ParseUint(local, 10, 64)
+	return err != nil || remoteVersion > localVersion
+}
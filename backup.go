@@ -0,0 +1,293 @@
+package libcore
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	backupManifestName = "manifest.json"
+	backupVersion      = 1
+)
+
+type backupManifest struct {
+	Version int `json:"version"`
+	// Roots maps the directory name in the archive to the backed up path.
+	Roots map[string]string `json:"roots"`
+	// Files maps archive entries to their sha256.
+	Files map[string]string `json:"files"`
+}
+
+// CreateBackup writes the directories in paths (separated by newlines) to the
+// zip archive destZip, pcap captures are skipped.
+func CreateBackup(paths string, destZip string) error {
+	manifest := &backupManifest{
+		Version: backupVersion,
+		Roots:   make(map[string]string),
+		Files:   make(map[string]string),
+	}
+	tmpPath := destZip + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return exportError(newError("create backup").Base(err))
+	}
+	writer := zip.NewWriter(file)
+	err = writeBackup(writer, manifest, paths)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, destZip)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return exportError(newError("create backup").Base(err))
+	}
+	return nil
+}
+
+// backupRoots names the directories in paths (separated by newlines) after
+// their base name, numbering duplicates in order.
+func backupRoots(paths string) map[string]string {
+	roots := make(map[string]string)
+	for _, root := range strings.Split(paths, "\n") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		root = filepath.Clean(root)
+		name := filepath.Base(root)
+		for i := 1; roots[name] != ""; i++ {
+			name = filepath.Base(root) + "-" + strconv.Itoa(i)
+		}
+		roots[name] = root
+	}
+	return roots
+}
+
+func writeBackup(writer *zip.Writer, manifest *backupManifest, paths string) error {
+	manifest.Roots = backupRoots(paths)
+	names := make([]string, 0, len(manifest.Roots))
+	for name := range manifest.Roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		root := manifest.Roots[name]
+		err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == "pcap" && filePath != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			relative, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			entry := path.Join(name, filepath.ToSlash(relative))
+			sum, err := writeBackupFile(writer, entry, filePath, info)
+			if err != nil {
+				return newError("backup ", filePath).Base(err)
+			}
+			manifest.Files[entry] = sum
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	entry, err := writer.Create(backupManifestName)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(entry).Encode(manifest)
+}
+
+func writeBackupFile(writer *zip.Writer, entry string, filePath string, info os.FileInfo) (string, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return "", err
+	}
+	header.Name = entry
+	header.Method = zip.Deflate
+	w, err := writer.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(w, hash), file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RestoreBackup restores an archive created by CreateBackup to paths, which
+// are given as to CreateBackup and matched to the archive by their names.
+// The paths recorded in the archive are not used, and roots not in paths are
+// rejected. Everything is extracted and verified against the manifest
+// checksums first, existing files are only replaced if all of them are
+// valid. Files missing from the backup are kept.
+func RestoreBackup(zipPath string, paths string) error {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return exportError(newError("open backup").Base(err))
+	}
+	defer reader.Close()
+
+	manifest, err := readBackupManifest(&reader.Reader)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, err)
+	}
+
+	roots := backupRoots(paths)
+	for name := range manifest.Roots {
+		if _, ok := roots[name]; !ok {
+			return withCode(ErrorCodeConfigInvalid, newError("backup root ", name, " is not configured"))
+		}
+	}
+
+	staging := make(map[string]string)
+	defer func() {
+		for _, dir := range staging {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	for name := range manifest.Roots {
+		root := roots[name]
+		if err = os.MkdirAll(root, 0o755); err != nil {
+			return exportError(newError("create ", root).Base(err))
+		}
+		dir, err := ioutil.TempDir(filepath.Dir(root), ".restore-")
+		if err != nil {
+			return exportError(newError("create staging dir for ", root).Base(err))
+		}
+		staging[name] = dir
+	}
+
+	e := newExtractor(nil)
+	for _, file := range reader.File {
+		if file.Name == backupManifestName || !file.Mode().IsRegular() {
+			continue
+		}
+		sum, ok := manifest.Files[file.Name]
+		if !ok {
+			return withCode(ErrorCodeConfigInvalid, newError("unexpected file in backup: ", file.Name))
+		}
+		name, relative := splitBackupEntry(file.Name)
+		dir, ok := staging[name]
+		if !ok || relative == "" {
+			return withCode(ErrorCodeConfigInvalid, newError("invalid backup entry: ", file.Name))
+		}
+		if err = restoreBackupFile(e, file, dir, relative, sum); err != nil {
+			return withCode(ErrorCodeConfigInvalid, newError("restore ", file.Name).Base(err))
+		}
+	}
+
+	for name, dir := range staging {
+		if err = moveTree(dir, roots[name]); err != nil {
+			return exportError(newError("restore ", roots[name]).Base(err))
+		}
+	}
+	return nil
+}
+
+func readBackupManifest(reader *zip.Reader) (*backupManifest, error) {
+	for _, file := range reader.File {
+		if file.Name != backupManifestName {
+			continue
+		}
+		entry, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer entry.Close()
+		var manifest backupManifest
+		if err = json.NewDecoder(entry).Decode(&manifest); err != nil {
+			return nil, newError("invalid backup manifest").Base(err)
+		}
+		if manifest.Version != backupVersion {
+			return nil, newError("unsupported backup version ", manifest.Version)
+		}
+		return &manifest, nil
+	}
+	return nil, newError("backup manifest not found")
+}
+
+func splitBackupEntry(entry string) (string, string) {
+	index := strings.IndexByte(entry, '/')
+	if index < 0 {
+		return entry, ""
+	}
+	return entry[:index], entry[index+1:]
+}
+
+// restoreBackupFile extracts file to dir and checks its sha256, json files
+// are also checked to be well-formed.
+func restoreBackupFile(e *extractor, file *zip.File, dir string, relative string, sum string) error {
+	entry, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+	actual, err := e.extract(dir, relative, file.Mode(), entry)
+	if err != nil {
+		return err
+	}
+	if actual != sum {
+		return newError("checksum mismatch")
+	}
+	if strings.HasSuffix(relative, ".json") {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(relative)))
+		if err != nil {
+			return err
+		}
+		if !json.Valid(content) {
+			return newError("invalid json")
+		}
+	}
+	return nil
+}
+
+// moveTree moves the files under source into target, replacing existing ones.
+func moveTree(source string, target string) error {
+	return filepath.Walk(source, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(source, filePath)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(target, relative)
+		if err = os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+			return err
+		}
+		return os.Rename(filePath, destination)
+	})
+}
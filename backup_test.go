@@ -0,0 +1,126 @@
+package libcore
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "files")
+	for name, content := range map[string]string{
+		"config.json":    `{"a":1}`,
+		"rules/cn.txt":   "cn",
+		"pcap/dump.pcap": "skipped",
+	} {
+		writeTestFile(t, filepath.Join(root, name), content)
+	}
+	archive := filepath.Join(dir, "backup.zip")
+	if err = CreateBackup(root, archive); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "config.json"), `{"a":2}`)
+	if err = os.RemoveAll(filepath.Join(root, "rules")); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestoreBackup(archive, root); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"config.json":    `{"a":1}`,
+		"rules/cn.txt":   "cn",
+		"pcap/dump.pcap": "skipped",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil || string(content) != want {
+			t.Errorf("%s: got %q, %v", name, content, err)
+		}
+	}
+}
+
+func TestRestoreBackupManifestRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "files")
+	outside := filepath.Join(dir, "outside")
+
+	archive := filepath.Join(dir, "unknown.zip")
+	writeTestBackup(t, archive, map[string]string{"evil": outside}, "evil/payload", "evil")
+	if err = RestoreBackup(archive, root); err == nil {
+		t.Fatal("restored a root that is not configured")
+	}
+	if _, err = os.Stat(filepath.Join(outside, "payload")); !os.IsNotExist(err) {
+		t.Fatal("wrote to the path of the manifest")
+	}
+
+	// a configured name restores to the configured path
+	archive = filepath.Join(dir, "redirected.zip")
+	writeTestBackup(t, archive, map[string]string{"files": outside}, "files/payload", "restored")
+	if err = RestoreBackup(archive, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(outside, "payload")); !os.IsNotExist(err) {
+		t.Fatal("wrote to the path of the manifest")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "payload"))
+	if err != nil || string(content) != "restored" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+}
+
+func writeTestFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestBackup writes an archive holding entry with a valid checksum and
+// a manifest with roots.
+func writeTestBackup(t *testing.T, archive string, roots map[string]string, entry string, content string) {
+	t.Helper()
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	w, err := writer.Create(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	manifest := &backupManifest{
+		Version: backupVersion,
+		Roots:   roots,
+		Files:   map[string]string{entry: hex.EncodeToString(sum[:])},
+	}
+	if w, err = writer.Create(backupManifestName); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.NewEncoder(w).Encode(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
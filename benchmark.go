@@ -0,0 +1,369 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// Names of the benchmarks of RunBenchmark.
+const (
+	// BenchmarkDial connects a protected tcp socket to a loopback server.
+	BenchmarkDial = "dial"
+	// BenchmarkConnection sets up a tun tcp connection through a freedom
+	// outbound and round trips one byte.
+	BenchmarkConnection = "connection"
+	// BenchmarkUdpRelay round trips a datagram over an open udp session of
+	// the tun.
+	BenchmarkUdpRelay = "udp-relay"
+	// BenchmarkStats writes a 16KiB chunk through the traffic stats of a
+	// connection, to a conn discarding it.
+	BenchmarkStats = "stats"
+	// BenchmarkUidSockDiag and BenchmarkUidProc look up the owner of a
+	// loopback tcp connection with NewSockDiagUidDumper and by scanning
+	// /proc/net.
+	BenchmarkUidSockDiag = "uid-sock-diag"
+	BenchmarkUidProc     = "uid-proc"
+)
+
+// benchmarkTime is how long RunBenchmark runs the operations of each
+// benchmark, as go test does by default.
+const benchmarkTime = time.Second
+
+// benchmarkOp is one operation of a benchmark.
+type benchmarkOp func() error
+
+// benchmarkSetup prepares a benchmark on env, outside of the measured time,
+// and returns its operation and what to release after it.
+type benchmarkSetup func(env *benchmarkEnv) (op benchmarkOp, cleanup func(), err error)
+
+// errBenchmarkSkipped is returned by setups that can not run on this device.
+var errBenchmarkSkipped = newError("benchmark skipped")
+
+var benchmarks = []struct {
+	name  string
+	setup benchmarkSetup
+}{
+	{BenchmarkDial, benchmarkDial},
+	{BenchmarkConnection, benchmarkConnection},
+	{BenchmarkUdpRelay, benchmarkUdpRelay},
+	{BenchmarkStats, benchmarkStats},
+	{BenchmarkUidSockDiag, benchmarkUidSockDiag},
+	{BenchmarkUidProc, benchmarkUidProc},
+}
+
+type BenchmarkResult struct {
+	Name        string
+	Iterations  int32
+	NsPerOp     int64
+	AllocsPerOp int64
+	BytesPerOp  int64
+}
+
+type BenchmarkResults struct {
+	results []*BenchmarkResult
+}
+
+func (r *BenchmarkResults) Len() int32 {
+	return int32(len(r.results))
+}
+
+func (r *BenchmarkResults) Get(index int32) *BenchmarkResult {
+	if index < 0 || int(index) >= len(r.results) {
+		return nil
+	}
+	return r.results[index]
+}
+
+// RunBenchmark runs the benchmarks named in names, separated by commas, or
+// all of them if names is empty. They run against loopback servers on a
+// private instance and tun, which take no device, and last about a second
+// each. Benchmarks of a running tun differ since the dialer is global.
+func RunBenchmark(names string) (*BenchmarkResults, error) {
+	var selected []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected = append(selected, name)
+		}
+	}
+	for _, name := range selected {
+		if !hasBenchmark(name) {
+			return nil, withCode(ErrorCodeInvalidArgument, newError("unknown benchmark ", name))
+		}
+	}
+
+	env, err := newBenchmarkEnv()
+	if err != nil {
+		return nil, exportError(err)
+	}
+	defer env.close()
+
+	results := new(BenchmarkResults)
+	for _, benchmark := range benchmarks {
+		if len(selected) > 0 && !containsString(selected, benchmark.name) {
+			continue
+		}
+		result, err := runBenchmark(env, benchmark.setup)
+		if err != nil {
+			return nil, exportError(newError("benchmark ", benchmark.name, " failed").Base(err))
+		}
+		result.Name = benchmark.name
+		results.results = append(results.results, result)
+	}
+	return results, nil
+}
+
+// runBenchmark repeats the operation of setup, growing the count until the
+// run lasts benchmarkTime, and reports the last run. Skipped benchmarks have
+// no iterations.
+func runBenchmark(env *benchmarkEnv, setup benchmarkSetup) (*BenchmarkResult, error) {
+	op, cleanup, err := setup(env)
+	if err == errBenchmarkSkipped {
+		return new(BenchmarkResult), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	var before, after runtime.MemStats
+	n := 1
+	for {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err = op(); err != nil {
+				return nil, err
+			}
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		if elapsed >= benchmarkTime || n >= 1e9 {
+			return &BenchmarkResult{
+				Iterations:  int32(n),
+				NsPerOp:     elapsed.Nanoseconds() / int64(n),
+				AllocsPerOp: int64(after.Mallocs-before.Mallocs) / int64(n),
+				BytesPerOp:  int64(after.TotalAlloc-before.TotalAlloc) / int64(n),
+			}, nil
+		}
+		// aim 20% past the target, growing at most 100 times per run
+		next := int(int64(benchmarkTime) * 6 / 5 * int64(n) / (elapsed.Nanoseconds() + 1))
+		if next > 100*n {
+			next = 100 * n
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
+
+func hasBenchmark(name string) bool {
+	for _, benchmark := range benchmarks {
+		if benchmark.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+const benchmarkConfig = `{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "direct"}]
+}`
+
+// benchmarkEnv is an instance with a freedom outbound, a tun nic taking
+// connections without a device, and tcp and udp echo servers sharing a
+// port.
+type benchmarkEnv struct {
+	instance *V2RayInstance
+	tun      *Tun2ray
+	nic      *tunNic
+	tcp      net.Listener
+	udp      net.PacketConn
+	echo     v2rayNet.Address
+	port     v2rayNet.Port
+}
+
+func newBenchmarkEnv() (*benchmarkEnv, error) {
+	env := new(benchmarkEnv)
+	var err error
+	if env.udp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	env.port = v2rayNet.Port(env.udp.LocalAddr().(*net.UDPAddr).Port)
+	env.echo = v2rayNet.LocalHostIP
+	if env.tcp, err = net.Listen("tcp4", env.udp.LocalAddr().String()); err != nil {
+		env.close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := env.tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := env.udp.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = env.udp.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	env.instance = NewV2rayInstance()
+	if err = env.instance.LoadConfig(benchmarkConfig); err == nil {
+		err = env.instance.Start()
+	}
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+	env.tun = &Tun2ray{v2ray: env.instance, udpTable: newSessionTable(), speed: new(speedSampler), pipes: new(pipeTotals), lifecycle: newLifecycle(nil)}
+	env.tun.statsReporter = newStatsReporter(env.tun)
+	env.nic = &tunNic{t: env.tun, router: "172.19.0.2", tag: "benchmark", dnsTag: "benchmark-dns"}
+	return env, nil
+}
+
+func (e *benchmarkEnv) destination(network v2rayNet.Network) v2rayNet.Destination {
+	return v2rayNet.Destination{Network: network, Address: e.echo, Port: e.port}
+}
+
+func (e *benchmarkEnv) close() {
+	if e.instance != nil {
+		e.instance.Close()
+	}
+	if e.tcp != nil {
+		e.tcp.Close()
+	}
+	if e.udp != nil {
+		e.udp.Close()
+	}
+}
+
+func benchmarkDial(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	dialer := protectedDialer{protector: noopProtectorInstance}
+	destination := env.destination(v2rayNet.Network_TCP)
+	return func() error {
+		conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}, func() {}, nil
+}
+
+func benchmarkConnection(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	source := v2rayNet.TCPDestination(v2rayNet.ParseAddress("172.19.0.1"), 40000)
+	destination := env.destination(v2rayNet.Network_TCP)
+	message := []byte{1}
+	reply := make([]byte, 1)
+	return func() error {
+		app, tunSide := net.Pipe()
+		defer app.Close()
+		go env.nic.NewConnection(source, destination, tunSide)
+		if _, err := app.Write(message); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(app, reply)
+		return err
+	}, func() {}, nil
+}
+
+func benchmarkUdpRelay(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	source := v2rayNet.UDPDestination(v2rayNet.ParseAddress("172.19.0.1"), 40000)
+	destination := env.destination(v2rayNet.Network_UDP)
+	replies := make(chan struct{}, 1)
+	writeBack := func([]byte, *net.UDPAddr) (int, error) {
+		replies <- struct{}{}
+		return 0, nil
+	}
+	cleanup := func() {
+		if conn, ok := env.tun.udpTable.load(env.nic.natKey(source.NetAddr())); ok {
+			conn.Close()
+		}
+	}
+	return func() error {
+		env.nic.NewPacket(source, destination, make([]byte, 64), writeBack, nopCloser{})
+		select {
+		case <-replies:
+			return nil
+		case <-time.After(5 * time.Second):
+			return newError("udp reply timed out")
+		}
+	}, cleanup, nil
+}
+
+func benchmarkStats(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	flow := env.tun.domainStats.newFlow(env.nic.newContent(), v2rayNet.Destination{}, env.destination(v2rayNet.Network_TCP), 0)
+	var uplink, downlink uint64
+	conn := &statsConn{discardConn{}, &uplink, &downlink, flow, env.tun.statsReporter, env.tun.speed}
+	chunk := make([]byte, 16*1024)
+	return func() error {
+		_, err := conn.Write(chunk)
+		return err
+	}, func() { env.tun.domainStats.closeFlow(flow) }, nil
+}
+
+func benchmarkUidSockDiag(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	if !kernelUids.probe() {
+		return nil, nil, errBenchmarkSkipped
+	}
+	return benchmarkUid(env, NewSockDiagUidDumper(procUidDumper{}))
+}
+
+func benchmarkUidProc(env *benchmarkEnv) (benchmarkOp, func(), error) {
+	return benchmarkUid(env, procUidDumper{})
+}
+
+// benchmarkUid looks up the owner of a loopback connection to the echo
+// server with dumper.
+func benchmarkUid(env *benchmarkEnv, dumper UidDumper) (benchmarkOp, func(), error) {
+	conn, err := net.Dial("tcp", env.tcp.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	source, destination := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	return func() error {
+		_, err := dumper.DumpUid(false, false, source.IP.String(), int32(source.Port), destination.IP.String(), int32(destination.Port))
+		return err
+	}, func() { conn.Close() }, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// discardConn is a connected net.Conn that drops writes.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
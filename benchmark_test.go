@@ -0,0 +1,52 @@
+package libcore
+
+import "testing"
+
+// runGoBenchmark runs setup on a fresh benchmark environment, the go test
+// counterpart of RunBenchmark.
+func runGoBenchmark(b *testing.B, setup benchmarkSetup) {
+	env, err := newBenchmarkEnv()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer env.close()
+	op, cleanup, err := setup(env)
+	if err == errBenchmarkSkipped {
+		b.Skip(err)
+	} else if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = op(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkProtectedDial(b *testing.B) {
+	runGoBenchmark(b, benchmarkDial)
+}
+
+func BenchmarkTunConnection(b *testing.B) {
+	runGoBenchmark(b, benchmarkConnection)
+}
+
+func BenchmarkTunUdpRelay(b *testing.B) {
+	runGoBenchmark(b, benchmarkUdpRelay)
+}
+
+func BenchmarkStatsConn(b *testing.B) {
+	runGoBenchmark(b, benchmarkStats)
+}
+
+func BenchmarkUidLookupSockDiag(b *testing.B) {
+	runGoBenchmark(b, benchmarkUidSockDiag)
+}
+
+func BenchmarkUidLookupProc(b *testing.B) {
+	runGoBenchmark(b, benchmarkUidProc)
+}
@@ -1,8 +1,6 @@
 package libcore
 
 import (
-	"syscall"
-
 	"github.com/sirupsen/logrus"
 )
 
@@ -13,7 +11,7 @@ func bindToUpstream(fd uintptr) {
 		logrus.Warn("empty upstream network name")
 		return
 	}
-	err := syscall.BindToDevice(int(fd), upstreamNetworkName)
+	err := bindToDevice(int(fd), upstreamNetworkName)
 	if err != nil {
 		logrus.Warn("failed to bind socket to upstream network ", upstreamNetworkName, ": ", err)
 	}
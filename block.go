@@ -0,0 +1,128 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/transport"
+)
+
+// Outbound tags of the built in block actions, usable from rules and the v2ray
+// routing. An outbound of the configuration with the same tag takes
+// precedence.
+const (
+	// BlockTagReject resets tcp connections and answers udp with an icmp
+	// administratively prohibited.
+	BlockTagReject = "REJECT"
+	// BlockTagClose accepts tcp connections and closes them at once.
+	BlockTagClose = "REJECT-CLOSE"
+	// BlockTagDrop ignores the connection until the app gives up.
+	BlockTagDrop = "REJECT-DROP"
+	// BlockTagHttp answers plain http requests with 403 Forbidden and resets
+	// everything else.
+	BlockTagHttp = "REJECT-HTTP"
+)
+
+const (
+	blockAttribute   = "libcore.block"
+	blockDropTimeout = 2 * time.Minute
+	blockReadTimeout = 5 * time.Second
+)
+
+var errBlocked = errors.New("blocked")
+
+var blockResponse = []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+type blockHandler struct {
+	tag string
+}
+
+func registerBlockHandlers(manager outbound.Manager) {
+	for _, tag := range []string{BlockTagReject, BlockTagClose, BlockTagDrop, BlockTagHttp} {
+		if manager.GetHandler(tag) != nil {
+			continue
+		}
+		if err := manager.AddHandler(context.Background(), &blockHandler{tag}); err != nil {
+			newError("failed to add block handler ", tag).Base(err).AtWarning().WriteToLog()
+		}
+	}
+}
+
+func (h *blockHandler) Start() error {
+	return nil
+}
+
+func (h *blockHandler) Close() error {
+	return nil
+}
+
+func (h *blockHandler) Tag() string {
+	return h.tag
+}
+
+// Dispatch applies the action to the link, the tun reads the attribute to
+// answer blocked udp sessions.
+func (h *blockHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	if content := session.ContentFromContext(ctx); content != nil {
+		content.SetAttribute(blockAttribute, h.tag)
+	}
+	var network v2rayNet.Network
+	if outbound := session.OutboundFromContext(ctx); outbound != nil {
+		network = outbound.Target.Network
+	}
+	switch h.tag {
+	case BlockTagClose:
+		common.Interrupt(link.Reader)
+		common.Close(link.Writer)
+	case BlockTagDrop:
+		ctx, cancel := context.WithTimeout(ctx, blockDropTimeout)
+		defer cancel()
+		go func() {
+			_ = buf.Copy(link.Reader, buf.Discard)
+			cancel()
+		}()
+		<-ctx.Done()
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+	case BlockTagHttp:
+		if network == v2rayNet.Network_TCP && isHttpRequest(link.Reader) {
+			common.Interrupt(link.Reader)
+			if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, blockResponse)); err == nil {
+				common.Close(link.Writer)
+				return
+			}
+		}
+		fallthrough
+	default:
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+	}
+}
+
+func isHttpRequest(reader buf.Reader) bool {
+	var mb buf.MultiBuffer
+	var err error
+	if timeoutReader, ok := reader.(buf.TimeoutReader); ok {
+		mb, err = timeoutReader.ReadMultiBufferTimeout(blockReadTimeout)
+	} else {
+		mb, err = reader.ReadMultiBuffer()
+	}
+	defer buf.ReleaseMulti(mb)
+	if err != nil || mb.IsEmpty() {
+		return false
+	}
+	first := mb[0].Bytes()
+	for _, method := range []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "} {
+		if bytes.HasPrefix(first, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+)
+
+var bootstrapDns struct {
+	access  sync.RWMutex
+	servers []dnsUpstream
+}
+
+// SetBootstrapDns sets dns servers, ip addresses with an optional port
+// separated by commas or lines, which resolve the hostnames of proxy servers
+// and DoH endpoints only, directly over udp. They break the loop of a dns
+// server that is only reachable through the proxy it has to resolve. The
+// servers are tried in order, then the default resolver. Empty servers
+// remove them.
+func SetBootstrapDns(servers string) error {
+	var upstreams []dnsUpstream
+	for _, server := range splitRules(servers) {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return withCode(ErrorCodeInvalidArgument, newError("bootstrap dns must be an ip address: ", server))
+		}
+		p, err := v2rayNet.PortFromString(port)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid bootstrap dns ", server).Base(err))
+		}
+		upstreams = append(upstreams, &dnsDirectUpstream{v2rayNet.UDPDestination(v2rayNet.IPAddress(ip), p)})
+	}
+	bootstrapDns.access.Lock()
+	bootstrapDns.servers = upstreams
+	bootstrapDns.access.Unlock()
+	return nil
+}
+
+// isServerDial is whether a dial goes to a proxy or dns server rather than
+// to the target of the connection, as freedom does.
+func isServerDial(ctx context.Context, destination v2rayNet.Destination) bool {
+	outbound := session.OutboundFromContext(ctx)
+	return outbound == nil || outbound.Target.Address == nil || outbound.Target.Address.String() != destination.Address.String()
+}
+
+// lookupBootstrap resolves domain with the bootstrap servers, ok is false if
+// there are none.
+func lookupBootstrap(ctx context.Context, network string, domain string) (ips []net.IP, ok bool, err error) {
+	bootstrapDns.access.RLock()
+	servers := bootstrapDns.servers
+	bootstrapDns.access.RUnlock()
+	if len(servers) == 0 {
+		return nil, false, nil
+	}
+	for _, server := range servers {
+		ips, err = exchangeLookup(ctx, nil, server, network, domain)
+		if err == nil {
+			return ips, true, nil
+		}
+		newError("bootstrap dns ", server.(*dnsDirectUpstream).destination, " failed to resolve ", domain).Base(err).AtDebug().WriteToLog()
+	}
+	return nil, true, err
+}
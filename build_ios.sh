@@ -0,0 +1,10 @@
+#!/bin/bash
+
+source .github/env.sh
+
+BUILD="../libcore_build"
+
+rm -rf $BUILD/ios
+
+gomobile bind -v -target ios -cache $(realpath $BUILD) -trimpath -ldflags='-s -w' -o $BUILD/ios/Libcore.xcframework . || exit 1
+echo ">> build $(realpath $BUILD)/ios/Libcore.xcframework"
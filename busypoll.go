@@ -0,0 +1,67 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+
+	"libcore/comm"
+)
+
+// busyPollMaxSpin bounds the spin in microseconds, so a reader always
+// yields its core soon.
+const busyPollMaxSpin = 1000
+
+type busyPollState struct {
+	access sync.Mutex
+	spin   time.Duration
+	// minBatteryLevel is the battery percentage below which busy polling is
+	// paused while discharging.
+	minBatteryLevel int32
+	charging        bool
+	batteryLevel    int32
+	powerSave       bool
+}
+
+// busyPoll assumes a charging device until NotifyBatteryState says otherwise.
+var busyPoll = &busyPollState{charging: true, batteryLevel: 100}
+
+// SetBusyPoll enables adaptive busy polling of the tun fd on the system and
+// gvisor implementations: after a packet the reader keeps trying to read for
+// up to spinMicros before blocking in poll, cutting the wakeup latency of
+// bursts for some cpu. It falls back to blocking reads while the tun is
+// idle. Zero disables it. Busy polling is paused in power save mode, and
+// below minBatteryLevel percent unless charging, as reported by
+// NotifyBatteryState.
+func SetBusyPoll(spinMicros int32, minBatteryLevel int32) error {
+	if spinMicros < 0 || spinMicros > busyPollMaxSpin {
+		return withCode(ErrorCodeInvalidArgument, newError("busy poll spin must be within 0 and ", busyPollMaxSpin, " microseconds"))
+	}
+	busyPoll.access.Lock()
+	busyPoll.spin = time.Duration(spinMicros) * time.Microsecond
+	busyPoll.minBatteryLevel = minBatteryLevel
+	busyPoll.apply()
+	busyPoll.access.Unlock()
+	return nil
+}
+
+// NotifyBatteryState passes the battery state of the device to busy polling,
+// it should be called whenever the state changes.
+func NotifyBatteryState(charging bool, level int32, powerSave bool) {
+	busyPoll.access.Lock()
+	busyPoll.charging = charging
+	busyPoll.batteryLevel = level
+	busyPoll.powerSave = powerSave
+	busyPoll.apply()
+	busyPoll.access.Unlock()
+}
+
+func (p *busyPollState) apply() {
+	spin := p.spin
+	if p.powerSave || !p.charging && p.batteryLevel < p.minBatteryLevel {
+		spin = 0
+	}
+	if spin != comm.BusyPollSpin() {
+		newError("busy poll spin set to ", spin).AtDebug().WriteToLog()
+	}
+	comm.SetBusyPollSpin(spin)
+}
@@ -0,0 +1,431 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+)
+
+const (
+	captureSnapLen   = 65535
+	captureQueueSize = 1024
+	captureLinkType  = 101 // LINKTYPE_RAW
+)
+
+// nicCapture writes the packets of a tun device to its pcap file and the live
+// capture streams.
+type nicCapture struct {
+	t     *Tun2ray
+	index uint32
+
+	fileAccess sync.Mutex
+	file       *os.File
+	fileOpen   int32
+}
+
+func newNicCapture(t *Tun2ray, index int, file *os.File) (*nicCapture, error) {
+	c := &nicCapture{t: t, index: uint32(index)}
+	if file != nil {
+		fileHeader := make([]byte, 24)
+		binary.BigEndian.PutUint32(fileHeader[0:], 0xa1b2c3d4)
+		binary.BigEndian.PutUint16(fileHeader[4:], 2)
+		binary.BigEndian.PutUint16(fileHeader[6:], 4)
+		binary.BigEndian.PutUint32(fileHeader[16:], captureSnapLen)
+		binary.BigEndian.PutUint32(fileHeader[20:], captureLinkType)
+		if _, err := file.Write(fileHeader); err != nil {
+			return nil, err
+		}
+		c.file = file
+		c.fileOpen = 1
+	}
+	return c, nil
+}
+
+func (c *nicCapture) Capturing() bool {
+	return atomic.LoadInt32(&c.fileOpen) == 1 || atomic.LoadInt32(&c.t.captureStreamCount) > 0
+}
+
+func (c *nicCapture) CapturePacket(packet []byte, inbound bool) {
+	now := time.Now()
+	captured := packet
+	if len(captured) > captureSnapLen {
+		captured = captured[:captureSnapLen]
+	}
+	var parsed *capturedPacket
+	parse := func() *capturedPacket {
+		if parsed == nil {
+			p, ok := parseCapturedPacket(packet)
+			if !ok {
+				return nil
+			}
+			parsed = &p
+		}
+		return parsed
+	}
+	if atomic.LoadInt32(&c.fileOpen) == 1 {
+		filter, _ := c.t.pcapFilter.Load().(*pcapFilter)
+		if filter == nil {
+			c.writeFile(now, captured, len(packet))
+		} else if p := parse(); p != nil && filter.match(p, func() (uint32, bool) {
+			return c.t.captureUidOf(p, inbound)
+		}) {
+			c.writeFile(now, captured, len(packet))
+		}
+	}
+	if atomic.LoadInt32(&c.t.captureStreamCount) > 0 {
+		c.t.captureAccess.RLock()
+		var block []byte
+		for stream := range c.t.captureStreams {
+			if stream.filter != nil {
+				if p := parse(); p == nil || !stream.filter(p) {
+					continue
+				}
+			}
+			if block == nil {
+				block = pcapngPacketBlock(c.index, now, captured, len(packet), inbound)
+			}
+			stream.send(c.index, block)
+		}
+		c.t.captureAccess.RUnlock()
+	}
+}
+
+// SetPcapFilter limits what is written to the pcap files from now on, nil
+// writes every packet.
+func (t *Tun2ray) SetPcapFilter(filter *PcapFilter) error {
+	parsed, err := parsePcapFilter(filter)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, err)
+	}
+	t.pcapFilter.Store(parsed)
+	return nil
+}
+
+const captureUidCacheSize = 4096
+
+type captureUid struct {
+	uid uint32
+	ok  bool
+}
+
+// captureUidOf looks up the app of a tcp or udp packet once per flow, the
+// app side is the source of packets read from the tun.
+func (t *Tun2ray) captureUidOf(p *capturedPacket, inbound bool) (uint32, bool) {
+	if !p.hasPorts || uidDumper == nil {
+		return 0, false
+	}
+	local, localPort, remote, remotePort := p.source, p.sourcePort, p.destination, p.destinationPort
+	if !inbound {
+		local, localPort, remote, remotePort = remote, remotePort, local, localPort
+	}
+	udp := p.protocol == uint8(header.UDPProtocolNumber)
+	key := fmt.Sprint(p.protocol, " ", net.JoinHostPort(local.String(), strconv.Itoa(int(localPort))), " ", net.JoinHostPort(remote.String(), strconv.Itoa(int(remotePort))))
+
+	t.captureUidAccess.Lock()
+	cached, found := t.captureUids[key]
+	t.captureUidAccess.Unlock()
+	if found {
+		return cached.uid, cached.ok
+	}
+
+	uid, err := dumpUid(p.ipv6, udp, local.String(), int32(localPort), remote.String(), int32(remotePort))
+	cached = captureUid{normalizeUid(uint32(uid)), err == nil && uid >= 0}
+
+	t.captureUidAccess.Lock()
+	if t.captureUids == nil || len(t.captureUids) >= captureUidCacheSize {
+		t.captureUids = make(map[string]captureUid)
+	}
+	t.captureUids[key] = cached
+	t.captureUidAccess.Unlock()
+	return cached.uid, cached.ok
+}
+
+func (c *nicCapture) writeFile(now time.Time, captured []byte, length int) {
+	record := make([]byte, 16+len(captured))
+	binary.BigEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(captured)))
+	binary.BigEndian.PutUint32(record[12:], uint32(length))
+	copy(record[16:], captured)
+	c.fileAccess.Lock()
+	defer c.fileAccess.Unlock()
+	if c.file == nil {
+		return
+	}
+	if _, err := c.file.Write(record); err != nil {
+		logrus.Debug("write pcap file failed: ", err)
+	}
+}
+
+func (c *nicCapture) Close() error {
+	c.fileAccess.Lock()
+	defer c.fileAccess.Unlock()
+	atomic.StoreInt32(&c.fileOpen, 0)
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+type PacketCaptureListener interface {
+	// OnCaptureData receives pcapng blocks, starting with the section header.
+	OnCaptureData(data []byte)
+}
+
+// CaptureStream is a live capture of the tun devices in the pcapng format,
+// packets are dropped while the receiver can not keep up.
+type CaptureStream struct {
+	dropped uint64
+
+	t          *Tun2ray
+	filter     captureFilter
+	queue      chan []byte
+	access     sync.Mutex
+	interfaces uint32
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// StartCaptureStream calls listener with the packets matching filter, in the
+// tcpdump syntax described by parseCaptureFilter.
+func (t *Tun2ray) StartCaptureStream(filter string, listener PacketCaptureListener) (*CaptureStream, error) {
+	stream, err := t.startCapture(filter, func(data []byte) error {
+		listener.OnCaptureData(data)
+		return nil
+	})
+	return stream, exportError(err)
+}
+
+func (t *Tun2ray) startCapture(filter string, write func(data []byte) error) (*CaptureStream, error) {
+	compiled, err := parseCaptureFilter(filter)
+	if err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	t.nicsLock.Lock()
+	interfaces := uint32(len(t.nics))
+	t.nicsLock.Unlock()
+	stream := &CaptureStream{
+		t:          t,
+		filter:     compiled,
+		queue:      make(chan []byte, captureQueueSize),
+		interfaces: interfaces,
+		done:       make(chan struct{}),
+	}
+	headers := pcapngSectionHeader()
+	for index := uint32(0); index < interfaces; index++ {
+		headers = append(headers, pcapngInterfaceBlock()...)
+	}
+	t.captureAccess.Lock()
+	if t.captureStreams == nil {
+		t.captureStreams = make(map[*CaptureStream]struct{})
+	}
+	t.captureStreams[stream] = struct{}{}
+	atomic.StoreInt32(&t.captureStreamCount, int32(len(t.captureStreams)))
+	t.captureAccess.Unlock()
+	go stream.loop(headers, write)
+	return stream, nil
+}
+
+func (s *CaptureStream) loop(headers []byte, write func(data []byte) error) {
+	if err := write(headers); err != nil {
+		s.Close()
+		return
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case block := <-s.queue:
+			if err := write(block); err != nil {
+				newError("capture stream closed").Base(err).AtDebug().WriteToLog()
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+// send queues a packet block, announcing devices added after the stream
+// started first.
+func (s *CaptureStream) send(index uint32, block []byte) {
+	s.access.Lock()
+	for s.interfaces <= index {
+		if !s.push(pcapngInterfaceBlock()) {
+			s.access.Unlock()
+			return
+		}
+		s.interfaces++
+	}
+	s.access.Unlock()
+	s.push(block)
+}
+
+func (s *CaptureStream) push(block []byte) bool {
+	select {
+	case s.queue <- block:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+}
+
+// GetDropped returns the number of packets dropped because the receiver was
+// too slow.
+func (s *CaptureStream) GetDropped() int64 {
+	return int64(atomic.LoadUint64(&s.dropped))
+}
+
+func (s *CaptureStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.t.captureAccess.Lock()
+		delete(s.t.captureStreams, s)
+		atomic.StoreInt32(&s.t.captureStreamCount, int32(len(s.t.captureStreams)))
+		s.t.captureAccess.Unlock()
+		close(s.done)
+	})
+	return nil
+}
+
+// CaptureServer serves a live capture to every client connecting to it, e.g.
+// "adb forward tcp:19000 tcp:19000" and "nc 127.0.0.1 19000 | wireshark -k -i -".
+type CaptureServer struct {
+	t        *Tun2ray
+	filter   string
+	listener net.Listener
+
+	access  sync.Mutex
+	streams []*CaptureStream
+	closed  bool
+}
+
+// StartCaptureServer listens on address, usually on the loopback.
+func (t *Tun2ray) StartCaptureServer(address string, filter string) (*CaptureServer, error) {
+	if _, err := parseCaptureFilter(filter); err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, exportError(newError("failed to listen for capture clients").Base(err))
+	}
+	server := &CaptureServer{t: t, filter: filter, listener: listener}
+	go server.acceptLoop()
+	return server, nil
+}
+
+func (s *CaptureServer) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		stream, err := s.t.startCapture(s.filter, func(data []byte) error {
+			_, err := conn.Write(data)
+			return err
+		})
+		if err != nil {
+			comm.CloseIgnore(conn)
+			continue
+		}
+		s.access.Lock()
+		if s.closed {
+			s.access.Unlock()
+			comm.CloseIgnore(stream, conn)
+			return
+		}
+		s.streams = append(s.streams, stream)
+		s.access.Unlock()
+		go func() {
+			<-stream.done
+			comm.CloseIgnore(conn)
+		}()
+	}
+}
+
+func (s *CaptureServer) GetAddress() string {
+	return s.listener.Addr().String()
+}
+
+func (s *CaptureServer) Close() error {
+	s.access.Lock()
+	s.closed = true
+	streams := s.streams
+	s.streams = nil
+	s.access.Unlock()
+	for _, stream := range streams {
+		comm.CloseIgnore(stream)
+	}
+	return s.listener.Close()
+}
+
+func (t *Tun2ray) closeCaptures() {
+	t.captureAccess.Lock()
+	streams := make([]*CaptureStream, 0, len(t.captureStreams))
+	for stream := range t.captureStreams {
+		streams = append(streams, stream)
+	}
+	t.captureAccess.Unlock()
+	for _, stream := range streams {
+		comm.CloseIgnore(stream)
+	}
+}
+
+func pcapngSectionHeader() []byte {
+	block := make([]byte, 28)
+	binary.LittleEndian.PutUint32(block[0:], 0x0a0d0d0a)
+	binary.LittleEndian.PutUint32(block[4:], 28)
+	binary.LittleEndian.PutUint32(block[8:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(block[12:], 1)
+	binary.LittleEndian.PutUint16(block[14:], 0)
+	binary.LittleEndian.PutUint64(block[16:], 0xffffffffffffffff)
+	binary.LittleEndian.PutUint32(block[24:], 28)
+	return block
+}
+
+func pcapngInterfaceBlock() []byte {
+	block := make([]byte, 20)
+	binary.LittleEndian.PutUint32(block[0:], 1)
+	binary.LittleEndian.PutUint32(block[4:], 20)
+	binary.LittleEndian.PutUint16(block[8:], captureLinkType)
+	binary.LittleEndian.PutUint32(block[12:], captureSnapLen)
+	binary.LittleEndian.PutUint32(block[16:], 20)
+	return block
+}
+
+// pcapngPacketBlock builds an enhanced packet block with the direction flag,
+// timestamps are in microseconds.
+func pcapngPacketBlock(index uint32, now time.Time, captured []byte, length int, inbound bool) []byte {
+	padded := (len(captured) + 3) &^ 3
+	total := 28 + padded + 12 + 4
+	block := make([]byte, total)
+	timestamp := uint64(now.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(block[0:], 6)
+	binary.LittleEndian.PutUint32(block[4:], uint32(total))
+	binary.LittleEndian.PutUint32(block[8:], index)
+	binary.LittleEndian.PutUint32(block[12:], uint32(timestamp>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(timestamp))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(length))
+	copy(block[28:], captured)
+	options := block[28+padded:]
+	binary.LittleEndian.PutUint16(options[0:], 2) // epb_flags
+	binary.LittleEndian.PutUint16(options[2:], 4)
+	if inbound {
+		binary.LittleEndian.PutUint32(options[4:], 1)
+	} else {
+		binary.LittleEndian.PutUint32(options[4:], 2)
+	}
+	binary.LittleEndian.PutUint32(block[total-4:], uint32(total))
+	return block
+}
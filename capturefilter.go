@@ -0,0 +1,356 @@
+package libcore
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// capturedPacket is what capture filters match of a raw IP packet.
+type capturedPacket struct {
+	ipv6            bool
+	protocol        uint8
+	source          net.IP
+	destination     net.IP
+	sourcePort      uint16
+	destinationPort uint16
+	hasPorts        bool
+}
+
+func parseCapturedPacket(packet []byte) (p capturedPacket, ok bool) {
+	var payload []byte
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		ipHdr := header.IPv4(packet)
+		if !ipHdr.IsValid(len(packet)) {
+			return p, false
+		}
+		p.protocol = ipHdr.Protocol()
+		p.source = net.IP(ipHdr.SourceAddress())
+		p.destination = net.IP(ipHdr.DestinationAddress())
+		if ipHdr.FragmentOffset() == 0 {
+			payload = ipHdr.Payload()
+		}
+	case header.IPv6Version:
+		ipHdr := header.IPv6(packet)
+		if !ipHdr.IsValid(len(packet)) {
+			return p, false
+		}
+		p.ipv6 = true
+		p.protocol = uint8(ipHdr.TransportProtocol())
+		p.source = net.IP(ipHdr.SourceAddress())
+		p.destination = net.IP(ipHdr.DestinationAddress())
+		payload = ipHdr.Payload()
+	default:
+		return p, false
+	}
+	switch p.protocol {
+	case uint8(header.TCPProtocolNumber), uint8(header.UDPProtocolNumber):
+		if len(payload) >= 4 {
+			p.sourcePort = uint16(payload[0])<<8 | uint16(payload[1])
+			p.destinationPort = uint16(payload[2])<<8 | uint16(payload[3])
+			p.hasPorts = true
+		}
+	}
+	return p, true
+}
+
+type captureFilter func(p *capturedPacket) bool
+
+// parseCaptureFilter compiles a subset of the tcpdump filter syntax: the
+// protocols ip, ip6, tcp, udp, icmp and icmp6, [src|dst] host ADDRESS,
+// [src|dst] net CIDR, [src|dst] port PORT and [src|dst] portrange FROM-TO,
+// combined with and, or, not and parentheses. An empty filter matches all
+// packets.
+func parseCaptureFilter(expression string) (captureFilter, error) {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expression)
+	parser := &captureFilterParser{tokens: strings.Fields(expression)}
+	if len(parser.tokens) == 0 {
+		return nil, nil
+	}
+	filter, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, newError("unexpected ", parser.tokens[parser.position], " in capture filter")
+	}
+	return filter, nil
+}
+
+type captureFilterParser struct {
+	tokens   []string
+	position int
+}
+
+func (p *captureFilterParser) peek() string {
+	if p.position < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.position])
+	}
+	return ""
+}
+
+func (p *captureFilterParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.position++
+	}
+	return token
+}
+
+func (p *captureFilterParser) parseOr() (captureFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orFilter(left, right)
+	}
+	return left, nil
+}
+
+func (p *captureFilterParser) parseAnd() (captureFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andFilter(left, right)
+	}
+	return left, nil
+}
+
+func orFilter(left, right captureFilter) captureFilter {
+	return func(packet *capturedPacket) bool {
+		return left(packet) || right(packet)
+	}
+}
+
+func andFilter(left, right captureFilter) captureFilter {
+	return func(packet *capturedPacket) bool {
+		return left(packet) && right(packet)
+	}
+}
+
+func (p *captureFilterParser) parseUnary() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(packet *capturedPacket) bool {
+			return !filter(packet)
+		}, nil
+	case "(":
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, newError("missing ) in capture filter")
+		}
+		return filter, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *captureFilterParser) parsePrimitive() (captureFilter, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return nil, newError("unexpected end of capture filter")
+	case "ip":
+		return func(packet *capturedPacket) bool { return !packet.ipv6 }, nil
+	case "ip6":
+		return func(packet *capturedPacket) bool { return packet.ipv6 }, nil
+	case "tcp":
+		return protocolFilter(uint8(header.TCPProtocolNumber)), nil
+	case "udp":
+		return protocolFilter(uint8(header.UDPProtocolNumber)), nil
+	case "icmp":
+		return protocolFilter(uint8(header.ICMPv4ProtocolNumber)), nil
+	case "icmp6":
+		return protocolFilter(uint8(header.ICMPv6ProtocolNumber)), nil
+	}
+	source, destination := true, true
+	switch token {
+	case "src":
+		destination = false
+		token = p.next()
+	case "dst":
+		source = false
+		token = p.next()
+	}
+	value := p.next()
+	if value == "" {
+		return nil, newError("missing value for ", token, " in capture filter")
+	}
+	switch token {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, newError("invalid host ", value, " in capture filter")
+		}
+		return func(packet *capturedPacket) bool {
+			return source && ip.Equal(packet.source) || destination && ip.Equal(packet.destination)
+		}, nil
+	case "net":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, newError("invalid net ", value, " in capture filter").Base(err)
+		}
+		return func(packet *capturedPacket) bool {
+			return source && network.Contains(packet.source) || destination && network.Contains(packet.destination)
+		}, nil
+	case "port", "portrange":
+		from, to := value, value
+		if token == "portrange" {
+			index := strings.IndexByte(value, '-')
+			if index < 0 {
+				return nil, newError("invalid port range ", value, " in capture filter")
+			}
+			from, to = value[:index], value[index+1:]
+		}
+		low, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, newError("invalid port ", from, " in capture filter")
+		}
+		high, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return nil, newError("invalid port ", to, " in capture filter")
+		}
+		inRange := func(port uint16) bool {
+			return uint64(port) >= low && uint64(port) <= high
+		}
+		return func(packet *capturedPacket) bool {
+			return packet.hasPorts && (source && inRange(packet.sourcePort) || destination && inRange(packet.destinationPort))
+		}, nil
+	}
+	return nil, newError("unknown primitive ", token, " in capture filter")
+}
+
+func protocolFilter(protocol uint8) captureFilter {
+	return func(packet *capturedPacket) bool {
+		return packet.protocol == protocol
+	}
+}
+
+// PcapFilter limits what is written to the pcap files, each list is
+// separated by commas and an empty list matches everything.
+type PcapFilter struct {
+	// Uids are the apps, packets of flows the uid dumper can not resolve are
+	// skipped.
+	Uids string
+	// Cidrs match the source or the destination.
+	Cidrs string
+	// Ports match the source or the destination, e.g. 53,8000-9000.
+	Ports string
+	// Protocols are tcp, udp and icmp, which includes icmpv6.
+	Protocols string
+}
+
+type pcapFilter struct {
+	uids      map[uint32]bool
+	networks  []*net.IPNet
+	ports     v2rayNet.MemoryPortList
+	protocols map[uint8]bool
+}
+
+func parsePcapFilter(filter *PcapFilter) (*pcapFilter, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	parsed := new(pcapFilter)
+	for _, uid := range splitRules(filter.Uids) {
+		value, err := strconv.ParseUint(strings.TrimSpace(uid), 10, 32)
+		if err != nil {
+			return nil, newError("invalid uid ", uid).Base(err)
+		}
+		if parsed.uids == nil {
+			parsed.uids = make(map[uint32]bool)
+		}
+		parsed.uids[uint32(value)] = true
+	}
+	for _, cidr := range splitRules(filter.Cidrs) {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, newError("invalid cidr ", cidr).Base(err)
+		}
+		parsed.networks = append(parsed.networks, network)
+	}
+	for _, port := range splitRules(filter.Ports) {
+		portRange, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		parsed.ports = append(parsed.ports, portRange)
+	}
+	for _, protocol := range splitRules(filter.Protocols) {
+		if parsed.protocols == nil {
+			parsed.protocols = make(map[uint8]bool)
+		}
+		switch strings.ToLower(strings.TrimSpace(protocol)) {
+		case "tcp":
+			parsed.protocols[uint8(header.TCPProtocolNumber)] = true
+		case "udp":
+			parsed.protocols[uint8(header.UDPProtocolNumber)] = true
+		case "icmp":
+			parsed.protocols[uint8(header.ICMPv4ProtocolNumber)] = true
+			parsed.protocols[uint8(header.ICMPv6ProtocolNumber)] = true
+		default:
+			return nil, newError("invalid protocol ", protocol)
+		}
+	}
+	if parsed.uids == nil && parsed.networks == nil && parsed.ports == nil && parsed.protocols == nil {
+		return nil, nil
+	}
+	return parsed, nil
+}
+
+// match checks the cheap conditions before looking up the uid of the flow.
+func (f *pcapFilter) match(packet *capturedPacket, uidOf func() (uint32, bool)) bool {
+	if f.protocols != nil && !f.protocols[packet.protocol] {
+		return false
+	}
+	if f.networks != nil {
+		var matched bool
+		for _, network := range f.networks {
+			if network.Contains(packet.source) || network.Contains(packet.destination) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.ports != nil {
+		if !packet.hasPorts {
+			return false
+		}
+		if !f.ports.Contains(v2rayNet.Port(packet.sourcePort)) && !f.ports.Contains(v2rayNet.Port(packet.destinationPort)) {
+			return false
+		}
+	}
+	if f.uids != nil {
+		uid, ok := uidOf()
+		return ok && f.uids[uid]
+	}
+	return true
+}
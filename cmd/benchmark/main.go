@@ -0,0 +1,32 @@
+// Command benchmark runs the benchmarks of libcore.RunBenchmark on the host
+// and prints them in the format of go test -bench, for comparing releases
+// with benchstat.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"libcore"
+)
+
+var (
+	names = flag.String("bench", "", "benchmarks to run, separated by commas, all if empty")
+	count = flag.Int("count", 1, "times to run each benchmark")
+)
+
+func main() {
+	flag.Parse()
+
+	for i := 0; i < *count; i++ {
+		results, err := libcore.RunBenchmark(*names)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for index := int32(0); index < results.Len(); index++ {
+			result := results.Get(index)
+			fmt.Printf("BenchmarkLibcore/%s\t%d\t%d ns/op\t%d B/op\t%d allocs/op\n", result.Name, result.Iterations, result.NsPerOp, result.BytesPerOp, result.AllocsPerOp)
+		}
+	}
+}
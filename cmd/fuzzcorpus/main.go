@@ -0,0 +1,204 @@
+// Command fuzzcorpus writes the seed corpora of the go-fuzz entry points, see
+// fuzz.sh. Seeds are valid inputs the fuzzer mutates, existing files of the
+// corpus (found by earlier runs) are kept.
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var workdir = flag.String("workdir", "fuzz", "directory of the fuzz workdirs, one per target")
+
+var (
+	client4 = tcpip.Address(net.IPv4(172, 19, 0, 1).To4())
+	remote4 = tcpip.Address(net.IPv4(1, 1, 1, 1).To4())
+	client6 = tcpip.Address(net.ParseIP("fdfe:dcba:9876::1"))
+	remote6 = tcpip.Address(net.ParseIP("2606:4700:4700::1111"))
+)
+
+func main() {
+	flag.Parse()
+
+	seeds := map[string][][]byte{
+		"nat":           natSeeds(),
+		"subscription":  textSeeds(strings.Join(shareLinkSeeds, "\n"), base64.StdEncoding.EncodeToString([]byte(strings.Join(shareLinkSeeds, "\n"))), onlineConfigSeeds[0]),
+		"online-config": textSeeds(onlineConfigSeeds...),
+		"share-link":    textSeeds(shareLinkSeeds...),
+		"ooc-token":     textSeeds(oocTokenSeed()),
+		"rules":         textSeeds(rulesSeed...),
+		"rule-provider": textSeeds("payload:\n  - '+.example.com'\n  - 'DOMAIN,example.org'\n  - 10.0.0.0/8\n"),
+		"pac":           textSeeds(pacSeed),
+		"dns-upstream":  textSeeds("local", "proxy", "https://1.1.1.1/dns-query", "https+local://dns.google/dns-query", "tcp://8.8.8.8:53", "udp://[2606:4700:4700::1111]:53", "9.9.9.9"),
+		"ntlm":          {ntlmChallengeSeed()},
+		"socks-address": socksAddressSeeds(),
+	}
+	for target, corpus := range seeds {
+		dir := filepath.Join(*workdir, target, "corpus")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Fatalln(err)
+		}
+		for _, seed := range corpus {
+			// go-fuzz names inputs by their sha1 too, so seeds are not duplicated
+			sum := sha1.Sum(seed)
+			if err := ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(sum[:])), seed, 0o644); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		log.Println(target, ": ", len(corpus), " seeds")
+	}
+}
+
+var shareLinkSeeds = []string{
+	"ss://YWVzLTI1Ni1nY206cGFzc3dvcmQ@example.com:8388#ss",
+	"ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:password@example.com:8388")) + "#legacy",
+	"ssr://" + base64.RawURLEncoding.EncodeToString([]byte("example.com:8388:origin:aes-256-cfb:plain:"+base64.RawURLEncoding.EncodeToString([]byte("password"))+"/?remarks="+base64.RawURLEncoding.EncodeToString([]byte("ssr")))),
+	"vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"v":"2","ps":"vmess","add":"example.com","port":"443","id":"b831381d-6324-4d53-ad4f-8cda48b30811"}`)),
+	"vless://b831381d-6324-4d53-ad4f-8cda48b30811@[2001:db8::1]:443?security=tls#vless",
+	"trojan://password@example.com:443?sni=example.com#trojan",
+}
+
+var onlineConfigSeeds = []string{
+	`{"version":1,"servers":[{"id":"27b8a625-4f4b-4428-9f0f-8a2317db7c79","remarks":"sip008","server":"example.com","server_port":8388,"method":"aes-256-gcm","password":"password","plugin":"v2ray-plugin","plugin_opts":"server"}],"bytes_used":1,"bytes_remaining":2}`,
+	`{"username":"user","bytesUsed":1,"bytesRemaining":2,"expiryDate":"2030-01-01T00:00:00Z","protocols":["shadowsocks"],"shadowsocks":[{"id":"27b8a625-4f4b-4428-9f0f-8a2317db7c79","name":"ooc","address":"example.com","port":8388,"method":"aes-256-gcm","password":"password"}]}`,
+}
+
+func oocTokenSeed() string {
+	token := `{"version":1,"baseUrl":"https://example.com/","secret":"secret","userId":"user","certSha256":""}`
+	return "ooc://" + base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+var rulesSeed = []string{
+	"DOMAIN-SUFFIX,example.com,proxy",
+	"IP-CIDR,10.0.0.0/8,direct,no-resolve",
+	"DST-PORT,443,proxy,dscp=46",
+	"AND,((DOMAIN-KEYWORD,video),(NETWORK-TYPE,wifi)),proxy\nTIME,22:00-07:00,REJECT\nWEEKDAY,mon-fri,direct",
+	"NOT,((RULE-SET,ads)),direct\nMATCH,proxy",
+}
+
+const pacSeed = `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host) || shExpMatch(host, "*.local")) return "DIRECT";
+  if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) return "DIRECT";
+  var i = 0;
+  while (i < 3) { i++; }
+  return "PROXY proxy.example.com:8080; DIRECT";
+}`
+
+func textSeeds(seeds ...string) [][]byte {
+	corpus := make([][]byte, 0, len(seeds))
+	for _, seed := range seeds {
+		corpus = append(corpus, []byte(seed))
+	}
+	return corpus
+}
+
+func natSeeds() [][]byte {
+	payload := []byte("seed")
+	tcpSyn := make([]byte, header.TCPMinimumSize)
+	header.TCP(tcpSyn).Encode(&header.TCPFields{SrcPort: 40000, DstPort: 443, SeqNum: 1, Flags: header.TCPFlagSyn, DataOffset: header.TCPMinimumSize, WindowSize: 65535})
+	udp := make([]byte, header.UDPMinimumSize+len(payload))
+	header.UDP(udp).Encode(&header.UDPFields{SrcPort: 40000, DstPort: 53, Length: uint16(len(udp))})
+	copy(udp[header.UDPMinimumSize:], payload)
+	echo4 := make([]byte, header.ICMPv4MinimumSize+len(payload))
+	header.ICMPv4(echo4).SetType(header.ICMPv4Echo)
+	copy(echo4[header.ICMPv4MinimumSize:], payload)
+	echo6 := make([]byte, header.ICMPv6EchoMinimumSize+len(payload))
+	header.ICMPv6(echo6).SetType(header.ICMPv6EchoRequest)
+	copy(echo6[header.ICMPv6EchoMinimumSize:], payload)
+	// the second fragment carries 8 bytes of the udp datagram
+	fragmented := append(append([]byte(nil), udp...), make([]byte, 8-len(udp)%8+8)...)
+	header.UDP(fragmented).SetLength(uint16(len(fragmented)))
+
+	return [][]byte{
+		ipv4Packet(header.TCPProtocolNumber, tcpSyn, 0, false),
+		ipv4Packet(header.UDPProtocolNumber, udp, 0, false),
+		ipv4Packet(header.ICMPv4ProtocolNumber, echo4, 0, false),
+		ipv4Packet(header.UDPProtocolNumber, fragmented[:len(fragmented)-8], 0, true),
+		ipv4Packet(header.UDPProtocolNumber, fragmented[len(fragmented)-8:], len(fragmented)-8, false),
+		ipv6Packet(header.TCPProtocolNumber, tcpSyn),
+		ipv6Packet(header.UDPProtocolNumber, udp),
+		ipv6Packet(header.ICMPv6ProtocolNumber, echo6),
+		ipv6Fragment(header.UDPProtocolNumber, fragmented[:len(fragmented)-8], 0, true),
+	}
+}
+
+func ipv4Packet(protocol tcpip.TransportProtocolNumber, payload []byte, offset int, more bool) []byte {
+	packet := make([]byte, header.IPv4MinimumSize+len(payload))
+	ipHdr := header.IPv4(packet)
+	var flags uint8
+	if more {
+		flags = header.IPv4FlagMoreFragments
+	}
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength:    uint16(len(packet)),
+		ID:             1,
+		Flags:          flags,
+		FragmentOffset: uint16(offset),
+		TTL:            64,
+		Protocol:       uint8(protocol),
+		SrcAddr:        client4,
+		DstAddr:        remote4,
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	copy(packet[header.IPv4MinimumSize:], payload)
+	return packet
+}
+
+func ipv6Packet(protocol tcpip.TransportProtocolNumber, payload []byte) []byte {
+	packet := make([]byte, header.IPv6MinimumSize+len(payload))
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(payload)),
+		TransportProtocol: protocol,
+		HopLimit:          64,
+		SrcAddr:           client6,
+		DstAddr:           remote6,
+	})
+	copy(packet[header.IPv6MinimumSize:], payload)
+	return packet
+}
+
+func ipv6Fragment(protocol tcpip.TransportProtocolNumber, payload []byte, offset int, more bool) []byte {
+	fragment := make([]byte, header.IPv6FragmentHeaderSize+len(payload))
+	fragment[0] = uint8(protocol)
+	offsetAndFlags := uint16(offset/8) << 3
+	if more {
+		offsetAndFlags |= 1
+	}
+	binary.BigEndian.PutUint16(fragment[2:], offsetAndFlags)
+	binary.BigEndian.PutUint32(fragment[4:], 1)
+	copy(fragment[header.IPv6FragmentHeaderSize:], payload)
+	return ipv6Packet(header.IPv6FragmentHeader, fragment)
+}
+
+func ntlmChallengeSeed() []byte {
+	targetInfo := []byte{7, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	message := make([]byte, 48, 48+len(targetInfo))
+	copy(message, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[20:], 0x00800000)
+	copy(message[24:32], "8bytes!!")
+	binary.LittleEndian.PutUint16(message[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(message[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(message[44:], 48)
+	return append(message, targetInfo...)
+}
+
+func socksAddressSeeds() [][]byte {
+	return [][]byte{
+		{1, 127, 0, 0, 1, 0x1f, 0x90},
+		append(append([]byte{3, 11}, "example.com"...), 1, 0xbb),
+		append(append([]byte{4}, net.ParseIP("2001:db8::1")...), 0, 53),
+	}
+}
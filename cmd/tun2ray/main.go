@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+// Command tun2ray runs libcore on desktop Linux: it creates a tun device and
+// routes it through a v2ray configuration, for development and integration
+// tests. It needs CAP_NET_ADMIN, and CAP_NET_RAW with -interface.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"libcore"
+	"libcore/comm"
+)
+
+var (
+	configPath = flag.String("config", "config.json", "v2ray json configuration")
+	device     = flag.String("tun", "tun2ray", "name of the tun device to create")
+	mtu        = flag.Int("mtu", 9000, "mtu of the tun device")
+	address4   = flag.String("address4", "172.19.0.1/30", "ipv4 address of the tun device, empty to disable")
+	gateway4   = flag.String("gateway4", "172.19.0.2", "ipv4 address of the stack")
+	address6   = flag.String("address6", "fdfe:dcba:9876::1/126", "ipv6 address of the tun device, empty to disable")
+	gateway6   = flag.String("gateway6", "fdfe:dcba:9876::2", "ipv6 address of the stack")
+	stack      = flag.String("stack", "gvisor", "tun implementation, gvisor or system")
+	upstream   = flag.String("interface", "", "interface outbound sockets are bound to")
+	mark       = flag.Int("mark", 0, "mark of outbound sockets, for policy routing")
+	assets     = flag.String("assets", "", "assets directory, the user cache directory if empty")
+	setup      = flag.Bool("setup", true, "configure the addresses of the tun device with ip")
+	sniff      = flag.Bool("sniff", true, "sniff domains for routing")
+	debug      = flag.Bool("debug", false, "enable debug logging")
+)
+
+type errorHandler struct{}
+
+func (errorHandler) HandleError(err string) {
+	log.Println("tun: ", err)
+}
+
+func main() {
+	flag.Parse()
+
+	if err := libcore.InitializeLinux(*assets); err != nil {
+		log.Fatalln("initialize: ", err)
+	}
+	content, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		log.Fatalln("read config: ", err)
+	}
+	instance := libcore.NewV2rayInstance()
+	if err = instance.LoadConfig(string(content)); err != nil {
+		log.Fatalln("load config: ", err)
+	}
+	if err = instance.Start(); err != nil {
+		log.Fatalln("start: ", err)
+	}
+	defer instance.Close()
+
+	fd, err := openTun(*device)
+	if err != nil {
+		log.Fatalln("open tun: ", err)
+	}
+	if *setup {
+		if err = setupTun(*device, *address4, *address6, *mtu); err != nil {
+			log.Fatalln("setup tun: ", err)
+		}
+	}
+
+	libcore.SetSocketMark(int32(*mark))
+	config := &libcore.TunConfig{
+		FileDescriptor: int32(fd),
+		Protect:        true,
+		Protector:      libcore.NewLinuxProtector(*upstream),
+		MTU:            int32(*mtu),
+		V2Ray:          instance,
+		Gateway4:       *gateway4,
+		Gateway6:       *gateway6,
+		Sniffing:       *sniff,
+		Debug:          *debug,
+		DumpUID:        true,
+		ErrorHandler:   errorHandler{},
+	}
+	switch {
+	case *address4 == "":
+		config.IPv6Mode = comm.IPv6Only
+	case *address6 == "":
+		config.IPv6Mode = comm.IPv6Disable
+	default:
+		config.IPv6Mode = comm.IPv6Enable
+	}
+	switch *stack {
+	case "gvisor":
+		config.Implementation = comm.TunImplementationGVisor
+	case "system":
+		config.Implementation = comm.TunImplementationSystem
+	default:
+		log.Fatalln("unknown stack ", *stack)
+	}
+	tun, err := libcore.NewTun2ray(config)
+	if err != nil {
+		log.Fatalln("start tun: ", err)
+	}
+	defer tun.Close()
+	log.Println("tun2ray started on ", *device)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+}
+
+func openTun(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	var request struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(request.name[:], name)
+	request.flags = unix.IFF_TUN | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		unix.Close(fd)
+		return -1, errno
+	}
+	return fd, nil
+}
+
+func setupTun(name, address4, address6 string, mtu int) error {
+	commands := [][]string{{"link", "set", name, "mtu", strconv.Itoa(mtu), "up"}}
+	if address4 != "" {
+		commands = append(commands, []string{"addr", "add", address4, "dev", name})
+	}
+	if address6 != "" {
+		commands = append(commands, []string{"-6", "addr", "add", address6, "dev", name})
+	}
+	for _, args := range commands {
+		output, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
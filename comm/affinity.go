@@ -0,0 +1,16 @@
+package comm
+
+import "sync/atomic"
+
+var packetCpus atomic.Value
+
+// SetPacketCpus sets the cpus the packet loops started afterwards are pinned
+// to, none to leave them to the scheduler.
+func SetPacketCpus(cpus []int) {
+	packetCpus.Store(append([]int(nil), cpus...))
+}
+
+func PacketCpus() []int {
+	cpus, _ := packetCpus.Load().([]int)
+	return cpus
+}
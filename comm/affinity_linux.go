@@ -0,0 +1,23 @@
+package comm
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// PinPacketThread dedicates the thread of the calling goroutine to it and
+// pins the thread to the packet cpus, if any. The thread exits with the
+// goroutine.
+func PinPacketThread() error {
+	cpus := PacketCpus()
+	if len(cpus) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package comm
+
+import "runtime"
+
+// PinPacketThread dedicates the thread of the calling goroutine to it if
+// packet cpus are set, pinning is not supported on this platform.
+func PinPacketThread() error {
+	if len(PacketCpus()) > 0 {
+		runtime.LockOSThread()
+	}
+	return nil
+}
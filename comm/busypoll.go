@@ -0,0 +1,18 @@
+package comm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// busyPollSpin is how long tun readers keep polling without blocking after a
+// packet, in nanoseconds. Zero disables busy polling.
+var busyPollSpin int64
+
+func SetBusyPollSpin(spin time.Duration) {
+	atomic.StoreInt64(&busyPollSpin, int64(spin))
+}
+
+func BusyPollSpin() time.Duration {
+	return time.Duration(atomic.LoadInt64(&busyPollSpin))
+}
@@ -0,0 +1,59 @@
+package comm
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+)
+
+const (
+	// busyPollMaxMisses is how many spins in a row may find nothing before
+	// the reader falls back to blocking reads.
+	busyPollMaxMisses = 8
+	// busyPollBurstGap is the longest wait in a blocking read that still
+	// counts as a burst, resuming busy polling.
+	busyPollBurstGap = time.Millisecond
+)
+
+// BusyPoller reads packets from a non-blocking tun fd, spinning on readv for
+// a while after each packet while traffic is flowing, and blocking in poll
+// when it is idle.
+type BusyPoller struct {
+	misses     int
+	lastPacket time.Time
+}
+
+// ReadvUntilStopped works as rawfile.BlockingReadvUntilStopped.
+func (p *BusyPoller) ReadvUntilStopped(efd int, fd int, iovecs []unix.Iovec) (int, tcpip.Error) {
+	spin := BusyPollSpin()
+	if spin > 0 && p.misses < busyPollMaxMisses {
+		deadline := time.Now().Add(spin)
+		for {
+			n, _, e := unix.RawSyscall(unix.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+			if e == 0 {
+				p.misses = 0
+				p.lastPacket = time.Now()
+				return int(n), nil
+			}
+			if e != unix.EWOULDBLOCK {
+				return 0, rawfile.TranslateErrno(e)
+			}
+			if time.Now().After(deadline) {
+				p.misses++
+				break
+			}
+		}
+	}
+	n, err := rawfile.BlockingReadvUntilStopped(efd, fd, iovecs)
+	if n > 0 && spin > 0 {
+		now := time.Now()
+		if now.Sub(p.lastPacket) < busyPollBurstGap {
+			p.misses = 0
+		}
+		p.lastPacket = now
+	}
+	return n, err
+}
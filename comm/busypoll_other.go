@@ -0,0 +1,39 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package comm
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// BusyPoller reads packets from a non-blocking tun fd, busy polling is not
+// supported on this platform and reads always block in poll.
+type BusyPoller struct{}
+
+// ReadvUntilStopped reads a packet into iovecs, blocking until fd is readable
+// or efd signals the stop, in which case it returns -1.
+func (p *BusyPoller) ReadvUntilStopped(efd int, fd int, iovecs []unix.Iovec) (int, tcpip.Error) {
+	for {
+		n, _, e := unix.Syscall(unix.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+		if e == 0 {
+			return int(n), nil
+		}
+		if e != unix.EWOULDBLOCK && e != unix.EINTR {
+			return 0, &tcpip.ErrAborted{}
+		}
+		fds := []unix.PollFd{
+			{Fd: int32(fd), Events: unix.POLLIN},
+			{Fd: int32(efd), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil && err != unix.EINTR {
+			return 0, &tcpip.ErrAborted{}
+		}
+		if fds[1].Revents&unix.POLLIN != 0 {
+			return -1, nil
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package comm
+
+const (
+	MulticastModeDrop = iota
+	MulticastModeForward
+	MulticastModeReflect
+)
@@ -3,4 +3,12 @@ package comm
 const (
 	TunImplementationGVisor = iota
 	TunImplementationSystem
+	// TunImplementationWintun and TunImplementationUtun create the device
+	// named by TunConfig.DeviceName on Windows and macOS, with the gvisor
+	// stack.
+	TunImplementationWintun
+	TunImplementationUtun
+	// TunImplementationPacketFlow exchanges packets with TunConfig.PacketFlow
+	// and Tun2ray.InputPacket, with the gvisor stack.
+	TunImplementationPacketFlow
 )
@@ -3,22 +3,17 @@ package libcore
 import (
 	"os"
 
-	"github.com/sagernet/libping"
 	"libcore/stun"
 )
 
 //go:generate go run ./errorgen
 
 func Setenv(key, value string) error {
-	return os.Setenv(key, value)
+	return withCode(ErrorCodeInvalidArgument, os.Setenv(key, value))
 }
 
 func Unsetenv(key string) error {
-	return os.Unsetenv(key)
-}
-
-func IcmpPing(address string, timeout int32) (int32, error) {
-	return libping.IcmpPing(address, timeout)
+	return withCode(ErrorCodeInvalidArgument, os.Unsetenv(key))
 }
 
 const (
@@ -37,7 +32,7 @@ type StunResult struct {
 func StunTest(serverAddress string, socksPort int32) (*StunResult, error) {
 	natMapping, natFiltering, err := stun.Test(serverAddress, int(socksPort))
 	if err != nil {
-		return nil, err
+		return nil, exportError(err)
 	}
 	return &StunResult{
 		NatMapping:   int32(natMapping),
@@ -0,0 +1,184 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// hijackDns answers a dns-in query locally when possible, returning nil if
+// the query should be passed on to v2ray.
+func (t *Tun2ray) hijackDns(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte) []byte {
+	if !t.trafficStats {
+		return t.v2ray.handleDns(data, nil)
+	}
+	uid, dumped := t.dumpDnsUid(source, destination)
+	result := DnsQueryForwarded
+	response := t.v2ray.handleDns(data, func() {
+		result = DnsQueryBlocked
+		if dumped {
+			t.countDnsBlocked(uid)
+		}
+	})
+	if response != nil && result != DnsQueryBlocked {
+		result = DnsQueryAnswered
+	}
+	if dumped {
+		t.logDnsQuery(uid, data, result)
+	}
+	return response
+}
+
+func (instance *V2RayInstance) handleDns(data []byte, onBlocked func()) []byte {
+	var message dnsmessage.Message
+	if err := message.Unpack(data); err != nil {
+		return nil
+	}
+	if message.Response || len(message.Questions) != 1 {
+		return nil
+	}
+	domain := strings.TrimSuffix(message.Questions[0].Name.String(), ".")
+
+	if response := instance.answerHosts(&message, domain); response != nil {
+		return response
+	}
+
+	if dnsFilter.match(domain) {
+		if onBlocked != nil {
+			onBlocked()
+		}
+		newError("[DNS] blocked ", domain).AtDebug().WriteToLog()
+		return dnsFilter.response(&message)
+	}
+
+	if response := dnsNegative.answer(&message, domain); response != nil {
+		return response
+	}
+
+	if response := dnsPrefetch.answer(instance, &message, domain); response != nil {
+		return response
+	}
+
+	if upstream, name := dnsRoutes.match(domain); upstream != nil {
+		response, err := dnsInflight.exchange(data, func() ([]byte, error) {
+			return upstream.exchange(context.Background(), instance, &message, data)
+		})
+		if err != nil {
+			newError("[DNS] exchange ", domain, " with ", name, " failed").Base(err).WriteToLog()
+			response = packDnsResponse(&message, dnsmessage.RCodeServerFailure, nil)
+		}
+		dnsNegative.record(response)
+		return response
+	}
+
+	return nil
+}
+
+func (instance *V2RayInstance) answerHosts(message *dnsmessage.Message, domain string) []byte {
+	ips, alias, ok := hosts.lookupIP(domain, "ip")
+	if !ok {
+		return nil
+	}
+
+	question := message.Questions[0]
+	var answers []dnsmessage.Resource
+	if alias != "" {
+		cname, err := dnsmessage.NewName(alias + ".")
+		if err != nil {
+			return nil
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeCNAME,
+				Class: dnsmessage.ClassINET,
+				TTL:   hostsTTL,
+			},
+			Body: &dnsmessage.CNAMEResource{CNAME: cname},
+		})
+		question.Name = cname
+		ips, _ = instance.dnsClient.LookupIP(alias)
+	}
+	answers = append(answers, newDnsAnswers(question, ips, hostsTTL)...)
+	newError("[DNS] ", domain, " answered from hosts").AtDebug().WriteToLog()
+	return packDnsResponse(message, dnsmessage.RCodeSuccess, answers)
+}
+
+func newDnsAnswers(question dnsmessage.Question, ips []net.IP, ttl uint32) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if question.Type != dnsmessage.TypeA {
+				continue
+			}
+			resource := &dnsmessage.AResource{}
+			copy(resource.A[:], ip4)
+			header.Type = dnsmessage.TypeA
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: resource})
+		} else {
+			if question.Type != dnsmessage.TypeAAAA {
+				continue
+			}
+			resource := &dnsmessage.AAAAResource{}
+			copy(resource.AAAA[:], ip.To16())
+			header.Type = dnsmessage.TypeAAAA
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: resource})
+		}
+	}
+	return answers
+}
+
+func dnsAnswerIPs(message *dnsmessage.Message) []net.IP {
+	var ips []net.IP
+	for _, answer := range message.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips
+}
+
+func packDnsResponse(query *dnsmessage.Message, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+		Answers:   answers,
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		newError("[DNS] failed to pack response").Base(err).AtWarning().WriteToLog()
+		return nil
+	}
+	return packed
+}
+
+func dnsRCodeFromError(err error) dnsmessage.RCode {
+	var rcode dns.RCodeError
+	if errors.As(err, &rcode) {
+		return dnsmessage.RCode(rcode)
+	}
+	if errors.Is(err, dns.ErrEmptyResponse) {
+		return dnsmessage.RCodeSuccess
+	}
+	return dnsmessage.RCodeServerFailure
+}
@@ -0,0 +1,214 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// nat64DiscoveryDomain resolves to 192.0.0.170 and 192.0.0.171 only, their
+// synthesized AAAA records tell the prefix of the network (RFC 7050).
+const nat64DiscoveryDomain = "ipv4only.arpa"
+
+var nat64WellKnownIPs = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+// nat64PrefixLengths are the prefix lengths of RFC 6052, longest first.
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+var dns64 struct {
+	access  sync.RWMutex
+	enabled bool
+	// prefix is nil unless the network is ipv6 only with a nat64
+	prefix *net.IPNet
+	// discovered is whether the prefix was found by DiscoverNat64Prefix
+	// rather than set by the platform
+	discovered bool
+}
+
+// SetDns64 synthesizes AAAA records from the A records of the platform
+// resolver for the domains without ipv6 addresses, like the resolver of
+// Android does, once the network is known to be ipv6 only: the platform set
+// its nat64 prefix, or DiscoverNat64Prefix found one. The prefix is
+// discovered again on NotifyNetworkChange. Off by default.
+func SetDns64(enabled bool) {
+	dns64.access.Lock()
+	dns64.enabled = enabled
+	dns64.access.Unlock()
+	if enabled {
+		go rediscoverNat64Prefix()
+	}
+}
+
+// SetNat64Prefix sets the nat64 prefix of the network as reported by the
+// platform, e.g. "64:ff9b::/96". Empty clears it, the network is then
+// considered dual stack or ipv4 only.
+func SetNat64Prefix(prefix string) error {
+	if prefix == "" {
+		dns64.access.Lock()
+		dns64.prefix = nil
+		dns64.discovered = false
+		dns64.access.Unlock()
+		return nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid nat64 prefix ", prefix).Base(err))
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv6len || !isNat64PrefixLength(ones) {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid nat64 prefix length ", prefix))
+	}
+	dns64.access.Lock()
+	dns64.prefix = network
+	dns64.discovered = false
+	dns64.access.Unlock()
+	return nil
+}
+
+// DiscoverNat64Prefix looks the nat64 prefix of the network up with the
+// platform resolver, and uses it for dns64. It returns the prefix, empty if
+// the network has none.
+func DiscoverNat64Prefix() (string, error) {
+	result, ok, err := resolveLocal(context.Background(), "ip6", nat64DiscoveryDomain)
+	if err == nil && !ok {
+		err = newError("no local resolver")
+	}
+	if err != nil {
+		return "", exportError(err)
+	}
+	var prefix *net.IPNet
+	for _, address := range result.addresses {
+		if prefix = extractNat64Prefix(address.ip); prefix != nil {
+			break
+		}
+	}
+	dns64.access.Lock()
+	if prefix != nil || dns64.discovered {
+		dns64.prefix = prefix
+		dns64.discovered = prefix != nil
+	}
+	dns64.access.Unlock()
+	if prefix == nil {
+		return "", nil
+	}
+	newError("[DNS] discovered nat64 prefix ", prefix).AtInfo().WriteToLog()
+	return prefix.String(), nil
+}
+
+// rediscoverNat64Prefix drops a discovered prefix and looks it up again, on
+// network changes. A prefix set by the platform is kept for it to update.
+func rediscoverNat64Prefix() {
+	dns64.access.Lock()
+	enabled := dns64.enabled
+	if dns64.discovered {
+		dns64.prefix = nil
+		dns64.discovered = false
+	}
+	dns64.access.Unlock()
+	if !enabled {
+		return
+	}
+	if _, err := DiscoverNat64Prefix(); err != nil {
+		newError("[DNS] nat64 prefix discovery failed").Base(err).AtDebug().WriteToLog()
+	}
+}
+
+func isNat64PrefixLength(length int) bool {
+	for _, l := range nat64PrefixLengths {
+		if l == length {
+			return true
+		}
+	}
+	return false
+}
+
+// extractNat64Prefix returns the prefix of an address synthesized for a
+// well known address of ipv4only.arpa, nil if it is not one.
+func extractNat64Prefix(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	for _, length := range nat64PrefixLengths {
+		prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(length, 128)), Mask: net.CIDRMask(length, 128)}
+		embedded := unembedNat64(prefix, ip)
+		for _, wellKnown := range nat64WellKnownIPs {
+			if embedded.Equal(wellKnown) {
+				return prefix
+			}
+		}
+	}
+	return nil
+}
+
+// embedNat64 places ip4 after prefix as RFC 6052 does, skipping bits 64 to
+// 71.
+func embedNat64(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	offset := ones / 8
+	for _, b := range ip4.To4() {
+		if offset == 8 {
+			offset++
+		}
+		ip[offset] = b
+		offset++
+	}
+	return ip
+}
+
+func unembedNat64(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip4 := make(net.IP, net.IPv4len)
+	offset := ones / 8
+	for i := range ip4 {
+		if offset == 8 {
+			offset++
+		}
+		ip4[i] = ip[offset]
+		offset++
+	}
+	return ip4
+}
+
+// synthesizeDns64 adds the AAAA records synthesized from the A records of
+// domain to a result of the platform resolver without ipv6 addresses.
+func synthesizeDns64(ctx context.Context, network string, domain string, result *ResolveResult) {
+	dns64.access.RLock()
+	enabled, prefix := dns64.enabled, dns64.prefix
+	dns64.access.RUnlock()
+	if !enabled || prefix == nil || result.Rcode != 0 || strings.EqualFold(strings.TrimSuffix(domain, "."), nat64DiscoveryDomain) {
+		return
+	}
+	var ipv4 []resolvedAddress
+	for _, address := range result.addresses {
+		if address.ip.To4() == nil {
+			return
+		}
+		ipv4 = append(ipv4, address)
+	}
+	if network == "ip6" {
+		resultV4, ok, err := resolveLocal(ctx, "ip4", domain)
+		if !ok || err != nil || resultV4.Rcode != 0 {
+			return
+		}
+		ipv4 = resultV4.addresses
+		if len(result.cnames) == 0 {
+			result.cnames = resultV4.cnames
+		}
+	}
+	var synthesized int
+	for _, address := range ipv4 {
+		ip4 := address.ip.To4()
+		if ip4 == nil || ip4.IsLoopback() || ip4.IsUnspecified() || ip4.IsLinkLocalUnicast() {
+			continue
+		}
+		result.addresses = append(result.addresses, resolvedAddress{embedNat64(prefix, ip4), address.ttl})
+		synthesized++
+	}
+	if synthesized > 0 {
+		newError("[DNS] synthesized ", synthesized, " AAAA records for ", domain).AtDebug().WriteToLog()
+	}
+}
@@ -0,0 +1,175 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"libcore/comm"
+)
+
+var dnsInflight = &dnsCoalescer{
+	calls:   make(map[dnsInflightKey]*dnsInflightCall),
+	pending: make(map[dnsInflightKey]*dnsPendingQuery),
+}
+
+// dnsCoalescer sends concurrent queries of the same name and type to the
+// upstream once, the queries arriving while it is in flight get a copy of
+// its response with their own id.
+type dnsCoalescer struct {
+	access sync.Mutex
+	calls  map[dnsInflightKey]*dnsInflightCall
+	// pending are the queries of the tun forwarded to dns-in, whose
+	// responses arrive on the udp session of the first one
+	pending   map[dnsInflightKey]*dnsPendingQuery
+	coalesced int64
+}
+
+type dnsPendingQuery struct {
+	waiters []dnsWaiter
+	timer   *time.Timer
+}
+
+type dnsWaiter struct {
+	id        uint16
+	writeBack func([]byte, *net.UDPAddr) (int, error)
+	// closer is the udp session of the waiting query, kept open for its
+	// response
+	closer io.Closer
+}
+
+type dnsInflightKey struct {
+	domain string
+	qtype  dnsmessage.Type
+	class  dnsmessage.Class
+}
+
+type dnsInflightCall struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+// GetDnsCoalescedQueries returns the number of queries answered with the
+// response of an identical query already in flight.
+func GetDnsCoalescedQueries() int64 {
+	return atomic.LoadInt64(&dnsInflight.coalesced)
+}
+
+// exchange runs exchange for query unless an identical query is in flight,
+// in which case its response is returned. Queries that do not parse are
+// exchanged alone.
+func (c *dnsCoalescer) exchange(query []byte, exchange func() ([]byte, error)) ([]byte, error) {
+	header, key, ok := parseDnsInflightKey(query)
+	if !ok {
+		return exchange()
+	}
+
+	c.access.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.access.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return copyDnsResponse(call.response, header.ID), nil
+	}
+	call := &dnsInflightCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.access.Unlock()
+
+	call.response, call.err = exchange()
+	c.access.Lock()
+	delete(c.calls, key)
+	c.access.Unlock()
+	close(call.done)
+	if call.err != nil {
+		return nil, call.err
+	}
+	// the callers may rewrite their response, the shared one is kept intact
+	return copyDnsResponse(call.response, header.ID), nil
+}
+
+// join registers a query of the tun forwarded to dns-in, it returns true if
+// an identical query is pending and writeBack will get its response, false
+// if the query has to be sent. Pending queries expire after the exchange
+// timeout.
+func (c *dnsCoalescer) join(query []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) bool {
+	header, key, ok := parseDnsInflightKey(query)
+	if !ok || header.Response {
+		return false
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	if pending, ok := c.pending[key]; ok {
+		pending.waiters = append(pending.waiters, dnsWaiter{header.ID, writeBack, closer})
+		atomic.AddInt64(&c.coalesced, 1)
+		return true
+	}
+	pending := new(dnsPendingQuery)
+	pending.timer = time.AfterFunc(dnsExchangeTimeout, func() {
+		c.access.Lock()
+		if c.pending[key] != pending {
+			c.access.Unlock()
+			return
+		}
+		delete(c.pending, key)
+		c.access.Unlock()
+		for _, waiter := range pending.waiters {
+			comm.CloseIgnore(waiter.closer)
+		}
+	})
+	c.pending[key] = pending
+	return false
+}
+
+// complete fans a response of dns-in out to the queries waiting for it.
+func (c *dnsCoalescer) complete(response []byte) {
+	_, key, ok := parseDnsInflightKey(response)
+	if !ok {
+		return
+	}
+	c.access.Lock()
+	pending, ok := c.pending[key]
+	if ok {
+		delete(c.pending, key)
+	}
+	c.access.Unlock()
+	if !ok {
+		return
+	}
+	pending.timer.Stop()
+	for _, waiter := range pending.waiters {
+		if _, err := waiter.writeBack(copyDnsResponse(response, waiter.id), nil); err != nil {
+			newError("[DNS] failed to write coalesced response").Base(err).AtDebug().WriteToLog()
+		}
+		comm.CloseIgnore(waiter.closer)
+	}
+}
+
+func parseDnsInflightKey(message []byte) (dnsmessage.Header, dnsInflightKey, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(message)
+	if err != nil {
+		return header, dnsInflightKey{}, false
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return header, dnsInflightKey{}, false
+	}
+	return header, dnsInflightKey{strings.ToLower(question.Name.String()), question.Type, question.Class}, true
+}
+
+func copyDnsResponse(response []byte, id uint16) []byte {
+	response = append([]byte(nil), response...)
+	if len(response) >= 2 {
+		binary.BigEndian.PutUint16(response, id)
+	}
+	return response
+}
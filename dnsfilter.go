@@ -0,0 +1,217 @@
+package libcore
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5/common/strmatcher"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DnsFilterModeNxDomain int32 = iota
+	DnsFilterModeNullIP
+)
+
+var dnsFilter = new(dnsFilterEngine)
+
+type dnsFilterRules struct {
+	blockFull   strmatcher.FullMatcherGroup
+	blockDomain strmatcher.DomainMatcherGroup
+	allowFull   strmatcher.FullMatcherGroup
+	allowDomain strmatcher.DomainMatcherGroup
+	size        int
+}
+
+type dnsFilterEngine struct {
+	access  sync.RWMutex
+	enabled bool
+	mode    int32
+	rules   *dnsFilterRules
+	pending *dnsFilterRules
+	blocked uint64
+}
+
+func SetDnsFilterEnabled(enabled bool) {
+	dnsFilter.access.Lock()
+	dnsFilter.enabled = enabled
+	dnsFilter.access.Unlock()
+}
+
+func SetDnsFilterMode(mode int32) {
+	dnsFilter.access.Lock()
+	dnsFilter.mode = mode
+	dnsFilter.access.Unlock()
+}
+
+// AddDnsFilterList parses a hosts or adblock style list into the pending rule
+// set, call CompileDnsFilter to apply it.
+func AddDnsFilterList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return exportError(newError("open filter list").Base(err))
+	}
+	defer file.Close()
+	return dnsFilter.parse(file)
+}
+
+func AddDnsFilterRules(content string) error {
+	return dnsFilter.parse(strings.NewReader(content))
+}
+
+// CompileDnsFilter replaces the running rule set with all lists added since the
+// last compilation and returns the rule count.
+func CompileDnsFilter() int32 {
+	dnsFilter.access.Lock()
+	defer dnsFilter.access.Unlock()
+	rules := dnsFilter.pending
+	dnsFilter.pending = nil
+	dnsFilter.rules = rules
+	if rules == nil {
+		return 0
+	}
+	logrus.Info("compiled ", rules.size, " dns filter rules")
+	return int32(rules.size)
+}
+
+func ClearDnsFilter() {
+	dnsFilter.access.Lock()
+	dnsFilter.rules = nil
+	dnsFilter.pending = nil
+	dnsFilter.access.Unlock()
+}
+
+func GetDnsBlockedTotal() int64 {
+	return int64(atomic.LoadUint64(&dnsFilter.blocked))
+}
+
+func (f *dnsFilterEngine) parse(reader io.Reader) error {
+	f.access.Lock()
+	rules := f.pending
+	if rules == nil {
+		rules = new(dnsFilterRules)
+		f.pending = rules
+	}
+	f.access.Unlock()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		if isCosmeticRule(line) {
+			continue
+		}
+		line = stripComment(line)
+
+		allow := false
+		if strings.HasPrefix(line, "@@") {
+			allow = true
+			line = line[2:]
+		}
+
+		var domain string
+		var suffix bool
+		if strings.HasPrefix(line, "||") {
+			line = line[2:]
+			if index := strings.IndexByte(line, '$'); index >= 0 {
+				if line[index+1:] != "important" {
+					continue
+				}
+				line = line[:index]
+			}
+			domain = strings.TrimSuffix(line, "^")
+			suffix = true
+		} else if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			// hosts format, only the first name of each line is used
+			domain = fields[1]
+		} else if len(fields) == 1 {
+			domain = fields[0]
+		} else {
+			continue
+		}
+
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if domain == "" || domain == "localhost" || strings.ContainsAny(domain, "/*^|:$") {
+			continue
+		}
+
+		f.access.Lock()
+		switch {
+		case allow && suffix:
+			rules.allowDomain.AddDomainMatcher(strmatcher.DomainMatcher(domain), 0)
+		case allow:
+			rules.allowFull.AddFullMatcher(strmatcher.FullMatcher(domain), 0)
+		case suffix:
+			rules.blockDomain.AddDomainMatcher(strmatcher.DomainMatcher(domain), 0)
+		default:
+			rules.blockFull.AddFullMatcher(strmatcher.FullMatcher(domain), 0)
+		}
+		rules.size++
+		f.access.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return newError("read filter list").Base(err)
+	}
+	return nil
+}
+
+func (f *dnsFilterEngine) match(domain string) bool {
+	f.access.RLock()
+	defer f.access.RUnlock()
+	rules := f.rules
+	if !f.enabled || rules == nil {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	if rules.allowFull.MatchAny(domain) || rules.allowDomain.MatchAny(domain) {
+		return false
+	}
+	return rules.blockFull.MatchAny(domain) || rules.blockDomain.MatchAny(domain)
+}
+
+func (f *dnsFilterEngine) response(query *dnsmessage.Message) []byte {
+	f.access.RLock()
+	mode := f.mode
+	f.access.RUnlock()
+	atomic.AddUint64(&f.blocked, 1)
+
+	if mode == DnsFilterModeNxDomain {
+		return packDnsResponse(query, dnsmessage.RCodeNameError, nil)
+	}
+	question := query.Questions[0]
+	return packDnsResponse(query, dnsmessage.RCodeSuccess, newDnsAnswers(question, []net.IP{net.IPv4zero.To4(), net.IPv6zero}, hostsTTL))
+}
+
+func (t *Tun2ray) countDnsBlocked(uid uint32) {
+	atomic.AddUint64(&t.getAppStats(uid).dnsBlocked, 1)
+}
+
+// isCosmeticRule is whether line is an element hiding or scriptlet rule of an
+// adblock list, which apply to pages and not to dns.
+func isCosmeticRule(line string) bool {
+	for _, separator := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripComment removes a trailing hosts comment, a # only starts one after
+// whitespace.
+func stripComment(line string) string {
+	for index := 1; index < len(line); index++ {
+		if line[index] == '#' && (line[index-1] == ' ' || line[index-1] == '\t') {
+			return strings.TrimSpace(line[:index])
+		}
+	}
+	return line
+}
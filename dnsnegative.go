@@ -0,0 +1,187 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsNegativeMaxSize = 4096
+	// dnsServfailThreshold is the number of consecutive SERVFAILs of a
+	// domain after which it is backed off.
+	dnsServfailThreshold = 2
+	dnsServfailBackoff   = time.Second
+)
+
+var dnsNegative = &dnsNegativeCache{entries: make(map[dnsNegativeKey]*dnsNegativeEntry)}
+
+// dnsNegativeCache answers the queries that failed recently without asking
+// the upstream again: NXDOMAIN and empty answers for ttl, and domains whose
+// upstream keeps failing with SERVFAIL for a backoff doubled on each failure.
+type dnsNegativeCache struct {
+	access     sync.Mutex
+	ttl        time.Duration
+	maxBackoff time.Duration
+	entries    map[dnsNegativeKey]*dnsNegativeEntry
+
+	negativeHits int64
+	backoffHits  int64
+	servfails    int64
+}
+
+type dnsNegativeKey struct {
+	domain string
+	qtype  dnsmessage.Type
+}
+
+type dnsNegativeEntry struct {
+	rcode     dnsmessage.RCode
+	expiresAt time.Time
+	// servfails counts the consecutive SERVFAIL answers
+	servfails int
+}
+
+type DnsNegativeCacheStats struct {
+	// NegativeHits counts the NXDOMAIN and empty answers served from the
+	// cache, BackoffHits the SERVFAILs served while a domain is backed off.
+	NegativeHits int64
+	BackoffHits  int64
+	// Servfails counts the SERVFAIL answers of the upstreams.
+	Servfails int64
+	Size      int32
+}
+
+// SetDnsNegativeCache caches the NXDOMAIN and empty answers of dns-in and the
+// dns server for ttlSeconds, and answers SERVFAIL for the domains failing
+// twice in a row with it, for one second doubled on each further failure up
+// to maxBackoffSeconds, so apps retrying failed queries in a loop do not
+// flood the tunnel. Zero disables each, both are off by default.
+func SetDnsNegativeCache(ttlSeconds int32, maxBackoffSeconds int32) error {
+	if ttlSeconds < 0 || maxBackoffSeconds < 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid negative cache policy"))
+	}
+	dnsNegative.access.Lock()
+	defer dnsNegative.access.Unlock()
+	dnsNegative.ttl = time.Duration(ttlSeconds) * time.Second
+	dnsNegative.maxBackoff = time.Duration(maxBackoffSeconds) * time.Second
+	if ttlSeconds == 0 && maxBackoffSeconds == 0 {
+		dnsNegative.entries = make(map[dnsNegativeKey]*dnsNegativeEntry)
+	}
+	return nil
+}
+
+func GetDnsNegativeCacheStats() *DnsNegativeCacheStats {
+	dnsNegative.access.Lock()
+	defer dnsNegative.access.Unlock()
+	return &DnsNegativeCacheStats{
+		NegativeHits: dnsNegative.negativeHits,
+		BackoffHits:  dnsNegative.backoffHits,
+		Servfails:    dnsNegative.servfails,
+		Size:         int32(len(dnsNegative.entries)),
+	}
+}
+
+// answer returns the cached failure of the query, nil if there is none.
+func (c *dnsNegativeCache) answer(query *dnsmessage.Message, domain string) []byte {
+	c.access.Lock()
+	if c.ttl == 0 && c.maxBackoff == 0 {
+		c.access.Unlock()
+		return nil
+	}
+	entry, ok := c.entries[dnsNegativeKey{strings.ToLower(domain), query.Questions[0].Type}]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		c.access.Unlock()
+		return nil
+	}
+	rcode := entry.rcode
+	if rcode == dnsmessage.RCodeServerFailure {
+		c.backoffHits++
+	} else {
+		c.negativeHits++
+	}
+	c.access.Unlock()
+	newError("[DNS] ", domain, " answered ", rcode, " from negative cache").AtDebug().WriteToLog()
+	return packDnsResponse(query, rcode, nil)
+}
+
+// record caches a response of the upstreams if it failed, and forgets the
+// failures of its domain otherwise.
+func (c *dnsNegativeCache) record(response []byte) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil || !header.Response || header.Truncated || len(response) < 12 {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+	answers := binary.BigEndian.Uint16(response[6:])
+	key := dnsNegativeKey{strings.ToLower(strings.TrimSuffix(question.Name.String(), ".")), question.Type}
+
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.ttl == 0 && c.maxBackoff == 0 {
+		return
+	}
+	now := time.Now()
+	entry := c.entries[key]
+	switch {
+	case header.RCode == dnsmessage.RCodeNameError, header.RCode == dnsmessage.RCodeSuccess && answers == 0:
+		if c.ttl == 0 {
+			return
+		}
+		if entry = c.entry(key, entry, now); entry != nil {
+			entry.rcode = header.RCode
+			entry.expiresAt = now.Add(c.ttl)
+			entry.servfails = 0
+		}
+	case header.RCode == dnsmessage.RCodeServerFailure:
+		c.servfails++
+		if c.maxBackoff == 0 {
+			return
+		}
+		if entry = c.entry(key, entry, now); entry == nil {
+			return
+		}
+		entry.rcode = header.RCode
+		entry.servfails++
+		if entry.servfails < dnsServfailThreshold {
+			entry.expiresAt = now
+			return
+		}
+		backoff := c.maxBackoff
+		if shift := entry.servfails - dnsServfailThreshold; shift < 16 && dnsServfailBackoff<<shift < backoff {
+			backoff = dnsServfailBackoff << shift
+		}
+		entry.expiresAt = now.Add(backoff)
+		newError("[DNS] backing off ", key.domain, " for ", backoff, " after ", entry.servfails, " failures").AtDebug().WriteToLog()
+	case header.RCode == dnsmessage.RCodeSuccess:
+		delete(c.entries, key)
+	}
+}
+
+// entry returns the existing entry or adds one, nil if the cache is full of
+// entries still in use.
+func (c *dnsNegativeCache) entry(key dnsNegativeKey, entry *dnsNegativeEntry, now time.Time) *dnsNegativeEntry {
+	if entry != nil {
+		return entry
+	}
+	if len(c.entries) >= dnsNegativeMaxSize {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= dnsNegativeMaxSize {
+			return nil
+		}
+	}
+	entry = new(dnsNegativeEntry)
+	c.entries[key] = entry
+	return entry
+}
@@ -0,0 +1,381 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPrefetchMaxDomains = 512
+	// dnsPrefetchMinHits is how many queries make a domain worth prefetching,
+	// hits are halved every dnsPrefetchDecay so only recent ones count.
+	dnsPrefetchMinHits  = 3
+	dnsPrefetchDecay    = 10 * time.Minute
+	dnsPrefetchLead     = 5 * time.Second
+	dnsPrefetchRetry    = 30 * time.Second
+	dnsPrefetchParallel = 4
+	// dnsPrefetchTracked is how many domains are counted per prefetched one.
+	dnsPrefetchTracked = 4
+)
+
+// dnsPrefetch refreshes the answers of the most queried domains shortly
+// before their ttl expires and answers the queries of the tun and the dns
+// server with them, so the first connection to a popular site does not wait
+// for the upstream.
+var dnsPrefetch = &dnsPrefetcher{entries: make(map[dnsPrefetchKey]*dnsPrefetchEntry)}
+
+type dnsPrefetchKey struct {
+	domain string
+	qtype  dnsmessage.Type
+}
+
+type dnsPrefetchEntry struct {
+	hits       float64
+	ips        []net.IP
+	expiresAt  time.Time
+	retryAt    time.Time
+	refreshing bool
+}
+
+type dnsPrefetcher struct {
+	access     sync.Mutex
+	owner      *V2RayInstance
+	maxDomains int
+	entries    map[dnsPrefetchKey]*dnsPrefetchEntry
+	// generation changes when the answers are dropped, refreshes started
+	// before are discarded
+	generation int
+	done       chan struct{}
+
+	hits      int64
+	misses    int64
+	refreshed int64
+	failed    int64
+}
+
+type DnsPrefetchStats struct {
+	// Tracked is the number of domains counted, Prefetched those of them
+	// with an answer ready.
+	Tracked    int32
+	Prefetched int32
+	// Hits and Misses count the queries answered from the prefetched answers
+	// and those passed on.
+	Hits      int64
+	Misses    int64
+	Refreshed int64
+	Failed    int64
+}
+
+// SetDnsPrefetch keeps the answers of the maxDomains most queried domains,
+// at most 512, fresh by resolving them again shortly before their ttl
+// expires. They are resolved with the dns route of the domain, or the dns of
+// the instance. The prefetcher belongs to one instance at a time, 0 disables
+// it.
+func (instance *V2RayInstance) SetDnsPrefetch(maxDomains int32) error {
+	if maxDomains < 0 || maxDomains > dnsPrefetchMaxDomains {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid dns prefetch size ", maxDomains))
+	}
+	if maxDomains == 0 {
+		dnsPrefetch.release(instance)
+		return nil
+	}
+	dnsPrefetch.configure(instance, int(maxDomains))
+	return nil
+}
+
+// GetDnsPrefetchStats returns the stats of the prefetcher since
+// SetDnsPrefetch, empty if it belongs to another instance.
+func (instance *V2RayInstance) GetDnsPrefetchStats() *DnsPrefetchStats {
+	p := dnsPrefetch
+	p.access.Lock()
+	defer p.access.Unlock()
+	stats := new(DnsPrefetchStats)
+	if p.owner != instance {
+		return stats
+	}
+	now := time.Now()
+	stats.Tracked = int32(len(p.entries))
+	for _, entry := range p.entries {
+		if entry.expiresAt.After(now) {
+			stats.Prefetched++
+		}
+	}
+	stats.Hits, stats.Misses, stats.Refreshed, stats.Failed = p.hits, p.misses, p.refreshed, p.failed
+	return stats
+}
+
+func (p *dnsPrefetcher) configure(owner *V2RayInstance, maxDomains int) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner != owner {
+		p.drop()
+		p.hits, p.misses, p.refreshed, p.failed = 0, 0, 0, 0
+	}
+	if p.done == nil {
+		p.done = make(chan struct{})
+		go p.loop(p.done)
+	}
+	p.owner = owner
+	p.maxDomains = maxDomains
+}
+
+// release disables the prefetcher if it belongs to owner, on
+// SetDnsPrefetch(0) and when the instance closes.
+func (p *dnsPrefetcher) release(owner *V2RayInstance) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner != owner {
+		return
+	}
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.owner = nil
+	p.drop()
+}
+
+// flush drops the answers, which were resolved over the previous network,
+// the hits are kept so the popular domains are prefetched again right away.
+func (p *dnsPrefetcher) flush() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner == nil {
+		return
+	}
+	p.generation++
+	for _, entry := range p.entries {
+		entry.ips = nil
+		entry.expiresAt = time.Time{}
+		entry.retryAt = time.Time{}
+		entry.refreshing = false
+	}
+}
+
+// drop forgets all domains, p.access must be held.
+func (p *dnsPrefetcher) drop() {
+	p.generation++
+	p.entries = make(map[dnsPrefetchKey]*dnsPrefetchEntry)
+}
+
+// answer counts the query and returns the prefetched answer to it, or nil if
+// there is none yet.
+func (p *dnsPrefetcher) answer(instance *V2RayInstance, query *dnsmessage.Message, domain string) []byte {
+	question := query.Questions[0]
+	if question.Class != dnsmessage.ClassINET || question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	key := dnsPrefetchKey{strings.ToLower(domain), question.Type}
+
+	p.access.Lock()
+	if p.owner != instance {
+		p.access.Unlock()
+		return nil
+	}
+	entry, ok := p.entries[key]
+	if !ok {
+		if len(p.entries) >= p.maxDomains*dnsPrefetchTracked {
+			p.evict()
+		}
+		entry = new(dnsPrefetchEntry)
+		p.entries[key] = entry
+	}
+	entry.hits++
+	remaining := time.Until(entry.expiresAt)
+	if remaining <= 0 {
+		p.misses++
+		p.access.Unlock()
+		return nil
+	}
+	p.hits++
+	ips := entry.ips
+	p.access.Unlock()
+
+	ttl := uint32(remaining / time.Second)
+	if ttl == 0 {
+		ttl = 1
+	}
+	newError("[DNS] ", domain, " answered from prefetch").AtDebug().WriteToLog()
+	return packDnsResponse(query, dnsmessage.RCodeSuccess, newDnsAnswers(question, ips, ttl))
+}
+
+// evict forgets the least queried domain, p.access must be held.
+func (p *dnsPrefetcher) evict() {
+	var (
+		least    dnsPrefetchKey
+		leastHit = -1.0
+	)
+	for key, entry := range p.entries {
+		if leastHit < 0 || entry.hits < leastHit {
+			least, leastHit = key, entry.hits
+		}
+	}
+	delete(p.entries, least)
+}
+
+func (p *dnsPrefetcher) loop(done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	decayAt := time.Now().Add(dnsPrefetchDecay)
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if now.After(decayAt) {
+				p.decay()
+				decayAt = now.Add(dnsPrefetchDecay)
+			}
+			p.schedule(now)
+		}
+	}
+}
+
+// decay halves the hits and forgets the domains no longer queried.
+func (p *dnsPrefetcher) decay() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for key, entry := range p.entries {
+		entry.hits /= 2
+		if entry.hits < 1 && !entry.refreshing {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// schedule refreshes the answers of the most queried domains that expire
+// within dnsPrefetchLead.
+func (p *dnsPrefetcher) schedule(now time.Time) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner == nil {
+		return
+	}
+	var (
+		popular    []dnsPrefetchKey
+		refreshing int
+	)
+	for key, entry := range p.entries {
+		if entry.refreshing {
+			refreshing++
+		}
+		if entry.hits >= dnsPrefetchMinHits {
+			popular = append(popular, key)
+		}
+	}
+	sort.Slice(popular, func(i, j int) bool {
+		return p.entries[popular[i]].hits > p.entries[popular[j]].hits
+	})
+	if len(popular) > p.maxDomains {
+		popular = popular[:p.maxDomains]
+	}
+	for _, key := range popular {
+		if refreshing >= dnsPrefetchParallel {
+			return
+		}
+		entry := p.entries[key]
+		if entry.refreshing || now.Before(entry.retryAt) || now.Before(entry.expiresAt.Add(-dnsPrefetchLead)) {
+			continue
+		}
+		entry.refreshing = true
+		refreshing++
+		go p.refresh(p.owner, key, p.generation)
+	}
+}
+
+func (p *dnsPrefetcher) refresh(instance *V2RayInstance, key dnsPrefetchKey, generation int) {
+	ips, ttl, err := instance.resolvePrefetch(key.domain, key.qtype)
+	ttl = clampTtl(ttl)
+
+	p.access.Lock()
+	defer p.access.Unlock()
+	entry, ok := p.entries[key]
+	if generation != p.generation || !ok {
+		return
+	}
+	entry.refreshing = false
+	if err != nil {
+		p.failed++
+		entry.retryAt = time.Now().Add(dnsPrefetchRetry)
+		newError("[DNS] failed to prefetch ", key.domain).Base(err).AtDebug().WriteToLog()
+		return
+	}
+	p.refreshed++
+	entry.ips = ips
+	entry.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	if time.Duration(ttl)*time.Second <= dnsPrefetchLead {
+		// a ttl this short is meant to be resolved every time
+		entry.retryAt = entry.expiresAt
+	}
+}
+
+// resolvePrefetch resolves domain with its dns route, or the dns of the
+// instance, which does not tell the ttl of its answers.
+func (instance *V2RayInstance) resolvePrefetch(domain string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	if upstream, _ := dnsRoutes.match(domain); upstream != nil {
+		name, err := dnsmessage.NewName(domain + ".")
+		if err != nil {
+			return nil, 0, err
+		}
+		query := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		raw, err := query.Pack()
+		if err != nil {
+			return nil, 0, err
+		}
+		response, err := upstream.exchange(context.Background(), instance, query, raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		var message dnsmessage.Message
+		if err = message.Unpack(response); err != nil {
+			return nil, 0, err
+		}
+		if message.RCode != dnsmessage.RCodeSuccess {
+			return nil, 0, dns.RCodeError(message.RCode)
+		}
+		var ttl uint32 = hostsTTL
+		for index, answer := range message.Answers {
+			if index == 0 || answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+		}
+		return dnsAnswerIPs(&message), ttl, nil
+	}
+
+	if instance.dnsClient == nil {
+		return nil, 0, newError("dns not initialized")
+	}
+	var (
+		ips []net.IP
+		err error
+	)
+	if qtype == dnsmessage.TypeA {
+		lookup, ok := instance.dnsClient.(dns.IPv4Lookup)
+		if !ok {
+			return nil, 0, newError("ipv4 lookup not supported")
+		}
+		ips, err = lookup.LookupIPv4(domain)
+	} else {
+		lookup, ok := instance.dnsClient.(dns.IPv6Lookup)
+		if !ok {
+			return nil, 0, newError("ipv6 lookup not supported")
+		}
+		ips, err = lookup.LookupIPv6(domain)
+	}
+	if err != nil && !errors.Is(err, dns.ErrEmptyResponse) {
+		return nil, 0, err
+	}
+	return ips, hostsTTL, nil
+}
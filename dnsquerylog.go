@@ -0,0 +1,124 @@
+package libcore
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQueryLogSize is how many dns-in queries are kept, older ones are
+// overwritten.
+const dnsQueryLogSize = 1024
+
+// How a dns-in query was handled.
+const (
+	// DnsQueryForwarded is passed on to the dns outbound of v2ray.
+	DnsQueryForwarded int32 = iota
+	// DnsQueryAnswered is answered locally, from hosts, the prefetch cache
+	// or a dns route.
+	DnsQueryAnswered
+	// DnsQueryBlocked is blocked by the dns filter.
+	DnsQueryBlocked
+)
+
+type DnsQuery struct {
+	Uid    int32
+	Domain string
+	// Type is the question type, like A or AAAA.
+	Type   string
+	Result int32
+	// Timestamp is in unix milliseconds.
+	Timestamp int64
+}
+
+type DnsQueryListener interface {
+	UpdateDnsQuery(q *DnsQuery)
+}
+
+// dnsQueryLog is a ring of the latest dns-in queries and the apps that sent
+// them.
+type dnsQueryLog struct {
+	access  sync.Mutex
+	entries []DnsQuery
+	next    int
+}
+
+func (l *dnsQueryLog) add(query DnsQuery) {
+	l.access.Lock()
+	if len(l.entries) < dnsQueryLogSize {
+		l.entries = append(l.entries, query)
+	} else {
+		l.entries[l.next] = query
+	}
+	l.next = (l.next + 1) % dnsQueryLogSize
+	l.access.Unlock()
+}
+
+func (l *dnsQueryLog) reset() {
+	l.access.Lock()
+	l.entries = nil
+	l.next = 0
+	l.access.Unlock()
+}
+
+// dumpDnsUid returns the app that sent a dns-in query, which is known by its
+// udp source port while the socket is open.
+func (t *Tun2ray) dumpDnsUid(source v2rayNet.Destination, destination v2rayNet.Destination) (uint32, bool) {
+	u, err := t.lookupUid(source.Address.Family().IsIPv6(), true, source.Address.String(), int32(source.Port), destination.Address.String(), int32(destination.Port))
+	if err != nil {
+		return 0, false
+	}
+	return normalizeUid(uint32(u)), true
+}
+
+// logDnsQuery records the question of a dns-in query with the app that sent
+// it.
+func (t *Tun2ray) logDnsQuery(uid uint32, data []byte, result int32) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(data); err != nil {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+	t.dnsQueries.add(DnsQuery{
+		Uid:       int32(uid),
+		Domain:    strings.TrimSuffix(question.Name.String(), "."),
+		Type:      strings.TrimPrefix(question.Type.String(), "Type"),
+		Result:    result,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// QueryDnsQueries reports the latest dns-in queries of the app uid, or of all
+// apps if uid is negative, newest first and at most limit of them if it is
+// positive. Queries are only logged with traffic stats enabled.
+func (t *Tun2ray) QueryDnsQueries(uid int32, limit int32, listener DnsQueryListener) error {
+	if !t.trafficStats {
+		return nil
+	}
+
+	t.dnsQueries.access.Lock()
+	var queries []DnsQuery
+	for i := 1; i <= len(t.dnsQueries.entries); i++ {
+		index := (t.dnsQueries.next - i + dnsQueryLogSize) % dnsQueryLogSize
+		query := t.dnsQueries.entries[index]
+		if uid >= 0 && query.Uid != uid {
+			continue
+		}
+		queries = append(queries, query)
+		if limit > 0 && len(queries) >= int(limit) {
+			break
+		}
+	}
+	t.dnsQueries.access.Unlock()
+
+	for i := range queries {
+		listener.UpdateDnsQuery(&queries[i])
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsExchangeTimeout = 5 * time.Second
+
+var dnsRoutes = new(dnsRouter)
+
+type dnsUpstream interface {
+	exchange(ctx context.Context, instance *V2RayInstance, query *dnsmessage.Message, raw []byte) ([]byte, error)
+}
+
+type dnsRoute struct {
+	matcher  *router.DomainMatcher
+	upstream dnsUpstream
+	name     string
+}
+
+type dnsRouter struct {
+	access sync.RWMutex
+	routes []*dnsRoute
+}
+
+// AddDnsRoute sends queries for domains matching rules (comma or line
+// separated v2ray domain rules, e.g. "corp.example,geosite:cn") to upstream.
+//
+// upstream is one of "local" (the platform resolver), "proxy" (the v2ray dns
+// path), "udp://ip:port", "tcp://ip:port", a plain address, "https://..." (DoH
+// through the proxy) or "https+local://..." (direct DoH).
+func AddDnsRoute(rules string, upstream string) error {
+	matcher, err := newDomainMatcher(splitRules(rules))
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("failed to parse dns route rules").Base(err))
+	}
+	u, err := parseDnsUpstream(upstream)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, err)
+	}
+	dnsRoutes.access.Lock()
+	dnsRoutes.routes = append(dnsRoutes.routes, &dnsRoute{matcher, u, upstream})
+	dnsRoutes.access.Unlock()
+	return nil
+}
+
+func ClearDnsRoutes() {
+	dnsRoutes.access.Lock()
+	dnsRoutes.routes = nil
+	dnsRoutes.access.Unlock()
+}
+
+// match returns the upstream of the first route matching domain. A nil
+// upstream means the v2ray dns path, for no route as well as for proxy
+// routes, which keep later routes from matching.
+func (r *dnsRouter) match(domain string) (dnsUpstream, string) {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	for _, route := range r.routes {
+		if route.matcher.Match(domain) {
+			if _, isProxy := route.upstream.(dnsProxyUpstream); isProxy {
+				return nil, route.name
+			}
+			return route.upstream, route.name
+		}
+	}
+	return nil, ""
+}
+
+func parseDnsUpstream(upstream string) (dnsUpstream, error) {
+	switch upstream {
+	case "local", "localhost":
+		return &dnsLocalUpstream{}, nil
+	case "proxy", "remote", "":
+		return dnsProxyUpstream{}, nil
+	}
+	if strings.HasPrefix(upstream, "https://") || strings.HasPrefix(upstream, "https+local://") {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, newError("invalid doh url ", upstream).Base(err)
+		}
+		local := u.Scheme == "https+local"
+		u.Scheme = "https"
+		return &dnsHTTPSUpstream{url: u.String(), local: local}, nil
+	}
+
+	network := v2rayNet.Network_UDP
+	address := upstream
+	if strings.HasPrefix(upstream, "tcp://") {
+		network = v2rayNet.Network_TCP
+		address = upstream[6:]
+	} else if strings.HasPrefix(upstream, "udp://") {
+		address = upstream[6:]
+	}
+	host, port, err := v2rayNet.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
+		port = "53"
+	}
+	p, err := v2rayNet.PortFromString(port)
+	if err != nil {
+		return nil, newError("invalid dns upstream ", upstream).Base(err)
+	}
+	return &dnsDirectUpstream{v2rayNet.Destination{
+		Network: network,
+		Address: v2rayNet.ParseAddress(host),
+		Port:    p,
+	}}, nil
+}
+
+// dnsProxyUpstream marks routes to the v2ray dns path, which match resolves
+// to a nil upstream, so it never exchanges itself.
+type dnsProxyUpstream struct{}
+
+func (dnsProxyUpstream) exchange(context.Context, *V2RayInstance, *dnsmessage.Message, []byte) ([]byte, error) {
+	return nil, newError("proxy dns routes are resolved by v2ray")
+}
+
+type dnsLocalUpstream struct{}
+
+func (u *dnsLocalUpstream) exchange(ctx context.Context, _ *V2RayInstance, query *dnsmessage.Message, raw []byte) ([]byte, error) {
+	question := query.Questions[0]
+	domain := strings.TrimSuffix(question.Name.String(), ".")
+	var network string
+	switch question.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	default:
+		response, ok, err := exchangeLocal(ctx, domain, raw)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || len(response) < 2 {
+			return packDnsResponse(query, dnsmessage.RCodeSuccess, nil), nil
+		}
+		// the platform may use its own id
+		binary.BigEndian.PutUint16(response, query.ID)
+		return response, nil
+	}
+	if result, ok, err := resolveLocal(ctx, network, domain); ok {
+		if err == nil {
+			err = result.err()
+		}
+		if err != nil && !errors.Is(err, dns.ErrEmptyResponse) {
+			return packDnsResponse(query, dnsRCodeFromError(err), nil), nil
+		}
+		answers, err := result.answers(question)
+		if err != nil {
+			return nil, err
+		}
+		return packDnsResponse(query, dnsmessage.RCodeSuccess, answers), nil
+	}
+	ips, err := localdns.LookupFunc(network, domain)
+	if err != nil {
+		return packDnsResponse(query, dnsRCodeFromError(err), nil), nil
+	}
+	return packDnsResponse(query, dnsmessage.RCodeSuccess, newDnsAnswers(question, ips, hostsTTL)), nil
+}
+
+type dnsDirectUpstream struct {
+	destination v2rayNet.Destination
+}
+
+func (u *dnsDirectUpstream) exchange(ctx context.Context, _ *V2RayInstance, _ *dnsmessage.Message, raw []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsExchangeTimeout)
+	defer cancel()
+	conn, err := internet.DialSystemDNS(ctx, u.destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsExchangeTimeout))
+
+	if u.destination.Network == v2rayNet.Network_UDP {
+		if _, err = conn.Write(raw); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, 65535)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return buffer[:n], nil
+	}
+	return exchangeDnsStream(conn, raw)
+}
+
+func exchangeDnsStream(conn io.ReadWriter, raw []byte) ([]byte, error) {
+	packet := make([]byte, 2+len(raw))
+	binary.BigEndian.PutUint16(packet, uint16(len(raw)))
+	copy(packet[2:], raw)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	_, err := io.ReadFull(conn, response)
+	return response, err
+}
+
+type dnsHTTPSUpstream struct {
+	url   string
+	local bool
+}
+
+func (u *dnsHTTPSUpstream) exchange(ctx context.Context, instance *V2RayInstance, _ *dnsmessage.Message, raw []byte) ([]byte, error) {
+	client := &http.Client{
+		Timeout: dnsExchangeTimeout,
+		Transport: withTlsKeyLog(&http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (v2rayNet.Conn, error) {
+				dest, err := v2rayNet.ParseDestination(network + ":" + addr)
+				if err != nil {
+					return nil, err
+				}
+				if u.local {
+					return internet.DialSystemDNS(ctx, dest, nil)
+				}
+				return instance.dialContext(ctx, dest)
+			},
+		}),
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError("doh server returned status ", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// routedLookups are the domains lookupRouted is resolving. The upstream of a
+// route may need the native resolver itself, e.g. a DoH route dialing
+// through a proxy whose server matches the route, so a domain looked up
+// again meanwhile goes to the platform resolver instead of recursing.
+var routedLookups sync.Map
+
+// lookupRouted resolves domain through its dns route for the native resolver,
+// ok is false when no route other than the platform resolver applies.
+func (instance *V2RayInstance) lookupRouted(network string, domain string) (ips []net.IP, ok bool, err error) {
+	upstream, _ := dnsRoutes.match(domain)
+	if upstream == nil {
+		return nil, false, nil
+	}
+	if _, isLocal := upstream.(*dnsLocalUpstream); isLocal {
+		return nil, false, nil
+	}
+	if _, loop := routedLookups.LoadOrStore(domain, struct{}{}); loop {
+		newError("[DNS] routed lookup of ", domain, " is already running, using the platform resolver").AtDebug().WriteToLog()
+		return nil, false, nil
+	}
+	defer routedLookups.Delete(domain)
+	ips, err = exchangeLookup(context.Background(), instance, upstream, network, domain)
+	return ips, true, err
+}
+
+// exchangeLookup resolves domain with the A and AAAA queries network asks
+// for.
+func exchangeLookup(ctx context.Context, instance *V2RayInstance, upstream dnsUpstream, network string, domain string) ([]net.IP, error) {
+	var types []dnsmessage.Type
+	switch network {
+	case "ip4":
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, qtype := range types {
+		query := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		raw, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		response, err := upstream.exchange(ctx, instance, query, raw)
+		if err != nil {
+			return nil, err
+		}
+		var message dnsmessage.Message
+		if err = message.Unpack(response); err != nil {
+			return nil, err
+		}
+		if message.RCode != dnsmessage.RCodeSuccess {
+			return nil, dns.RCodeError(message.RCode)
+		}
+		ips = append(ips, dnsAnswerIPs(&message)...)
+	}
+	if len(ips) == 0 {
+		return nil, dns.ErrEmptyResponse
+	}
+	return ips, nil
+}
@@ -0,0 +1,128 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"libcore/comm"
+)
+
+// DnsServer serves the libcore dns pipeline (hosts, filter and dns routes) on
+// a local port for proxy-only mode, passing everything else to dns-in.
+type DnsServer struct {
+	access   sync.Mutex
+	instance *V2RayInstance
+	port     int32
+
+	conn    *net.UDPConn
+	started bool
+}
+
+func NewDnsServer(instance *V2RayInstance, port int32) *DnsServer {
+	return &DnsServer{
+		instance: instance,
+		port:     port,
+	}
+}
+
+func (s *DnsServer) Start() (err error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.started {
+		return errors.New("already started")
+	}
+
+	s.conn, err = net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: int(s.port),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.started = true
+	go s.loop(s.conn)
+
+	return nil
+}
+
+func (s *DnsServer) Close() {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.started {
+		s.started = false
+		comm.CloseIgnore(s.conn)
+	}
+}
+
+// loop serves conn, the server may be restarted with another conn once it
+// has been closed.
+func (s *DnsServer) loop(conn *net.UDPConn) {
+	for {
+		buffer := make([]byte, 65535)
+		length, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			s.access.Lock()
+			closed := !s.started || s.conn != conn
+			s.access.Unlock()
+			if !closed {
+				logrus.Warn("dns server: read failed: ", err)
+			}
+			return
+		}
+		go s.handle(conn, buffer[:length], addr)
+	}
+}
+
+func (s *DnsServer) handle(conn *net.UDPConn, query []byte, addr *net.UDPAddr) {
+	response := s.instance.handleDns(query, nil)
+	if response == nil {
+		var err error
+		response, err = dnsInflight.exchange(query, func() ([]byte, error) {
+			return s.forward(query)
+		})
+		if err != nil {
+			newError("[DNS] forward to dns-in failed").Base(err).WriteToLog()
+			return
+		}
+		dnsNegative.record(response)
+	}
+	if _, err := conn.WriteToUDP(clampDnsTtl(response), addr); err != nil {
+		newError("[DNS] failed to write response").Base(err).WriteToLog()
+	}
+}
+
+func (s *DnsServer) forward(query []byte) ([]byte, error) {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:         "dns-in",
+		NetworkType: networkType,
+		WifiSSID:    wifiSSID,
+	})
+	conn, err := s.instance.dialContext(ctx, v2rayNet.UDPDestination(v2rayNet.LocalHostIP, 53))
+	if err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(dnsExchangeTimeout, func() {
+		comm.CloseIgnore(conn)
+	})
+	defer timer.Stop()
+	defer comm.CloseIgnore(conn)
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
@@ -0,0 +1,93 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// dnsTypeOPT is the type of the edns pseudo record, whose ttl field holds
+// flags.
+const dnsTypeOPT = 41
+
+var dnsTtl struct {
+	// min and max are zero if unset
+	min uint32
+	max uint32
+}
+
+// SetDnsTtl clamps the ttl of the records answered to the apps through dns-in
+// and the dns server, and of the prefetched answers, to [minTtl, maxTtl]
+// seconds. Upstreams answering with ttls of 0 or 1 otherwise make the apps
+// query again for every connection. Zero leaves a bound unset.
+func SetDnsTtl(minTtl int32, maxTtl int32) error {
+	if minTtl < 0 || maxTtl < 0 || maxTtl > 0 && maxTtl < minTtl {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid dns ttl range ", minTtl, "-", maxTtl))
+	}
+	atomic.StoreUint32(&dnsTtl.min, uint32(minTtl))
+	atomic.StoreUint32(&dnsTtl.max, uint32(maxTtl))
+	return nil
+}
+
+func clampTtl(ttl uint32) uint32 {
+	if min := atomic.LoadUint32(&dnsTtl.min); ttl < min {
+		ttl = min
+	}
+	if max := atomic.LoadUint32(&dnsTtl.max); max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// clampDnsTtl rewrites the ttls of the records of a packed response in
+// place, malformed messages are returned as they are.
+func clampDnsTtl(message []byte) []byte {
+	if atomic.LoadUint32(&dnsTtl.min) == 0 && atomic.LoadUint32(&dnsTtl.max) == 0 {
+		return message
+	}
+	if len(message) < 12 {
+		return message
+	}
+	questions := int(binary.BigEndian.Uint16(message[4:]))
+	records := int(binary.BigEndian.Uint16(message[6:])) + int(binary.BigEndian.Uint16(message[8:])) + int(binary.BigEndian.Uint16(message[10:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		if offset = skipDnsName(message, offset); offset < 0 || offset+4 > len(message) {
+			return message
+		}
+		offset += 4
+	}
+	for i := 0; i < records; i++ {
+		if offset = skipDnsName(message, offset); offset < 0 || offset+10 > len(message) {
+			return message
+		}
+		recordType := binary.BigEndian.Uint16(message[offset:])
+		if recordType != dnsTypeOPT {
+			ttl := binary.BigEndian.Uint32(message[offset+4:])
+			binary.BigEndian.PutUint32(message[offset+4:], clampTtl(ttl))
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(message[offset+8:]))
+	}
+	return message
+}
+
+// skipDnsName returns the offset after the name at offset, -1 if it is
+// malformed.
+func skipDnsName(message []byte, offset int) int {
+	for offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			// a compression pointer ends the name
+			if offset+2 > len(message) {
+				return -1
+			}
+			return offset + 2
+		case length&0xc0 != 0:
+			return -1
+		}
+		offset += 1 + length
+	}
+	return -1
+}
@@ -0,0 +1,249 @@
+package libcore
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+// flowAttribute identifies a tun connection in the session content, so the
+// router can hand the domain it routed by to the traffic accounting.
+const flowAttribute = "libcore.flow"
+
+const (
+	domainStatsHalfLife = time.Hour
+	domainStatsMax      = 2048
+)
+
+var (
+	flowIds uint64
+	flows   sync.Map
+)
+
+type DomainStats struct {
+	Domain string
+
+	// Uplink and Downlink decay with a half life of an hour.
+	Uplink   int64
+	Downlink int64
+
+	UplinkTotal   int64
+	DownlinkTotal int64
+}
+
+type DomainStatsListener interface {
+	UpdateDomainStats(s *DomainStats)
+}
+
+// domainFlow counts the traffic of a connection until its domain is known,
+// and keeps what the flow exporter records of it.
+type domainFlow struct {
+	uplink        uint64
+	downlink      uint64
+	uplinkTotal   uint64
+	downlinkTotal uint64
+
+	id          string
+	fallback    string
+	domain      atomic.Value
+	outbound    atomic.Value
+	source      v2rayNet.Destination
+	destination v2rayNet.Destination
+	uid         uint32
+	startedAt   time.Time
+}
+
+func (f *domainFlow) getDomain() string {
+	domain, _ := f.domain.Load().(string)
+	return domain
+}
+
+func (f *domainFlow) getOutbound() string {
+	outbound, _ := f.outbound.Load().(string)
+	return outbound
+}
+
+type domainStat struct {
+	uplink    float64
+	downlink  float64
+	updatedAt time.Time
+
+	uplinkTotal   int64
+	downlinkTotal int64
+}
+
+func (s *domainStat) decay(now time.Time) {
+	factor := math.Exp2(-float64(now.Sub(s.updatedAt)) / float64(domainStatsHalfLife))
+	s.uplink *= factor
+	s.downlink *= factor
+	s.updatedAt = now
+}
+
+type domainStatsTable struct {
+	access sync.Mutex
+	stats  map[string]*domainStat
+	flows  sync.Map
+}
+
+func (t *domainStatsTable) newFlow(content *session.Content, source v2rayNet.Destination, destination v2rayNet.Destination, uid uint32) *domainFlow {
+	flow := &domainFlow{
+		id:          strconv.FormatUint(atomic.AddUint64(&flowIds, 1), 10),
+		fallback:    destination.Address.String(),
+		source:      source,
+		destination: destination,
+		uid:         uid,
+		startedAt:   time.Now(),
+	}
+	if destination.Address.Family().IsDomain() {
+		flow.domain.Store(strings.ToLower(destination.Address.Domain()))
+	}
+	content.SetAttribute(flowAttribute, flow.id)
+	flows.Store(flow.id, flow)
+	t.flows.Store(flow, nil)
+	return flow
+}
+
+func (t *domainStatsTable) closeFlow(flow *domainFlow) {
+	flows.Delete(flow.id)
+	t.flows.Delete(flow)
+	t.fold(flow, true)
+	flowExport.export(flow)
+}
+
+// fold moves the traffic of a flow into its domain, connections without a
+// domain are accounted to their address once closed.
+func (t *domainStatsTable) fold(flow *domainFlow, closed bool) {
+	domain := flow.getDomain()
+	if domain == "" {
+		if !closed {
+			return
+		}
+		domain = flow.fallback
+	}
+	uplink := atomic.SwapUint64(&flow.uplink, 0)
+	downlink := atomic.SwapUint64(&flow.downlink, 0)
+	if uplink == 0 && downlink == 0 {
+		return
+	}
+	atomic.AddUint64(&flow.uplinkTotal, uplink)
+	atomic.AddUint64(&flow.downlinkTotal, downlink)
+	now := time.Now()
+	t.access.Lock()
+	defer t.access.Unlock()
+	stat := t.stats[domain]
+	if stat == nil {
+		if t.stats == nil {
+			t.stats = make(map[string]*domainStat)
+		}
+		if len(t.stats) >= domainStatsMax {
+			t.evict(now)
+		}
+		stat = &domainStat{updatedAt: now}
+		t.stats[domain] = stat
+	}
+	stat.decay(now)
+	stat.uplink += float64(uplink)
+	stat.downlink += float64(downlink)
+	stat.uplinkTotal += int64(uplink)
+	stat.downlinkTotal += int64(downlink)
+}
+
+// evict drops the domain with the least recent traffic.
+func (t *domainStatsTable) evict(now time.Time) {
+	var lowest string
+	score := math.MaxFloat64
+	for domain, stat := range t.stats {
+		stat.decay(now)
+		if stat.uplink+stat.downlink < score {
+			lowest, score = domain, stat.uplink+stat.downlink
+		}
+	}
+	delete(t.stats, lowest)
+}
+
+func (t *domainStatsTable) reset() {
+	t.flows.Range(func(key, value interface{}) bool {
+		flow := key.(*domainFlow)
+		atomic.StoreUint64(&flow.uplink, 0)
+		atomic.StoreUint64(&flow.downlink, 0)
+		return true
+	})
+	t.access.Lock()
+	t.stats = nil
+	t.access.Unlock()
+}
+
+// setFlowDomain records the domain a tun connection is routed by, which is
+// the sniffed one if sniffing is enabled.
+func setFlowDomain(ctx routing.Context) {
+	attributes := ctx.GetAttributes()
+	if attributes == nil || attributes[flowAttribute] == "" {
+		return
+	}
+	domain := ctx.GetTargetDomain()
+	if domain == "" {
+		return
+	}
+	if flow, ok := flows.Load(attributes[flowAttribute]); ok {
+		flow.(*domainFlow).domain.Store(strings.ToLower(domain))
+	}
+}
+
+// setFlowOutbound records the outbound a tun connection is routed to.
+func setFlowOutbound(ctx routing.Context, route routing.Route) {
+	attributes := ctx.GetAttributes()
+	if route == nil || attributes == nil || attributes[flowAttribute] == "" {
+		return
+	}
+	if flow, ok := flows.Load(attributes[flowAttribute]); ok {
+		flow.(*domainFlow).outbound.Store(route.GetOutboundTag())
+	}
+}
+
+// QueryDomainStats reports the domains with the most recent traffic, at most
+// limit of them if it is positive.
+func (t *Tun2ray) QueryDomainStats(limit int32, listener DomainStatsListener) error {
+	if !t.trafficStats {
+		return nil
+	}
+
+	t.domainStats.flows.Range(func(key, value interface{}) bool {
+		t.domainStats.fold(key.(*domainFlow), false)
+		return true
+	})
+
+	now := time.Now()
+	t.domainStats.access.Lock()
+	stats := make([]*DomainStats, 0, len(t.domainStats.stats))
+	for domain, stat := range t.domainStats.stats {
+		stat.decay(now)
+		stats = append(stats, &DomainStats{
+			Domain:        domain,
+			Uplink:        int64(stat.uplink),
+			Downlink:      int64(stat.downlink),
+			UplinkTotal:   stat.uplinkTotal,
+			DownlinkTotal: stat.downlinkTotal,
+		})
+	}
+	t.domainStats.access.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Uplink+stats[i].Downlink > stats[j].Uplink+stats[j].Downlink
+	})
+	if limit > 0 && len(stats) > int(limit) {
+		stats = stats[:limit]
+	}
+	for _, stat := range stats {
+		listener.UpdateDomainStats(stat)
+	}
+
+	return nil
+}
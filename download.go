@@ -0,0 +1,384 @@
+package libcore
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+const (
+	downloadTimeout  = 60 * time.Second
+	downloadAttempts = 3
+	downloadMaxSize  = 64 * 1024 * 1024
+)
+
+var errDownloadTooLarge = newError("response too large")
+
+var (
+	downloadCacheAccess sync.Mutex
+	downloadCacheDir    string
+	// downloadLocks serializes downloads of the same url, they share the
+	// cache files
+	downloadLocks sync.Map
+)
+
+// SetDownloadCacheDir keeps the responses of the rule provider, asset and
+// subscription downloads in dir with their ETag and Last-Modified, so a
+// refresh of unchanged content is a 304 and an interrupted download resumes
+// where it stopped. An empty dir disables the cache.
+func SetDownloadCacheDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return exportError(newError("create download cache").Base(err))
+		}
+	}
+	downloadCacheAccess.Lock()
+	downloadCacheDir = dir
+	downloadCacheAccess.Unlock()
+	return nil
+}
+
+type downloadRequest struct {
+	url string
+	// outbound is the tag to download through, empty for a direct
+	// connection.
+	outbound string
+	headers  map[string]string
+	maxSize  int64
+	timeout  time.Duration
+	// certSha256 pins the hex sha256 of the certificate of the server, which
+	// is then accepted even if self signed.
+	certSha256 string
+}
+
+type downloadResult struct {
+	content []byte
+	// modified is false when the server answered the cached content is
+	// still current.
+	modified bool
+	header   http.Header
+}
+
+// downloadMeta is the json file next to a cached response.
+type downloadMeta struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Complete is false while the body is only partly downloaded.
+	Complete bool `json:"complete"`
+}
+
+func (instance *V2RayInstance) httpClient(request downloadRequest) *http.Client {
+	outbound := request.outbound
+	var tlsConfig *tls.Config
+	if request.certSha256 != "" {
+		pin := strings.ToLower(strings.ReplaceAll(request.certSha256, ":", ""))
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return newError("no certificate")
+				}
+				sum := sha256.Sum256(rawCerts[0])
+				if hex.EncodeToString(sum[:]) != pin {
+					return newError("certificate ", hex.EncodeToString(sum[:]), " does not match the pinned ", pin)
+				}
+				return nil
+			},
+		}
+	}
+	return &http.Client{
+		Timeout: request.timeout,
+		Transport: withTlsKeyLog(&http.Transport{
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				portNum, err := strconv.Atoi(port)
+				if err != nil {
+					return nil, err
+				}
+				return instance.dialVia(ctx, host, int32(portNum), outbound)
+			},
+		}),
+	}
+}
+
+// download fetches the url, with the cache enabled a failed attempt is
+// resumed with a range request, and left for the next download after
+// downloadAttempts.
+func (instance *V2RayInstance) download(request downloadRequest) (*downloadResult, error) {
+	if request.maxSize == 0 {
+		request.maxSize = downloadMaxSize
+	}
+	if request.timeout == 0 {
+		request.timeout = downloadTimeout
+	}
+	downloadCacheAccess.Lock()
+	dir := downloadCacheDir
+	downloadCacheAccess.Unlock()
+	if dir == "" {
+		return instance.downloadUncached(request)
+	}
+
+	lock, _ := downloadLocks.LoadOrStore(request.url, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	sum := sha256.Sum256([]byte(request.url))
+	cache := &downloadCache{path: filepath.Join(dir, hex.EncodeToString(sum[:16]))}
+	cache.load(request.url)
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		var result *downloadResult
+		var retry bool
+		result, retry, err = instance.downloadCached(request, cache)
+		if err == nil {
+			return result, nil
+		}
+		if !retry {
+			break
+		}
+		newError("download ", request.url, " interrupted at ", cache.size(), " bytes, attempt ", attempt).Base(err).AtDebug().WriteToLog()
+	}
+	return nil, err
+}
+
+func (instance *V2RayInstance) newDownloadRequest(request downloadRequest) (*http.Request, error) {
+	req, err := http.NewRequest("GET", request.url, nil)
+	if err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	for key, value := range request.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (instance *V2RayInstance) downloadUncached(request downloadRequest) (*downloadResult, error) {
+	req, err := instance.newDownloadRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := instance.httpClient(request).Do(req)
+	if err != nil {
+		return nil, withCode(ErrorCodeNetworkUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(request.url, " returned status ", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, request.maxSize+1))
+	if err != nil {
+		return nil, withCode(ErrorCodeNetworkUnreachable, err)
+	}
+	if int64(len(content)) > request.maxSize {
+		return nil, newError(request.url, " is larger than ", request.maxSize, " bytes")
+	}
+	return &downloadResult{content, true, resp.Header}, nil
+}
+
+// downloadCached makes one attempt, retry is whether the body was cut off
+// and a next attempt can resume it.
+func (instance *V2RayInstance) downloadCached(request downloadRequest, cache *downloadCache) (result *downloadResult, retry bool, err error) {
+	req, err := instance.newDownloadRequest(request)
+	if err != nil {
+		return nil, false, err
+	}
+	offset := cache.size()
+	switch {
+	case cache.meta.Complete:
+		if cache.meta.ETag != "" {
+			req.Header.Set("If-None-Match", cache.meta.ETag)
+		}
+		if cache.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cache.meta.LastModified)
+		}
+	case offset > 0 && (cache.meta.ETag != "" || cache.meta.LastModified != ""):
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if cache.meta.ETag != "" {
+			req.Header.Set("If-Range", cache.meta.ETag)
+		} else {
+			req.Header.Set("If-Range", cache.meta.LastModified)
+		}
+	default:
+		offset = 0
+	}
+
+	resp, err := instance.httpClient(request).Do(req)
+	if err != nil {
+		return nil, true, withCode(ErrorCodeNetworkUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if !cache.meta.Complete {
+			return nil, false, newError(request.url, " returned not modified without a cached response")
+		}
+		content, err := ioutil.ReadFile(cache.path)
+		if err != nil {
+			cache.remove()
+			return nil, false, newError("read download cache").Base(err)
+		}
+		return &downloadResult{content, false, resp.Header}, false, nil
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-") {
+			cache.remove()
+			return nil, true, newError(request.url, " returned range ", resp.Header.Get("Content-Range"), " instead of ", offset, "-")
+		}
+	case http.StatusOK:
+		offset = 0
+	default:
+		return nil, false, newError(request.url, " returned status ", resp.StatusCode)
+	}
+
+	cache.meta = downloadMeta{
+		Url:          request.url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err = cache.write(resp.Body, offset, request.maxSize); err != nil {
+		if err == errDownloadTooLarge {
+			cache.remove()
+			return nil, false, newError(request.url, " is larger than ", request.maxSize, " bytes")
+		}
+		cache.saveMeta()
+		// only a response with a validator can be resumed
+		return nil, cache.meta.ETag != "" || cache.meta.LastModified != "", withCode(ErrorCodeNetworkUnreachable, err)
+	}
+	cache.meta.Complete = true
+	cache.saveMeta()
+	content, err := ioutil.ReadFile(cache.path)
+	if err != nil {
+		return nil, false, newError("read download cache").Base(err)
+	}
+	return &downloadResult{content, true, resp.Header}, false, nil
+}
+
+// downloadCache is the body of a response at path and its metadata at
+// path.json.
+type downloadCache struct {
+	path string
+	meta downloadMeta
+}
+
+func (c *downloadCache) load(url string) {
+	content, err := ioutil.ReadFile(c.path + ".json")
+	if err == nil {
+		err = json.Unmarshal(content, &c.meta)
+	}
+	if err != nil || c.meta.Url != url {
+		c.meta = downloadMeta{Url: url}
+	}
+}
+
+func (c *downloadCache) size() int64 {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// write appends the body at offset, the file is truncated there first so
+// a retry never duplicates content.
+func (c *downloadCache) write(body io.Reader, offset int64, maxSize int64) error {
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := io.Copy(file, io.LimitReader(body, maxSize-offset+1))
+	if err != nil {
+		return err
+	}
+	if offset+written > maxSize {
+		return errDownloadTooLarge
+	}
+	return nil
+}
+
+func (c *downloadCache) saveMeta() {
+	content, err := json.Marshal(&c.meta)
+	if err == nil {
+		err = ioutil.WriteFile(c.path+".json", content, 0o644)
+	}
+	if err != nil {
+		newError("failed to write download cache").Base(err).AtWarning().WriteToLog()
+	}
+}
+
+func (c *downloadCache) remove() {
+	c.meta = downloadMeta{Url: c.meta.Url}
+	_ = os.Remove(c.path)
+	_ = os.Remove(c.path + ".json")
+}
+
+// DownloadAsset downloads geoip.dat or geosite.dat from url through the
+// outbound tagged outbound, or directly if empty, and installs it with
+// version if it changed. It returns whether it did, instances started before
+// keep the previous asset.
+func (instance *V2RayInstance) DownloadAsset(name string, url string, version string, outbound string) (bool, error) {
+	if name != geoipDat && name != geositeDat {
+		return false, withCode(ErrorCodeInvalidArgument, newError("unknown asset ", name))
+	}
+	result, err := instance.download(downloadRequest{url: url, outbound: outbound})
+	if err != nil {
+		return false, exportError(newError("download ", name).Base(err))
+	}
+	path := externalAssetsPath + name
+	if !result.modified {
+		if _, err = os.Stat(path); err == nil {
+			return false, nil
+		}
+	}
+	if name == geoipDat {
+		err = proto.Unmarshal(result.content, new(routercommon.GeoIPList))
+	} else {
+		err = proto.Unmarshal(result.content, new(routercommon.GeoSiteList))
+	}
+	if err != nil {
+		return false, withCode(ErrorCodeAssetMissing, newError("invalid ", name).Base(err))
+	}
+
+	temp := path + ".tmp"
+	if err = ioutil.WriteFile(temp, result.content, 0o644); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		return false, exportError(newError("install ", name).Base(err))
+	}
+	if version != "" {
+		if err = ioutil.WriteFile(externalAssetsPath+assetVersionFile(name), []byte(version), 0o644); err != nil {
+			return true, exportError(newError("write version of ", name).Base(err))
+		}
+	}
+	newError("installed ", name, " ", version).AtInfo().WriteToLog()
+	return true, nil
+}
@@ -0,0 +1,112 @@
+package libcore
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+// dscpAttribute carries the DSCP for the outbound sockets of a connection in
+// the session content, from the tun through routing to the dialer.
+const dscpAttribute = "libcore.dscp"
+
+var dscpAccess sync.RWMutex
+
+var (
+	dscpPassthrough bool
+	dscpMapping     map[int]int
+)
+
+// SetDscpPassthrough copies the DSCP marking of tunneled packets to the
+// sockets of their outbound connections.
+func SetDscpPassthrough(enabled bool) {
+	dscpAccess.Lock()
+	defer dscpAccess.Unlock()
+	dscpPassthrough = enabled
+}
+
+// SetDscpMapping sets "from=to" pairs, separated by commas or lines, to
+// rewrite passed through DSCP values, e.g. "46=34,10=0". An empty mapping
+// passes every value unchanged.
+func SetDscpMapping(mapping string) error {
+	var parsed map[int]int
+	for _, pair := range splitRules(mapping) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		index := strings.IndexByte(pair, '=')
+		if index < 0 {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid dscp mapping ", pair))
+		}
+		from, err := parseDscp(pair[:index])
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, err)
+		}
+		to, err := parseDscp(pair[index+1:])
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, err)
+		}
+		if parsed == nil {
+			parsed = make(map[int]int)
+		}
+		parsed[from] = to
+	}
+	dscpAccess.Lock()
+	defer dscpAccess.Unlock()
+	dscpMapping = parsed
+	return nil
+}
+
+func parseDscp(value string) (int, error) {
+	dscp, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, newError("invalid dscp ", value)
+	}
+	return dscp, nil
+}
+
+// setTrafficClass records the DSCP for a flow from the traffic class of its
+// first packet, the attribute is set even if there is nothing to pass through
+// so rules can override it.
+func setTrafficClass(content *session.Content, tos uint8) {
+	dscpAccess.RLock()
+	defer dscpAccess.RUnlock()
+	value := ""
+	if dscpPassthrough && tos != 0 {
+		dscp := int(tos >> 2)
+		if mapped, ok := dscpMapping[dscp]; ok {
+			dscp = mapped
+		}
+		value = strconv.Itoa(dscp)
+	}
+	content.SetAttribute(dscpAttribute, value)
+}
+
+// overrideDscp sets the DSCP of a routed connection, the attributes of the
+// routing context are those of the session content.
+func overrideDscp(ctx routing.Context, dscp int) {
+	if attributes := ctx.GetAttributes(); attributes != nil {
+		if _, ok := attributes[dscpAttribute]; ok {
+			attributes[dscpAttribute] = strconv.Itoa(dscp)
+		}
+	}
+}
+
+func dscpFromContext(ctx context.Context) (int, bool) {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		return 0, false
+	}
+	dscp, err := strconv.Atoi(content.Attribute(dscpAttribute))
+	return dscp, err == nil
+}
+
+// applyDscp marks the packets of an outbound socket.
+func applyDscp(fd int, ipv6 bool, dscp int) error {
+	return setTos(fd, ipv6, dscp<<2)
+}
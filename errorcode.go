@@ -0,0 +1,208 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+// Error codes are stable, errors returned by the public api are prefixed
+// with "E<code>: " so the app can get them back with GetErrorCode.
+const (
+	ErrorCodeUnknown int32 = iota
+	ErrorCodeNetworkUnreachable
+	ErrorCodeProtectFailed
+	ErrorCodeAuthFailed
+	ErrorCodeConfigInvalid
+	ErrorCodeAssetMissing
+	ErrorCodeFdDead
+	ErrorCodeTimeout
+	ErrorCodeDnsRcode
+	ErrorCodeInvalidArgument
+	ErrorCodeInvalidState
+)
+
+var errorMessages = map[int32]string{
+	ErrorCodeUnknown:            "Unknown error",
+	ErrorCodeNetworkUnreachable: "Network is unreachable",
+	ErrorCodeProtectFailed:      "Failed to protect socket from the VPN",
+	ErrorCodeAuthFailed:         "Authentication failed",
+	ErrorCodeConfigInvalid:      "Invalid configuration",
+	ErrorCodeAssetMissing:       "Required asset file is missing",
+	ErrorCodeFdDead:             "VPN interface is closed",
+	ErrorCodeTimeout:            "Operation timed out",
+	ErrorCodeDnsRcode:           "DNS query failed",
+	ErrorCodeInvalidArgument:    "Invalid argument",
+	ErrorCodeInvalidState:       "Invalid state",
+}
+
+var errProtectFailed = &codedError{code: ErrorCodeProtectFailed, err: errors.New("protect failed")}
+
+type codedError struct {
+	code int32
+	err  error
+	// cause is the coded error err wraps, whose prefix is moved to the front
+	cause *codedError
+}
+
+func (e *codedError) prefix() string {
+	return "E" + strconv.Itoa(int(e.code)) + ": "
+}
+
+func (e *codedError) Error() string {
+	message := e.err.Error()
+	if e.cause != nil {
+		message = strings.Replace(message, e.cause.prefix(), "", 1)
+	}
+	return e.prefix() + message
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode attaches code to err unless it already has one, an err wrapping a
+// coded error keeps its code and gets no second prefix.
+func withCode(code int32, err error) error {
+	if err == nil {
+		return nil
+	}
+	var cause *codedError
+	walkError(err, func(err error) bool {
+		cause, _ = err.(*codedError)
+		return cause != nil
+	})
+	if cause == err {
+		return err
+	}
+	if cause != nil {
+		return &codedError{code: cause.code, err: err, cause: cause}
+	}
+	return &codedError{code: code, err: err}
+}
+
+// exportError classifies err for returning it from the public api.
+func exportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return withCode(classifyError(err), err)
+}
+
+func classifyError(err error) int32 {
+	code := ErrorCodeUnknown
+	walkError(err, func(err error) bool {
+		var coded *codedError
+		var rcode dns.RCodeError
+		var errno syscall.Errno
+		switch {
+		case errors.As(err, &coded):
+			code = coded.code
+		case errors.As(err, &rcode):
+			code = ErrorCodeDnsRcode
+		case errors.As(err, &errno):
+			switch errno {
+			case syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ENETDOWN:
+				code = ErrorCodeNetworkUnreachable
+			case syscall.EBADF:
+				code = ErrorCodeFdDead
+			case syscall.ETIMEDOUT:
+				code = ErrorCodeTimeout
+			case syscall.ENOENT:
+				code = ErrorCodeAssetMissing
+			}
+		case errors.Is(err, os.ErrNotExist):
+			code = ErrorCodeAssetMissing
+		case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+			code = ErrorCodeTimeout
+		default:
+			if timeout, ok := err.(interface{ Timeout() bool }); ok && timeout.Timeout() {
+				code = ErrorCodeTimeout
+			}
+		}
+		return code != ErrorCodeUnknown
+	})
+	return code
+}
+
+// walkError calls fn for err and its causes until it returns true, v2ray
+// errors expose their cause with Inner instead of Unwrap.
+func walkError(err error, fn func(error) bool) {
+	for err != nil {
+		if fn(err) {
+			return
+		}
+		if inner, ok := err.(interface{ Inner() error }); ok && inner.Inner() != nil {
+			err = inner.Inner()
+		} else {
+			err = errors.Unwrap(err)
+		}
+	}
+}
+
+// GetErrorCode returns the code of an error message returned by libcore, or
+// the one of a message in the same format raised by the app.
+func GetErrorCode(message string) int32 {
+	code, _ := parseErrorCode(message)
+	return code
+}
+
+// GetErrorMessage returns a user displayable description of code.
+func GetErrorMessage(code int32) string {
+	if message, ok := errorMessages[code]; ok {
+		return message
+	}
+	return errorMessages[ErrorCodeUnknown]
+}
+
+// NewDnsRcodeError formats the error the LocalResolver should raise for a
+// dns failure.
+func NewDnsRcodeError(rcode int32) string {
+	return (&codedError{code: ErrorCodeDnsRcode, err: fmt.Errorf("rcode %d", rcode)}).Error()
+}
+
+func parseErrorCode(message string) (int32, string) {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, "E") {
+		return ErrorCodeUnknown, message
+	}
+	index := strings.Index(message, ": ")
+	if index < 0 {
+		return ErrorCodeUnknown, message
+	}
+	code, err := strconv.ParseInt(message[1:index], 10, 32)
+	if err != nil {
+		return ErrorCodeUnknown, message
+	}
+	return int32(code), message[index+2:]
+}
+
+// parseResolverError converts an error raised by the LocalResolver, both the
+// coded format and the legacy "rcode <n>" message are accepted.
+func parseResolverError(err error) error {
+	code, message := parseErrorCode(err.Error())
+	if code != ErrorCodeUnknown && code != ErrorCodeDnsRcode {
+		return withCode(code, err)
+	}
+	if strings.HasPrefix(message, "rcode ") {
+		if rcode, err := strconv.Atoi(strings.TrimSpace(message[6:])); err == nil {
+			return dns.RCodeError(rcode)
+		}
+	}
+	return err
+}
+
+// withConfigCode marks config loading errors, unless they are about a
+// missing asset.
+func withConfigCode(err error) error {
+	if classifyError(err) == ErrorCodeAssetMissing || strings.Contains(err.Error(), "not found in geo") {
+		return withCode(ErrorCodeAssetMissing, err)
+	}
+	return withCode(ErrorCodeConfigInvalid, err)
+}
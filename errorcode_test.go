@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithCode(t *testing.T) {
+	plain := errors.New("failed")
+	coded := withCode(ErrorCodeConfigInvalid, plain)
+	if coded.Error() != "E4: failed" {
+		t.Fatalf("message %q", coded.Error())
+	}
+	if withCode(ErrorCodeTimeout, coded) != coded {
+		t.Fatal("coded error was wrapped again")
+	}
+
+	wrapped := fmt.Errorf("load config: %w", coded)
+	for _, err := range []error{withCode(ErrorCodeTimeout, wrapped), exportError(wrapped)} {
+		if err.Error() != "E4: load config: failed" {
+			t.Errorf("message %q", err.Error())
+		}
+		if code := GetErrorCode(err.Error()); code != ErrorCodeConfigInvalid {
+			t.Errorf("code %d, want %d", code, ErrorCodeConfigInvalid)
+		}
+		if !errors.Is(err, plain) {
+			t.Error("cause was lost")
+		}
+	}
+
+	inner := newError("load config").Base(errProtectFailed)
+	if err := exportError(inner); GetErrorCode(err.Error()) != ErrorCodeProtectFailed {
+		t.Errorf("v2ray error %q lost its code", err.Error())
+	}
+}
+
+func TestExportedErrorCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errorcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notXz := filepath.Join(dir, "plain.txt")
+	if err = ioutil.WriteFile(notXz, []byte("plain"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		call func() error
+		code int32
+	}{
+		{"Unxz missing", func() error { return Unxz(filepath.Join(dir, "missing.xz"), filepath.Join(dir, "out")) }, ErrorCodeAssetMissing},
+		{"Unxz invalid", func() error { return Unxz(notXz, filepath.Join(dir, "out")) }, ErrorCodeInvalidArgument},
+		{"ApiInstance.Start", func() error { return (&ApiInstance{started: true}).Start() }, ErrorCodeInvalidState},
+		{"InitializeV2Ray", func() error { return InitializeV2Ray(dir, dir, "", nil, nil) }, ErrorCodeInvalidArgument},
+		{"Setenv", func() error { return Setenv("", "value") }, ErrorCodeInvalidArgument},
+		{"StunTest", func() error {
+			_, err := StunTest("no-port", 0)
+			return err
+		}, ErrorCodeUnknown},
+	} {
+		err := test.call()
+		var coded *codedError
+		if !errors.As(err, &coded) {
+			t.Errorf("%s: uncoded error %v", test.name, err)
+			continue
+		}
+		if code := GetErrorCode(err.Error()); code != test.code {
+			t.Errorf("%s: code %d in %q, want %d", test.name, code, err.Error(), test.code)
+		}
+	}
+	if err = Unsetenv("LIBCORE_ERRORCODE_TEST"); err != nil {
+		t.Fatalf("Unsetenv: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the exit ip endpoint.
+const (
+	// ExitIpFormatPlain is a bare address, or key=value lines with ip and
+	// loc as served by /cdn-cgi/trace.
+	ExitIpFormatPlain int32 = iota
+	// ExitIpFormatJson is an object with the address in ip, query, origin or
+	// address, and the country code in country_code, countryCode, cc or
+	// country.
+	ExitIpFormatJson
+)
+
+const (
+	exitIpDefaultEndpoint = "https://www.cloudflare.com/cdn-cgi/trace"
+	exitIpTimeout         = 10 * time.Second
+	exitIpCacheTTL        = 10 * time.Minute
+	exitIpMaxSize         = 64 * 1024
+)
+
+var exitIpEndpoint = struct {
+	access sync.Mutex
+	url    string
+	format int32
+	// generation changes with the endpoint, results of a previous one are
+	// stale
+	generation int
+}{url: exitIpDefaultEndpoint, format: ExitIpFormatPlain}
+
+type ExitIpResult struct {
+	Tag string
+	Ip  string
+	// Country is the code the endpoint reported, if any.
+	Country string
+	// ResolvedAt is in unix seconds.
+	ResolvedAt int64
+	Cached     bool
+}
+
+// SetExitIpEndpoint sets the "what is my ip" service queried by
+// ResolveOutboundExitIP, an empty url restores the default. Results cached
+// from the previous endpoint are discarded.
+func SetExitIpEndpoint(url string, format int32) error {
+	if format != ExitIpFormatPlain && format != ExitIpFormatJson {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid exit ip format ", format))
+	}
+	if url == "" {
+		url, format = exitIpDefaultEndpoint, ExitIpFormatPlain
+	}
+	exitIpEndpoint.access.Lock()
+	exitIpEndpoint.url = url
+	exitIpEndpoint.format = format
+	exitIpEndpoint.generation++
+	exitIpEndpoint.access.Unlock()
+	return nil
+}
+
+type cachedExitIp struct {
+	result     ExitIpResult
+	generation int
+}
+
+// ResolveOutboundExitIP queries the exit ip endpoint through the outbound
+// tagged tag, which is the address of the landing server for chained
+// outbounds. Results are cached for ten minutes unless refresh.
+func (instance *V2RayInstance) ResolveOutboundExitIP(tag string, refresh bool) (*ExitIpResult, error) {
+	if tag == "" {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("missing outbound tag"))
+	}
+	exitIpEndpoint.access.Lock()
+	endpoint, format, generation := exitIpEndpoint.url, exitIpEndpoint.format, exitIpEndpoint.generation
+	exitIpEndpoint.access.Unlock()
+
+	if !refresh {
+		if value, ok := instance.exitIps.Load(tag); ok {
+			cached := value.(*cachedExitIp)
+			if cached.generation == generation && time.Since(time.Unix(cached.result.ResolvedAt, 0)) < exitIpCacheTTL {
+				result := cached.result
+				result.Cached = true
+				return &result, nil
+			}
+		}
+	}
+
+	client := instance.httpClient(downloadRequest{outbound: tag, timeout: exitIpTimeout})
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	req.Header.Set("User-Agent", "curl/7.79.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, exportError(newError("query exit ip through ", tag).Base(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError("exit ip endpoint returned status ", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, exitIpMaxSize))
+	if err != nil {
+		return nil, exportError(newError("read exit ip").Base(err))
+	}
+
+	result := &ExitIpResult{Tag: tag, ResolvedAt: time.Now().Unix()}
+	if format == ExitIpFormatJson {
+		result.Ip, result.Country, err = parseExitIpJson(content)
+	} else {
+		result.Ip, result.Country, err = parseExitIpPlain(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	instance.exitIps.Store(tag, &cachedExitIp{*result, generation})
+	return result, nil
+}
+
+func parseExitIpPlain(content []byte) (string, string, error) {
+	text := strings.TrimSpace(string(content))
+	if ip := net.ParseIP(text); ip != nil {
+		return ip.String(), "", nil
+	}
+	var address, country string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		key, value := scanner.Text(), ""
+		if index := strings.IndexByte(key, '='); index >= 0 {
+			key, value = key[:index], strings.TrimSpace(key[index+1:])
+		}
+		switch key {
+		case "ip":
+			address = value
+		case "loc":
+			country = value
+		}
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", "", newError("no ip in exit ip response")
+	}
+	return ip.String(), strings.ToUpper(country), nil
+}
+
+func parseExitIpJson(content []byte) (string, string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return "", "", newError("invalid exit ip response").Base(err)
+	}
+	lookup := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := fields[key].(string); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	// httpbin reports proxies in front of it as "client, proxy"
+	address := strings.TrimSpace(strings.Split(lookup("ip", "query", "origin", "address"), ",")[0])
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", "", newError("no ip in exit ip response")
+	}
+	country := lookup("country_code", "countryCode", "cc")
+	if country == "" {
+		// a country name is only taken if it looks like a code
+		if name := lookup("country"); len(name) == 2 {
+			country = name
+		}
+	}
+	return ip.String(), strings.ToUpper(country), nil
+}
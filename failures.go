@@ -0,0 +1,220 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+// Reasons of failed connections.
+const (
+	FailureDns         = "dns"
+	FailureRefused     = "refused"
+	FailureReset       = "reset"
+	FailureUnreachable = "unreachable"
+	FailureTimeout     = "timeout"
+	FailureProtocol    = "protocol"
+	FailureBlocked     = "blocked"
+	FailureUnknown     = "unknown"
+)
+
+const (
+	recentFailuresSize       = 64
+	recentFailureMessageSize = 512
+)
+
+var recentFailures = new(failureLog)
+
+type ConnectionFailure struct {
+	// Time is in unix milliseconds.
+	Time        int64
+	Network     string
+	Destination string
+	// Domain is the sniffed one if the tun has traffic stats enabled.
+	Domain   string
+	Outbound string
+	Uid      int32
+	Reason   string
+	Message  string
+}
+
+type ConnectionFailures struct {
+	failures []*ConnectionFailure
+}
+
+func (f *ConnectionFailures) Len() int32 {
+	return int32(len(f.failures))
+}
+
+func (f *ConnectionFailures) Get(index int32) *ConnectionFailure {
+	if index < 0 || int(index) >= len(f.failures) {
+		return nil
+	}
+	return f.failures[index]
+}
+
+// GetRecentFailures returns the latest tun connections that failed before
+// receiving anything, newest first.
+func GetRecentFailures() *ConnectionFailures {
+	return &ConnectionFailures{recentFailures.list()}
+}
+
+func ClearRecentFailures() {
+	recentFailures.clear()
+}
+
+type failureLog struct {
+	access  sync.Mutex
+	entries []*ConnectionFailure
+	next    int
+}
+
+func (l *failureLog) list() []*ConnectionFailure {
+	l.access.Lock()
+	defer l.access.Unlock()
+	failures := make([]*ConnectionFailure, 0, len(l.entries))
+	for index := len(l.entries) - 1; index >= 0; index-- {
+		failures = append(failures, l.entries[(l.next+index)%len(l.entries)])
+	}
+	return failures
+}
+
+func (l *failureLog) clear() {
+	l.access.Lock()
+	l.entries = nil
+	l.next = 0
+	l.access.Unlock()
+}
+
+func (l *failureLog) add(failure *ConnectionFailure) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if len(l.entries) < recentFailuresSize {
+		l.entries = append(l.entries, failure)
+		return
+	}
+	l.entries[l.next] = failure
+	l.next = (l.next + 1) % recentFailuresSize
+}
+
+// record adds a failed connection, the reason is taken from the block action
+// the router picked or else from err.
+func (l *failureLog) record(destination v2rayNet.Destination, uid uint32, content *session.Content, flow *domainFlow, err error) {
+	failure := &ConnectionFailure{
+		Time:        time.Now().UnixNano() / int64(time.Millisecond),
+		Network:     destination.Network.SystemString(),
+		Destination: destination.NetAddr(),
+		Uid:         int32(uid),
+	}
+	if flow != nil {
+		failure.Domain = flow.getDomain()
+		failure.Outbound = flow.getOutbound()
+	} else if destination.Address.Family().IsDomain() {
+		failure.Domain = destination.Address.Domain()
+	}
+	if tag := content.Attribute(blockAttribute); tag != "" {
+		failure.Reason = FailureBlocked
+		failure.Outbound = tag
+	} else if err != nil {
+		failure.Reason = classifyFailure(err)
+	} else {
+		return
+	}
+	if err != nil {
+		failure.Message = err.Error()
+		if len(failure.Message) > recentFailureMessageSize {
+			failure.Message = failure.Message[:recentFailureMessageSize]
+		}
+	}
+	l.add(failure)
+}
+
+// classifyFailure looks for a known cause in the chain of err, falling back
+// to the message of its innermost cause.
+func classifyFailure(err error) string {
+	reason := FailureUnknown
+	cause := err
+	walkError(err, func(err error) bool {
+		cause = err
+		var rcode dns.RCodeError
+		var dnsErr *net.DNSError
+		var errno syscall.Errno
+		switch {
+		case errors.Is(err, errBlocked):
+			reason = FailureBlocked
+		case errors.As(err, &rcode), errors.As(err, &dnsErr):
+			reason = FailureDns
+		case errors.As(err, &errno):
+			switch errno {
+			case syscall.ECONNREFUSED:
+				reason = FailureRefused
+			case syscall.ECONNRESET, syscall.EPIPE:
+				reason = FailureReset
+			case syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ENETDOWN:
+				reason = FailureUnreachable
+			case syscall.ETIMEDOUT:
+				reason = FailureTimeout
+			}
+		case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+			reason = FailureTimeout
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			// the server closed the connection during the handshake
+			reason = FailureProtocol
+		default:
+			if timeout, ok := err.(interface{ Timeout() bool }); ok && timeout.Timeout() {
+				reason = FailureTimeout
+			}
+		}
+		return reason != FailureUnknown
+	})
+	if reason != FailureUnknown {
+		return reason
+	}
+	message := strings.ToLower(cause.Error())
+	switch {
+	case strings.Contains(message, "lookup"), strings.Contains(message, "no such host"),
+		strings.Contains(message, "resolve"):
+		return FailureDns
+	case strings.Contains(message, "refused"):
+		return FailureRefused
+	case strings.Contains(message, "reset by peer"):
+		return FailureReset
+	case strings.Contains(message, "timeout"), strings.Contains(message, "timed out"):
+		return FailureTimeout
+	case strings.Contains(message, "tls:"), strings.Contains(message, "handshake"),
+		strings.Contains(message, "invalid"), strings.Contains(message, "authentication"),
+		strings.Contains(message, "unexpected"), strings.Contains(message, "response"):
+		return FailureProtocol
+	}
+	return FailureUnknown
+}
+
+// failureTracker receives the error the outbound handler fails with.
+type failureTracker struct {
+	access sync.Mutex
+	err    error
+}
+
+func (t *failureTracker) SubmitError(err error) {
+	t.access.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.access.Unlock()
+}
+
+func (t *failureTracker) error() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.err
+}
@@ -0,0 +1,46 @@
+package libcore
+
+import (
+	"embed"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:generate go run ./fallbackgen ../SagerNet/app/src/main/assets/v2ray/geoip.dat ../SagerNet/app/src/main/assets/v2ray/geosite.dat
+
+// fallbackAssets are minimal geoip and geosite files with the cn and private
+// entries, regenerate them with go generate from the full assets of the app
+// checkout next to libcore.
+//
+//go:embed fallback/geoip.dat fallback/geosite.dat
+var fallbackAssets embed.FS
+
+// extractFallbackAsset writes the embedded version of name to the external
+// assets dir if it has none yet, so routing works before the full assets are
+// available. The version is set to 0 so any real asset replaces it.
+func extractFallbackAsset(name string) error {
+	if name != geoipDat && name != geositeDat {
+		return newError("no fallback for ", name)
+	}
+	path := externalAssetsPath + name
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	content, err := fallbackAssets.ReadFile("fallback/" + name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(externalAssetsPath, 0o755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+".tmp", content, 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	logrus.Warn("using embedded fallback ", name)
+	return ioutil.WriteFile(externalAssetsPath+assetVersionFile(name), []byte("0"), 0o644)
+}
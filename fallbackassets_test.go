@@ -0,0 +1,96 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+func TestFallbackGeoip(t *testing.T) {
+	content, err := fallbackAssets.ReadFile("fallback/" + geoipDat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list routercommon.GeoIPList
+	if err = proto.Unmarshal(content, &list); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]*routercommon.GeoIP)
+	for _, entry := range list.Entry {
+		entries[strings.ToLower(entry.CountryCode)] = entry
+	}
+	contains := func(code string, address string) bool {
+		ip := net.ParseIP(address)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, cidr := range entries[code].Cidr {
+			network := net.IPNet{IP: cidr.Ip, Mask: net.CIDRMask(int(cidr.Prefix), len(cidr.Ip)*8)}
+			if len(cidr.Ip) == len(ip) && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, code := range []string{"cn", "private"} {
+		if entries[code] == nil || len(entries[code].Cidr) == 0 {
+			t.Fatalf("no %s entry", code)
+		}
+	}
+	for _, address := range []string{"114.114.114.114", "223.5.5.5", "119.29.29.29", "2400:3200::1"} {
+		if !contains("cn", address) {
+			t.Errorf("%s is not in geoip:cn", address)
+		}
+	}
+	for _, address := range []string{"8.8.8.8", "1.1.1.1", "2001:4860:4860::8888"} {
+		if contains("cn", address) {
+			t.Errorf("%s is in geoip:cn", address)
+		}
+	}
+	if !contains("private", "192.168.1.1") || !contains("private", "fd00::1") {
+		t.Error("private ranges are missing from geoip:private")
+	}
+}
+
+func TestFallbackGeosite(t *testing.T) {
+	content, err := fallbackAssets.ReadFile("fallback/" + geositeDat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list routercommon.GeoSiteList
+	if err = proto.Unmarshal(content, &list); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]*routercommon.GeoSite)
+	for _, entry := range list.Entry {
+		entries[strings.ToLower(entry.CountryCode)] = entry
+	}
+	matches := func(code string, domain string) bool {
+		for _, rule := range entries[code].Domain {
+			if rule.Type == routercommon.Domain_RootDomain && (domain == rule.Value || strings.HasSuffix(domain, "."+rule.Value)) ||
+				rule.Type == routercommon.Domain_Full && domain == rule.Value {
+				return true
+			}
+		}
+		return false
+	}
+	for _, code := range []string{"cn", "private"} {
+		if entries[code] == nil || len(entries[code].Domain) == 0 {
+			t.Fatalf("no %s entry", code)
+		}
+	}
+	for _, domain := range []string{"www.gov.cn", "www.baidu.com", "qq.com", "xn--fiqs8s"} {
+		if !matches("cn", domain) {
+			t.Errorf("%s is not in geosite:cn", domain)
+		}
+	}
+	if matches("cn", "www.google.com") {
+		t.Error("www.google.com is in geosite:cn")
+	}
+	if !matches("private", "printer.local") {
+		t.Error("printer.local is not in geosite:private")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+// fallbackgen writes the minimal geo assets embedded into libcore from the
+// full geoip.dat and geosite.dat, keeping their cn and private entries. The
+// built-in private entries are only used if an asset has none.
+//
+//	go run ./fallbackgen geoip.dat geosite.dat
+
+var keep = map[string]bool{
+	"CN":      true,
+	"PRIVATE": true,
+}
+
+var privateCIDRs = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"255.255.255.255/32", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+var privateDomains = []string{
+	"local", "localhost", "localdomain", "lan", "home.arpa", "internal",
+}
+
+func main() {
+	geoip := &routercommon.GeoIPList{}
+	geosite := &routercommon.GeoSiteList{}
+	if len(os.Args) != 3 {
+		fail(fmt.Errorf("usage: fallbackgen geoip.dat geosite.dat"))
+	}
+	if err := load(os.Args[1], geoip); err != nil {
+		fail(err)
+	}
+	if err := load(os.Args[2], geosite); err != nil {
+		fail(err)
+	}
+
+	var ipEntries []*routercommon.GeoIP
+	for _, entry := range geoip.Entry {
+		if keep[strings.ToUpper(entry.CountryCode)] {
+			ipEntries = append(ipEntries, entry)
+		}
+	}
+	if !hasIP(ipEntries, "CN") {
+		fail(fmt.Errorf("%s has no cn entry", os.Args[1]))
+	}
+	if !hasIP(ipEntries, "PRIVATE") {
+		private := &routercommon.GeoIP{CountryCode: "PRIVATE"}
+		for _, cidr := range privateCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				fail(err)
+			}
+			ip := network.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			prefix, _ := network.Mask.Size()
+			private.Cidr = append(private.Cidr, &routercommon.CIDR{Ip: ip, Prefix: uint32(prefix)})
+		}
+		ipEntries = append(ipEntries, private)
+	}
+
+	var siteEntries []*routercommon.GeoSite
+	for _, entry := range geosite.Entry {
+		if keep[strings.ToUpper(entry.CountryCode)] {
+			siteEntries = append(siteEntries, entry)
+		}
+	}
+	if !hasSite(siteEntries, "CN") {
+		fail(fmt.Errorf("%s has no cn entry", os.Args[2]))
+	}
+	if !hasSite(siteEntries, "PRIVATE") {
+		private := &routercommon.GeoSite{CountryCode: "PRIVATE"}
+		for _, domain := range privateDomains {
+			private.Domain = append(private.Domain, &routercommon.Domain{Type: routercommon.Domain_RootDomain, Value: domain})
+		}
+		siteEntries = append(siteEntries, private)
+	}
+
+	if err := save("fallback/geoip.dat", &routercommon.GeoIPList{Entry: ipEntries}); err != nil {
+		fail(err)
+	}
+	if err := save("fallback/geosite.dat", &routercommon.GeoSiteList{Entry: siteEntries}); err != nil {
+		fail(err)
+	}
+}
+
+func hasIP(entries []*routercommon.GeoIP, code string) bool {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.CountryCode, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSite(entries []*routercommon.GeoSite, code string) bool {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.CountryCode, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func load(path string, message proto.Message) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(content, message)
+}
+
+func save(path string, message proto.Message) error {
+	content, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0o644)
+}
+
+func fail(err error) {
+	fmt.Println("fallbackgen:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,301 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+const (
+	flowExportMaxSize  = 10 * 1024 * 1024
+	flowExportMaxFiles = 3
+)
+
+// FlowExporterConfig selects where the records of closed tun connections are
+// written, both a file and a collector may be set. Flows are tracked if the
+// tun has traffic stats enabled.
+type FlowExporterConfig struct {
+	// Path is a JSON lines file, rotated to Path.1 to Path.MaxFiles.
+	Path     string
+	MaxSize  int64
+	MaxFiles int32
+	// Collector is the host:port of an IPFIX collector, records are sent over
+	// udp without the uid, domain and outbound.
+	Collector string
+}
+
+type flowRecord struct {
+	Start       string `json:"start"`
+	DurationMs  int64  `json:"duration_ms"`
+	Network     string `json:"network"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Uid         uint32 `json:"uid"`
+	Domain      string `json:"domain,omitempty"`
+	Outbound    string `json:"outbound,omitempty"`
+	Uplink      uint64 `json:"uplink"`
+	Downlink    uint64 `json:"downlink"`
+}
+
+type flowExporter struct {
+	access    sync.Mutex
+	config    *FlowExporterConfig
+	file      *os.File
+	size      int64
+	collector net.Conn
+	sequence  uint32
+}
+
+var flowExport = new(flowExporter)
+
+// SetFlowExporter starts exporting flow records, nil stops it.
+func SetFlowExporter(config *FlowExporterConfig) error {
+	flowExport.access.Lock()
+	defer flowExport.access.Unlock()
+	flowExport.closeLocked()
+	if config == nil || config.Path == "" && config.Collector == "" {
+		return nil
+	}
+	config = &FlowExporterConfig{config.Path, config.MaxSize, config.MaxFiles, config.Collector}
+	if config.MaxSize <= 0 {
+		config.MaxSize = flowExportMaxSize
+	}
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = flowExportMaxFiles
+	}
+	if config.Path != "" {
+		if err := flowExport.openLocked(config.Path); err != nil {
+			return exportError(newError("failed to open flow export file").Base(err))
+		}
+	}
+	if config.Collector != "" {
+		if _, err := v2rayNet.ParseDestination("udp:" + config.Collector); err != nil {
+			flowExport.closeLocked()
+			return withCode(ErrorCodeInvalidArgument, newError("invalid ipfix collector ", config.Collector).Base(err))
+		}
+	}
+	flowExport.config = config
+	return nil
+}
+
+func (e *flowExporter) openLocked(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	e.file = file
+	e.size = info.Size()
+	return nil
+}
+
+func (e *flowExporter) closeLocked() {
+	if e.file != nil {
+		e.file.Close()
+		e.file = nil
+	}
+	if e.collector != nil {
+		e.collector.Close()
+		e.collector = nil
+	}
+	e.config = nil
+}
+
+// rotateLocked moves the file to Path.1, shifting the older ones.
+func (e *flowExporter) rotateLocked() error {
+	e.file.Close()
+	e.file = nil
+	path := e.config.Path
+	for index := e.config.MaxFiles - 1; index > 0; index-- {
+		_ = os.Rename(fmt.Sprint(path, ".", index), fmt.Sprint(path, ".", index+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+	return e.openLocked(path)
+}
+
+func (e *flowExporter) export(flow *domainFlow) {
+	e.access.Lock()
+	defer e.access.Unlock()
+	if e.config == nil {
+		return
+	}
+	now := time.Now()
+	if e.file != nil {
+		e.writeRecord(flow, now)
+	}
+	if e.config.Collector != "" {
+		e.sendRecord(flow, now)
+	}
+}
+
+// sendRecord connects to the collector on demand, through the system dialer
+// which is protected while a tun is running.
+func (e *flowExporter) sendRecord(flow *domainFlow, now time.Time) {
+	if e.collector == nil {
+		destination, _ := v2rayNet.ParseDestination("udp:" + e.config.Collector)
+		collector, err := internet.DialSystem(context.Background(), destination, nil)
+		if err != nil {
+			newError("failed to connect to the ipfix collector").Base(err).AtDebug().WriteToLog()
+			return
+		}
+		e.collector = collector
+	}
+	if _, err := e.collector.Write(e.ipfixMessage(flow, now)); err != nil {
+		newError("failed to send ipfix record").Base(err).AtDebug().WriteToLog()
+		e.collector.Close()
+		e.collector = nil
+	}
+}
+
+func (e *flowExporter) writeRecord(flow *domainFlow, now time.Time) {
+	record := &flowRecord{
+		Start:       flow.startedAt.Format(time.RFC3339Nano),
+		DurationMs:  now.Sub(flow.startedAt).Milliseconds(),
+		Network:     flow.destination.Network.SystemString(),
+		Source:      flow.source.NetAddr(),
+		Destination: flow.destination.NetAddr(),
+		Uid:         flow.uid,
+		Domain:      flow.getDomain(),
+		Outbound:    flow.getOutbound(),
+		Uplink:      atomic.LoadUint64(&flow.uplinkTotal),
+		Downlink:    atomic.LoadUint64(&flow.downlinkTotal),
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if e.size+int64(len(line)) > e.config.MaxSize && e.size > 0 {
+		if err = e.rotateLocked(); err != nil {
+			newError("failed to rotate flow export file").Base(err).AtWarning().WriteToLog()
+			if e.file == nil {
+				return
+			}
+		}
+	}
+	n, err := e.file.Write(line)
+	e.size += int64(n)
+	if err != nil {
+		newError("failed to write flow record").Base(err).AtWarning().WriteToLog()
+	}
+}
+
+// IPFIX (RFC 7011) templates for flows over IPv4 and IPv6, the downlink is
+// the reverse octet count of RFC 5103.
+const (
+	ipfixVersion              = 10
+	ipfixTemplateSetId        = 2
+	ipfixTemplateIPv4         = 256
+	ipfixTemplateIPv6         = 257
+	ipfixEnterpriseBit        = 0x8000
+	ipfixReversePen           = 29305
+	ipfixMessageHeader        = 16
+	ipfixSetHeader            = 4
+	ipfixFieldSourcePort      = 7
+	ipfixFieldDestinationPort = 11
+	ipfixFieldProtocol        = 4
+	ipfixFieldOctets          = 1
+	ipfixFieldStart           = 152
+	ipfixFieldEnd             = 153
+	ipfixFieldSourceIPv4      = 8
+	ipfixFieldDestinationIPv4 = 12
+	ipfixFieldSourceIPv6      = 27
+	ipfixFieldDestinationIPv6 = 28
+)
+
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+func ipfixFields(ipv6 bool) []ipfixField {
+	source, destination, length := uint16(ipfixFieldSourceIPv4), uint16(ipfixFieldDestinationIPv4), uint16(4)
+	if ipv6 {
+		source, destination, length = ipfixFieldSourceIPv6, ipfixFieldDestinationIPv6, 16
+	}
+	return []ipfixField{
+		{source, length, 0},
+		{destination, length, 0},
+		{ipfixFieldSourcePort, 2, 0},
+		{ipfixFieldDestinationPort, 2, 0},
+		{ipfixFieldProtocol, 1, 0},
+		{ipfixFieldOctets, 8, 0},
+		{ipfixFieldOctets | ipfixEnterpriseBit, 8, ipfixReversePen},
+		{ipfixFieldStart, 8, 0},
+		{ipfixFieldEnd, 8, 0},
+	}
+}
+
+// ipfixMessage builds a message with the template and one data record, the
+// template is repeated since udp collectors may miss it.
+func (e *flowExporter) ipfixMessage(flow *domainFlow, now time.Time) []byte {
+	sourceIP := flow.source.Address.IP()
+	destinationIP := net.IPv4zero
+	if flow.destination.Address.Family().IsIP() {
+		destinationIP = flow.destination.Address.IP()
+	}
+	ipv6 := sourceIP.To4() == nil || destinationIP.To4() == nil
+	templateId := uint16(ipfixTemplateIPv4)
+	if ipv6 {
+		templateId = ipfixTemplateIPv6
+	}
+	fields := ipfixFields(ipv6)
+
+	template := new(bytes.Buffer)
+	writeBigEndian(template, templateId, uint16(len(fields)))
+	for _, field := range fields {
+		writeBigEndian(template, field.id, field.length)
+		if field.enterprise != 0 {
+			writeBigEndian(template, field.enterprise)
+		}
+	}
+
+	record := new(bytes.Buffer)
+	if ipv6 {
+		record.Write(sourceIP.To16())
+		record.Write(destinationIP.To16())
+	} else {
+		record.Write(sourceIP.To4())
+		record.Write(destinationIP.To4())
+	}
+	protocol := uint8(6)
+	if flow.destination.Network == v2rayNet.Network_UDP {
+		protocol = 17
+	}
+	writeBigEndian(record, uint16(flow.source.Port), uint16(flow.destination.Port), protocol,
+		atomic.LoadUint64(&flow.uplinkTotal), atomic.LoadUint64(&flow.downlinkTotal),
+		uint64(flow.startedAt.UnixNano()/int64(time.Millisecond)), uint64(now.UnixNano()/int64(time.Millisecond)))
+
+	length := ipfixMessageHeader + ipfixSetHeader + template.Len() + ipfixSetHeader + record.Len()
+	message := bytes.NewBuffer(make([]byte, 0, length))
+	writeBigEndian(message, uint16(ipfixVersion), uint16(length), uint32(now.Unix()), e.sequence, uint32(0))
+	writeBigEndian(message, uint16(ipfixTemplateSetId), uint16(ipfixSetHeader+template.Len()))
+	message.Write(template.Bytes())
+	writeBigEndian(message, templateId, uint16(ipfixSetHeader+record.Len()))
+	message.Write(record.Bytes())
+	e.sequence++
+	return message.Bytes()
+}
+
+func writeBigEndian(buffer *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		_ = binary.Write(buffer, binary.BigEndian, value)
+	}
+}
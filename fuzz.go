@@ -0,0 +1,77 @@
+//go:build gofuzz
+// +build gofuzz
+
+package libcore
+
+import (
+	"bytes"
+)
+
+// The functions below are go-fuzz entry points for the parsers of untrusted
+// input: subscriptions, online configs and share links, rules and rule
+// providers downloaded from subscriptions, pac scripts, and the messages of
+// proxy clients and servers. fuzz.sh builds and runs
+// them, an input is interesting if it parses.
+
+func fuzzResult(err error) int {
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+func FuzzSubscription(data []byte) int {
+	_, err := parseSubscription(data)
+	return fuzzResult(err)
+}
+
+func FuzzOnlineConfig(data []byte) int {
+	_, err := parseOnlineConfig(data)
+	return fuzzResult(err)
+}
+
+func FuzzShareLink(data []byte) int {
+	_, err := parseShareLink(string(data))
+	return fuzzResult(err)
+}
+
+func FuzzOocToken(data []byte) int {
+	_, _, err := parseOocToken(string(data))
+	return fuzzResult(err)
+}
+
+func FuzzRules(data []byte) int {
+	_, err := parseRules(string(data), &ruleProviders{})
+	return fuzzResult(err)
+}
+
+func FuzzRuleProvider(data []byte) int {
+	if len(parseRuleProviderYaml(data)) == 0 {
+		return 0
+	}
+	return 1
+}
+
+func FuzzPac(data []byte) int {
+	_, err := compilePac(string(data))
+	return fuzzResult(err)
+}
+
+func FuzzDnsUpstream(data []byte) int {
+	_, err := parseDnsUpstream(string(data))
+	return fuzzResult(err)
+}
+
+func FuzzNtlmChallenge(data []byte) int {
+	challenge, err := parseNtlmChallenge(data)
+	if err != nil {
+		return 0
+	}
+	_, _ = ntlmAuthenticateMessage(challenge, "domain", "user", "password")
+	return 1
+}
+
+func FuzzSocksAddress(data []byte) int {
+	_, err := readSocksAddress(bytes.NewReader(data))
+	return fuzzResult(err)
+}
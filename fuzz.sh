@@ -0,0 +1,33 @@
+#!/bin/bash
+
+# fuzz.sh TARGET [go-fuzz flags]: builds and runs one go-fuzz entry point,
+# TARGET is one of nat, subscription, online-config, share-link, ooc-token,
+# rules, rule-provider, pac, dns-upstream, ntlm and socks-address. The corpus and the crashers are kept in fuzz/TARGET.
+
+export PATH="$PATH:$(go env GOPATH)/bin"
+
+TARGET=$1
+shift
+case $TARGET in
+nat) PKG=./nat FUNC=Fuzz ;;
+subscription) PKG=. FUNC=FuzzSubscription ;;
+online-config) PKG=. FUNC=FuzzOnlineConfig ;;
+share-link) PKG=. FUNC=FuzzShareLink ;;
+ooc-token) PKG=. FUNC=FuzzOocToken ;;
+rules) PKG=. FUNC=FuzzRules ;;
+rule-provider) PKG=. FUNC=FuzzRuleProvider ;;
+pac) PKG=. FUNC=FuzzPac ;;
+dns-upstream) PKG=. FUNC=FuzzDnsUpstream ;;
+ntlm) PKG=. FUNC=FuzzNtlmChallenge ;;
+socks-address) PKG=. FUNC=FuzzSocksAddress ;;
+*)
+  echo "usage: $0 nat|subscription|online-config|share-link|ooc-token|rules|rule-provider|pac|dns-upstream|ntlm|socks-address [go-fuzz flags]"
+  exit 1
+  ;;
+esac
+
+command -v go-fuzz >/dev/null || go install github.com/dvyukov/go-fuzz/go-fuzz@latest github.com/dvyukov/go-fuzz/go-fuzz-build@latest || exit 1
+
+go run ./cmd/fuzzcorpus -workdir fuzz || exit 1
+go-fuzz-build -func $FUNC -o fuzz/$TARGET/fuzz.zip $PKG || exit 1
+go-fuzz -bin fuzz/$TARGET/fuzz.zip -workdir fuzz/$TARGET "$@"
@@ -0,0 +1,306 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+// geoipIndex maps the ranges of the country codes of geoip.dat, codes that
+// are not countries like private or cloudflare are left out. The countries
+// of geoip.dat do not overlap, so the range before an address is the only
+// one that may contain it.
+type geoipIndex struct {
+	path       string
+	modifiedAt int64
+	checkedAt  time.Time
+	codes      []string
+	ipv4       []geoipRange4
+	ipv6       []geoipRange6
+}
+
+type geoipRange4 struct {
+	start, end uint32
+	code       uint16
+}
+
+type geoipRange6 struct {
+	start, end [2]uint64
+	code       uint16
+}
+
+type AsnInfo struct {
+	Number       int64
+	Organization string
+}
+
+// geoipRecheckInterval is how often geoip.dat is checked for updates.
+const geoipRecheckInterval = time.Minute
+
+var geoipLookup struct {
+	access  sync.Mutex
+	index   *geoipIndex
+	country *mmdbReader
+	asn     *mmdbReader
+	// scanned is whether the .mmdb files of the external assets were
+	// loaded, ClearMmdb sets it so they are not loaded again
+	scanned bool
+}
+
+// LoadMmdb loads a MaxMind DB for LookupCountry and GEOIP rules, or
+// LookupASN, by its type. A country or city db takes precedence over
+// geoip.dat. The .mmdb files in the external assets are loaded on the first
+// lookup without it.
+func LoadMmdb(path string) error {
+	if err := loadMmdb(path); err != nil {
+		return withCode(ErrorCodeAssetMissing, newError("load mmdb ", path).Base(err))
+	}
+	return nil
+}
+
+func loadMmdb(path string) error {
+	reader, err := openMmdb(path)
+	if err != nil {
+		return err
+	}
+	geoipLookup.access.Lock()
+	defer geoipLookup.access.Unlock()
+	geoipLookup.scanned = true
+	if strings.Contains(strings.ToUpper(reader.databaseType), "ASN") {
+		geoipLookup.asn = reader
+	} else {
+		geoipLookup.country = reader
+	}
+	newError("loaded mmdb ", reader.databaseType, " with ", reader.nodeCount, " nodes").AtInfo().WriteToLog()
+	return nil
+}
+
+// ClearMmdb unloads the MaxMind DBs, lookups then use geoip.dat.
+func ClearMmdb() {
+	geoipLookup.access.Lock()
+	geoipLookup.country = nil
+	geoipLookup.asn = nil
+	geoipLookup.scanned = true
+	geoipLookup.access.Unlock()
+}
+
+// scanMmdb loads the .mmdb files of the external assets once, a country db
+// like Country.mmdb of clash and an ASN db may be present.
+func scanMmdb() {
+	if externalAssetsPath == "" {
+		return
+	}
+	geoipLookup.access.Lock()
+	scanned := geoipLookup.scanned
+	geoipLookup.scanned = true
+	geoipLookup.access.Unlock()
+	if scanned {
+		return
+	}
+	paths, _ := filepath.Glob(externalAssetsPath + "*.mmdb")
+	for _, path := range paths {
+		if err := loadMmdb(path); err != nil {
+			newError("skipped ", path).Base(err).AtWarning().WriteToLog()
+		}
+	}
+}
+
+// LookupCountry returns the upper case country code of ip, empty if unknown.
+// geoip.dat is indexed on the first lookup and again when it is updated.
+func LookupCountry(ip string) (string, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return "", withCode(ErrorCodeInvalidArgument, newError("invalid ip ", ip))
+	}
+	return lookupCountry(address)
+}
+
+func lookupCountry(ip net.IP) (string, error) {
+	scanMmdb()
+	geoipLookup.access.Lock()
+	country := geoipLookup.country
+	geoipLookup.access.Unlock()
+	if country != nil {
+		record, err := country.lookup(ip)
+		if err != nil {
+			return "", newError("lookup ", ip).Base(err)
+		}
+		code, _ := mmdbPath(record, "country", "iso_code").(string)
+		if code == "" {
+			code, _ = mmdbPath(record, "registered_country", "iso_code").(string)
+		}
+		return strings.ToUpper(code), nil
+	}
+
+	index, err := loadGeoipIndex()
+	if err != nil {
+		return "", err
+	}
+	return index.lookup(ip), nil
+}
+
+// geoipCondition is the GEOIP rule, matching the country of the target
+// addresses.
+type geoipCondition struct {
+	country string
+}
+
+func (c *geoipCondition) match(rc *ruleContext) bool {
+	for _, ip := range rc.ips {
+		if country, err := lookupCountry(ip); err == nil && country == c.country {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *geoipCondition) String() string {
+	return "GEOIP," + c.country
+}
+
+// LookupASN returns the autonomous system of ip from the ASN db loaded with
+// LoadMmdb, nil if unknown.
+func LookupASN(ip string) (*AsnInfo, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("invalid ip ", ip))
+	}
+	scanMmdb()
+	geoipLookup.access.Lock()
+	asn := geoipLookup.asn
+	geoipLookup.access.Unlock()
+	if asn == nil {
+		return nil, withCode(ErrorCodeAssetMissing, newError("no asn db loaded"))
+	}
+	record, err := asn.lookup(address)
+	if err != nil {
+		return nil, newError("lookup ", ip).Base(err)
+	}
+	number := mmdbUint(mmdbPath(record, "autonomous_system_number"))
+	if number == 0 {
+		return nil, nil
+	}
+	organization, _ := mmdbPath(record, "autonomous_system_organization").(string)
+	return &AsnInfo{int64(number), organization}, nil
+}
+
+// loadGeoipIndex returns the index of the installed geoip.dat, built again if
+// the file changed.
+func loadGeoipIndex() (*geoipIndex, error) {
+	geoipLookup.access.Lock()
+	defer geoipLookup.access.Unlock()
+	now := time.Now()
+	if index := geoipLookup.index; index != nil && now.Sub(index.checkedAt) < geoipRecheckInterval {
+		return index, nil
+	}
+	status, err := GetAssetStatus(geoipDat, false)
+	if err != nil || status.Path == "" {
+		return nil, withCode(ErrorCodeAssetMissing, newError("geoip.dat not found"))
+	}
+	if index := geoipLookup.index; index != nil && index.path == status.Path && index.modifiedAt == status.ModifiedAt {
+		index.checkedAt = now
+		return index, nil
+	}
+	content, err := ioutil.ReadFile(status.Path)
+	if err != nil {
+		return nil, exportError(newError("read geoip.dat").Base(err))
+	}
+	var list routercommon.GeoIPList
+	if err = proto.Unmarshal(content, &list); err != nil {
+		return nil, withCode(ErrorCodeAssetMissing, newError("invalid geoip.dat").Base(err))
+	}
+	index := &geoipIndex{path: status.Path, modifiedAt: status.ModifiedAt, checkedAt: now}
+	for _, entry := range list.Entry {
+		if len(entry.CountryCode) != 2 || entry.InverseMatch {
+			continue
+		}
+		code := uint16(len(index.codes))
+		index.codes = append(index.codes, strings.ToUpper(entry.CountryCode))
+		for _, cidr := range entry.Cidr {
+			index.add(cidr, code)
+		}
+	}
+	sort.Slice(index.ipv4, func(i, j int) bool {
+		return index.ipv4[i].start < index.ipv4[j].start
+	})
+	sort.Slice(index.ipv6, func(i, j int) bool {
+		return lessUint128(index.ipv6[i].start, index.ipv6[j].start)
+	})
+	geoipLookup.index = index
+	newError("indexed ", len(index.ipv4), " ipv4 and ", len(index.ipv6), " ipv6 ranges of geoip.dat").AtDebug().WriteToLog()
+	return index, nil
+}
+
+func (x *geoipIndex) add(cidr *routercommon.CIDR, code uint16) {
+	switch len(cidr.Ip) {
+	case net.IPv4len:
+		if cidr.Prefix > 32 {
+			return
+		}
+		start := binary.BigEndian.Uint32(cidr.Ip)
+		mask := uint32(0xFFFFFFFF)
+		if cidr.Prefix < 32 {
+			mask = ^(uint32(0xFFFFFFFF) >> cidr.Prefix)
+		}
+		start &= mask
+		x.ipv4 = append(x.ipv4, geoipRange4{start, start | ^mask, code})
+	case net.IPv6len:
+		if cidr.Prefix > 128 {
+			return
+		}
+		start := toUint128(cidr.Ip)
+		var mask [2]uint64
+		for i := range mask {
+			bits := int(cidr.Prefix) - i*64
+			switch {
+			case bits >= 64:
+				mask[i] = 0xFFFFFFFFFFFFFFFF
+			case bits > 0:
+				mask[i] = ^(uint64(0xFFFFFFFFFFFFFFFF) >> uint(bits))
+			}
+		}
+		var end [2]uint64
+		for i := range start {
+			start[i] &= mask[i]
+			end[i] = start[i] | ^mask[i]
+		}
+		x.ipv6 = append(x.ipv6, geoipRange6{start, end, code})
+	}
+}
+
+func (x *geoipIndex) lookup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		value := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(x.ipv4), func(i int) bool {
+			return x.ipv4[i].start > value
+		}) - 1
+		if i >= 0 && value <= x.ipv4[i].end {
+			return x.codes[x.ipv4[i].code]
+		}
+		return ""
+	}
+	value := toUint128(ip.To16())
+	i := sort.Search(len(x.ipv6), func(i int) bool {
+		return lessUint128(value, x.ipv6[i].start)
+	}) - 1
+	if i >= 0 && !lessUint128(x.ipv6[i].end, value) {
+		return x.codes[x.ipv6[i].code]
+	}
+	return ""
+}
+
+func toUint128(ip []byte) [2]uint64 {
+	return [2]uint64{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func lessUint128(a, b [2]uint64) bool {
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
@@ -0,0 +1,49 @@
+package gvisor
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/tun"
+)
+
+// captureEndpoint passes the packets of the wrapped endpoint to a capture,
+// like the sniffer but only copying them while something is capturing.
+type captureEndpoint struct {
+	nested.Endpoint
+	capture tun.PacketCapture
+}
+
+func newCaptureEndpoint(lower stack.LinkEndpoint, capture tun.PacketCapture) stack.LinkEndpoint {
+	endpoint := &captureEndpoint{capture: capture}
+	endpoint.Endpoint.Init(lower, endpoint)
+	return endpoint
+}
+
+func (e *captureEndpoint) DeliverNetworkPacket(remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	e.capturePacket(pkt, true)
+	e.Endpoint.DeliverNetworkPacket(remote, local, protocol, pkt)
+}
+
+func (e *captureEndpoint) WritePacket(r stack.RouteInfo, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) tcpip.Error {
+	e.capturePacket(pkt, false)
+	return e.Endpoint.WritePacket(r, protocol, pkt)
+}
+
+func (e *captureEndpoint) WritePackets(r stack.RouteInfo, pkts stack.PacketBufferList, protocol tcpip.NetworkProtocolNumber) (int, tcpip.Error) {
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		e.capturePacket(pkt, false)
+	}
+	return e.Endpoint.WritePackets(r, pkts, protocol)
+}
+
+func (e *captureEndpoint) capturePacket(pkt *stack.PacketBuffer, inbound bool) {
+	if !e.capture.Capturing() {
+		return
+	}
+	packet := make([]byte, 0, pkt.Size())
+	for _, view := range pkt.Views() {
+		packet = append(packet, view...)
+	}
+	e.capture.CapturePacket(packet, inbound)
+}
@@ -0,0 +1,132 @@
+package gvisor
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+var _ stack.LinkEndpoint = (*deviceEndpoint)(nil)
+
+// deviceEndpoint implements stack.LinkEndpoint on a tun.Device, for the
+// platforms without a tun fd.
+type deviceEndpoint struct {
+	device     tun.Device
+	mtu        uint32
+	wg         sync.WaitGroup
+	dispatcher stack.NetworkDispatcher
+}
+
+func newDeviceEndpoint(device tun.Device) *deviceEndpoint {
+	return &deviceEndpoint{device: device, mtu: uint32(device.MTU())}
+}
+
+func (e *deviceEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	if dispatcher == nil && e.dispatcher != nil {
+		_ = e.device.Close()
+		e.Wait()
+		e.dispatcher = nil
+		return
+	}
+	if dispatcher != nil && e.dispatcher == nil {
+		e.dispatcher = dispatcher
+		e.wg.Add(1)
+		go func() {
+			if err := comm.PinPacketThread(); err != nil {
+				newError("failed to pin packet thread").Base(err).AtWarning().WriteToLog()
+			}
+			e.dispatchLoop()
+			e.wg.Done()
+		}()
+	}
+}
+
+func (e *deviceEndpoint) dispatchLoop() {
+	packet := make([]byte, e.mtu)
+	for {
+		n, err := e.device.Read(packet)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		var protocol tcpip.NetworkProtocolNumber
+		switch header.IPVersion(packet) {
+		case header.IPv4Version:
+			protocol = header.IPv4ProtocolNumber
+		case header.IPv6Version:
+			protocol = header.IPv6ProtocolNumber
+		default:
+			continue
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data:              buffer.NewViewFromBytes(packet[:n]).ToVectorisedView(),
+			IsForwardedPacket: true,
+		})
+		e.dispatcher.DeliverNetworkPacket("", "", protocol, pkt)
+		pkt.DecRef()
+	}
+}
+
+func (e *deviceEndpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+func (e *deviceEndpoint) WritePacket(_ stack.RouteInfo, _ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) tcpip.Error {
+	return e.WriteRawPacket(pkt)
+}
+
+func (e *deviceEndpoint) WritePackets(_ stack.RouteInfo, pkts stack.PacketBufferList, _ tcpip.NetworkProtocolNumber) (int, tcpip.Error) {
+	n := 0
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		if err := e.WriteRawPacket(pkt); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (e *deviceEndpoint) WriteRawPacket(pkt *stack.PacketBuffer) tcpip.Error {
+	packet := make([]byte, 0, pkt.Size())
+	for _, view := range pkt.Views() {
+		packet = append(packet, view...)
+	}
+	if _, err := e.device.Write(packet); err != nil {
+		return &tcpip.ErrClosedForSend{}
+	}
+	return nil
+}
+
+func (e *deviceEndpoint) MTU() uint32 {
+	return e.mtu
+}
+
+func (e *deviceEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityNone
+}
+
+func (*deviceEndpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+func (*deviceEndpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+func (*deviceEndpoint) ARPHardwareType() header.ARPHardwareType {
+	return header.ARPHardwareNone
+}
+
+func (e *deviceEndpoint) AddHeader(tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+}
+
+func (e *deviceEndpoint) Wait() {
+	e.wg.Wait()
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package gvisor
 
 import (
@@ -7,8 +10,8 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
 )
 
 // bufConfig defines the shape of the vectorised view used to read packets from the NIC.
@@ -109,6 +112,8 @@ type readVDispatcher struct {
 
 	// buf is the iovec buffer that contains the packet contents.
 	buf *iovecBuffer
+
+	poller comm.BusyPoller
 }
 
 func newReadVDispatcher(fd int, e *rwEndpoint) (*readVDispatcher, error) {
@@ -127,7 +132,7 @@ func newReadVDispatcher(fd int, e *rwEndpoint) (*readVDispatcher, error) {
 
 // dispatch reads one packet from the file descriptor and dispatches it.
 func (d *readVDispatcher) dispatch() (bool, tcpip.Error) {
-	n, err := rawfile.BlockingReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
+	n, err := d.poller.ReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
 	if n <= 0 || err != nil {
 		return false, err
 	}
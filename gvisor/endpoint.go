@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package gvisor
 
 import (
@@ -8,6 +11,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
 )
 
 var _ stack.InjectableLinkEndpoint = (*rwEndpoint)(nil)
@@ -58,6 +62,9 @@ func (e *rwEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
 		e.dispatcher = dispatcher
 		e.wg.Add(1)
 		go func() {
+			if err := comm.PinPacketThread(); err != nil {
+				newError("failed to pin packet thread").Base(err).AtWarning().WriteToLog()
+			}
 			e.dispatchLoop(e.inbound)
 			e.wg.Done()
 		}()
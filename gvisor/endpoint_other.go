@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package gvisor
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// newRwEndpoint fails on platforms where the tun is not a file descriptor,
+// NewWithDevice is used instead.
+func newRwEndpoint(dev int32, mtu int32) (stack.LinkEndpoint, error) {
+	return nil, newError("tun file descriptors are not supported on this platform")
+}
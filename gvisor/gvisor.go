@@ -2,13 +2,10 @@ package gvisor
 
 import (
 	"errors"
-	"io"
-	"os"
 
 	"github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -25,29 +22,46 @@ var _ tun.Tun = (*GVisor)(nil)
 
 type GVisor struct {
 	Endpoint stack.LinkEndpoint
-	PcapFile *os.File
 	Stack    *stack.Stack
+
+	endpoints  *endpointRegistry
+	advertiser *raEndpoint
 }
 
 func (t *GVisor) Close() error {
-	t.Stack.Close()
-	if t.PcapFile != nil {
-		_ = t.PcapFile.Close()
+	t.endpoints.close()
+	if t.advertiser != nil {
+		t.advertiser.close()
 	}
+	t.Stack.Close()
 	return nil
 }
 
 const DefaultNIC tcpip.NICID = 0x01
 
-func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool, pcapFile *os.File, snapLen uint32, ipv6Mode int32) (*GVisor, error) {
-	var endpoint stack.LinkEndpoint
-	endpoint, _ = newRwEndpoint(dev, mtu)
-	if pcap {
-		pcapEndpoint, err := sniffer.NewWithWriter(endpoint, &pcapFileWrapper{pcapFile}, snapLen)
-		if err != nil {
-			return nil, err
-		}
-		endpoint = pcapEndpoint
+// New creates the stack on the tun fd, advertisement enables router
+// advertisements if not nil and IPv6 is enabled.
+func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, capture tun.PacketCapture, ipv6Mode int32, advertisement *RouterAdvertisement) (*GVisor, error) {
+	endpoint, err := newRwEndpoint(dev, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return newStack(endpoint, handler, nicId, capture, ipv6Mode, advertisement)
+}
+
+// NewWithDevice creates the stack on a wintun or utun device, see New.
+func NewWithDevice(device tun.Device, handler tun.Handler, nicId tcpip.NICID, capture tun.PacketCapture, ipv6Mode int32, advertisement *RouterAdvertisement) (*GVisor, error) {
+	return newStack(newDeviceEndpoint(device), handler, nicId, capture, ipv6Mode, advertisement)
+}
+
+func newStack(endpoint stack.LinkEndpoint, handler tun.Handler, nicId tcpip.NICID, capture tun.PacketCapture, ipv6Mode int32, advertisement *RouterAdvertisement) (*GVisor, error) {
+	if capture != nil {
+		endpoint = newCaptureEndpoint(endpoint, capture)
+	}
+	var advertiser *raEndpoint
+	if advertisement != nil && ipv6Mode != comm.IPv6Disable {
+		advertiser = newRaEndpoint(endpoint, *advertisement)
+		endpoint = advertiser
 	}
 	var o stack.Options
 	switch ipv6Mode {
@@ -98,26 +112,15 @@ func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool
 			NIC:         nicId,
 		},
 	})
-	gTcpHandler(s, handler)
+	endpoints := newEndpointRegistry()
+	gTcpHandler(s, handler, endpoints)
 	gUdpHandler(s, handler)
 	gIcmpHandler(s, endpoint, handler)
 	gMust(s.CreateNIC(nicId, endpoint))
 	gMust(s.SetSpoofing(nicId, true))
 	gMust(s.SetPromiscuousMode(nicId, true))
 
-	return &GVisor{endpoint, pcapFile, s}, nil
-}
-
-type pcapFileWrapper struct {
-	io.Writer
-}
-
-func (w *pcapFileWrapper) Write(p []byte) (n int, err error) {
-	n, err = w.Writer.Write(p)
-	if err != nil {
-		logrus.Debug("write pcap file failed: ", err)
-	}
-	return n, nil
+	return &GVisor{endpoint, s, endpoints, advertiser}, nil
 }
 
 func gMust(err tcpip.Error) {
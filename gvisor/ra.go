@@ -0,0 +1,234 @@
+package gvisor
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// RouterAdvertisement configures the router advertisements sent on the nic,
+// for guests sharing the tun which configure IPv6 by SLAAC, and the stateless
+// DHCPv6 replies carrying the dns servers.
+type RouterAdvertisement struct {
+	Prefix *net.IPNet
+	Dns    []net.IP
+	MTU    uint32
+}
+
+const (
+	raInterval         = 10 * time.Minute
+	raRouterLifetime   = 1800
+	raValidLifetime    = 86400
+	raPreferedLifetime = 14400
+	raDnsLifetime      = 1800
+
+	raFlagOtherConfig = 0x40
+	raPrefixOnLink    = 0x80
+	raPrefixAutonomus = 0x40
+
+	ndpOptionPrefix = 3
+	ndpOptionMTU    = 5
+	ndpOptionRDNSS  = 25
+
+	dhcp6ClientPort         = 546
+	dhcp6ServerPort         = 547
+	dhcp6Reply              = 7
+	dhcp6InformationRequest = 11
+	dhcp6OptionClientId     = 1
+	dhcp6OptionServerId     = 2
+	dhcp6OptionDns          = 23
+)
+
+// raRouterAddress is the link local source of the advertisements, guests
+// use it as their default gateway.
+var raRouterAddress = tcpip.Address(net.ParseIP("fe80::1"))
+
+// dhcp6ServerDuid is a DUID-LL with a locally administered address.
+var dhcp6ServerDuid = []byte{0, 3, 0, 1, 0x02, 0, 0, 0, 0, 0x01}
+
+// raEndpoint answers router solicitations and DHCPv6 information requests
+// read from the device, other packets are passed to the stack.
+type raEndpoint struct {
+	nested.Endpoint
+	config RouterAdvertisement
+	done   chan struct{}
+}
+
+func newRaEndpoint(lower stack.LinkEndpoint, config RouterAdvertisement) *raEndpoint {
+	endpoint := &raEndpoint{config: config, done: make(chan struct{})}
+	endpoint.Endpoint.Init(lower, endpoint)
+	go endpoint.loop()
+	return endpoint
+}
+
+func (e *raEndpoint) close() {
+	close(e.done)
+}
+
+func (e *raEndpoint) loop() {
+	ticker := time.NewTicker(raInterval)
+	defer ticker.Stop()
+	e.advertise(header.IPv6AllNodesMulticastAddress)
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			e.advertise(header.IPv6AllNodesMulticastAddress)
+		}
+	}
+}
+
+func (e *raEndpoint) DeliverNetworkPacket(remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if protocol == header.IPv6ProtocolNumber && e.handlePacket(pkt) {
+		return
+	}
+	e.Endpoint.DeliverNetworkPacket(remote, local, protocol, pkt)
+}
+
+func (e *raEndpoint) handlePacket(pkt *stack.PacketBuffer) bool {
+	view, ok := pkt.Data().PullUp(header.IPv6MinimumSize + header.UDPMinimumSize)
+	if !ok {
+		return false
+	}
+	ipHdr := header.IPv6(view)
+	source := ipHdr.SourceAddress()
+	switch ipHdr.TransportProtocol() {
+	case header.ICMPv6ProtocolNumber:
+		if header.ICMPv6(ipHdr.Payload()).Type() != header.ICMPv6RouterSolicit {
+			return false
+		}
+		destination := source
+		if source == header.IPv6Any {
+			destination = header.IPv6AllNodesMulticastAddress
+		}
+		e.advertise(destination)
+		return true
+	case header.UDPProtocolNumber:
+		udpHdr := header.UDP(ipHdr.Payload())
+		if udpHdr.DestinationPort() != dhcp6ServerPort || len(e.config.Dns) == 0 {
+			return false
+		}
+		packet := make([]byte, 0, pkt.Data().Size())
+		for _, v := range pkt.Data().Views() {
+			packet = append(packet, v...)
+		}
+		if len(packet) < header.IPv6MinimumSize+header.UDPMinimumSize+4 {
+			return true
+		}
+		e.replyDhcp6(source, packet[header.IPv6MinimumSize+header.UDPMinimumSize:])
+		return true
+	}
+	return false
+}
+
+func (e *raEndpoint) advertise(destination tcpip.Address) {
+	message := make([]byte, header.ICMPv6HeaderSize+12)
+	message[0] = byte(header.ICMPv6RouterAdvert)
+	message[4] = 64
+	if len(e.config.Dns) > 0 {
+		message[5] = raFlagOtherConfig
+	}
+	binary.BigEndian.PutUint16(message[6:], raRouterLifetime)
+
+	if e.config.Prefix != nil {
+		prefixLength, _ := e.config.Prefix.Mask.Size()
+		option := make([]byte, 32)
+		option[0], option[1] = ndpOptionPrefix, 4
+		option[2] = byte(prefixLength)
+		option[3] = raPrefixOnLink | raPrefixAutonomus
+		binary.BigEndian.PutUint32(option[4:], raValidLifetime)
+		binary.BigEndian.PutUint32(option[8:], raPreferedLifetime)
+		copy(option[16:], e.config.Prefix.IP.To16())
+		message = append(message, option...)
+	}
+	if e.config.MTU > 0 {
+		option := make([]byte, 8)
+		option[0], option[1] = ndpOptionMTU, 1
+		binary.BigEndian.PutUint32(option[4:], e.config.MTU)
+		message = append(message, option...)
+	}
+	if len(e.config.Dns) > 0 {
+		option := make([]byte, 8, 8+16*len(e.config.Dns))
+		option[0], option[1] = ndpOptionRDNSS, byte(1+2*len(e.config.Dns))
+		binary.BigEndian.PutUint32(option[4:], raDnsLifetime)
+		for _, dns := range e.config.Dns {
+			option = append(option, dns.To16()...)
+		}
+		message = append(message, option...)
+	}
+
+	icmpHdr := header.ICMPv6(message)
+	icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmpHdr,
+		Src:    raRouterAddress,
+		Dst:    destination,
+	}))
+	e.write(header.ICMPv6ProtocolNumber, destination, message)
+}
+
+// replyDhcp6 answers an information request with the dns servers, the
+// addresses themselves are configured by SLAAC.
+func (e *raEndpoint) replyDhcp6(destination tcpip.Address, request []byte) {
+	if request[0] != dhcp6InformationRequest {
+		return
+	}
+	reply := []byte{dhcp6Reply, request[1], request[2], request[3]}
+	for options := request[4:]; len(options) >= 4; {
+		code := binary.BigEndian.Uint16(options)
+		length := int(binary.BigEndian.Uint16(options[2:]))
+		if 4+length > len(options) {
+			break
+		}
+		if code == dhcp6OptionClientId {
+			reply = append(reply, options[:4+length]...)
+		}
+		options = options[4+length:]
+	}
+	reply = appendDhcp6Option(reply, dhcp6OptionServerId, dhcp6ServerDuid)
+	var servers []byte
+	for _, dns := range e.config.Dns {
+		servers = append(servers, dns.To16()...)
+	}
+	reply = appendDhcp6Option(reply, dhcp6OptionDns, servers)
+
+	message := make([]byte, header.UDPMinimumSize, header.UDPMinimumSize+len(reply))
+	message = append(message, reply...)
+	udpHdr := header.UDP(message)
+	udpHdr.Encode(&header.UDPFields{
+		SrcPort: dhcp6ServerPort,
+		DstPort: dhcp6ClientPort,
+		Length:  uint16(len(message)),
+	})
+	checksum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, raRouterAddress, destination, uint16(len(message)))
+	udpHdr.SetChecksum(^header.Checksum(message, checksum))
+	e.write(header.UDPProtocolNumber, destination, message)
+}
+
+func appendDhcp6Option(message []byte, code uint16, value []byte) []byte {
+	message = append(message, byte(code>>8), byte(code), byte(len(value)>>8), byte(len(value)))
+	return append(message, value...)
+}
+
+func (e *raEndpoint) write(protocol tcpip.TransportProtocolNumber, destination tcpip.Address, payload []byte) {
+	packet := make([]byte, header.IPv6MinimumSize, header.IPv6MinimumSize+len(payload))
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(payload)),
+		TransportProtocol: protocol,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           raRouterAddress,
+		DstAddr:           destination,
+	})
+	packet = append(packet, payload...)
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(packet).ToVectorisedView()})
+	defer pkt.DecRef()
+	if err := e.WritePacket(stack.RouteInfo{}, header.IPv6ProtocolNumber, pkt); err != nil {
+		newError("failed to write router advertisement: ", err.String()).AtDebug().WriteToLog()
+	}
+}
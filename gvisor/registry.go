@@ -0,0 +1,162 @@
+package gvisor
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	janitorInterval = time.Minute
+	// orphanTimeout is how long a closed endpoint, or one whose handler has
+	// returned, may stay registered before it is force closed.
+	orphanTimeout = time.Minute
+)
+
+type endpointEntry struct {
+	id          uint64
+	source      string
+	destination string
+	created     time.Time
+	endpoint    tcpip.Endpoint
+	conn        net.Conn
+	orphanedAt  time.Time
+}
+
+// endpointRegistry keeps every live tcp endpoint created by the forwarder so
+// leaks can be found and cleaned up.
+type endpointRegistry struct {
+	access  sync.Mutex
+	nextID  uint64
+	entries map[uint64]*endpointEntry
+	done    chan struct{}
+}
+
+func newEndpointRegistry() *endpointRegistry {
+	r := &endpointRegistry{
+		entries: make(map[uint64]*endpointEntry),
+		done:    make(chan struct{}),
+	}
+	go r.janitor()
+	return r
+}
+
+func (r *endpointRegistry) add(source string, destination string, endpoint tcpip.Endpoint, conn net.Conn) uint64 {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.nextID++
+	r.entries[r.nextID] = &endpointEntry{
+		id:          r.nextID,
+		source:      source,
+		destination: destination,
+		created:     time.Now(),
+		endpoint:    endpoint,
+		conn:        conn,
+	}
+	return r.nextID
+}
+
+// release is called when the handler returns, the endpoint is closed if the
+// handler left it open.
+func (r *endpointRegistry) release(id uint64) {
+	r.access.Lock()
+	entry, ok := r.entries[id]
+	if ok {
+		delete(r.entries, id)
+	}
+	r.access.Unlock()
+	if ok {
+		_ = entry.conn.Close()
+	}
+}
+
+func (r *endpointRegistry) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.sweep(now)
+		}
+	}
+}
+
+func (r *endpointRegistry) sweep(now time.Time) {
+	var orphans []*endpointEntry
+	r.access.Lock()
+	for id, entry := range r.entries {
+		if !isClosedState(entry.endpoint.State()) {
+			entry.orphanedAt = time.Time{}
+			continue
+		}
+		if entry.orphanedAt.IsZero() {
+			entry.orphanedAt = now
+			continue
+		}
+		if now.Sub(entry.orphanedAt) >= orphanTimeout {
+			delete(r.entries, id)
+			orphans = append(orphans, entry)
+		}
+	}
+	r.access.Unlock()
+
+	for _, entry := range orphans {
+		newError("force closing orphaned endpoint ", entry.source, " -> ", entry.destination, " after ", now.Sub(entry.created).Round(time.Second)).AtWarning().WriteToLog()
+		entry.endpoint.Abort()
+		_ = entry.conn.Close()
+	}
+}
+
+func isClosedState(state uint32) bool {
+	switch tcp.EndpointState(state) {
+	case tcp.StateClose, tcp.StateError, tcp.StateTimeWait:
+		return true
+	}
+	return false
+}
+
+func (r *endpointRegistry) close() {
+	close(r.done)
+	r.access.Lock()
+	entries := r.entries
+	r.entries = make(map[uint64]*endpointEntry)
+	r.access.Unlock()
+	for _, entry := range entries {
+		_ = entry.conn.Close()
+	}
+}
+
+func (r *endpointRegistry) dump() string {
+	r.access.Lock()
+	entries := make([]*endpointEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	r.access.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+
+	now := time.Now()
+	var builder strings.Builder
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(&builder, "#%d tcp %s -> %s age=%s state=%s\n",
+			entry.id, entry.source, entry.destination, now.Sub(entry.created).Round(time.Second),
+			tcp.EndpointState(entry.endpoint.State()))
+	}
+	return builder.String()
+}
+
+// DumpEndpoints lists the live tcp endpoints of the stack with their age and
+// state, for debugging leaks.
+func (t *GVisor) DumpEndpoints() string {
+	return t.endpoints.dump()
+}
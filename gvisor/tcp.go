@@ -13,7 +13,7 @@ import (
 	"libcore/tun"
 )
 
-func gTcpHandler(s *stack.Stack, handler tun.Handler) {
+func gTcpHandler(s *stack.Stack, handler tun.Handler, endpoints *endpointRegistry) {
 	forwarder := tcp.NewForwarder(s, 0, 1024, func(request *tcp.ForwarderRequest) {
 		id := request.ID()
 		waitQueue := new(waiter.Queue)
@@ -37,7 +37,12 @@ func gTcpHandler(s *stack.Stack, handler tun.Handler) {
 			newError("[TCP] parse destination address ", dstAddr, " failed: ", err).AtWarning().WriteToLog()
 			return
 		}
-		go handler.NewConnection(src, dst, gonet.NewTCPConn(waitQueue, endpoint))
+		conn := gonet.NewTCPConn(waitQueue, endpoint)
+		entryID := endpoints.add(srcAddr, dstAddr, endpoint, conn)
+		go func() {
+			handler.NewConnection(src, dst, conn)
+			endpoints.release(entryID)
+		}()
 	})
 	s.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
 }
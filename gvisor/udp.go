@@ -48,12 +48,18 @@ func gUdpHandler(s *stack.Stack, handler tun.Handler) {
 			IP:   dst.Address.IP(),
 			Port: int(dst.Port),
 		}
-		go handler.NewPacket(src, dst, data.ToView(), func(bytes []byte, addr *net.UDPAddr) (int, error) {
+		writeBack := func(bytes []byte, addr *net.UDPAddr) (int, error) {
 			if addr == nil {
 				addr = destUdpAddr
 			}
 			return packet.WriteBack(bytes, addr)
-		}, nil)
+		}
+		if tcHandler, ok := handler.(tun.TrafficClassHandler); ok {
+			tos, _ := buffer.Network().TOS()
+			go tcHandler.NewPacketWithTrafficClass(src, dst, tos, data.ToView(), writeBack, nil)
+		} else {
+			go handler.NewPacket(src, dst, data.ToView(), writeBack, nil)
+		}
 		return true
 	})
 }
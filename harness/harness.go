@@ -0,0 +1,285 @@
+// Package harness runs tcp, udp, http and icmp traffic through the whole
+// Tun2ray path, from a userspace client stack over the packet flow to a
+// freedom outbound and local echo servers. It needs neither a tun device nor
+// root, so the tests of this package run with go test in CI.
+package harness
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"libcore"
+	"libcore/comm"
+)
+
+const (
+	clientNIC   tcpip.NICID = 1
+	harnessMTU              = 1500
+	httpBody                = "libcore harness"
+	icmpEchoId              = 0x4c43
+	tcpPayload              = 256 * 1024
+	udpDatagram             = 1200
+	udpRounds               = 8
+)
+
+var (
+	// clientAddress is the address of the client stack, the side of the tun
+	// the apps are on.
+	clientAddress = tcpip.Address(net.IPv4(172, 19, 0, 1).To4())
+	// targetAddress is a documentation address the freedom outbound
+	// redirects to the loopback servers.
+	targetAddress = tcpip.Address(net.IPv4(203, 0, 113, 1).To4())
+)
+
+const config = `{
+  "log": {"loglevel": "warning"},
+  "outbounds": [
+    {"protocol": "freedom", "tag": "direct", "settings": {"redirect": "127.0.0.1:0"}}
+  ]
+}`
+
+// env is a running instance with the tun in front of it, the client stack
+// behind the tun and the servers the freedom outbound redirects to.
+type env struct {
+	servers  *servers
+	client   *clientStack
+	instance *libcore.V2RayInstance
+	tun      *libcore.Tun2ray
+}
+
+// newEnv sets up the servers, the instance and the tun, close releases them
+// in reverse order.
+func newEnv() (*env, error) {
+	e := new(env)
+	var err error
+	if e.servers, err = startServers(); err != nil {
+		return nil, err
+	}
+	e.instance = libcore.NewV2rayInstance()
+	if err = e.instance.LoadConfig(config); err != nil {
+		e.close()
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if err = e.instance.Start(); err != nil {
+		e.close()
+		return nil, fmt.Errorf("start instance: %w", err)
+	}
+	e.client = newClientStack()
+	e.tun, err = libcore.NewTun2ray(&libcore.TunConfig{
+		MTU:            harnessMTU,
+		V2Ray:          e.instance,
+		Gateway4:       "172.19.0.2",
+		Gateway6:       "fdfe:dcba:9876::2",
+		IPv6Mode:       comm.IPv6Disable,
+		Implementation: comm.TunImplementationPacketFlow,
+		PacketFlow:     e.client,
+		ErrorHandler:   e.client,
+	})
+	if err != nil {
+		e.close()
+		return nil, fmt.Errorf("start tun: %w", err)
+	}
+	go e.client.forward(e.tun)
+	return e, nil
+}
+
+func (e *env) close() {
+	if e.tun != nil {
+		e.tun.Close()
+	}
+	if e.client != nil {
+		e.client.close()
+	}
+	if e.instance != nil {
+		e.instance.Close()
+	}
+	e.servers.close()
+}
+
+// servers echo tcp and udp on the same port and answer http on another.
+type servers struct {
+	tcp      net.Listener
+	udp      net.PacketConn
+	http     *http.Server
+	httpPort uint16
+}
+
+func startServers() (*servers, error) {
+	s := new(servers)
+	var err error
+	// bind udp first, the tcp port of the same number is usually free
+	if s.udp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	port := s.udp.LocalAddr().(*net.UDPAddr).Port
+	if s.tcp, err = net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+		s.udp.Close()
+		return nil, err
+	}
+	httpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.httpPort = uint16(httpListener.Addr().(*net.TCPAddr).Port)
+	s.http = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, httpBody)
+	})}
+	go func() {
+		_ = s.http.Serve(httpListener)
+	}()
+	go func() {
+		for {
+			conn, err := s.tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := s.udp.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = s.udp.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return s, nil
+}
+
+func (s *servers) echoPort() uint16 {
+	return uint16(s.udp.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (s *servers) close() {
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+}
+
+// clientStack plays the system side of the tun, its packets are passed to
+// Tun2ray.InputPacket and the packets of Tun2ray are injected into it.
+type clientStack struct {
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	cancel   context.CancelFunc
+	ctx      context.Context
+	replies  chan uint16
+}
+
+func newClientStack() *clientStack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	endpoint := channel.New(512, harnessMTU, "")
+	if err := s.CreateNIC(clientNIC, endpoint); err != nil {
+		panic(err.String())
+	}
+	_ = s.AddProtocolAddress(clientNIC, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: clientAddress, PrefixLen: 30},
+	}, stack.AddressProperties{})
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: clientNIC}})
+	ctx, cancel := context.WithCancel(context.Background())
+	return &clientStack{stack: s, endpoint: endpoint, ctx: ctx, cancel: cancel, replies: make(chan uint16, 16)}
+}
+
+// forward passes the packets of the client stack to the tun.
+func (c *clientStack) forward(tun *libcore.Tun2ray) {
+	for {
+		info, ok := c.endpoint.ReadContext(c.ctx)
+		if !ok {
+			return
+		}
+		packet := make([]byte, 0, info.Pkt.Size())
+		for _, view := range info.Pkt.Views() {
+			packet = append(packet, view...)
+		}
+		info.Pkt.DecRef()
+		tun.InputPacket(packet)
+	}
+}
+
+// WritePacket implements libcore.PacketFlow, echo replies for the icmp check
+// are reported before the client stack drops them.
+func (c *clientStack) WritePacket(packet []byte) error {
+	if ipHdr := header.IPv4(packet); len(packet) >= header.IPv4MinimumSize+header.ICMPv4MinimumSize &&
+		ipHdr.IsValid(len(packet)) && ipHdr.TransportProtocol() == header.ICMPv4ProtocolNumber {
+		icmpHdr := header.ICMPv4(ipHdr.Payload())
+		if icmpHdr.Type() == header.ICMPv4EchoReply && icmpHdr.Ident() == icmpEchoId {
+			select {
+			case c.replies <- icmpHdr.Sequence():
+			default:
+			}
+		}
+	}
+	data := make([]byte, len(packet))
+	copy(data, packet)
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(data).ToVectorisedView()})
+	c.endpoint.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+	return nil
+}
+
+// HandleError implements libcore.ErrorHandler.
+func (c *clientStack) HandleError(err string) {
+}
+
+func (c *clientStack) close() {
+	c.cancel()
+	c.stack.Close()
+}
+
+func (c *clientStack) target(port uint16) tcpip.FullAddress {
+	return tcpip.FullAddress{NIC: clientNIC, Addr: targetAddress, Port: port}
+}
+
+func (c *clientStack) sendEcho(sequence uint16) {
+	payload := []byte("libcore harness ping")
+	packet := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(payload))
+	ipHdr := header.IPv4(packet)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     clientAddress,
+		DstAddr:     targetAddress,
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	icmpHdr := header.ICMPv4(ipHdr.Payload())
+	icmpHdr.SetType(header.ICMPv4Echo)
+	binary.BigEndian.PutUint16(icmpHdr[4:], icmpEchoId)
+	binary.BigEndian.PutUint16(icmpHdr[6:], sequence)
+	copy(icmpHdr[header.ICMPv4MinimumSize:], payload)
+	icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr[:header.ICMPv4MinimumSize], header.Checksum(payload, 0)))
+	info := stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(packet).ToVectorisedView()})
+	defer info.DecRef()
+	_ = c.endpoint.WritePacket(stack.RouteInfo{}, ipv4.ProtocolNumber, info)
+}
@@ -0,0 +1,149 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+const checkTimeout = 30 * time.Second
+
+// run sets up an environment and runs check against it within checkTimeout.
+func run(t *testing.T, check func(ctx context.Context, c *clientStack, s *servers) error) {
+	e, err := newEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	if err = check(ctx, e.client, e.servers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	run(t, checkTCP)
+}
+
+func TestUDP(t *testing.T) {
+	run(t, checkUDP)
+}
+
+func TestHTTP(t *testing.T) {
+	run(t, checkHTTP)
+}
+
+func TestICMP(t *testing.T) {
+	run(t, checkICMP)
+}
+
+func checkTCP(ctx context.Context, c *clientStack, s *servers) error {
+	conn, err := gonet.DialContextTCP(ctx, c.stack, c.target(s.echoPort()), ipv4.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	payload := make([]byte, tcpPayload)
+	_, _ = rand.Read(payload)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		writeErr <- err
+	}()
+	echo := make([]byte, len(payload))
+	if _, err = io.ReadFull(conn, echo); err != nil {
+		return fmt.Errorf("read echo: %w", err)
+	}
+	if err = <-writeErr; err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if !bytes.Equal(payload, echo) {
+		return fmt.Errorf("echo differs from the payload")
+	}
+	return nil
+}
+
+func checkUDP(ctx context.Context, c *clientStack, s *servers) error {
+	target := c.target(s.echoPort())
+	conn, err := gonet.DialUDP(c.stack, nil, &target, ipv4.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	payload := make([]byte, udpDatagram)
+	echo := make([]byte, udpDatagram+1)
+	for round := 0; round < udpRounds; round++ {
+		_, _ = rand.Read(payload)
+		if _, err = conn.Write(payload); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		n, err := conn.Read(echo)
+		if err != nil {
+			return fmt.Errorf("read echo %d: %w", round, err)
+		}
+		if !bytes.Equal(payload, echo[:n]) {
+			return fmt.Errorf("echo %d differs from the payload", round)
+		}
+	}
+	return nil
+}
+
+func checkHTTP(ctx context.Context, c *clientStack, s *servers) error {
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return gonet.DialContextTCP(ctx, c.stack, c.target(s.httpPort), ipv4.ProtocolNumber)
+		},
+	}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://harness.test/", nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK || string(body) != httpBody {
+		return fmt.Errorf("unexpected response %s: %q", response.Status, body)
+	}
+	return nil
+}
+
+// checkICMP sends echo requests until one is answered, by the outbound or
+// by the stack of Tun2ray if the outbound can not ping.
+func checkICMP(ctx context.Context, c *clientStack, _ *servers) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for sequence := uint16(1); ; sequence++ {
+		c.sendEcho(sequence)
+		select {
+		case <-c.replies:
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("no echo reply: %w", ctx.Err())
+		}
+	}
+}
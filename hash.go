@@ -0,0 +1,61 @@
+package libcore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// hashProgressStep is how many bytes are hashed between progress callbacks.
+const hashProgressStep = 4 << 20
+
+type HashProgress interface {
+	OnProgress(processed int64, total int64)
+}
+
+// Sha256File returns the hex encoded sha256 of the file at path, streaming it
+// instead of loading it into memory. progress may be nil.
+func Sha256File(path string, progress HashProgress) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", exportError(newError("open ", path).Base(err))
+	}
+	defer file.Close()
+	var total int64
+	if info, err := file.Stat(); err == nil {
+		total = info.Size()
+	}
+
+	hash := sha256.New()
+	var processed int64
+	for {
+		n, err := io.CopyN(hash, file, hashProgressStep)
+		processed += n
+		if progress != nil && n > 0 {
+			progress.OnProgress(processed, total)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", exportError(newError("read ", path).Base(err))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyChecksumFile returns whether the sha256 of the file at path is
+// expected, which may also be a sha256sum line ("<hash>  <name>").
+func VerifyChecksumFile(path string, expected string, progress HashProgress) (bool, error) {
+	fields := strings.Fields(expected)
+	if len(fields) == 0 {
+		return false, withCode(ErrorCodeInvalidArgument, newError("empty checksum"))
+	}
+	sum, err := Sha256File(path, progress)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(sum, fields[0]), nil
+}
@@ -0,0 +1,189 @@
+package libcore
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5/common/strmatcher"
+)
+
+const hostsTTL = 60
+
+var hosts = new(hostsMap)
+
+type hostsEntry struct {
+	ips   []net.IP
+	alias string
+}
+
+type hostsMap struct {
+	access  sync.RWMutex
+	path    string
+	entries []*hostsEntry
+	full    strmatcher.FullMatcherGroup
+	domain  strmatcher.DomainMatcherGroup
+}
+
+// LoadHostsFile loads a hosts file and remembers its path for ReloadHosts.
+//
+// Each line is "<value> <domain> [domain...]", where value is either an ip
+// address or another domain name to alias to. A domain prefixed with "*."
+// matches all of its subdomains, but not the domain itself.
+func LoadHostsFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return exportError(newError("open hosts file").Base(err))
+	}
+	defer file.Close()
+	err = hosts.load(file)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, err)
+	}
+	hosts.access.Lock()
+	hosts.path = path
+	hosts.access.Unlock()
+	return nil
+}
+
+// SetHosts loads hosts entries from content in the same format as LoadHostsFile.
+func SetHosts(content string) error {
+	err := hosts.load(strings.NewReader(content))
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, err)
+	}
+	hosts.access.Lock()
+	hosts.path = ""
+	hosts.access.Unlock()
+	return nil
+}
+
+func ReloadHosts() error {
+	hosts.access.RLock()
+	path := hosts.path
+	hosts.access.RUnlock()
+	if path == "" {
+		return nil
+	}
+	return LoadHostsFile(path)
+}
+
+func ClearHosts() {
+	hosts.access.Lock()
+	defer hosts.access.Unlock()
+	hosts.path = ""
+	hosts.entries = nil
+	hosts.full = strmatcher.FullMatcherGroup{}
+	hosts.domain = strmatcher.DomainMatcherGroup{}
+}
+
+func (h *hostsMap) load(reader io.Reader) error {
+	var entries []*hostsEntry
+	var full strmatcher.FullMatcherGroup
+	var domain strmatcher.DomainMatcherGroup
+	names := make(map[string]*hostsEntry)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value := fields[0]
+		ip := net.ParseIP(value)
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			entry, loaded := names[name]
+			if !loaded {
+				entry = &hostsEntry{}
+				names[name] = entry
+				index := uint32(len(entries))
+				entries = append(entries, entry)
+				if strings.HasPrefix(name, "*.") {
+					domain.AddDomainMatcher(strmatcher.DomainMatcher(name[2:]), index)
+				} else {
+					full.AddFullMatcher(strmatcher.FullMatcher(name), index)
+				}
+			}
+			if ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				entry.ips = append(entry.ips, ip)
+			} else if entry.alias == "" {
+				entry.alias = strings.ToLower(strings.TrimSuffix(value, "."))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return newError("read hosts").Base(err)
+	}
+
+	h.access.Lock()
+	h.entries = entries
+	h.full = full
+	h.domain = domain
+	h.access.Unlock()
+
+	logrus.Debug("loaded ", len(entries), " hosts entries")
+	return nil
+}
+
+func (h *hostsMap) lookup(domain string) *hostsEntry {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	h.access.RLock()
+	defer h.access.RUnlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	if matches := h.full.Match(domain); len(matches) > 0 {
+		return h.entries[matches[0]]
+	}
+	// wildcards match the parent, so that they leave out the domain itself
+	if dot := strings.IndexByte(domain, '.'); dot >= 0 {
+		if matches := h.domain.Match(domain[dot+1:]); len(matches) > 0 {
+			return h.entries[matches[0]]
+		}
+	}
+	return nil
+}
+
+// lookupIP resolves domain from hosts, following aliases inside the map.
+// It returns the final name when the alias chain leaves the map.
+func (h *hostsMap) lookupIP(domain string, network string) (ips []net.IP, alias string, ok bool) {
+	for i := 0; i < 8; i++ {
+		entry := h.lookup(domain)
+		if entry == nil {
+			if i == 0 {
+				return nil, "", false
+			}
+			return nil, domain, true
+		}
+		if len(entry.ips) > 0 {
+			return filterIPs(entry.ips, network), "", true
+		}
+		domain = entry.alias
+	}
+	return nil, "", true
+}
+
+func filterIPs(ips []net.IP, network string) []net.IP {
+	if network != "ip4" && network != "ip6" {
+		return ips
+	}
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "ip4") {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,45 @@
+package libcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostsLookup(t *testing.T) {
+	h := new(hostsMap)
+	err := h.load(strings.NewReader(`
+1.1.1.1 example.com
+2.2.2.2 *.example.com
+3.3.3.3 *.wildcard.test
+alias.test *.alias.test # comment
+4.4.4.4 alias.test
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		domain string
+		ip     string
+	}{
+		{"example.com", "1.1.1.1"},
+		{"Example.COM.", "1.1.1.1"},
+		{"www.example.com", "2.2.2.2"},
+		{"a.b.example.com", "2.2.2.2"},
+		{"sub.wildcard.test", "3.3.3.3"},
+		{"wildcard.test", ""},
+		{"test", ""},
+		{"other.com", ""},
+		{"www.alias.test", "4.4.4.4"},
+	} {
+		ips, _, ok := h.lookupIP(test.domain, "ip")
+		if test.ip == "" {
+			if ok {
+				t.Errorf("%s: matched %v", test.domain, ips)
+			}
+			continue
+		}
+		if !ok || len(ips) != 1 || ips[0].String() != test.ip {
+			t.Errorf("%s: got %v, want %s", test.domain, ips, test.ip)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/common/task"
+	"github.com/v2fly/v2ray-core/v5/transport"
+)
+
+const (
+	httpProxyHandshakeTimeout = 30 * time.Second
+	httpProxyMaxRounds        = 4
+)
+
+// HttpProxyConfig is an upstream http proxy reached with CONNECT, for
+// networks which only allow their web proxy out.
+type HttpProxyConfig struct {
+	Tag    string
+	Server string
+	// Tls connects to the proxy over tls, verifying ServerName or the host of
+	// Server.
+	Tls        bool
+	ServerName string
+	// Username may be given as DOMAIN\user for NTLM.
+	Username string
+	Password string
+	Domain   string
+	// Via is the outbound the proxy is reached through, the system dialer is
+	// used if it is empty.
+	Via string
+}
+
+// HttpProxyAuthenticator supplies SPNEGO tokens for the Negotiate scheme,
+// e.g. from the Kerberos credentials of the device. Without it Negotiate is
+// answered with NTLM messages.
+type HttpProxyAuthenticator interface {
+	// NegotiateToken returns the base64 token for the proxy host, challenge is
+	// the base64 token of the proxy or empty in the first round.
+	NegotiateToken(host string, challenge string) (string, error)
+}
+
+// httpProxyHandler is an outbound tunneling tcp connections through CONNECT
+// requests, other outbounds can chain through it with proxySettings.
+type httpProxyHandler struct {
+	instance      *V2RayInstance
+	config        HttpProxyConfig
+	server        v2rayNet.Destination
+	authenticator HttpProxyAuthenticator
+	// scheme is the last accepted auth scheme, basic credentials are sent
+	// along the first request once the proxy asked for them.
+	scheme atomic.Value
+}
+
+// AddHttpProxyOutbound registers an http proxy outbound, replacing the one
+// with the same tag.
+func (instance *V2RayInstance) AddHttpProxyOutbound(config *HttpProxyConfig, authenticator HttpProxyAuthenticator) error {
+	if instance.outboundManager == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	if config == nil || config.Tag == "" {
+		return withCode(ErrorCodeInvalidArgument, newError("missing tag"))
+	}
+	server, err := v2rayNet.ParseDestination("tcp:" + config.Server)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid http proxy server ", config.Server).Base(err))
+	}
+	handler := &httpProxyHandler{
+		instance:      instance,
+		config:        *config,
+		server:        server,
+		authenticator: authenticator,
+	}
+	handler.scheme.Store("")
+	if err = instance.outboundManager.AddHandler(context.Background(), handler); err != nil {
+		return exportError(err)
+	}
+	return nil
+}
+
+func (instance *V2RayInstance) RemoveHttpProxyOutbound(tag string) {
+	if instance.outboundManager == nil {
+		return
+	}
+	if handler, ok := instance.outboundManager.GetHandler(tag).(*httpProxyHandler); ok {
+		_ = instance.outboundManager.RemoveHandler(context.Background(), tag)
+		_ = handler.Close()
+	}
+}
+
+func (h *httpProxyHandler) Tag() string {
+	return h.config.Tag
+}
+
+func (h *httpProxyHandler) Start() error {
+	return nil
+}
+
+func (h *httpProxyHandler) Close() error {
+	return nil
+}
+
+func (h *httpProxyHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	outbound := session.OutboundFromContext(ctx)
+	if err := h.process(ctx, outbound, link); err != nil {
+		err := newError("failed to process http proxy outbound traffic").Base(err)
+		session.SubmitOutboundErrorToOriginator(ctx, err)
+		err.WriteToLog(session.ExportIDToError(ctx))
+		common.Interrupt(link.Writer)
+	} else {
+		common.Close(link.Writer)
+	}
+	common.Interrupt(link.Reader)
+}
+
+func (h *httpProxyHandler) process(ctx context.Context, outbound *session.Outbound, link *transport.Link) error {
+	if outbound == nil || !outbound.Target.IsValid() {
+		return newError("target not specified")
+	}
+	destination := outbound.Target
+	if destination.Network != v2rayNet.Network_TCP {
+		return newError("udp is not supported by http proxies")
+	}
+	conn, err := h.connect(ctx, destination.NetAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	requestDone := func() error {
+		return buf.Copy(link.Reader, buf.NewWriter(conn))
+	}
+	responseDone := func() error {
+		return buf.Copy(buf.NewReader(conn), link.Writer)
+	}
+	return task.Run(ctx, requestDone, task.OnSuccess(responseDone, task.Close(link.Writer)))
+}
+
+func (h *httpProxyHandler) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := h.instance.dialVia(ctx, h.server.Address.String(), int32(h.server.Port), h.config.Via)
+	if err != nil {
+		return nil, newError("failed to connect to http proxy ", h.server.NetAddr()).Base(err)
+	}
+	if !h.config.Tls {
+		return conn, nil
+	}
+	serverName := h.config.ServerName
+	if serverName == "" {
+		serverName = h.server.Address.String()
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, KeyLogWriter: tlsKeyLogWriter()})
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, newError("tls handshake with http proxy failed").Base(err)
+	}
+	return tlsConn, nil
+}
+
+// connect opens a tunnel to target, answering authentication challenges on
+// the same connection as connection based schemes require.
+func (h *httpProxyHandler) connect(ctx context.Context, target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpProxyHandshakeTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	var reader *bufio.Reader
+
+	auth := &httpProxyAuth{handler: h, scheme: h.scheme.Load().(string)}
+	for round := 0; round < httpProxyMaxRounds; round++ {
+		if conn == nil {
+			var err error
+			if conn, err = h.dial(ctx); err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				_ = conn.SetDeadline(deadline)
+			}
+			reader = bufio.NewReader(conn)
+		}
+
+		request := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: target},
+			Host:   target,
+			Header: make(http.Header),
+		}
+		request.Header.Set("Proxy-Connection", "Keep-Alive")
+		if credentials, err := auth.next(); err != nil {
+			conn.Close()
+			return nil, err
+		} else if credentials != "" {
+			request.Header.Set("Proxy-Authorization", credentials)
+		}
+		if err := request.Write(conn); err != nil {
+			conn.Close()
+			return nil, newError("failed to write CONNECT request").Base(err)
+		}
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			conn.Close()
+			return nil, newError("failed to read CONNECT response").Base(err)
+		}
+
+		switch response.StatusCode {
+		case http.StatusOK:
+			_ = conn.SetDeadline(time.Time{})
+			h.scheme.Store(auth.scheme)
+			if reader.Buffered() > 0 {
+				return &bufferedConn{conn, reader}, nil
+			}
+			return conn, nil
+		case http.StatusProxyAuthRequired:
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+			if err = auth.challenge(response.Header.Values("Proxy-Authenticate")); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if response.Close {
+				// basic auth works on a new connection, the connection based
+				// schemes start over
+				conn.Close()
+				conn = nil
+				auth.restart()
+			}
+		default:
+			response.Body.Close()
+			conn.Close()
+			return nil, newError("http proxy responded ", response.Status)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return nil, newError("http proxy authentication failed")
+}
+
+// httpProxyAuth follows the Proxy-Authorization exchange of one tunnel.
+type httpProxyAuth struct {
+	handler  *httpProxyHandler
+	scheme   string
+	token    string
+	round    int
+	rejected bool
+}
+
+func (a *httpProxyAuth) restart() {
+	a.token = ""
+	a.round = 0
+}
+
+// next returns the Proxy-Authorization header of the following request.
+func (a *httpProxyAuth) next() (string, error) {
+	config := a.handler.config
+	switch a.scheme {
+	case "":
+		return "", nil
+	case "Basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password)), nil
+	case "NTLM", "Negotiate":
+		if a.scheme == "Negotiate" && a.handler.authenticator != nil {
+			token, err := a.handler.authenticator.NegotiateToken(a.handler.server.Address.String(), a.token)
+			if err != nil {
+				return "", newError("failed to get negotiate token").Base(err)
+			}
+			return "Negotiate " + token, nil
+		}
+		if a.token == "" {
+			return a.scheme + " " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+		}
+		raw, err := base64.StdEncoding.DecodeString(a.token)
+		if err != nil {
+			return "", newError("invalid ntlm challenge").Base(err)
+		}
+		challenge, err := parseNtlmChallenge(raw)
+		if err != nil {
+			return "", err
+		}
+		message, err := ntlmAuthenticateMessage(challenge, config.Domain, config.Username, config.Password)
+		if err != nil {
+			return "", err
+		}
+		return a.scheme + " " + base64.StdEncoding.EncodeToString(message), nil
+	}
+	return "", newError("unsupported auth scheme ", a.scheme)
+}
+
+// challenge picks the scheme to answer a 407 with, keeping the current
+// one while the proxy continues its exchange.
+func (a *httpProxyAuth) challenge(headers []string) error {
+	offered := make(map[string]string)
+	for _, header := range headers {
+		scheme, token := header, ""
+		if index := strings.IndexByte(header, ' '); index >= 0 {
+			scheme, token = header[:index], strings.TrimSpace(header[index+1:])
+		}
+		offered[strings.ToLower(scheme)] = token
+	}
+	a.round++
+	if a.scheme != "" {
+		token, ok := offered[strings.ToLower(a.scheme)]
+		if ok && token != "" && a.scheme != "Basic" {
+			a.token = token
+			return nil
+		}
+		if a.rejected || a.round > 1 && a.scheme == "Basic" {
+			return newError("http proxy rejected the ", a.scheme, " credentials")
+		}
+		// the preferred scheme of a previous tunnel failed, choose again
+		a.rejected = true
+	}
+	config := a.handler.config
+	hasCredentials := config.Username != ""
+	switch {
+	case hasOffer(offered, "negotiate") && (a.handler.authenticator != nil || hasCredentials):
+		a.scheme = "Negotiate"
+	case hasOffer(offered, "ntlm") && hasCredentials:
+		a.scheme = "NTLM"
+	case hasOffer(offered, "basic") && hasCredentials:
+		a.scheme = "Basic"
+	default:
+		return newError("http proxy requires authentication: ", strings.Join(headers, ", "))
+	}
+	a.token = ""
+	return nil
+}
+
+func hasOffer(offered map[string]string, scheme string) bool {
+	_, ok := offered[scheme]
+	return ok
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
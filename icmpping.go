@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"github.com/sagernet/libping"
+)
+
+func IcmpPing(address string, timeout int32) (int32, error) {
+	latency, err := libping.IcmpPing(address, timeout)
+	return latency, exportError(err)
+}
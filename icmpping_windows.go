@@ -0,0 +1,6 @@
+package libcore
+
+// IcmpPing needs unprivileged icmp sockets, which Windows does not have.
+func IcmpPing(address string, timeout int32) (int32, error) {
+	return -1, exportError(newError("icmp ping is not supported on Windows"))
+}
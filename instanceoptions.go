@@ -0,0 +1,192 @@
+package libcore
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/dns"
+	appLog "github.com/v2fly/v2ray-core/v5/app/log"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+	v2rayTls "github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Values of the switches of InstanceOptions.
+const (
+	// OptionDefault keeps the setting of the config.
+	OptionDefault int32 = iota
+	OptionEnabled
+	OptionDisabled
+)
+
+const defaultMuxConcurrency = 8
+
+// InstanceOptions are global settings of the app applied over the config
+// loaded by the instance.
+type InstanceOptions struct {
+	// LogLevel is debug, info, warning, error or none, empty keeps the
+	// config.
+	LogLevel string
+	// Sniffing switches sniffing of the inbounds and the tun.
+	Sniffing int32
+	// Mux switches mux of the proxy outbounds, with MuxConcurrency
+	// connections per mux connection, 8 if 0.
+	Mux            int32
+	MuxConcurrency int32
+	// AllowInsecure switches skipping certificate verification of the tls
+	// outbounds.
+	AllowInsecure int32
+	// DnsStrategy is the query strategy of the dns, UseIP, UseIPv4 or
+	// UseIPv6, empty keeps the config.
+	DnsStrategy string
+}
+
+// NewV2rayInstanceWithOptions returns an instance applying options to every
+// config it loads.
+func NewV2rayInstanceWithOptions(options *InstanceOptions) *V2RayInstance {
+	instance := NewV2rayInstance()
+	if options != nil {
+		copied := *options
+		instance.options = &copied
+	}
+	return instance
+}
+
+// sniffingEnabled applies the sniffing option over enabled.
+func (o *InstanceOptions) sniffingEnabled(enabled bool) bool {
+	if o == nil || o.Sniffing == OptionDefault {
+		return enabled
+	}
+	return o.Sniffing == OptionEnabled
+}
+
+func (o *InstanceOptions) apply(config *core.Config) error {
+	if o.LogLevel != "" {
+		if err := o.applyLogLevel(config); err != nil {
+			return err
+		}
+	}
+	if o.DnsStrategy != "" {
+		if err := o.applyDnsStrategy(config); err != nil {
+			return err
+		}
+	}
+	if o.Sniffing != OptionDefault {
+		for _, inbound := range config.Inbound {
+			receiver, ok := typedInstance(inbound.ReceiverSettings).(*proxyman.ReceiverConfig)
+			if !ok {
+				continue
+			}
+			if receiver.SniffingSettings == nil {
+				receiver.SniffingSettings = new(proxyman.SniffingConfig)
+			}
+			receiver.SniffingSettings.Enabled = o.Sniffing == OptionEnabled
+			if receiver.SniffingSettings.Enabled && len(receiver.SniffingSettings.DestinationOverride) == 0 {
+				receiver.SniffingSettings.DestinationOverride = []string{"http", "tls"}
+			}
+			inbound.ReceiverSettings = commonSerial.ToTypedMessage(receiver)
+		}
+	}
+	if o.Mux == OptionDefault && o.AllowInsecure == OptionDefault {
+		return nil
+	}
+	for _, outbound := range config.Outbound {
+		proxySettings := typedInstance(outbound.ProxySettings)
+		if proxySettings == nil {
+			continue
+		}
+		// only proxies have a server, not freedom, blackhole or dns
+		if _, ok := findServerEndpoint(proto.MessageReflect(proxySettings)); !ok {
+			continue
+		}
+		sender, ok := typedInstance(outbound.SenderSettings).(*proxyman.SenderConfig)
+		if !ok {
+			sender = new(proxyman.SenderConfig)
+		}
+		if o.Mux != OptionDefault {
+			if sender.MultiplexSettings == nil {
+				sender.MultiplexSettings = new(proxyman.MultiplexingConfig)
+			}
+			sender.MultiplexSettings.Enabled = o.Mux == OptionEnabled
+			if o.MuxConcurrency > 0 {
+				sender.MultiplexSettings.Concurrency = uint32(o.MuxConcurrency)
+			} else if sender.MultiplexSettings.Concurrency == 0 {
+				sender.MultiplexSettings.Concurrency = defaultMuxConcurrency
+			}
+		}
+		if o.AllowInsecure != OptionDefault && sender.StreamSettings != nil {
+			for index, settings := range sender.StreamSettings.SecuritySettings {
+				if tlsConfig, ok := typedInstance(settings).(*v2rayTls.Config); ok {
+					tlsConfig.AllowInsecure = o.AllowInsecure == OptionEnabled
+					sender.StreamSettings.SecuritySettings[index] = commonSerial.ToTypedMessage(tlsConfig)
+				}
+			}
+		}
+		outbound.SenderSettings = commonSerial.ToTypedMessage(sender)
+	}
+	return nil
+}
+
+func (o *InstanceOptions) applyLogLevel(config *core.Config) error {
+	specification := &appLog.LogSpecification{Type: appLog.LogType_Console}
+	switch strings.ToLower(o.LogLevel) {
+	case "debug":
+		specification.Level = log.Severity_Debug
+	case "info":
+		specification.Level = log.Severity_Info
+	case "warning":
+		specification.Level = log.Severity_Warning
+	case "error":
+		specification.Level = log.Severity_Error
+	case "none":
+		specification.Type = appLog.LogType_None
+	default:
+		return newError("invalid log level ", o.LogLevel)
+	}
+	for index, app := range config.App {
+		if logConfig, ok := typedInstance(app).(*appLog.Config); ok {
+			logConfig.Error = specification
+			config.App[index] = commonSerial.ToTypedMessage(logConfig)
+			return nil
+		}
+	}
+	config.App = append(config.App, commonSerial.ToTypedMessage(&appLog.Config{Error: specification}))
+	return nil
+}
+
+func (o *InstanceOptions) applyDnsStrategy(config *core.Config) error {
+	var strategy dns.QueryStrategy
+	switch strings.ToLower(o.DnsStrategy) {
+	case "useip":
+		strategy = dns.QueryStrategy_USE_IP
+	case "useipv4":
+		strategy = dns.QueryStrategy_USE_IP4
+	case "useipv6":
+		strategy = dns.QueryStrategy_USE_IP6
+	default:
+		return newError("invalid dns strategy ", o.DnsStrategy)
+	}
+	for index, app := range config.App {
+		if dnsConfig, ok := typedInstance(app).(*dns.Config); ok {
+			dnsConfig.QueryStrategy = strategy
+			config.App[index] = commonSerial.ToTypedMessage(dnsConfig)
+		}
+	}
+	return nil
+}
+
+// typedInstance returns the message of settings, or nil if there is none or
+// it is unknown.
+func typedInstance(settings *anypb.Any) proto.Message {
+	if settings == nil {
+		return nil
+	}
+	message, err := commonSerial.GetInstanceOf(settings)
+	if err != nil {
+		return nil
+	}
+	return message
+}
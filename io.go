@@ -1,14 +1,25 @@
 package libcore
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/ulikunitz/xz"
 	"libcore/comm"
 )
 
+const (
+	archiveMaxSize  = 1 << 30
+	archiveMaxFiles = 65536
+)
+
 type packetConn interface {
 	net.PacketConn
 	readFrom() (p []byte, addr net.Addr, err error)
@@ -17,21 +28,21 @@ type packetConn interface {
 func Unxz(archive string, path string) error {
 	i, err := os.Open(archive)
 	if err != nil {
-		return err
+		return exportError(err)
 	}
 	r, err := xz.NewReader(i)
 	if err != nil {
 		comm.CloseIgnore(i)
-		return err
+		return withCode(ErrorCodeInvalidArgument, newError("invalid xz archive ", archive).Base(err))
 	}
 	o, err := os.Create(path)
 	if err != nil {
 		comm.CloseIgnore(i)
-		return err
+		return exportError(err)
 	}
 	_, err = io.Copy(o, r)
 	comm.CloseIgnore(i, o)
-	return err
+	return exportError(err)
 }
 
 func unxz(path string) error {
@@ -41,3 +52,127 @@ func unxz(path string) error {
 	}
 	return os.Rename(path+".tmp", path)
 }
+
+type ExtractProgress interface {
+	// OnProgress is called after each file with the bytes extracted so far.
+	OnProgress(entry string, extracted int64)
+}
+
+// ExtractZip extracts archive into dir, rejecting entries escaping dir and
+// archives expanding beyond the size limits. Symlinks are skipped.
+func ExtractZip(archive string, dir string, progress ExtractProgress) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return exportError(newError("open archive").Base(err))
+	}
+	defer reader.Close()
+	e := newExtractor(progress)
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || !file.Mode().IsRegular() {
+			continue
+		}
+		entry, err := file.Open()
+		if err != nil {
+			return exportError(newError("extract ", file.Name).Base(err))
+		}
+		_, err = e.extract(dir, file.Name, file.Mode(), entry)
+		comm.CloseIgnore(entry)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("extract ", file.Name).Base(err))
+		}
+	}
+	return nil
+}
+
+// ExtractTarXz extracts a tar.xz archive into dir with the same checks as
+// ExtractZip.
+func ExtractTarXz(archive string, dir string, progress ExtractProgress) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return exportError(newError("open archive").Base(err))
+	}
+	defer file.Close()
+	xzReader, err := xz.NewReader(file)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("open archive").Base(err))
+	}
+	reader := tar.NewReader(xzReader)
+	e := newExtractor(progress)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("read archive").Base(err))
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, err = e.extract(dir, header.Name, header.FileInfo().Mode(), reader); err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("extract ", header.Name).Base(err))
+		}
+	}
+}
+
+// extractor writes archive entries while enforcing the limits over the whole
+// archive.
+type extractor struct {
+	progress ExtractProgress
+	written  int64
+	files    int
+}
+
+func newExtractor(progress ExtractProgress) *extractor {
+	return &extractor{progress: progress}
+}
+
+// extract writes reader to name under dir and returns its sha256.
+func (e *extractor) extract(dir string, name string, mode os.FileMode, reader io.Reader) (string, error) {
+	target, err := safeJoin(dir, name)
+	if err != nil {
+		return "", err
+	}
+	e.files++
+	if e.files > archiveMaxFiles {
+		return "", newError("too many files")
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	remaining := archiveMaxSize - e.written
+	n, err := io.Copy(io.MultiWriter(output, hash), io.LimitReader(reader, remaining+1))
+	comm.CloseIgnore(output)
+	e.written += n
+	if err == nil && n > remaining {
+		err = newError("archive too large")
+	}
+	if err != nil {
+		_ = os.Remove(target)
+		return "", err
+	}
+	if e.progress != nil {
+		e.progress.OnProgress(name, e.written)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// safeJoin returns name under dir, failing for absolute names or names that
+// escape dir (zip slip).
+func safeJoin(dir string, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+		return "", newError("illegal path ", name)
+	}
+	dir = filepath.Clean(dir)
+	target := filepath.Join(dir, name)
+	if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", newError("illegal path ", name)
+	}
+	return target, nil
+}
@@ -0,0 +1,36 @@
+package libcore
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tcpKeepAliveProbes is the number of unanswered probes before the kernel
+// drops the connection.
+const tcpKeepAliveProbes = 4
+
+var tcpKeepAlive int32
+
+// setTcpKeepAlive sets the idle seconds before keepalive probes are sent on
+// the sockets of the outbounds, zero disables it.
+func setTcpKeepAlive(seconds int32) {
+	if seconds < 0 {
+		seconds = 0
+	}
+	atomic.StoreInt32(&tcpKeepAlive, seconds)
+}
+
+// applyTcpKeepAlive enables keepalive on a tcp socket of the protected
+// dialer. All the tcp based transports, websocket and grpc included, run on
+// these sockets, so the probes keep their NAT mappings alive as well. The
+// socket settings of an outbound are applied afterwards and take precedence.
+func applyTcpKeepAlive(fd int) {
+	seconds := int(atomic.LoadInt32(&tcpKeepAlive))
+	if seconds == 0 {
+		return
+	}
+	if err := setKeepAliveOptions(fd, seconds); err != nil {
+		logrus.Debug("set keepalive: ", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+func setKeepAliveOptions(fd int, seconds int) error {
+	return newError("tcp keepalive options are not supported on this platform")
+}
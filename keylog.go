@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var keyLogAccess sync.Mutex
+
+var keyLogFile *os.File
+
+// SetTlsKeyLogPath appends the secrets of the TLS sessions started by libcore
+// itself, i.e. probes, tcp pings, url tests, rule provider downloads and DNS
+// over HTTPS, to path in the SSLKEYLOGFILE format, so captures of them can be
+// decrypted. It only takes effect in debug mode, an empty path stops it. The
+// tls transports of v2ray build their configs internally without a key log
+// option, so outbound sessions are not logged until the v2ray fork takes a
+// KeyLogWriter.
+func SetTlsKeyLogPath(path string) error {
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLogFile != nil {
+		keyLogFile.Close()
+		keyLogFile = nil
+	}
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return exportError(newError("failed to open tls key log").Base(err))
+	}
+	keyLogFile = file
+	logrus.Warn("tls key logging enabled for the connections of libcore, the key log decrypts captured sessions")
+	logrus.Warn("tls key logging does not cover the v2ray outbounds")
+	return nil
+}
+
+type keyLogWriter struct{}
+
+func (keyLogWriter) Write(p []byte) (int, error) {
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLogFile == nil {
+		return len(p), nil
+	}
+	return keyLogFile.Write(p)
+}
+
+// tlsKeyLogWriter returns the writer for tls.Config.KeyLogWriter, or nil if
+// key logging is off.
+func tlsKeyLogWriter() io.Writer {
+	if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		return nil
+	}
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLogFile == nil {
+		return nil
+	}
+	return keyLogWriter{}
+}
+
+// withTlsKeyLog enables key logging on an http transport, the transports of
+// libcore dial themselves so this does not change their http/2 support.
+func withTlsKeyLog(transport *http.Transport) *http.Transport {
+	if writer := tlsKeyLogWriter(); writer != nil {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = new(tls.Config)
+		}
+		transport.TLSClientConfig.KeyLogWriter = writer
+	}
+	return transport
+}
@@ -0,0 +1,40 @@
+package libcore
+
+import (
+	"sync/atomic"
+)
+
+// killSwitch blocks the traffic of a tun while its instance is stopping,
+// stopped or failed, so nothing leaves in clear between the core going away
+// and the app tearing the vpn down.
+type killSwitch struct {
+	enabled bool
+	// engaged is set once blocking started, it is not reset since the
+	// instance is not restarted under a running tun
+	engaged int32
+}
+
+// blocking is whether the connections of the tun have to be rejected.
+func (t *Tun2ray) blocking() bool {
+	if !t.killSwitch.enabled || atomic.LoadInt32(&t.killSwitch.engaged) == 0 && !t.instanceDown() {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&t.killSwitch.engaged, 0, 1) {
+		newError("kill switch engaged, instance is ", stateNames[t.v2ray.lifecycle.get()]).AtWarning().WriteToLog()
+	}
+	return true
+}
+
+func (t *Tun2ray) instanceDown() bool {
+	switch t.v2ray.lifecycle.get() {
+	case StateStopping, StateStopped, StateFailed:
+		return true
+	}
+	return false
+}
+
+// IsKillSwitchEngaged reports whether the kill switch is blocking the
+// traffic, the app should tear the vpn down or start a new instance and tun.
+func (t *Tun2ray) IsKillSwitchEngaged() bool {
+	return atomic.LoadInt32(&t.killSwitch.engaged) != 0
+}
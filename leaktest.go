@@ -0,0 +1,225 @@
+package libcore
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+	"libcore/comm"
+)
+
+// Statuses of LeakCheck.
+const (
+	// LeakCheckRouted is a probe that arrived at the tun.
+	LeakCheckRouted int32 = iota
+	// LeakCheckBlocked is a probe the system refused to send.
+	LeakCheckBlocked
+	// LeakCheckLeaked is a probe that was sent but never arrived at the tun.
+	LeakCheckLeaked
+	// LeakCheckUnverified is an ipv6 probe sent while ipv6 is disabled in
+	// the tun, which drops it as a leak would.
+	LeakCheckUnverified
+)
+
+const leakTestDefaultTimeout = 3 * time.Second
+
+// The probes go to documentation addresses, nothing answers them if they
+// leak.
+var (
+	leakTestIPv4 = net.IPv4(198, 51, 100, 7)
+	leakTestIPv6 = net.ParseIP("2001:db8::7")
+	leakTestDns  = net.IPv4(203, 0, 113, 53)
+)
+
+var leakProbes = &leakProbeSet{pending: make(map[string]chan struct{})}
+
+// leakProbeSet holds the destinations of the probes being sent, the tun
+// drops the connections to them and reports their arrival.
+type leakProbeSet struct {
+	active  int32
+	access  sync.Mutex
+	pending map[string]chan struct{}
+}
+
+type LeakCheck struct {
+	// Name is tcp4, udp4, tcp6, udp6 or dns.
+	Name    string
+	Status  int32
+	Message string
+}
+
+type LeakTestReport struct {
+	// Leaked is whether any probe leaked.
+	Leaked bool
+	checks []*LeakCheck
+}
+
+func (r *LeakTestReport) Len() int32 {
+	return int32(len(r.checks))
+}
+
+func (r *LeakTestReport) Get(index int32) *LeakCheck {
+	if index < 0 || int(index) >= len(r.checks) {
+		return nil
+	}
+	return r.checks[index]
+}
+
+// VerifyNoLeak sends tcp, udp and dns probes over ipv4 and ipv6 from
+// unprotected sockets, as apps do, and reports for each whether it arrived at
+// the tun, was refused by the system or left through another interface. The
+// dns probe goes to a server other than the gateway. Probes are not
+// forwarded to any outbound. The sockets belong to this process, so the
+// result is only meaningful if it is not excluded from the vpn. timeoutMs is
+// 3000 if 0.
+func (t *Tun2ray) VerifyNoLeak(timeoutMs int32) (*LeakTestReport, error) {
+	if t.lifecycle.get() != StateStarted {
+		return nil, withCode(ErrorCodeInvalidState, newError("tun not started"))
+	}
+	timeout := leakTestDefaultTimeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	ipv6Routed := false
+	t.nicsLock.Lock()
+	for _, nic := range t.nics {
+		if nic.ipv6Mode != comm.IPv6Disable {
+			ipv6Routed = true
+		}
+	}
+	t.nicsLock.Unlock()
+
+	atomic.AddInt32(&leakProbes.active, 1)
+	defer atomic.AddInt32(&leakProbes.active, -1)
+
+	probes := []struct {
+		name    string
+		network string
+		ip      net.IP
+		port    int
+		payload []byte
+	}{
+		{"tcp4", "tcp", leakTestIPv4, leakTestPort(), nil},
+		{"udp4", "udp", leakTestIPv4, leakTestPort(), []byte("libcore leak test")},
+		{"tcp6", "tcp", leakTestIPv6, leakTestPort(), nil},
+		{"udp6", "udp", leakTestIPv6, leakTestPort(), []byte("libcore leak test")},
+		{"dns", "udp", leakTestDns, 53, leakTestQuery()},
+	}
+	report := &LeakTestReport{checks: make([]*LeakCheck, len(probes))}
+	var wg sync.WaitGroup
+	for index, probe := range probes {
+		wg.Add(1)
+		go func(index int, name, network string, ip net.IP, port int, payload []byte) {
+			defer wg.Done()
+			check := leakProbes.send(network, ip, port, payload, timeout)
+			check.Name = name
+			if check.Status == LeakCheckLeaked && ip.To4() == nil && !ipv6Routed {
+				check.Status = LeakCheckUnverified
+				check.Message = "ipv6 is disabled in the tun, which drops what it gets"
+			}
+			report.checks[index] = check
+		}(index, probe.name, probe.network, probe.ip, probe.port, probe.payload)
+	}
+	wg.Wait()
+	for _, check := range report.checks {
+		if check.Status == LeakCheckLeaked {
+			report.Leaked = true
+			newError("leak test: ", check.Name, " leaked").AtWarning().WriteToLog()
+		}
+	}
+	return report, nil
+}
+
+func leakTestPort() int {
+	return 20000 + rand.Intn(40000)
+}
+
+func leakTestQuery() []byte {
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("leak-test.invalid."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, _ := query.Pack()
+	return packed
+}
+
+// send sends a probe from a plain socket and waits for the tun to report it.
+func (s *leakProbeSet) send(network string, ip net.IP, port int, payload []byte, timeout time.Duration) *LeakCheck {
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	arrived := make(chan struct{})
+	key := network + ":" + address
+	s.access.Lock()
+	s.pending[key] = arrived
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.pending, key)
+		s.access.Unlock()
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err == nil {
+			if payload != nil {
+				_, err = conn.Write(payload)
+			}
+			conn.Close()
+		}
+		failed <- err
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-arrived:
+			return &LeakCheck{Status: LeakCheckRouted}
+		case err := <-failed:
+			if err != nil && isRouteRefused(err) {
+				return &LeakCheck{Status: LeakCheckBlocked, Message: err.Error()}
+			}
+			// a tcp probe reaching the tun is reset, keep waiting for the
+			// tun to report it
+			failed = nil
+		case <-deadline.C:
+			return &LeakCheck{Status: LeakCheckLeaked, Message: "not seen by the tun"}
+		}
+	}
+}
+
+func isRouteRefused(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// observe reports a probe arriving at the tun, it returns true if the
+// connection is one and must be dropped.
+func (s *leakProbeSet) observe(network v2rayNet.Network, destination v2rayNet.Destination) bool {
+	if atomic.LoadInt32(&s.active) == 0 || !destination.Address.Family().IsIP() {
+		return false
+	}
+	key := network.SystemString() + ":" + destination.NetAddr()
+	s.access.Lock()
+	defer s.access.Unlock()
+	arrived, ok := s.pending[key]
+	if ok {
+		// retransmissions are dropped too, until the probe is done
+		select {
+		case <-arrived:
+		default:
+			close(arrived)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,131 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+// States of V2RayInstance and Tun2ray.
+const (
+	StateCreated int32 = iota
+	StateStarting
+	StateStarted
+	StateStopping
+	StateStopped
+	StateFailed
+)
+
+var stateNames = []string{"created", "starting", "started", "stopping", "stopped", "failed"}
+
+type StateListener interface {
+	// OnStateChanged is called after every transition, timestampMs is when
+	// state was entered and message the error if it is StateFailed. It runs
+	// within Start and Close, which must not be called from it.
+	OnStateChanged(state int32, previous int32, timestampMs int64, message string)
+}
+
+// lifecycle is the state of an instance or a tun with the time each state
+// was last entered.
+type lifecycle struct {
+	access     sync.Mutex
+	state      int32
+	timestamps [StateFailed + 1]int64
+	message    string
+	listener   StateListener
+}
+
+func newLifecycle(listener StateListener) *lifecycle {
+	l := &lifecycle{listener: listener}
+	l.timestamps[StateCreated] = time.Now().UnixNano() / int64(time.Millisecond)
+	return l
+}
+
+// set enters state, err is the message of StateFailed.
+func (l *lifecycle) set(state int32, err error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var message string
+	if err != nil {
+		message = err.Error()
+	}
+	l.access.Lock()
+	previous := l.state
+	l.state = state
+	l.timestamps[state] = now
+	l.message = message
+	listener := l.listener
+	l.access.Unlock()
+	newError("state ", stateNames[previous], " -> ", stateNames[state]).AtDebug().WriteToLog()
+	if listener != nil {
+		listener.OnStateChanged(state, previous, now, message)
+	}
+}
+
+func (l *lifecycle) get() int32 {
+	l.access.Lock()
+	defer l.access.Unlock()
+	return l.state
+}
+
+func (l *lifecycle) timestamp(state int32) int64 {
+	if state < StateCreated || state > StateFailed {
+		return 0
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	return l.timestamps[state]
+}
+
+func (l *lifecycle) failure() string {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.state != StateFailed {
+		return ""
+	}
+	return l.message
+}
+
+func (l *lifecycle) setListener(listener StateListener) {
+	l.access.Lock()
+	l.listener = listener
+	l.access.Unlock()
+}
+
+// GetState returns the current state of the instance.
+func (instance *V2RayInstance) GetState() int32 {
+	return instance.lifecycle.get()
+}
+
+// GetStateTimestamp returns when the instance last entered state, in
+// milliseconds since the epoch, or 0 if it never did.
+func (instance *V2RayInstance) GetStateTimestamp(state int32) int64 {
+	return instance.lifecycle.timestamp(state)
+}
+
+// GetFailure returns the error of the instance if it is StateFailed.
+func (instance *V2RayInstance) GetFailure() string {
+	return instance.lifecycle.failure()
+}
+
+func (instance *V2RayInstance) SetStateListener(listener StateListener) {
+	instance.lifecycle.setListener(listener)
+}
+
+// GetState returns the current state of the tun.
+func (t *Tun2ray) GetState() int32 {
+	return t.lifecycle.get()
+}
+
+// GetStateTimestamp returns when the tun last entered state, in milliseconds
+// since the epoch, or 0 if it never did.
+func (t *Tun2ray) GetStateTimestamp(state int32) int64 {
+	return t.lifecycle.timestamp(state)
+}
+
+// GetFailure returns the error of the tun if it is StateFailed.
+func (t *Tun2ray) GetFailure() string {
+	return t.lifecycle.failure()
+}
+
+func (t *Tun2ray) SetStateListener(listener StateListener) {
+	t.lifecycle.setListener(listener)
+}
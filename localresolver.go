@@ -0,0 +1,243 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localResolveTimeout bounds lookups that have no deadline of their own.
+const localResolveTimeout = 10 * time.Second
+
+// ResolveRequest is passed to LocalResolverV2, the resolver should give up
+// once it is cancelled or the deadline passed.
+type ResolveRequest struct {
+	Network string
+	Domain  string
+	// Deadline is in unix milliseconds.
+	Deadline int64
+
+	ctx context.Context
+}
+
+func (r *ResolveRequest) IsCancelled() bool {
+	return r.ctx.Err() != nil
+}
+
+type resolvedAddress struct {
+	ip  net.IP
+	ttl uint32
+}
+
+type ResolveResult struct {
+	Rcode int32
+
+	addresses []resolvedAddress
+	cnames    []string
+}
+
+func NewResolveResult() *ResolveResult {
+	return &ResolveResult{}
+}
+
+func (r *ResolveResult) AddAddress(ip string, ttl int32) error {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid ip ", ip))
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	r.addresses = append(r.addresses, resolvedAddress{address, uint32(ttl)})
+	return nil
+}
+
+// AddCname appends the next name of the cname chain, starting from the
+// requested domain.
+func (r *ResolveResult) AddCname(name string) {
+	r.cnames = append(r.cnames, strings.TrimSuffix(name, "."))
+}
+
+func (r *ResolveResult) ips() []net.IP {
+	ips := make([]net.IP, 0, len(r.addresses))
+	for _, address := range r.addresses {
+		ips = append(ips, address.ip)
+	}
+	return ips
+}
+
+func (r *ResolveResult) err() error {
+	if r.Rcode != 0 {
+		return dns.RCodeError(r.Rcode)
+	}
+	if len(r.addresses) == 0 {
+		return dns.ErrEmptyResponse
+	}
+	return nil
+}
+
+// answers builds the cname chain and address records for question.
+func (r *ResolveResult) answers(question dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	var answers []dnsmessage.Resource
+	var ttl uint32 = hostsTTL
+	for i, address := range r.addresses {
+		if i == 0 || address.ttl < ttl {
+			ttl = address.ttl
+		}
+	}
+	for _, alias := range r.cnames {
+		cname, err := dnsmessage.NewName(alias + ".")
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeCNAME,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.CNAMEResource{CNAME: cname},
+		})
+		question.Name = cname
+	}
+	for _, address := range r.addresses {
+		answers = append(answers, newDnsAnswers(question, []net.IP{address.ip}, address.ttl)...)
+	}
+	return answers, nil
+}
+
+// LocalResolverV2 resolves with the platform resolver. Failures should be
+// reported with Rcode, errors are for the resolver itself failing.
+//
+// ExchangeRaw sends a packed dns query of any type (e.g. HTTPS, SVCB, TXT,
+// SRV) and returns the packed response, Network of the request is empty.
+// Resolvers without raw support return an error with ErrorCodeInvalidState.
+type LocalResolverV2 interface {
+	Resolve(request *ResolveRequest) (*ResolveResult, error)
+	ExchangeRaw(request *ResolveRequest, query []byte) ([]byte, error)
+}
+
+var errRawUnsupported = &codedError{code: ErrorCodeInvalidState, err: errors.New("raw dns exchange not supported")}
+
+// legacyResolver adapts a LocalResolver, which returns comma separated ips
+// and fails with "rcode <n>" messages.
+type legacyResolver struct {
+	LocalResolver
+}
+
+func (r legacyResolver) Resolve(request *ResolveRequest) (*ResolveResult, error) {
+	result := NewResolveResult()
+	response, err := r.LookupIP(request.Network, request.Domain)
+	if err != nil {
+		err = parseResolverError(err)
+		var rcode dns.RCodeError
+		if !errors.As(err, &rcode) {
+			return nil, err
+		}
+		result.Rcode = int32(rcode)
+		return result, nil
+	}
+	for _, addr := range strings.Split(response, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			if err = result.AddAddress(addr, hostsTTL); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (r legacyResolver) ExchangeRaw(*ResolveRequest, []byte) ([]byte, error) {
+	return nil, errRawUnsupported
+}
+
+var localResolver struct {
+	access   sync.RWMutex
+	resolver LocalResolverV2
+}
+
+func setLocalResolver(resolver LocalResolverV2) {
+	localResolver.access.Lock()
+	localResolver.resolver = resolver
+	localResolver.access.Unlock()
+}
+
+// resolveLocal resolves with the platform resolver, ok is false if none is
+// set.
+func resolveLocal(ctx context.Context, network string, domain string) (result *ResolveResult, ok bool, err error) {
+	response, ok, err := callLocalResolver(ctx, network, domain, func(resolver LocalResolverV2, request *ResolveRequest) (interface{}, error) {
+		return resolver.Resolve(request)
+	})
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	if result = response.(*ResolveResult); result == nil {
+		result = NewResolveResult()
+	}
+	if network != "ip4" {
+		synthesizeDns64(ctx, network, domain, result)
+	}
+	return result, true, nil
+}
+
+// exchangeLocal sends query to the platform resolver, ok is false if none is
+// set or it does not support raw queries.
+func exchangeLocal(ctx context.Context, domain string, query []byte) (response []byte, ok bool, err error) {
+	raw, ok, err := callLocalResolver(ctx, "", domain, func(resolver LocalResolverV2, request *ResolveRequest) (interface{}, error) {
+		return resolver.ExchangeRaw(request, query)
+	})
+	if errors.Is(err, errRawUnsupported) {
+		return nil, false, nil
+	}
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return raw.([]byte), true, nil
+}
+
+// callLocalResolver runs call with a request bound to ctx, giving up when ctx
+// is done even if the platform resolver does not.
+func callLocalResolver(ctx context.Context, network string, domain string, call func(LocalResolverV2, *ResolveRequest) (interface{}, error)) (interface{}, bool, error) {
+	localResolver.access.RLock()
+	resolver := localResolver.resolver
+	localResolver.access.RUnlock()
+	if resolver == nil {
+		return nil, false, nil
+	}
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, localResolveTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	request := &ResolveRequest{
+		Network:  network,
+		Domain:   domain,
+		Deadline: deadline.UnixNano() / int64(time.Millisecond),
+		ctx:      ctx,
+	}
+
+	type response struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan response, 1)
+	go func() {
+		value, err := call(resolver, request)
+		done <- response{value, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, true, exportError(ctx.Err())
+	case r := <-done:
+		return r.value, true, r.err
+	}
+}
@@ -95,7 +95,7 @@ func (w *v2rayLogWriter) Write(s string) error {
 		priority = C.ANDROID_LOG_DEBUG
 	}
 
-	str := C.CString(strings.TrimSpace(s))
+	str := C.CString(strings.TrimSpace(redactLog(s)))
 	C.__android_log_write(priority, tagV2Ray, str)
 	C.free(unsafe.Pointer(str))
 	return nil
@@ -108,7 +108,7 @@ func (w *v2rayLogWriter) Close() error {
 type stdLogWriter struct{}
 
 func (stdLogWriter) Write(p []byte) (n int, err error) {
-	str := C.CString(string(p))
+	str := C.CString(redactLog(string(p)))
 	C.__android_log_write(C.ANDROID_LOG_INFO, tag, str)
 	C.free(unsafe.Pointer(str))
 	return len(p), nil
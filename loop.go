@@ -0,0 +1,149 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	core "github.com/v2fly/v2ray-core/v5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/proxy"
+	"github.com/v2fly/v2ray-core/v5/proxy/blackhole"
+	proxyDns "github.com/v2fly/v2ray-core/v5/proxy/dns"
+	"github.com/v2fly/v2ray-core/v5/proxy/freedom"
+)
+
+const (
+	loopServerTTL      = 10 * time.Minute
+	loopReportInterval = 10 * time.Second
+)
+
+// RoutingLoopError is returned for tun connections that would come back into
+// the tun, Reason is "gateway" or "server".
+type RoutingLoopError struct {
+	Network     string
+	Source      string
+	Destination string
+	Reason      string
+}
+
+func (e *RoutingLoopError) Error() string {
+	return fmt.Sprintf("routing loop detected (%s): %s %s ==> %s", e.Reason, e.Network, e.Source, e.Destination)
+}
+
+type RoutingLoopListener interface {
+	OnRoutingLoop(network string, source string, destination string, reason string)
+}
+
+var loopGuard = &loopDetector{
+	servers:  make(map[string]time.Time),
+	reported: make(map[string]time.Time),
+}
+
+type loopDetector struct {
+	access   sync.Mutex
+	listener RoutingLoopListener
+	servers  map[string]time.Time
+	reported map[string]time.Time
+}
+
+func SetRoutingLoopListener(listener RoutingLoopListener) {
+	loopGuard.access.Lock()
+	loopGuard.listener = listener
+	loopGuard.access.Unlock()
+}
+
+// addServer remembers the address of a proxy server in use, which libcore
+// connected to through the protected dialer.
+func (d *loopDetector) addServer(address v2rayNet.Address) {
+	d.access.Lock()
+	d.servers[address.String()] = time.Now()
+	d.access.Unlock()
+}
+
+// isProxyDial is whether a protected dial of ctx connects to the server of a
+// proxy outbound, and not to the target of a direct outbound or to a dns
+// server. Connections not dispatched by an instance are not.
+func isProxyDial(ctx context.Context) bool {
+	instance := core.FromContext(ctx)
+	content := session.ContentFromContext(ctx)
+	if instance == nil || content == nil {
+		return false
+	}
+	manager, ok := instance.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if !ok {
+		return false
+	}
+	var handler outbound.Handler
+	if tag := content.Attribute(outboundAttribute); tag != "" {
+		handler = manager.GetHandler(tag)
+	} else {
+		handler = manager.GetDefaultHandler()
+	}
+	getter, ok := handler.(interface{ GetOutbound() proxy.Outbound })
+	if !ok {
+		return false
+	}
+	switch getter.GetOutbound().(type) {
+	case *freedom.Handler, *blackhole.Handler, *proxyDns.Handler:
+		return false
+	}
+	return true
+}
+
+// check returns a RoutingLoopError if the connection targets the gateway of
+// the tun, or is made by this process to a proxy server in use.
+func (d *loopDetector) check(n *tunNic, network string, source v2rayNet.Destination, destination v2rayNet.Destination, self bool, isDns bool) error {
+	var reason string
+	address := destination.Address.String()
+	if !isDns && (address == n.router || address == n.router6) {
+		reason = "gateway"
+	} else if self {
+		d.access.Lock()
+		lastDial, ok := d.servers[address]
+		d.access.Unlock()
+		if ok && time.Since(lastDial) < loopServerTTL {
+			reason = "server"
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	err := &RoutingLoopError{network, source.NetAddr(), destination.NetAddr(), reason}
+	d.report(err)
+	return err
+}
+
+// report notifies the listener at most once per interval and destination, a
+// loop usually produces a storm of connections.
+func (d *loopDetector) report(err *RoutingLoopError) {
+	now := time.Now()
+	d.access.Lock()
+	if last, ok := d.reported[err.Destination]; ok && now.Sub(last) < loopReportInterval {
+		d.access.Unlock()
+		return
+	}
+	d.reported[err.Destination] = now
+	for key, last := range d.reported {
+		if now.Sub(last) >= loopReportInterval {
+			delete(d.reported, key)
+		}
+	}
+	for key, last := range d.servers {
+		if now.Sub(last) >= loopServerTTL {
+			delete(d.servers, key)
+		}
+	}
+	listener := d.listener
+	d.access.Unlock()
+
+	logrus.Warn(err.Error())
+	if listener != nil {
+		listener.OnRoutingLoop(err.Network, err.Source, err.Destination, err.Reason)
+	}
+}
@@ -0,0 +1,81 @@
+package libcore
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// LoopbackForward bridges a local port into the proxy pipeline, for apps
+// hardcoded to the port of a proxy they used before.
+type LoopbackForward struct {
+	Port int32
+	// Target is the host:port connections are relayed to, the port speaks
+	// socks5 and http proxy like the socks inbound if it is empty.
+	Target string
+	Tag    string
+	Sniff  bool
+}
+
+// AddLoopbackForward listens on 127.0.0.1 at the port until
+// RemoveLoopbackForward or Close, replacing the bridge on the same port.
+func (instance *V2RayInstance) AddLoopbackForward(forward *LoopbackForward) error {
+	if forward == nil || forward.Port <= 0 || forward.Port > 65535 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid loopback port"))
+	}
+	var target v2rayNet.Destination
+	if forward.Target != "" {
+		var err error
+		target, err = v2rayNet.ParseDestination("tcp:" + forward.Target)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid loopback target ", forward.Target).Base(err))
+		}
+	}
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return withCode(ErrorCodeInvalidState, newError("not started"))
+	}
+	if loopback, ok := instance.loopbacks[forward.Port]; ok {
+		loopback.close()
+		delete(instance.loopbacks, forward.Port)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(socksDefaultListen, strconv.Itoa(int(forward.Port))))
+	if err != nil {
+		return exportError(newError("listen loopback port ", forward.Port).Base(err))
+	}
+	loopback := &socksInbound{
+		instance: instance,
+		config:   SocksInboundConfig{Port: forward.Port, Tag: forward.Tag, Sniff: forward.Sniff},
+		listener: listener,
+		done:     make(chan struct{}),
+		forward:  target,
+	}
+	if instance.loopbacks == nil {
+		instance.loopbacks = make(map[int32]*socksInbound)
+	}
+	instance.loopbacks[forward.Port] = loopback
+	go loopback.loop()
+	logrus.Info("loopback forward started at ", listener.Addr(), " to ", forward.Target)
+	return nil
+}
+
+func (instance *V2RayInstance) RemoveLoopbackForward(port int32) {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if loopback, ok := instance.loopbacks[port]; ok {
+		loopback.close()
+		delete(instance.loopbacks, port)
+	}
+}
+
+func (s *socksInbound) handleForward(conn net.Conn) error {
+	ctx := s.newContext(v2rayNet.DestinationFromAddr(conn.RemoteAddr()))
+	link, err := s.instance.dispatcher.Dispatch(ctx, s.forward)
+	if err != nil {
+		return newError("dispatch failed").Base(err)
+	}
+	return s.relay(ctx, conn, conn, link.Reader, link.Writer)
+}
@@ -0,0 +1,39 @@
+package libcore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/rule"
+)
+
+// newDomainMatcher builds a matcher from v2ray style domain rules, rules
+// without a type prefix match the domain and all of its subdomains.
+func newDomainMatcher(rules []string) (*router.DomainMatcher, error) {
+	ctx := cfgcommon.NewConfigureLoadingContext(context.Background())
+	var domains []*routercommon.Domain
+	for _, domainRule := range rules {
+		domainRule = strings.TrimSpace(domainRule)
+		if domainRule == "" {
+			continue
+		}
+		if !strings.Contains(domainRule, ":") {
+			domainRule = "domain:" + domainRule
+		}
+		parsed, err := rule.ParseDomainRule(ctx, domainRule)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, parsed...)
+	}
+	return router.NewDomainMatcher("mph", domains)
+}
+
+func splitRules(content string) []string {
+	return strings.FieldsFunc(content, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+}
@@ -0,0 +1,166 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+	"libcore/comm"
+)
+
+const (
+	MulticastDnsModeDisabled int32 = iota
+	MulticastDnsModePassthrough
+	MulticastDnsModeResponder
+)
+
+const (
+	mdnsPort  = 5353
+	llmnrPort = 5355
+
+	multicastDnsTimeout = 3 * time.Second
+)
+
+var (
+	mdnsGroup4  = net.IPv4(224, 0, 0, 251).To4()
+	mdnsGroup6  = net.ParseIP("ff02::fb")
+	llmnrGroup4 = net.IPv4(224, 0, 0, 252).To4()
+	llmnrGroup6 = net.ParseIP("ff02::1:3")
+)
+
+func isMulticastDns(destination v2rayNet.Destination) bool {
+	ip := destination.Address.IP()
+	switch destination.Port {
+	case mdnsPort:
+		return ip.Equal(mdnsGroup4) || ip.Equal(mdnsGroup6)
+	case llmnrPort:
+		return ip.Equal(llmnrGroup4) || ip.Equal(llmnrGroup6)
+	}
+	return false
+}
+
+// handleMulticastDns answers a multicast query and closes closer once done.
+// Passthrough waits for responders, so it runs in its own goroutine.
+func (n *tunNic) handleMulticastDns(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	switch n.t.multicastDnsMode {
+	case MulticastDnsModePassthrough:
+		go func() {
+			n.t.passthroughMulticastDns(destination, data, writeBack)
+			comm.CloseIgnore(closer)
+		}()
+		return
+	case MulticastDnsModeResponder:
+		n.respondMulticastDns(source, destination, data, writeBack)
+	}
+	comm.CloseIgnore(closer)
+}
+
+// passthroughMulticastDns sends the query to the local network as a one-shot
+// (legacy unicast) query, so responders answer directly to our socket.
+func (t *Tun2ray) passthroughMulticastDns(destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error)) {
+	ipv6 := destination.Address.Family().IsIPv6()
+	conn, err := listenUpstreamUDP(t.bindUpstream, ipv6)
+	if err != nil {
+		newError("[mDNS] failed to create upstream socket").Base(err).WriteToLog()
+		return
+	}
+	defer comm.CloseIgnore(conn)
+
+	if rawConn, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	}); ok {
+		if sc, err := rawConn.SyscallConn(); err == nil {
+			_ = sc.Control(func(fd uintptr) {
+				_ = setMulticastHops(int(fd), ipv6, 255)
+			})
+		}
+	}
+
+	_, err = conn.WriteTo(data, &net.UDPAddr{
+		IP:   destination.Address.IP(),
+		Port: int(destination.Port),
+	})
+	if err != nil {
+		newError("[mDNS] failed to send query").Base(err).WriteToLog()
+		return
+	}
+
+	buffer := make([]byte, 9000)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(multicastDnsTimeout))
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		udpAddr, _ := addr.(*net.UDPAddr)
+		if udpAddr != nil {
+			if ip4 := udpAddr.IP.To4(); ip4 != nil {
+				udpAddr.IP = ip4
+			}
+		}
+		if _, err = writeBack(buffer[:n], udpAddr); err != nil {
+			return
+		}
+	}
+}
+
+// respondMulticastDns answers queries for names in the hosts map.
+func (n *tunNic) respondMulticastDns(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error)) {
+	var query dnsmessage.Message
+	if err := query.Unpack(data); err != nil || query.Response {
+		return
+	}
+
+	var answers []dnsmessage.Resource
+	for _, question := range query.Questions {
+		name := strings.TrimSuffix(question.Name.String(), ".")
+		if destination.Port == mdnsPort && !strings.HasSuffix(strings.ToLower(name), ".local") ||
+			destination.Port == llmnrPort && strings.Contains(name, ".") {
+			continue
+		}
+		ips, _, ok := hosts.lookupIP(name, "ip")
+		if !ok {
+			continue
+		}
+		question.Class &^= 1 << 15 // unicast-response bit
+		answers = append(answers, newDnsAnswers(question, ips, hostsTTL)...)
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:      true,
+			Authoritative: true,
+		},
+		Answers: answers,
+	}
+	legacy := destination.Port == llmnrPort || source.Port != mdnsPort
+	if legacy {
+		response.ID = query.ID
+		response.Questions = query.Questions
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		newError("[mDNS] failed to pack response").Base(err).WriteToLog()
+		return
+	}
+
+	var router net.IP
+	if destination.Address.Family().IsIPv6() {
+		router = net.ParseIP(n.router6)
+	} else {
+		router = net.ParseIP(n.router).To4()
+	}
+	if router == nil {
+		return
+	}
+	if _, err = writeBack(packed, &net.UDPAddr{IP: router, Port: int(destination.Port)}); err != nil {
+		newError("[mDNS] failed to write response").Base(err).WriteToLog()
+	}
+}
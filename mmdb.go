@@ -0,0 +1,265 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbReader reads MaxMind DB files, like GeoLite2-Country and GeoLite2-ASN,
+// loaded into memory.
+type mmdbReader struct {
+	buffer       []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	// ipv4Start is the node of ::/96 in an ipv6 tree
+	ipv4Start uint
+}
+
+func openMmdb(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, newError("not a maxmind db")
+	}
+	metadataStart := index + len(mmdbMetadataMarker)
+	metadata, _, err := (&mmdbReader{data: buffer[metadataStart:]}).decode(0, 0)
+	if err != nil {
+		return nil, newError("invalid metadata").Base(err)
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, newError("invalid metadata")
+	}
+	r := &mmdbReader{buffer: buffer}
+	r.nodeCount = uint(mmdbUint(fields["node_count"]))
+	r.recordSize = uint(mmdbUint(fields["record_size"]))
+	r.ipVersion = uint(mmdbUint(fields["ip_version"]))
+	r.databaseType, _ = fields["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, newError("unsupported record size ", r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(index) {
+		return nil, newError("truncated search tree")
+	}
+	r.data = buffer[treeSize+16 : index]
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	offset := node * r.recordSize / 4
+	b := r.buffer[offset:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record of ip, or nil if the db has none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, newError("invalid search tree")
+	}
+	value, _, err := r.decode(node-r.nodeCount-16, 0)
+	return value, err
+}
+
+// decode reads the value at offset of the data section and returns the
+// offset after it.
+func (r *mmdbReader) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, newError("data nested too deep")
+	}
+	if offset >= uint(len(r.data)) {
+		return nil, 0, newError("data offset out of range")
+	}
+	control := r.data[offset]
+	offset++
+	kind := control >> 5
+	if kind == 1 {
+		pointer, next, err := r.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := r.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == 0 {
+		if offset >= uint(len(r.data)) {
+			return nil, 0, newError("data offset out of range")
+		}
+		kind = 7 + r.data[offset]
+		offset++
+	}
+	size := uint(control & 0x1F)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(r.data)) {
+			return nil, 0, newError("data offset out of range")
+		}
+		value := uint(0)
+		for _, b := range r.data[offset : offset+extra] {
+			value = value<<8 | uint(b)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + value
+		case 2:
+			size = 285 + value
+		default:
+			size = 65821 + value
+		}
+	}
+
+	switch kind {
+	case 7:
+		fields := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, newError("map key is not a string")
+			}
+			value, next, err := r.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			fields[name] = value
+			offset = next
+		}
+		return fields, offset, nil
+	case 11:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := r.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(r.data)) {
+		return nil, 0, newError("data offset out of range")
+	}
+	content := r.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2:
+		return string(content), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, newError("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(content)), offset, nil
+	case 4:
+		return content, offset, nil
+	case 5, 6, 9, 10:
+		value := uint64(0)
+		for _, b := range content {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case 8:
+		value := int32(0)
+		for _, b := range content {
+			value = value<<8 | int32(b)
+		}
+		return value, offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, newError("invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(content)), offset, nil
+	}
+	return nil, 0, newError("unsupported data type ", kind)
+}
+
+func (r *mmdbReader) pointer(control byte, offset uint) (uint, uint, error) {
+	size := uint(control>>3) & 0x3
+	if offset+size+1 > uint(len(r.data)) {
+		return 0, 0, newError("data offset out of range")
+	}
+	b := r.data[offset : offset+size+1]
+	var pointer uint
+	switch size {
+	case 0:
+		pointer = uint(control&0x7)<<8 | uint(b[0])
+	case 1:
+		pointer = (uint(control&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		pointer = (uint(control&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		pointer = uint(binary.BigEndian.Uint32(b))
+	}
+	return pointer, offset + size + 1, nil
+}
+
+func mmdbUint(value interface{}) uint64 {
+	number, _ := value.(uint64)
+	return number
+}
+
+// mmdbPath returns the value at path of nested maps, or nil.
+func mmdbPath(value interface{}, path ...string) interface{} {
+	for _, key := range path {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = fields[key]
+	}
+	return value
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package nat
 
 import (
@@ -8,6 +11,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
 )
 
 // bufConfig defines the shape of the vectorised view used to read packets from the NIC.
@@ -108,6 +112,8 @@ type readVDispatcher struct {
 
 	// buf is the iovec buffer that contains the packet contents.
 	buf *iovecBuffer
+
+	poller comm.BusyPoller
 }
 
 func newReadVDispatcher(fd int, e *SystemTun) (*readVDispatcher, error) {
@@ -126,7 +132,7 @@ func newReadVDispatcher(fd int, e *SystemTun) (*readVDispatcher, error) {
 
 // dispatch reads one packet from the file descriptor and dispatches it.
 func (d *readVDispatcher) dispatch() (bool, tcpip.Error) {
-	n, err := rawfile.BlockingReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
+	n, err := d.poller.ReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
 	if n <= 0 || err != nil {
 		return false, err
 	}
@@ -135,11 +141,15 @@ func (d *readVDispatcher) dispatch() (bool, tcpip.Error) {
 		Data: d.buf.pullViews(n),
 	})
 	defer pkt.DecRef()
+	d.capturePacket(pkt, true)
 	d.e.deliverPacket(pkt)
 	return true, nil
 }
 
 func (d *readVDispatcher) dispatchLoop() tcpip.Error {
+	if err := comm.PinPacketThread(); err != nil {
+		newError("failed to pin packet thread").Base(err).AtWarning().WriteToLog()
+	}
 	for {
 		cont, err := d.dispatch()
 		if err != nil || !cont {
@@ -149,6 +159,7 @@ func (d *readVDispatcher) dispatchLoop() tcpip.Error {
 }
 
 func (d *readVDispatcher) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
+	d.capturePacket(pkt, false)
 	views := pkt.Views()
 	numIovecs := len(views)
 	if numIovecs > rawfile.MaxIovs {
@@ -167,5 +178,19 @@ func (d *readVDispatcher) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
 }
 
 func (d *readVDispatcher) writeBuffer(bytes []byte) tcpip.Error {
+	if d.e.capture != nil && d.e.capture.Capturing() {
+		d.e.capture.CapturePacket(append([]byte(nil), bytes...), false)
+	}
 	return rawfile.NonBlockingWrite(d.fd, bytes)
 }
+
+func (d *readVDispatcher) capturePacket(pkt *stack.PacketBuffer, inbound bool) {
+	if d.e.capture == nil || !d.e.capture.Capturing() {
+		return
+	}
+	packet := make([]byte, 0, pkt.Size())
+	for _, view := range pkt.Views() {
+		packet = append(packet, view...)
+	}
+	d.e.capture.CapturePacket(packet, inbound)
+}
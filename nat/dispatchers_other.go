@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package nat
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// readVDispatcher reads the tun fd with readv, which the system stack only
+// supports on Linux.
+type readVDispatcher struct{}
+
+func newReadVDispatcher(fd int, e *SystemTun) (*readVDispatcher, error) {
+	return nil, newError("the system stack is not supported on this platform")
+}
+
+func (d *readVDispatcher) dispatchLoop() tcpip.Error {
+	return &tcpip.ErrNotSupported{}
+}
+
+func (d *readVDispatcher) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
+	return &tcpip.ErrNotSupported{}
+}
+
+func (d *readVDispatcher) writeBuffer(bytes []byte) tcpip.Error {
+	return &tcpip.ErrNotSupported{}
+}
+
+func (d *readVDispatcher) stop() {
+}
@@ -0,0 +1,196 @@
+package nat
+
+import (
+	"sort"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	fragmentTimeout      = 30 * time.Second
+	fragmentMaxCount     = 64
+	fragmentMemoryLimit  = 4 << 20
+	fragmentMaxPacket    = 65535
+	fragmentSweepDelay   = time.Second
+	ipv6FragmentHdrSize  = 8
+	ipv6FragmentHdrIdent = uint8(header.IPv6FragmentExtHdrIdentifier)
+)
+
+type fragmentKey struct {
+	source      tcpip.Address
+	destination tcpip.Address
+	id          uint32
+	protocol    uint8
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type fragmentPacket struct {
+	header    []byte
+	fragments []fragment
+	size      int
+	total     int
+	deadline  time.Time
+}
+
+// reassembler collects ip fragments read from the tun. It is only used from
+// the dispatch loop so it needs no locking.
+type reassembler struct {
+	packets   map[fragmentKey]*fragmentPacket
+	memory    int
+	lastSweep time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{packets: make(map[fragmentKey]*fragmentPacket)}
+}
+
+// process adds a fragment, it returns the header of the first fragment and the
+// reassembled payload once all fragments have arrived.
+func (r *reassembler) process(key fragmentKey, offset int, more bool, hdr []byte, payload []byte) ([]byte, []byte) {
+	now := time.Now()
+	if now.Sub(r.lastSweep) > fragmentSweepDelay {
+		r.sweep(now)
+	}
+
+	packet, ok := r.packets[key]
+	if !ok {
+		packet = &fragmentPacket{total: -1, deadline: now.Add(fragmentTimeout)}
+		r.packets[key] = packet
+	}
+
+	end := offset + len(payload)
+	if end > fragmentMaxPacket || more && len(payload)%8 != 0 || packet.total >= 0 && (end > packet.total || !more && end != packet.total) ||
+		len(packet.fragments) >= fragmentMaxCount {
+		r.drop(key, packet)
+		return nil, nil
+	}
+	for _, f := range packet.fragments {
+		if offset < f.offset+len(f.data) && f.offset < end {
+			// overlapping fragments are dropped altogether, see RFC 5722
+			r.drop(key, packet)
+			return nil, nil
+		}
+	}
+	if r.memory+len(payload) > fragmentMemoryLimit {
+		r.evictOldest()
+		if r.memory+len(payload) > fragmentMemoryLimit {
+			r.drop(key, packet)
+			return nil, nil
+		}
+	}
+
+	packet.fragments = append(packet.fragments, fragment{offset, append([]byte(nil), payload...)})
+	packet.size += len(payload)
+	r.memory += len(payload)
+	if offset == 0 {
+		packet.header = append([]byte(nil), hdr...)
+	}
+	if !more {
+		packet.total = end
+	}
+	if packet.total < 0 || packet.header == nil || packet.size != packet.total {
+		return nil, nil
+	}
+
+	sort.Slice(packet.fragments, func(i, j int) bool {
+		return packet.fragments[i].offset < packet.fragments[j].offset
+	})
+	data := make([]byte, 0, packet.total)
+	for _, f := range packet.fragments {
+		data = append(data, f.data...)
+	}
+	r.drop(key, packet)
+	return packet.header, data
+}
+
+func (r *reassembler) drop(key fragmentKey, packet *fragmentPacket) {
+	delete(r.packets, key)
+	r.memory -= packet.size
+}
+
+func (r *reassembler) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, packet := range r.packets {
+		if now.After(packet.deadline) {
+			r.drop(key, packet)
+		}
+	}
+}
+
+func (r *reassembler) evictOldest() {
+	var oldestKey fragmentKey
+	var oldest *fragmentPacket
+	for key, packet := range r.packets {
+		if oldest == nil || packet.deadline.Before(oldest.deadline) {
+			oldestKey, oldest = key, packet
+		}
+	}
+	if oldest != nil {
+		r.drop(oldestKey, oldest)
+	}
+}
+
+// reassembleIPv4 returns the reassembled packet once pkt completes one.
+func (n *SystemTun) reassembleIPv4(pkt *stack.PacketBuffer) *stack.PacketBuffer {
+	ipHdr := header.IPv4(pkt.NetworkHeader().View())
+	key := fragmentKey{
+		source:      ipHdr.SourceAddress(),
+		destination: ipHdr.DestinationAddress(),
+		id:          uint32(ipHdr.ID()),
+		protocol:    ipHdr.Protocol(),
+	}
+	hdr, payload := n.fragments.process(key, int(ipHdr.FragmentOffset()), ipHdr.More(), ipHdr, pkt.Data().AsRange().ToOwnedView())
+	if payload == nil {
+		return nil
+	}
+
+	newHdr := header.IPv4(hdr)
+	if len(hdr)+len(payload) > fragmentMaxPacket {
+		return nil
+	}
+	newHdr.SetFlagsFragmentOffset(0, 0)
+	newHdr.SetTotalLength(uint16(len(hdr) + len(payload)))
+	newHdr.SetChecksum(0)
+	newHdr.SetChecksum(^newHdr.CalculateChecksum())
+	return newPacket(hdr, payload)
+}
+
+// reassembleIPv6 returns the reassembled packet once pkt completes one. Only
+// a fragment header directly following the fixed header is supported.
+func (n *SystemTun) reassembleIPv6(pkt *stack.PacketBuffer, id uint32, offset uint16, more bool) *stack.PacketBuffer {
+	netHdr := pkt.NetworkHeader().View()
+	ipHdr := header.IPv6(netHdr)
+	if ipHdr.NextHeader() != ipv6FragmentHdrIdent || len(netHdr) != header.IPv6MinimumSize+ipv6FragmentHdrSize {
+		return nil
+	}
+	nextHeader := netHdr[header.IPv6MinimumSize]
+	key := fragmentKey{
+		source:      ipHdr.SourceAddress(),
+		destination: ipHdr.DestinationAddress(),
+		id:          id,
+		protocol:    nextHeader,
+	}
+	// offset is in 8 byte units
+	hdr, payload := n.fragments.process(key, int(offset)*8, more, netHdr[:header.IPv6MinimumSize], pkt.Data().AsRange().ToOwnedView())
+	if payload == nil {
+		return nil
+	}
+
+	newHdr := header.IPv6(hdr)
+	newHdr.SetNextHeader(nextHeader)
+	newHdr.SetPayloadLength(uint16(len(payload)))
+	return newPacket(hdr, payload)
+}
+
+func newPacket(hdr []byte, payload []byte) *stack.PacketBuffer {
+	data := buffer.NewVectorisedView(len(hdr)+len(payload), []buffer.View{hdr, payload})
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{Data: data})
+}
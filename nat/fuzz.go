@@ -0,0 +1,96 @@
+//go:build gofuzz
+// +build gofuzz
+
+package nat
+
+import (
+	"io"
+	"sync"
+
+	"github.com/Dreamacro/clash/common/cache"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
+)
+
+// fuzzHandler answers every flow at once, so the rewrite paths of replies
+// run on the fuzzed headers as well.
+type fuzzHandler struct{}
+
+func (fuzzHandler) NewConnection(_ v2rayNet.Destination, _ v2rayNet.Destination, conn v2rayNet.Conn) {
+	conn.Close()
+}
+
+func (fuzzHandler) NewPacket(_ v2rayNet.Destination, _ v2rayNet.Destination, data []byte, writeBack func([]byte, *v2rayNet.UDPAddr) (int, error), closer io.Closer) {
+	_, _ = writeBack(data, nil)
+	closer.Close()
+}
+
+func (fuzzHandler) NewPingPacket(_ v2rayNet.Destination, _ v2rayNet.Destination, message []byte, writeBack func([]byte) error) bool {
+	_ = writeBack(message)
+	return true
+}
+
+var (
+	fuzzTunOnce sync.Once
+	fuzzTun     *SystemTun
+)
+
+// newFuzzTun returns a SystemTun writing to a socketpair that is drained in
+// the background. The tcp forwarder has no listener since only the session
+// table is used.
+func newFuzzTun() *SystemTun {
+	fuzzTunOnce.Do(func() {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		if err == nil {
+			err = unix.SetNonblock(fds[0], true)
+		}
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			drain := make([]byte, 65535)
+			for {
+				if _, err := unix.Read(fds[1], drain); err != nil {
+					return
+				}
+			}
+		}()
+		t := &SystemTun{
+			dev:           int32(fds[0]),
+			mtu:           1500,
+			handler:       fuzzHandler{},
+			ipv6Mode:      comm.IPv6Enable,
+			errorHandler:  func(string) {},
+			multicastMode: comm.MulticastModeReflect,
+			fragments:     newReassembler(),
+		}
+		if t.dispatcher, err = newReadVDispatcher(fds[0], t); err != nil {
+			panic(err)
+		}
+		t.tcpForwarder = &tcpForwarder{tun: t, port: 1, sessions: cache.NewLRUCache(cache.WithAge(300))}
+		fuzzTun = t
+	})
+	return fuzzTun
+}
+
+// Fuzz feeds data to the nat stack as a packet read from the tun, for
+// go-fuzz. Packets of a known ip version are interesting.
+func Fuzz(data []byte) int {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(data).ToVectorisedView(),
+	})
+	defer pkt.DecRef()
+	newFuzzTun().deliverPacket(pkt)
+	if len(data) == 0 {
+		return 0
+	}
+	switch header.IPVersion(data) {
+	case header.IPv4Version, header.IPv6Version:
+		return 1
+	}
+	return 0
+}
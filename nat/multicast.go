@@ -0,0 +1,239 @@
+package nat
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+)
+
+const multicastIdleTimeout = 2 * time.Minute
+
+type multicastKey struct {
+	group tcpip.Address
+	port  uint16
+}
+
+// multicastSession is a protected socket joined to a group on the upstream
+// network, datagrams it receives are written into the tun as sent to the group.
+type multicastSession struct {
+	conn       net.PacketConn
+	lastActive int64
+}
+
+type multicastForwarder struct {
+	tun      *SystemTun
+	control  func(fd uintptr)
+	access   sync.Mutex
+	sessions map[multicastKey]*multicastSession
+}
+
+func newMulticastForwarder(tun *SystemTun, control func(fd uintptr)) *multicastForwarder {
+	return &multicastForwarder{
+		tun:      tun,
+		control:  control,
+		sessions: make(map[multicastKey]*multicastSession),
+	}
+}
+
+// isForwardedMulticast reports whether the system stack handles address
+// itself, link-local groups (mDNS, LLMNR, SSDP...) are left to the handler.
+func isForwardedMulticast(address tcpip.Address) bool {
+	switch len(address) {
+	case header.IPv4AddressSize:
+		return header.IsV4MulticastAddress(address) && !header.IsV4LinkLocalMulticastAddress(address)
+	case header.IPv6AddressSize:
+		return header.IsV6MulticastAddress(address) && !header.IsV6LinkLocalMulticastAddress(address)
+	}
+	return false
+}
+
+func (n *SystemTun) processMulticast(hdr *UDPHeader) {
+	switch n.multicastMode {
+	case comm.MulticastModeForward:
+		if n.multicastForwarder == nil {
+			return
+		}
+		key := multicastKey{hdr.DestinationAddress(), hdr.DestinationPort()}
+		session, err := n.multicastForwarder.session(key)
+		if err != nil {
+			newError("multicast: failed to join group ", net.IP(key.group), ":", key.port).Base(err).AtWarning().WriteToLog()
+			return
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().Unix())
+		data := hdr.Packet().Data().ExtractVV()
+		_, err = session.conn.WriteTo(data.ToView(), &net.UDPAddr{IP: net.IP(key.group), Port: int(key.port)})
+		if err != nil {
+			newError("multicast: failed to send to group ", net.IP(key.group), ":", key.port).Base(err).AtDebug().WriteToLog()
+		}
+	case comm.MulticastModeReflect:
+		n.dispatcher.writePacket(hdr.Packet())
+	}
+}
+
+// processIGMP closes forwarded sessions when the client leaves a group.
+func (n *SystemTun) processIGMP(hdr *IPv4Header) {
+	if n.multicastForwarder == nil {
+		return
+	}
+	view, ok := hdr.Packet().Data().PullUp(header.IGMPMinimumSize)
+	if !ok {
+		return
+	}
+	igmp := header.IGMP(view)
+	if igmp.Type() == header.IGMPLeaveGroup {
+		n.multicastForwarder.leave(igmp.GroupAddress())
+	}
+}
+
+func (f *multicastForwarder) session(key multicastKey) (*multicastSession, error) {
+	f.access.Lock()
+	defer f.access.Unlock()
+
+	if session, ok := f.sessions[key]; ok {
+		return session, nil
+	}
+
+	ipv6 := len(key.group) == header.IPv6AddressSize
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	config := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				if err = reuseAddress(int(fd)); err != nil {
+					return
+				}
+				if f.control != nil {
+					f.control(fd)
+				}
+				err = joinGroup(int(fd), key.group, ipv6)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	address := net.JoinHostPort(net.IP(key.group).String(), strconv.Itoa(int(key.port)))
+	conn, err := config.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	session := &multicastSession{conn: conn, lastActive: time.Now().Unix()}
+	f.sessions[key] = session
+	go f.loop(key, session)
+	return session, nil
+}
+
+func (f *multicastForwarder) loop(key multicastKey, session *multicastSession) {
+	defer func() {
+		f.access.Lock()
+		if f.sessions[key] == session {
+			delete(f.sessions, key)
+		}
+		f.access.Unlock()
+		comm.CloseIgnore(session.conn)
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		_ = session.conn.SetReadDeadline(time.Now().Add(multicastIdleTimeout))
+		length, addr, err := session.conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+				time.Since(time.Unix(atomic.LoadInt64(&session.lastActive), 0)) < multicastIdleTimeout {
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().Unix())
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		source := udpAddr.IP
+		if len(key.group) == header.IPv4AddressSize {
+			source = source.To4()
+		} else {
+			source = source.To16()
+		}
+		if source == nil {
+			continue
+		}
+		packet := buildUDPPacket(tcpip.Address(source), uint16(udpAddr.Port), key.group, key.port, buffer[:length])
+		if err := f.tun.dispatcher.writeBuffer(packet); err != nil {
+			newError("multicast: failed to write packet to device: ", err.String()).AtDebug().WriteToLog()
+		}
+	}
+}
+
+func (f *multicastForwarder) leave(group tcpip.Address) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	for key, session := range f.sessions {
+		if key.group == group {
+			delete(f.sessions, key)
+			comm.CloseIgnore(session.conn)
+		}
+	}
+}
+
+func (f *multicastForwarder) Close() {
+	f.access.Lock()
+	defer f.access.Unlock()
+	for key, session := range f.sessions {
+		delete(f.sessions, key)
+		comm.CloseIgnore(session.conn)
+	}
+}
+
+func buildUDPPacket(sourceAddress tcpip.Address, sourcePort uint16, destinationAddress tcpip.Address, destinationPort uint16, payload []byte) []byte {
+	var hdrLen int
+	if len(destinationAddress) == header.IPv4AddressSize {
+		hdrLen = header.IPv4MinimumSize
+	} else {
+		hdrLen = header.IPv6MinimumSize
+	}
+	packet := make([]byte, hdrLen+header.UDPMinimumSize+len(payload))
+	udpLength := uint16(header.UDPMinimumSize + len(payload))
+
+	if hdrLen == header.IPv4MinimumSize {
+		ipHdr := header.IPv4(packet)
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     sourceAddress,
+			DstAddr:     destinationAddress,
+		})
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	} else {
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     udpLength,
+			TransportProtocol: header.UDPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           sourceAddress,
+			DstAddr:           destinationAddress,
+		})
+	}
+
+	udpHdr := header.UDP(packet[hdrLen:])
+	udpHdr.Encode(&header.UDPFields{
+		SrcPort: sourcePort,
+		DstPort: destinationPort,
+		Length:  udpLength,
+	})
+	copy(packet[hdrLen+header.UDPMinimumSize:], payload)
+	udpHdr.SetChecksum(^udpHdr.CalculateChecksum(header.Checksum(payload, header.PseudoHeaderChecksum(header.UDPProtocolNumber, sourceAddress, destinationAddress, udpLength))))
+	return packet
+}
@@ -0,0 +1,31 @@
+package nat
+
+import (
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func reuseAddress(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
+// joinGroup joins group on the interface the socket is bound to, or on the
+// default one when it is not bound to a device.
+func joinGroup(fd int, group tcpip.Address, ipv6 bool) error {
+	var ifIndex int
+	if name, err := unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE); err == nil && name != "" {
+		if ifreq, err := unix.NewIfreq(name); err == nil {
+			if err = unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, ifreq); err == nil {
+				ifIndex = int(ifreq.Uint32())
+			}
+		}
+	}
+	if ipv6 {
+		mreq := &unix.IPv6Mreq{Interface: uint32(ifIndex)}
+		copy(mreq.Multiaddr[:], group)
+		return unix.SetsockoptIPv6Mreq(fd, unix.IPPROTO_IPV6, unix.IPV6_JOIN_GROUP, mreq)
+	}
+	mreq := &unix.IPMreqn{Ifindex: int32(ifIndex)}
+	copy(mreq.Multiaddr[:], group)
+	return unix.SetsockoptIPMreqn(fd, unix.IPPROTO_IP, unix.IP_ADD_MEMBERSHIP, mreq)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package nat
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func reuseAddress(fd int) error {
+	return newError("multicast forwarding is not supported on this platform")
+}
+
+func joinGroup(fd int, group tcpip.Address, ipv6 bool) error {
+	return newError("multicast forwarding is not supported on this platform")
+}
@@ -31,15 +31,27 @@ type SystemTun struct {
 	ipv6Mode     int32
 	tcpForwarder *tcpForwarder
 	errorHandler func(err string)
+	capture      tun.PacketCapture
+
+	multicastMode      int32
+	multicastForwarder *multicastForwarder
+
+	fragments *reassembler
 }
 
-func New(dev int32, mtu int32, handler tun.Handler, ipv6Mode int32, errorHandler func(err string)) (*SystemTun, error) {
+func New(dev int32, mtu int32, handler tun.Handler, ipv6Mode int32, multicastMode int32, multicastControl func(fd uintptr), errorHandler func(err string), capture tun.PacketCapture) (*SystemTun, error) {
 	t := &SystemTun{
-		dev:          dev,
-		mtu:          mtu,
-		handler:      handler,
-		ipv6Mode:     ipv6Mode,
-		errorHandler: errorHandler,
+		dev:           dev,
+		mtu:           mtu,
+		handler:       handler,
+		ipv6Mode:      ipv6Mode,
+		errorHandler:  errorHandler,
+		capture:       capture,
+		multicastMode: multicastMode,
+		fragments:     newReassembler(),
+	}
+	if multicastMode == comm.MulticastModeForward {
+		t.multicastForwarder = newMulticastForwarder(t, multicastControl)
 	}
 	dispatcher, err := newReadVDispatcher(int(dev), t)
 	if err != nil {
@@ -74,13 +86,32 @@ func (n *SystemTun) deliverPacket(pkt *stack.PacketBuffer) {
 		if !parse.IPv4(pkt) {
 			return
 		}
+		ipv4 := header.IPv4(pkt.NetworkHeader().View())
+		// parse.IPv4 accepts an ihl below 5, the rewrites rely on HeaderLength
+		if int(ipv4.HeaderLength()) < header.IPv4MinimumSize {
+			return
+		}
+		if ipv4.More() || ipv4.FragmentOffset() != 0 {
+			if packet := n.reassembleIPv4(pkt); packet != nil {
+				n.deliverPacket(packet)
+				packet.DecRef()
+			}
+			return
+		}
 		ipHeader = &IPv4Header{pkt, header.IPv4(pkt.NetworkHeader().View())}
 		log += "ipv4: "
 	case header.IPv6Version:
-		proto, _, _, _, ok := parse.IPv6(pkt)
+		proto, fragID, fragOffset, fragMore, ok := parse.IPv6(pkt)
 		if !ok {
 			return
 		}
+		if fragMore || fragOffset != 0 {
+			if packet := n.reassembleIPv6(pkt, fragID, fragOffset, fragMore); packet != nil {
+				n.deliverPacket(packet)
+				packet.DecRef()
+			}
+			return
+		}
 		ipHeader = &IPv6Header{pkt, proto, header.IPv6(pkt.NetworkHeader().View())}
 		log += "ipv6: "
 	default:
@@ -94,7 +125,14 @@ func (n *SystemTun) deliverPacket(pkt *stack.PacketBuffer) {
 			newError(log, "unable to parse").AtWarning().WriteToLog()
 			return
 		}
-		if err := n.tcpForwarder.process(&TCPHeader{ipHeader, header.TCP(pkt.TransportHeader().View())}); err != nil {
+		tcpHdr := header.TCP(pkt.TransportHeader().View())
+		// parse.TCP keeps a data offset beyond the packet, the checksum would
+		// slice past the header
+		if offset := int(tcpHdr.DataOffset()); offset < header.TCPMinimumSize || offset > len(tcpHdr) {
+			newError(log, "invalid data offset").AtWarning().WriteToLog()
+			return
+		}
+		if err := n.tcpForwarder.process(&TCPHeader{ipHeader, tcpHdr}); err != nil {
 			newError(log, "process failed").Base(err).AtWarning().WriteToLog()
 			return
 		}
@@ -105,21 +143,32 @@ func (n *SystemTun) deliverPacket(pkt *stack.PacketBuffer) {
 			newError(log, "unable to parse").AtWarning().WriteToLog()
 			return
 		}
-		n.processUDP(&UDPHeader{ipHeader, header.UDP(pkt.TransportHeader().View())})
+		udpHeader := &UDPHeader{ipHeader, header.UDP(pkt.TransportHeader().View())}
+		if isForwardedMulticast(udpHeader.DestinationAddress()) {
+			n.processMulticast(udpHeader)
+			return
+		}
+		n.processUDP(udpHeader)
 	case header.ICMPv4ProtocolNumber:
 		log += "icmp4: "
-		if !parse.ICMPv4(pkt) {
+		ipv4Header, ok := ipHeader.(*IPv4Header)
+		if !ok || !parse.ICMPv4(pkt) {
 			newError(log, "unable to parse").AtWarning().WriteToLog()
 			return
 		}
-		n.processICMPv4(&ICMPv4Header{ipHeader.(*IPv4Header), header.ICMPv4(pkt.TransportHeader().View())})
+		n.processICMPv4(&ICMPv4Header{ipv4Header, header.ICMPv4(pkt.TransportHeader().View())})
 	case header.ICMPv6ProtocolNumber:
 		log += "icmp6: "
-		if !parse.ICMPv6(pkt) {
+		ipv6Header, ok := ipHeader.(*IPv6Header)
+		if !ok || !parse.ICMPv6(pkt) {
 			newError(log, "unable to parse").AtWarning().WriteToLog()
 			return
 		}
-		n.processICMPv6(&ICMPv6Header{ipHeader.(*IPv6Header), header.ICMPv6(pkt.TransportHeader().View())})
+		n.processICMPv6(&ICMPv6Header{ipv6Header, header.ICMPv6(pkt.TransportHeader().View())})
+	case header.IGMPProtocolNumber:
+		if ipv4Header, ok := ipHeader.(*IPv4Header); ok {
+			n.processIGMP(ipv4Header)
+		}
 	}
 }
 
@@ -144,8 +193,9 @@ func (n *SystemTun) processUDP(hdr *UDPHeader) {
 	hdr.SetDestinationAddress(sourceAddress)
 	hdr.SetDestinationPort(sourcePort)
 
+	tos, _ := hdr.TOS()
 	data := hdr.Packet().Data().ExtractVV()
-	go n.handler.NewPacket(source, destination, data.ToView(), func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
+	writeBack := func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
 		buffer := buf.New()
 		defer buffer.Release()
 
@@ -155,7 +205,8 @@ func (n *SystemTun) processUDP(hdr *UDPHeader) {
 			hdrLen = int(ipHdr.IPv4.HeaderLength())
 			buffer.Write(ipHdr.IPv4[:hdrLen])
 		case *IPv6Header:
-			hdrLen = len(ipHdr.IPv6) - int(ipHdr.IPv6.PayloadLength())
+			// the network header holds the extension headers as well
+			hdrLen = len(ipHdr.IPv6)
 			buffer.Write(ipHdr.IPv6[:hdrLen])
 		}
 		buffer.Write(hdr.UDP[:header.UDPMinimumSize])
@@ -182,7 +233,7 @@ func (n *SystemTun) processUDP(hdr *UDPHeader) {
 		case *IPv6Header:
 			ipHdr := header.IPv6(buffer.Bytes())
 			ipHdr.SetSourceAddress(newSourceAddress)
-			ipHdr.SetPayloadLength(uint16(buffer.Len() - int32(hdrLen)))
+			ipHdr.SetPayloadLength(uint16(buffer.Len() - header.IPv6MinimumSize))
 		}
 
 		udpHdr := header.UDP(buffer.BytesFrom(int32(hdrLen)))
@@ -196,7 +247,13 @@ func (n *SystemTun) processUDP(hdr *UDPHeader) {
 		}
 
 		return len(bytes), nil
-	}, comm.Closer(hdr.Packet().DecRef))
+	}
+	closer := &udpPacketCloser{n, hdr, sourceAddress, destinationAddress, destinationPort}
+	if handler, ok := n.handler.(tun.TrafficClassHandler); ok {
+		go handler.NewPacketWithTrafficClass(source, destination, tos, data.ToView(), writeBack, closer)
+	} else {
+		go n.handler.NewPacket(source, destination, data.ToView(), writeBack, closer)
+	}
 }
 
 func (n *SystemTun) processICMPv4(hdr *ICMPv4Header) {
@@ -298,5 +355,8 @@ func (n *SystemTun) processICMPv6(hdr *ICMPv6Header) {
 func (n *SystemTun) Close() error {
 	n.dispatcher.stop()
 	n.tcpForwarder.Close()
+	if n.multicastForwarder != nil {
+		n.multicastForwarder.Close()
+	}
 	return nil
 }
@@ -1,9 +1,17 @@
 package nat
 
 import (
+	"sync/atomic"
+
 	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
+const (
+	tcpStateClientFin uint32 = 1 << iota
+	tcpStateServerFin
+	tcpStateReset
+)
+
 type peerKey struct {
 	destinationAddress tcpip.Address
 	sourcePort         uint16
@@ -12,4 +20,16 @@ type peerKey struct {
 type peerValue struct {
 	sourceAddress   tcpip.Address
 	destinationPort uint16
+	// tos is the traffic class of the packet that created the session.
+	tos uint8
+
+	// state and closeAt are only used for tcp, closeAt is when both sides
+	// finished or the connection was reset, in unix nanoseconds.
+	state   uint32
+	closeAt int64
+}
+
+func (p *peerValue) closed() bool {
+	state := atomic.LoadUint32(&p.state)
+	return state&tcpStateReset != 0 || state&(tcpStateClientFin|tcpStateServerFin) == tcpStateClientFin|tcpStateServerFin
 }
@@ -2,12 +2,25 @@ package nat
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/Dreamacro/clash/common/cache"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"libcore/comm"
+	"libcore/tun"
+)
+
+const (
+	// tcpTimeWait keeps a finished session long enough for the last acks and
+	// retransmitted fins.
+	tcpTimeWait = 10 * time.Second
+	// tcpResetTimeout keeps a reset session for segments still in flight.
+	tcpResetTimeout = 2 * time.Second
+	// tcpOrphanTimeout drops half closed sessions that stay idle.
+	tcpOrphanTimeout = 2 * time.Minute
 )
 
 type tcpForwarder struct {
@@ -71,7 +84,11 @@ func (t *tcpForwarder) dispatch() (bool, error) {
 	}
 
 	go func() {
-		t.tun.handler.NewConnection(source, destination, conn)
+		if handler, ok := t.tun.handler.(tun.TrafficClassHandler); ok {
+			handler.NewConnectionWithTrafficClass(source, destination, session.tos, conn)
+		} else {
+			t.tun.handler.NewConnection(source, destination, conn)
+		}
 		t.sessions.SetWithExpire(key, session, time.Now().Add(time.Second*10))
 	}()
 
@@ -99,6 +116,8 @@ func (t *tcpForwarder) process(hdr *TCPHeader) error {
 	sourcePort := hdr.SourcePort()
 	destinationPort := hdr.DestinationPort()
 
+	flags := hdr.Flags()
+
 	var session *peerValue
 
 	if sourcePort != t.port {
@@ -107,13 +126,21 @@ func (t *tcpForwarder) process(hdr *TCPHeader) error {
 		iSession, ok := t.sessions.Get(key)
 		if ok {
 			session = iSession.(*peerValue)
-		} else {
+			// a new syn on a finished or different session means the port was reused
+			if flags&(header.TCPFlagSyn|header.TCPFlagAck) == header.TCPFlagSyn &&
+				(session.closed() || session.sourceAddress != sourceAddress || session.destinationPort != destinationPort) {
+				ok = false
+			}
+		}
+		if !ok {
 			/*if hdr.Flags() != header.TCPFlagSyn {
 				return newError("unable to create session: not tcp syn flag")
 			}*/
-			session = &peerValue{sourceAddress, destinationPort}
+			tos, _ := hdr.TOS()
+			session = &peerValue{sourceAddress: sourceAddress, destinationPort: destinationPort, tos: tos}
 			t.sessions.Set(key, session)
 		}
+		t.track(key, session, flags, tcpStateClientFin)
 
 		hdr.SetSourceAddress(destinationAddress)
 		hdr.SetDestinationAddress(hdr.Device())
@@ -125,12 +152,14 @@ func (t *tcpForwarder) process(hdr *TCPHeader) error {
 	} else {
 
 		// device:tcpServerPort -> destinationAddress:sourcePort
-		iSession, ok := t.sessions.Get(peerKey{destinationAddress, destinationPort})
+		key := peerKey{destinationAddress, destinationPort}
+		iSession, ok := t.sessions.Get(key)
 		if ok {
 			session = iSession.(*peerValue)
 		} else {
 			return newError("unknown tcp session with source port ", destinationPort, " to destination address ", destinationAddress)
 		}
+		t.track(key, session, flags, tcpStateServerFin)
 		hdr.SetSourceAddress(destinationAddress)
 		hdr.SetSourcePort(session.destinationPort)
 		hdr.SetDestinationAddress(session.sourceAddress)
@@ -140,6 +169,39 @@ func (t *tcpForwarder) process(hdr *TCPHeader) error {
 	return nil
 }
 
+// track updates the session state from the flags of a segment, fin is the
+// state bit of the sending side. Finished, reset and half closed sessions get
+// a shorter expiry than the default age.
+func (t *tcpForwarder) track(key peerKey, session *peerValue, flags header.TCPFlags, fin uint32) {
+	var update uint32
+	if flags&header.TCPFlagRst != 0 {
+		update = tcpStateReset
+	} else if flags&header.TCPFlagFin != 0 {
+		update = fin
+	}
+	for {
+		state := atomic.LoadUint32(&session.state)
+		if state|update == state || atomic.CompareAndSwapUint32(&session.state, state, state|update) {
+			break
+		}
+	}
+
+	state := atomic.LoadUint32(&session.state)
+	switch {
+	case state&tcpStateReset != 0:
+		atomic.CompareAndSwapInt64(&session.closeAt, 0, time.Now().Add(tcpResetTimeout).UnixNano())
+	case state&(tcpStateClientFin|tcpStateServerFin) == tcpStateClientFin|tcpStateServerFin:
+		atomic.CompareAndSwapInt64(&session.closeAt, 0, time.Now().Add(tcpTimeWait).UnixNano())
+	case state != 0:
+		t.sessions.SetWithExpire(key, session, time.Now().Add(tcpOrphanTimeout))
+		return
+	default:
+		return
+	}
+	// the cache extends the age on every lookup, pin the close deadline again
+	t.sessions.SetWithExpire(key, session, time.Unix(0, atomic.LoadInt64(&session.closeAt)))
+}
+
 func (t *tcpForwarder) Close() error {
 	return t.listener.Close()
 }
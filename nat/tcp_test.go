@@ -0,0 +1,189 @@
+package nat
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Dreamacro/clash/common/cache"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/header/parse"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const testForwarderPort = 40000
+
+var (
+	testApp    = tcpip.Address(net.IPv4(172, 19, 0, 2).To4())
+	testRemote = tcpip.Address(net.IPv4(203, 0, 113, 7).To4())
+	testDevice = tcpip.Address(vlanClient4.To4())
+)
+
+func newTestForwarder() *tcpForwarder {
+	return &tcpForwarder{port: testForwarderPort, sessions: cache.NewLRUCache(cache.WithAge(300), cache.WithUpdateAgeOnGet())}
+}
+
+// tcpPacket builds an ipv4 tcp segment and parses it as deliverPacket does.
+func tcpPacket(t *testing.T, source tcpip.Address, sourcePort uint16, destination tcpip.Address, destinationPort uint16, flags header.TCPFlags, payload string) *TCPHeader {
+	packet := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize+len(payload))
+	ipHdr := header.IPv4(packet)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     source,
+		DstAddr:     destination,
+	})
+	tcpHdr := header.TCP(ipHdr.Payload())
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    sourcePort,
+		DstPort:    destinationPort,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	copy(tcpHdr[header.TCPMinimumSize:], payload)
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(packet).ToVectorisedView()})
+	t.Cleanup(pkt.DecRef)
+	if !parse.IPv4(pkt) || !parse.TCP(pkt) {
+		t.Fatal("unable to parse the test packet")
+	}
+	return &TCPHeader{
+		&IPv4Header{pkt, header.IPv4(pkt.NetworkHeader().View())},
+		header.TCP(pkt.TransportHeader().View()),
+	}
+}
+
+func checkRewrite(t *testing.T, hdr *TCPHeader, source tcpip.Address, sourcePort uint16, destination tcpip.Address, destinationPort uint16) {
+	t.Helper()
+	if hdr.SourceAddress() != source || hdr.SourcePort() != sourcePort {
+		t.Errorf("source %s:%d, want %s:%d", hdr.SourceAddress(), hdr.SourcePort(), source, sourcePort)
+	}
+	if hdr.DestinationAddress() != destination || hdr.DestinationPort() != destinationPort {
+		t.Errorf("destination %s:%d, want %s:%d", hdr.DestinationAddress(), hdr.DestinationPort(), destination, destinationPort)
+	}
+	ipHdr := hdr.IPHeader.(*IPv4Header).IPv4
+	if !ipHdr.IsChecksumValid() {
+		t.Error("invalid ip checksum")
+	}
+	payload := hdr.Packet().Data()
+	if !hdr.TCP.IsChecksumValid(hdr.SourceAddress(), hdr.DestinationAddress(), payload.AsRange().Checksum(), uint16(payload.Size())) {
+		t.Error("invalid tcp checksum")
+	}
+}
+
+func TestTcpProcessRewritesBothDirections(t *testing.T) {
+	forwarder := newTestForwarder()
+
+	syn := tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")
+	if err := forwarder.process(syn); err != nil {
+		t.Fatal(err)
+	}
+	checkRewrite(t, syn, testRemote, 50000, testDevice, testForwarderPort)
+
+	reply := tcpPacket(t, testDevice, testForwarderPort, testRemote, 50000, header.TCPFlagSyn|header.TCPFlagAck, "")
+	if err := forwarder.process(reply); err != nil {
+		t.Fatal(err)
+	}
+	checkRewrite(t, reply, testRemote, 443, testApp, 50000)
+
+	data := tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagAck|header.TCPFlagPsh, "hello")
+	if err := forwarder.process(data); err != nil {
+		t.Fatal(err)
+	}
+	checkRewrite(t, data, testRemote, 50000, testDevice, testForwarderPort)
+}
+
+func TestTcpProcessUnknownReply(t *testing.T) {
+	forwarder := newTestForwarder()
+	reply := tcpPacket(t, testDevice, testForwarderPort, testRemote, 50000, header.TCPFlagAck, "")
+	if err := forwarder.process(reply); err == nil {
+		t.Fatal("reply of an unknown session was accepted")
+	}
+}
+
+func TestTcpProcessTracksClose(t *testing.T) {
+	forwarder := newTestForwarder()
+	key := peerKey{testRemote, 50000}
+
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagFin|header.TCPFlagAck, "")); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := forwarder.sessions.Get(key)
+	session := value.(*peerValue)
+	if session.closed() || atomic.LoadInt64(&session.closeAt) != 0 {
+		t.Fatal("half closed session is closed")
+	}
+
+	if err := forwarder.process(tcpPacket(t, testDevice, testForwarderPort, testRemote, 50000, header.TCPFlagFin|header.TCPFlagAck, "")); err != nil {
+		t.Fatal(err)
+	}
+	if !session.closed() || atomic.LoadInt64(&session.closeAt) == 0 {
+		t.Fatal("session closed by both sides is not closed")
+	}
+}
+
+func TestTcpProcessReset(t *testing.T) {
+	forwarder := newTestForwarder()
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwarder.process(tcpPacket(t, testDevice, testForwarderPort, testRemote, 50000, header.TCPFlagRst, "")); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := forwarder.sessions.Get(peerKey{testRemote, 50000})
+	if session := value.(*peerValue); !session.closed() || atomic.LoadUint32(&session.state)&tcpStateReset == 0 {
+		t.Fatal("reset session is not closed")
+	}
+}
+
+func TestTcpProcessPortReuse(t *testing.T) {
+	forwarder := newTestForwarder()
+	key := peerKey{testRemote, 50000}
+
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := forwarder.sessions.Get(key)
+
+	// a syn to another port of the same address reuses the source port
+	syn := tcpPacket(t, testApp, 50000, testRemote, 80, header.TCPFlagSyn, "")
+	if err := forwarder.process(syn); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := forwarder.sessions.Get(key)
+	if first == second {
+		t.Fatal("reused port kept the previous session")
+	}
+	if port := second.(*peerValue).destinationPort; port != 80 {
+		t.Fatalf("destination port %d, want 80", port)
+	}
+
+	reply := tcpPacket(t, testDevice, testForwarderPort, testRemote, 50000, header.TCPFlagSyn|header.TCPFlagAck, "")
+	if err := forwarder.process(reply); err != nil {
+		t.Fatal(err)
+	}
+	checkRewrite(t, reply, testRemote, 80, testApp, 50000)
+}
+
+func TestTcpProcessKeepsSessionOnRetransmittedSyn(t *testing.T) {
+	forwarder := newTestForwarder()
+	key := peerKey{testRemote, 50000}
+
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := forwarder.sessions.Get(key)
+	if err := forwarder.process(tcpPacket(t, testApp, 50000, testRemote, 443, header.TCPFlagSyn, "")); err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := forwarder.sessions.Get(key); first != second {
+		t.Fatal("retransmitted syn replaced the session")
+	}
+}
@@ -0,0 +1,104 @@
+package nat
+
+import (
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/tun"
+)
+
+// icmpv4AdminProhibited is the communication administratively prohibited code
+// of RFC 1812.
+const icmpv4AdminProhibited header.ICMPv4Code = 13
+
+// udpPacketCloser releases the packet of a udp session and answers it with
+// icmp errors. The packet header has the destination rewritten for replies,
+// the original is restored for the quoted datagram.
+type udpPacketCloser struct {
+	tun                *SystemTun
+	hdr                *UDPHeader
+	sourceAddress      tcpip.Address
+	destinationAddress tcpip.Address
+	destinationPort    uint16
+}
+
+var _ tun.UnreachableWriter = (*udpPacketCloser)(nil)
+
+func (c *udpPacketCloser) Close() error {
+	c.hdr.Packet().DecRef()
+	return nil
+}
+
+func (c *udpPacketCloser) WriteUnreachable(code int) error {
+	var quoted []byte
+	switch ipHdr := c.hdr.IPHeader.(type) {
+	case *IPv4Header:
+		quoted = append(quoted, ipHdr.IPv4[:ipHdr.IPv4.HeaderLength()]...)
+		original := header.IPv4(quoted)
+		original.SetDestinationAddress(c.destinationAddress)
+		original.SetChecksum(0)
+		original.SetChecksum(^original.CalculateChecksum())
+	case *IPv6Header:
+		quoted = append(quoted, ipHdr.IPv6...)
+		header.IPv6(quoted).SetDestinationAddress(c.destinationAddress)
+	}
+	udpStart := len(quoted)
+	quoted = append(quoted, c.hdr.UDP[:header.UDPMinimumSize]...)
+	header.UDP(quoted[udpStart:]).SetDestinationPort(c.destinationPort)
+
+	buffer := buf.New()
+	defer buffer.Release()
+	if c.hdr.Version() == header.IPv4ProtocolNumber {
+		icmpCode := header.ICMPv4HostUnreachable
+		switch code {
+		case tun.UnreachablePort:
+			icmpCode = header.ICMPv4PortUnreachable
+		case tun.UnreachableProhibited:
+			icmpCode = icmpv4AdminProhibited
+		}
+		packet := buffer.Extend(int32(header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(quoted)))
+		ipHdr := header.IPv4(packet)
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     c.destinationAddress,
+			DstAddr:     c.sourceAddress,
+		})
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+		icmpHdr := header.ICMPv4(packet[header.IPv4MinimumSize:])
+		icmpHdr.SetType(header.ICMPv4DstUnreachable)
+		icmpHdr.SetCode(icmpCode)
+		copy(icmpHdr[header.ICMPv4MinimumSize:], quoted)
+		icmpHdr.SetChecksum(^header.Checksum(icmpHdr, 0))
+	} else {
+		icmpCode := header.ICMPv6AddressUnreachable
+		switch code {
+		case tun.UnreachablePort:
+			icmpCode = header.ICMPv6PortUnreachable
+		case tun.UnreachableProhibited:
+			icmpCode = header.ICMPv6Prohibited
+		}
+		packet := buffer.Extend(int32(header.IPv6MinimumSize + header.ICMPv6MinimumSize + len(quoted)))
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(packet) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           c.destinationAddress,
+			DstAddr:           c.sourceAddress,
+		})
+		icmpHdr := header.ICMPv6(packet[header.IPv6MinimumSize:])
+		icmpHdr.SetType(header.ICMPv6DstUnreachable)
+		icmpHdr.SetCode(icmpCode)
+		copy(icmpHdr[header.ICMPv6MinimumSize:], quoted)
+		icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmpHdr,
+			Src:    c.destinationAddress,
+			Dst:    c.sourceAddress,
+		}))
+	}
+	if err := c.tun.dispatcher.writeBuffer(buffer.Bytes()); err != nil {
+		return newError("failed to write icmp error: ", err.String())
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package libcore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLMv2 messages of MS-NLMP, without signing or sealing, which the proxy
+// authentication does not use.
+const (
+	ntlmNegotiateUnicode      = 0x00000001
+	ntlmRequestTarget         = 0x00000004
+	ntlmNegotiateNtlm         = 0x00000200
+	ntlmNegotiateAlwaysSign   = 0x00008000
+	ntlmNegotiateExtendedSec  = 0x00080000
+	ntlmNegotiateTargetInfo   = 0x00800000
+	ntlmNegotiate128          = 0x20000000
+	ntlmNegotiate56           = 0x80000000
+	ntlmAvTimestamp           = 7
+	ntlmAvEOL                 = 0
+	ntlmChallengeMinSize      = 32
+	ntlmAuthenticateHeaderLen = 64
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+const ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNtlm | ntlmNegotiateAlwaysSign |
+	ntlmNegotiateExtendedSec | ntlmNegotiate128 | ntlmNegotiate56
+
+func ntlmNegotiateMessage() []byte {
+	message := new(bytes.Buffer)
+	message.Write(ntlmSignature)
+	writeLittleEndian(message, uint32(1), uint32(ntlmNegotiateFlags))
+	// empty domain and workstation
+	message.Write(make([]byte, 16))
+	return message.Bytes()
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNtlmChallenge(message []byte) (*ntlmChallenge, error) {
+	if len(message) < ntlmChallengeMinSize || !bytes.Equal(message[:8], ntlmSignature) || binary.LittleEndian.Uint32(message[8:]) != 2 {
+		return nil, newError("invalid ntlm challenge")
+	}
+	challenge := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(message[20:]),
+		challenge: message[24:32],
+	}
+	if challenge.flags&ntlmNegotiateTargetInfo != 0 && len(message) >= 48 {
+		length := int(binary.LittleEndian.Uint16(message[40:]))
+		offset := int(binary.LittleEndian.Uint32(message[44:]))
+		if offset+length > len(message) {
+			return nil, newError("invalid ntlm target info")
+		}
+		challenge.targetInfo = message[offset : offset+length]
+	}
+	return challenge, nil
+}
+
+// timestamp returns the server time of the target info, in windows file time.
+func (c *ntlmChallenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || 4+length > len(info) {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	return timestamp
+}
+
+func ntlmUnicode(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	buffer := make([]byte, len(encoded)*2)
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(buffer[i*2:], c)
+	}
+	return buffer
+}
+
+func ntlmHmac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ntlmAuthenticateMessage answers a challenge with NTLMv2 responses, the
+// user may be given as DOMAIN\user.
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, domain, user, password string) ([]byte, error) {
+	if index := strings.IndexByte(user, '\\'); index >= 0 && domain == "" {
+		domain, user = user[:index], user[index+1:]
+	}
+	hash := md4.New()
+	hash.Write(ntlmUnicode(password))
+	ntlmV2Hash := ntlmHmac(hash.Sum(nil), ntlmUnicode(strings.ToUpper(user)+domain))
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	blob := new(bytes.Buffer)
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(challenge.timestamp())
+	blob.Write(clientChallenge)
+	blob.Write(make([]byte, 4))
+	blob.Write(challenge.targetInfo)
+	blob.Write(make([]byte, 4))
+	ntProof := ntlmHmac(ntlmV2Hash, challenge.challenge, blob.Bytes())
+	ntResponse := append(ntProof, blob.Bytes()...)
+	lmResponse := append(ntlmHmac(ntlmV2Hash, challenge.challenge, clientChallenge), clientChallenge...)
+
+	fields := [][]byte{lmResponse, ntResponse, ntlmUnicode(domain), ntlmUnicode(user), nil, nil}
+	message := new(bytes.Buffer)
+	message.Write(ntlmSignature)
+	writeLittleEndian(message, uint32(3))
+	offset := uint32(ntlmAuthenticateHeaderLen)
+	for _, field := range fields {
+		writeLittleEndian(message, uint16(len(field)), uint16(len(field)), offset)
+		offset += uint32(len(field))
+	}
+	writeLittleEndian(message, uint32(ntlmNegotiateFlags&challenge.flags|ntlmNegotiateUnicode))
+	for _, field := range fields {
+		message.Write(field)
+	}
+	return message.Bytes(), nil
+}
+
+func writeLittleEndian(buffer *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		_ = binary.Write(buffer, binary.LittleEndian, value)
+	}
+}
@@ -0,0 +1,165 @@
+package libcore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oocToken is the api token of Open Online Config v1, shared as
+// ooc://BASE64URL(json).
+type oocToken struct {
+	Version    int    `json:"version"`
+	BaseUrl    string `json:"baseUrl"`
+	Secret     string `json:"secret"`
+	UserId     string `json:"userId"`
+	CertSha256 string `json:"certSha256"`
+}
+
+// parseOocToken returns the api url and the certificate pin of an ooc://
+// token.
+func parseOocToken(link string) (string, string, error) {
+	decoded, err := decodeBase64(strings.TrimPrefix(link, "ooc://"))
+	if err != nil {
+		return "", "", newError("invalid ooc token").Base(err)
+	}
+	var token oocToken
+	if err = json.Unmarshal(decoded, &token); err != nil {
+		return "", "", newError("invalid ooc token").Base(err)
+	}
+	if token.Version != 1 {
+		return "", "", newError("unsupported ooc version ", token.Version)
+	}
+	if token.BaseUrl == "" || token.Secret == "" || token.UserId == "" {
+		return "", "", newError("incomplete ooc token")
+	}
+	api := strings.TrimSuffix(token.BaseUrl, "/") + "/" + url.PathEscape(token.Secret) + "/ooc/v1/" + url.PathEscape(token.UserId)
+	return api, token.CertSha256, nil
+}
+
+type shadowsocksServer struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Port     int32  `json:"port"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+
+	PluginName    string `json:"pluginName"`
+	PluginOptions string `json:"pluginOptions"`
+}
+
+// sip008Server is a server of SIP008, which names the fields after the
+// shadowsocks config.
+type sip008Server struct {
+	Id         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int32  `json:"server_port"`
+	Method     string `json:"method"`
+	Password   string `json:"password"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+type onlineConfig struct {
+	// OOC v1
+	Username       string              `json:"username"`
+	BytesUsed      *int64              `json:"bytesUsed"`
+	BytesRemaining *int64              `json:"bytesRemaining"`
+	ExpiryDate     string              `json:"expiryDate"`
+	Protocols      []string            `json:"protocols"`
+	Shadowsocks    []shadowsocksServer `json:"shadowsocks"`
+
+	// SIP008
+	Servers              []sip008Server `json:"servers"`
+	Sip008BytesUsed      *int64         `json:"bytes_used"`
+	Sip008BytesRemaining *int64         `json:"bytes_remaining"`
+}
+
+// parseOnlineConfig reads an OOC v1 or SIP008 document. OOC lists the
+// protocols it carries, nodes of the others are kept from the previous
+// update, SIP008 replaces all nodes.
+func parseOnlineConfig(content []byte) (*subscriptionContent, error) {
+	var config onlineConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, newError("invalid online config").Base(err)
+	}
+	parsed := &subscriptionContent{upload: -1, download: -1, quota: -1, expire: -1}
+	used, remaining := config.Sip008BytesUsed, config.Sip008BytesRemaining
+
+	if config.Protocols != nil {
+		parsed.protocols = make(map[string]bool)
+		parsed.username = config.Username
+		used, remaining = config.BytesUsed, config.BytesRemaining
+		if config.ExpiryDate != "" {
+			if expiry, err := time.Parse(time.RFC3339, config.ExpiryDate); err == nil {
+				parsed.expire = expiry.Unix()
+			}
+		}
+		for _, protocol := range config.Protocols {
+			if protocol != "shadowsocks" {
+				newError("ooc protocol ", protocol, " is not supported").AtDebug().WriteToLog()
+				continue
+			}
+			parsed.protocols["ss"] = true
+			for _, server := range config.Shadowsocks {
+				parsed.nodes = append(parsed.nodes, newShadowsocksNode(server))
+			}
+		}
+	} else {
+		for _, server := range config.Servers {
+			parsed.nodes = append(parsed.nodes, newShadowsocksNode(shadowsocksServer{
+				Id:            server.Id,
+				Name:          server.Remarks,
+				Address:       server.Server,
+				Port:          server.ServerPort,
+				Method:        server.Method,
+				Password:      server.Password,
+				PluginName:    server.Plugin,
+				PluginOptions: server.PluginOpts,
+			}))
+		}
+	}
+	if used != nil {
+		parsed.upload, parsed.download = 0, *used
+		if remaining != nil {
+			parsed.quota = *used + *remaining
+		}
+	}
+	return parsed, nil
+}
+
+// newShadowsocksNode returns the server as a SIP002 link, keyed by its id
+// so renamed servers are reported as changed.
+func newShadowsocksNode(server shadowsocksServer) *SubscriptionNode {
+	link := &url.URL{
+		Scheme:   "ss",
+		User:     url.User(base64.RawURLEncoding.EncodeToString([]byte(server.Method + ":" + server.Password))),
+		Host:     net.JoinHostPort(server.Address, strconv.Itoa(int(server.Port))),
+		Path:     "/",
+		Fragment: server.Name,
+	}
+	if server.PluginName != "" {
+		plugin := server.PluginName
+		if server.PluginOptions != "" {
+			plugin += ";" + server.PluginOptions
+		}
+		link.RawQuery = url.Values{"plugin": {plugin}}.Encode()
+	}
+	node := &SubscriptionNode{
+		Name:     server.Name,
+		Protocol: "ss",
+		Address:  server.Address,
+		Port:     server.Port,
+		Link:     link.String(),
+	}
+	if server.Id != "" {
+		node.Key = "ss|id:" + server.Id
+	}
+	return node
+}
@@ -0,0 +1,109 @@
+package libcore
+
+import (
+	"context"
+	"io"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+	routingSession "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+type balancerOverrider interface {
+	SetOverrideTarget(tag, target string) error
+	GetOverrideTarget(tag string) (string, error)
+}
+
+// trackedConnection is an entry of the tun connection list, it keeps the
+// routing input so connections can be matched against a balancer later, and
+// the link metrics of tcp connections.
+type trackedConnection struct {
+	io.Closer
+	ctx         context.Context
+	destination v2rayNet.Destination
+	pipes       *pipeMeter
+}
+
+// SwitchOutbound makes balancer select target. Connections currently going
+// through another outbound of the balancer are reset unless keepConnections
+// is set, in which case they stay on the old outbound until they close.
+func (instance *V2RayInstance) SwitchOutbound(balancer string, target string, keepConnections bool) error {
+	overrider, ok := instance.router.(balancerOverrider)
+	if !ok {
+		return withCode(ErrorCodeInvalidState, newError("router does not support balancer override"))
+	}
+
+	var affected []io.Closer
+	if !keepConnections {
+		instance.tunnels.Range(func(key, _ interface{}) bool {
+			t := key.(*Tun2ray)
+			t.connectionsLock.Lock()
+			for item := t.connections.Front(); item != nil; item = item.Next() {
+				conn := item.Value.(*trackedConnection)
+				route := instance.routeOf(conn.ctx, conn.destination)
+				if route == nil || route.GetOutboundTag() == target {
+					continue
+				}
+				for _, group := range route.GetOutboundGroupTags() {
+					if group == balancer {
+						affected = append(affected, conn)
+						break
+					}
+				}
+			}
+			t.connectionsLock.Unlock()
+			return true
+		})
+	}
+
+	if err := overrider.SetOverrideTarget(balancer, target); err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("failed to switch balancer ", balancer).Base(err))
+	}
+	for _, conn := range affected {
+		_ = conn.Close()
+	}
+	if len(affected) > 0 {
+		newError("reset ", len(affected), " connections after switching ", balancer, " to ", target).AtInfo().WriteToLog()
+	}
+	return nil
+}
+
+// SelectOutbound makes the selector groupTag, a balancer, use outboundTag
+// for new connections and resets the connections through its other
+// outbounds, for the node picker of the app.
+func (instance *V2RayInstance) SelectOutbound(groupTag string, outboundTag string) error {
+	if instance.outboundManager == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	if instance.outboundManager.GetHandler(outboundTag) == nil {
+		return withCode(ErrorCodeInvalidArgument, newError("non existing tag: ", outboundTag))
+	}
+	return instance.SwitchOutbound(groupTag, outboundTag, false)
+}
+
+// GetSelected returns the outbound selected in groupTag with SelectOutbound,
+// or an empty string if its strategy picks the outbound.
+func (instance *V2RayInstance) GetSelected(groupTag string) (string, error) {
+	overrider, ok := instance.router.(balancerOverrider)
+	if !ok {
+		return "", withCode(ErrorCodeInvalidState, newError("router does not support balancer override"))
+	}
+	target, err := overrider.GetOverrideTarget(groupTag)
+	if err != nil {
+		return "", withCode(ErrorCodeInvalidArgument, newError("failed to get balancer ", groupTag).Base(err))
+	}
+	return target, nil
+}
+
+func (instance *V2RayInstance) routeOf(ctx context.Context, destination v2rayNet.Destination) routing.Route {
+	if instance.router == nil {
+		return nil
+	}
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+	route, err := instance.router.PickRoute(routingSession.AsRoutingContext(ctx))
+	if err != nil {
+		return nil
+	}
+	return route
+}
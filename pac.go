@@ -0,0 +1,297 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/protocol"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/proxy/freedom"
+	v2rayHttp "github.com/v2fly/v2ray-core/v5/proxy/http"
+	"github.com/v2fly/v2ray-core/v5/proxy/socks"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	v2rayTls "github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+)
+
+const (
+	// PacTagDirect is the outbound registered for the DIRECT result of a pac
+	// file, proxies are registered as pac-<type>-<host:port>.
+	PacTagDirect = "pac-direct"
+
+	pacCacheSize    = 1024
+	pacFailureTTL   = 30 * time.Second
+	pacFetchTimeout = 30 * time.Second
+	pacMaxSize      = 1024 * 1024
+)
+
+// pacRouter routes connections by the result of FindProxyForURL for their
+// sniffed domain, or their address without one. Results are cached per url
+// until the pac file is replaced, failures of the script for pacFailureTTL.
+type pacRouter struct {
+	access   sync.Mutex
+	instance *V2RayInstance
+	program  *pacProgram
+	cache    map[string]pacCacheEntry
+	tags     []string
+}
+
+// pacCacheEntry is a cached outbound tag, expire is zero unless the script
+// failed.
+type pacCacheEntry struct {
+	tag    string
+	expire time.Time
+}
+
+func (r *pacRouter) resolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	if r.instance.dnsClient == nil {
+		return ""
+	}
+	ips, err := r.instance.dnsClient.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return ""
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ips[0].String()
+}
+
+// pacUrl builds the url passed to FindProxyForURL, the scheme is guessed
+// from the port.
+func pacUrl(host string, port uint16) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	switch port {
+	case 80:
+		return "http://" + host + "/"
+	case 443, 0:
+		return "https://" + host + "/"
+	}
+	return "https://" + host + ":" + strconv.Itoa(int(port)) + "/"
+}
+
+// route returns the outbound tag for a connection, or an empty string if the
+// script fails or returns nothing usable.
+func (r *pacRouter) route(rc *ruleContext) string {
+	host := rc.domain
+	if host == "" && len(rc.ips) > 0 {
+		host = rc.ips[0].String()
+	}
+	if host == "" {
+		return ""
+	}
+	link := pacUrl(host, rc.port)
+
+	r.access.Lock()
+	entry, ok := r.cache[link]
+	r.access.Unlock()
+	if ok && (entry.expire.IsZero() || time.Now().Before(entry.expire)) {
+		return entry.tag
+	}
+	// the script may resolve names, whose queries are routed here as well,
+	// so it runs without holding the lock
+	result, err := r.program.findProxy(link, host, r.resolve)
+	r.access.Lock()
+	defer r.access.Unlock()
+	if err != nil {
+		newError("pac: FindProxyForURL failed for ", link).Base(err).AtWarning().WriteToLog()
+		r.store(link, pacCacheEntry{expire: time.Now().Add(pacFailureTTL)})
+		return ""
+	}
+	tag, err := r.outbound(result)
+	if err != nil {
+		newError("pac: unusable result ", result, " for ", link).Base(err).AtWarning().WriteToLog()
+	}
+	r.store(link, pacCacheEntry{tag: tag})
+	newError("pac: ", link, " returned ", result, ", taking detour [", tag, "]").AtDebug().WriteToLog()
+	return tag
+}
+
+func (r *pacRouter) store(link string, entry pacCacheEntry) {
+	if len(r.cache) >= pacCacheSize {
+		r.cache = make(map[string]pacCacheEntry)
+	}
+	r.cache[link] = entry
+}
+
+// outbound maps the first usable entry of a FindProxyForURL result to an
+// outbound, registering it on first use.
+func (r *pacRouter) outbound(result string) (string, error) {
+	var lastErr error
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			return PacTagDirect, r.register(PacTagDirect, &freedom.Config{}, nil)
+		}
+		if len(fields) < 2 {
+			lastErr = newError("missing server in ", entry)
+			continue
+		}
+		server, err := v2rayNet.ParseDestination("tcp:" + fields[1])
+		if err != nil {
+			lastErr = newError("invalid server in ", entry).Base(err)
+			continue
+		}
+		endpoint := []*protocol.ServerEndpoint{{
+			Address: v2rayNet.NewIPOrDomain(server.Address),
+			Port:    uint32(server.Port),
+		}}
+		tag := "pac-" + strings.ToLower(kind) + "-" + server.NetAddr()
+		switch kind {
+		case "PROXY", "HTTP":
+			err = r.register(tag, &v2rayHttp.ClientConfig{Server: endpoint}, nil)
+		case "HTTPS":
+			tlsConfig := &v2rayTls.Config{}
+			if server.Address.Family().IsDomain() {
+				tlsConfig.ServerName = server.Address.Domain()
+			}
+			stream := &internet.StreamConfig{SecurityType: serial.GetMessageType(tlsConfig)}
+			stream.SecuritySettings = append(stream.SecuritySettings, serial.ToTypedMessage(tlsConfig))
+			err = r.register(tag, &v2rayHttp.ClientConfig{Server: endpoint}, &proxyman.SenderConfig{StreamSettings: stream})
+		case "SOCKS", "SOCKS5":
+			err = r.register(tag, &socks.ClientConfig{Server: endpoint, Version: socks.Version_SOCKS5}, nil)
+		case "SOCKS4":
+			err = r.register(tag, &socks.ClientConfig{Server: endpoint, Version: socks.Version_SOCKS4A}, nil)
+		default:
+			err = newError("unknown proxy type ", fields[0])
+		}
+		if err == nil {
+			return tag, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = newError("empty result")
+	}
+	return "", lastErr
+}
+
+func (r *pacRouter) register(tag string, proxySettings proto.Message, senderSettings *proxyman.SenderConfig) error {
+	manager := r.instance.outboundManager
+	if manager.GetHandler(tag) != nil {
+		return nil
+	}
+	config := &core.OutboundHandlerConfig{
+		Tag:           tag,
+		ProxySettings: serial.ToTypedMessage(proxySettings),
+	}
+	if senderSettings != nil {
+		config.SenderSettings = serial.ToTypedMessage(senderSettings)
+	}
+	handler, err := core.CreateObject(r.instance.core, config)
+	if err != nil {
+		return err
+	}
+	if err = manager.AddHandler(context.Background(), handler.(outbound.Handler)); err != nil {
+		return err
+	}
+	r.tags = append(r.tags, tag)
+	return nil
+}
+
+// close removes the outbounds registered for the pac file.
+func (r *pacRouter) close() {
+	r.access.Lock()
+	defer r.access.Unlock()
+	for _, tag := range r.tags {
+		if handler := r.instance.outboundManager.GetHandler(tag); handler != nil {
+			_ = r.instance.outboundManager.RemoveHandler(context.Background(), tag)
+			_ = handler.Close()
+		}
+	}
+	r.tags = nil
+}
+
+// LoadPac evaluates script as a proxy auto-config file for every connection
+// after the rules and the route script, see scripteval.go for the supported
+// JavaScript. An empty script removes it.
+func (instance *V2RayInstance) LoadPac(script string) error {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	var pac *pacRouter
+	if strings.TrimSpace(script) != "" {
+		program, err := compilePac(script)
+		if err != nil {
+			return withCode(ErrorCodeConfigInvalid, newError("compile pac").Base(err))
+		}
+		pac = &pacRouter{instance: instance, program: program, cache: make(map[string]pacCacheEntry)}
+		if err = program.initialize(pac.resolve); err != nil {
+			return withCode(ErrorCodeConfigInvalid, newError("initialize pac").Base(err))
+		}
+	}
+	router.storePac(pac)
+	return nil
+}
+
+// LoadPacUrl downloads a pac file through the outbound tagged viaOutbound,
+// or directly if it is empty, and loads it.
+func (instance *V2RayInstance) LoadPacUrl(link string, viaOutbound string) error {
+	client := &http.Client{
+		Timeout: pacFetchTimeout,
+		Transport: withTlsKeyLog(&http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				portNum, err := strconv.Atoi(port)
+				if err != nil {
+					return nil, err
+				}
+				return instance.dialVia(ctx, host, int32(portNum), viaOutbound)
+			},
+		}),
+	}
+	resp, err := client.Get(link)
+	if err != nil {
+		return withCode(ErrorCodeNetworkUnreachable, newError("failed to download pac").Base(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return exportError(newError("pac url returned status ", resp.StatusCode))
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, pacMaxSize))
+	if err != nil {
+		return exportError(newError("failed to download pac").Base(err))
+	}
+	return instance.LoadPac(string(content))
+}
+
+// FindProxyForUrl evaluates the loaded pac file, returning its raw result.
+func (instance *V2RayInstance) FindProxyForUrl(link string, host string) (string, error) {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return "", err
+	}
+	pac := router.pac.Load().(*pacRouter)
+	if pac == nil {
+		return "", withCode(ErrorCodeInvalidState, newError("no pac loaded"))
+	}
+	result, err := pac.program.findProxy(link, host, pac.resolve)
+	return result, exportError(err)
+}
@@ -0,0 +1,118 @@
+package libcore
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+)
+
+// testPacDns resolves through lookup.
+type testPacDns struct {
+	dns.Client
+	lookup func(host string) ([]net.IP, error)
+}
+
+func (d *testPacDns) LookupIP(host string) ([]net.IP, error) {
+	return d.lookup(host)
+}
+
+// testPacOutbounds has every outbound registered already.
+type testPacOutbounds struct {
+	outbound.Manager
+}
+
+func (testPacOutbounds) GetHandler(string) outbound.Handler {
+	return testPacHandler{}
+}
+
+type testPacHandler struct {
+	outbound.Handler
+}
+
+func TestPacRouteResolve(t *testing.T) {
+	program, err := compilePac(`
+function FindProxyForURL(url, host) {
+	if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) {
+		return "SOCKS5 lan:1080";
+	}
+	return "DIRECT";
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &pacRouter{program: program, cache: make(map[string]pacCacheEntry)}
+	var server string
+	router.instance = &V2RayInstance{
+		outboundManager: testPacOutbounds{},
+		dnsClient: &testPacDns{lookup: func(host string) ([]net.IP, error) {
+			// the query of the dns server is routed while the script waits
+			done := make(chan string)
+			go func() {
+				done <- router.route(&ruleContext{ips: []net.IP{net.ParseIP("8.8.8.8")}, port: 53})
+			}()
+			server = <-done
+			if host == "intranet.test" {
+				return []net.IP{net.ParseIP("10.0.0.1")}, nil
+			}
+			return nil, newError("no such host")
+		}},
+	}
+	if err = program.initialize(router.resolve); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		done <- router.route(&ruleContext{domain: "intranet.test", port: 80})
+	}()
+	select {
+	case tag := <-done:
+		if tag != "pac-socks5-lan:1080" {
+			t.Errorf("intranet.test took %q", tag)
+		}
+		if server != PacTagDirect {
+			t.Errorf("dns server took %q", server)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("routing the query of dnsResolve deadlocked")
+	}
+}
+
+func TestPacRouteFailureCached(t *testing.T) {
+	program, err := compilePac(`
+function FindProxyForURL(url, host) {
+	return isResolvable(host) ? fail() : "DIRECT";
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lookups int
+	router := &pacRouter{program: program, cache: make(map[string]pacCacheEntry)}
+	router.instance = &V2RayInstance{
+		outboundManager: testPacOutbounds{},
+		dnsClient: &testPacDns{lookup: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}},
+	}
+	if err = program.initialize(router.resolve); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if tag := router.route(&ruleContext{domain: "broken.test", port: 443}); tag != "" {
+			t.Fatalf("a failed script took %q", tag)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("the failed script ran %d times", lookups)
+	}
+	router.cache["https://broken.test/"] = pacCacheEntry{expire: time.Now()}
+	router.route(&ruleContext{domain: "broken.test", port: 443})
+	if lookups != 2 {
+		t.Fatal("an expired failure was not retried")
+	}
+}
@@ -0,0 +1,87 @@
+package libcore
+
+import (
+	"io"
+	"sync"
+
+	"libcore/tun"
+)
+
+const packetFlowQueueSize = 256
+
+// PacketFlow writes packets to the system for apps without a tun fd, like an
+// iOS NEPacketTunnelProvider passing them to its packetFlow. The app reads the
+// packets of the system and passes them to Tun2ray.InputPacket.
+type PacketFlow interface {
+	WritePacket(packet []byte) error
+}
+
+var _ tun.Device = (*packetFlowDevice)(nil)
+
+type packetFlowDevice struct {
+	flow    PacketFlow
+	mtu     int
+	packets chan []byte
+	done    chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newPacketFlowDevice(flow PacketFlow, mtu int) *packetFlowDevice {
+	return &packetFlowDevice{
+		flow:    flow,
+		mtu:     mtu,
+		packets: make(chan []byte, packetFlowQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (d *packetFlowDevice) Name() string {
+	return "packetflow"
+}
+
+func (d *packetFlowDevice) MTU() int {
+	return d.mtu
+}
+
+func (d *packetFlowDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.packets:
+		return copy(p, packet), nil
+	case <-d.done:
+		return 0, io.EOF
+	}
+}
+
+func (d *packetFlowDevice) Write(p []byte) (int, error) {
+	if err := d.flow.WritePacket(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// input queues a packet from the app, dropping it if the stack falls behind
+// like a full tun queue would.
+func (d *packetFlowDevice) input(packet []byte) {
+	select {
+	case d.packets <- packet:
+	case <-d.done:
+	default:
+	}
+}
+
+func (d *packetFlowDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	return nil
+}
+
+// InputPacket passes a packet read by the app to the tun created with a
+// PacketFlow, the slice is kept and must not be reused.
+func (t *Tun2ray) InputPacket(packet []byte) {
+	nic := t.primaryNic()
+	if nic.flow != nil {
+		nic.flow.input(packet)
+	}
+}
@@ -0,0 +1,315 @@
+package libcore
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	pacMaxSteps    = 200000
+	pacTimeout     = 50 * time.Millisecond
+	pacMaxResolves = 32
+)
+
+// pacProgram is a proxy auto-config file compiled for the script evaluator,
+// see scripteval.go for the supported subset of JavaScript.
+type pacProgram struct {
+	body    []scriptStatement
+	globals *scriptScope
+}
+
+func compilePac(source string) (*pacProgram, error) {
+	body, err := parseScript(source)
+	if err != nil {
+		return nil, err
+	}
+	return &pacProgram{body: body}, nil
+}
+
+// pacContext is what the builtins of one evaluation see.
+type pacContext struct {
+	now      time.Time
+	resolve  func(host string) string
+	resolved map[string]string
+	env      *scriptEnv
+}
+
+func newPacContext(resolve func(string) string) *pacContext {
+	return &pacContext{now: time.Now(), resolve: resolve, resolved: make(map[string]string)}
+}
+
+// newPacEnv starts an evaluation with the builtins of a new context.
+func newPacEnv(resolve func(string) string) *scriptEnv {
+	c := newPacContext(resolve)
+	c.env = newScriptEnv(pacMaxSteps, pacTimeout, c.lookup)
+	return c.env
+}
+
+// resolveHost resolves host once per evaluation, the time spent waiting for
+// the answer does not count toward the deadline of the script. Hosts past
+// the first pacMaxResolves do not resolve.
+func (c *pacContext) resolveHost(host string) string {
+	if ip, ok := c.resolved[host]; ok {
+		return ip
+	}
+	if len(c.resolved) >= pacMaxResolves {
+		return ""
+	}
+	var ip string
+	if c.env != nil {
+		c.env.exclude(func() { ip = c.resolve(host) })
+	} else {
+		ip = c.resolve(host)
+	}
+	c.resolved[host] = ip
+	return ip
+}
+
+// lookup provides the builtins to the evaluator.
+func (c *pacContext) lookup(name string) (scriptValue, bool) {
+	builtin, ok := pacBuiltins[name]
+	if !ok {
+		return nil, false
+	}
+	return scriptBuiltin(func(args []scriptValue) (scriptValue, error) {
+		return builtin(c, args)
+	}), true
+}
+
+// builtins of the PAC specification
+
+var pacBuiltins map[string]func(c *pacContext, args []scriptValue) (scriptValue, error)
+
+func init() {
+	pacBuiltins = map[string]func(c *pacContext, args []scriptValue) (scriptValue, error){
+		"isPlainHostName": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return !strings.Contains(scriptArg(args, 0), "."), nil
+		},
+		"dnsDomainIs": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return strings.HasSuffix(strings.ToLower(scriptArg(args, 0)), strings.ToLower(scriptArg(args, 1))), nil
+		},
+		"localHostOrDomainIs": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			host, domain := strings.ToLower(scriptArg(args, 0)), strings.ToLower(scriptArg(args, 1))
+			if strings.Contains(host, ".") {
+				return host == domain, nil
+			}
+			return strings.HasPrefix(domain, host+"."), nil
+		},
+		"isResolvable": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return c.resolveHost(scriptArg(args, 0)) != "", nil
+		},
+		"dnsResolve": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			if ip := c.resolveHost(scriptArg(args, 0)); ip != "" {
+				return ip, nil
+			}
+			return nil, nil
+		},
+		"isInNet": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			host := scriptArg(args, 0)
+			ip := net.ParseIP(host)
+			if ip == nil {
+				ip = net.ParseIP(c.resolveHost(host))
+			}
+			pattern, mask := net.ParseIP(scriptArg(args, 1)), net.ParseIP(scriptArg(args, 2))
+			if ip == nil || pattern == nil || mask == nil {
+				return false, nil
+			}
+			ip, pattern, mask = ip.To16(), pattern.To16(), mask.To16()
+			if ip.To4() != nil && pattern.To4() != nil {
+				ip, pattern, mask = ip.To4(), pattern.To4(), mask.To4()
+			}
+			if mask == nil || len(ip) != len(pattern) {
+				return false, nil
+			}
+			return ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+		},
+		"convert_addr": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			ip := net.ParseIP(scriptArg(args, 0)).To4()
+			if ip == nil {
+				return float64(0), nil
+			}
+			return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+		},
+		"myIpAddress": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return pacLocalAddress(), nil
+		},
+		"dnsDomainLevels": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return float64(strings.Count(scriptArg(args, 0), ".")), nil
+		},
+		"shExpMatch": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return pacShellMatch(scriptArg(args, 0), scriptArg(args, 1)), nil
+		},
+		"weekdayRange": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return pacWeekdayRange(c, args), nil
+		},
+		"timeRange": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return pacTimeRange(c, args), nil
+		},
+		"dateRange": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			return pacDateRange(c, args), nil
+		},
+		"alert": func(c *pacContext, args []scriptValue) (scriptValue, error) {
+			newError("pac: ", scriptArg(args, 0)).AtDebug().WriteToLog()
+			return nil, nil
+		},
+	}
+}
+
+func pacShellMatch(s string, pattern string) bool {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expression.WriteString("$")
+	matched, _ := regexp.MatchString(expression.String(), s)
+	return matched
+}
+
+func pacLocalAddress() string {
+	addresses, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok && !network.IP.IsLoopback() && network.IP.To4() != nil {
+				return network.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+// pacClock returns the time in the zone selected by a trailing "GMT"
+// argument, and the arguments without it.
+func pacClock(c *pacContext, args []scriptValue) (time.Time, []scriptValue) {
+	now := c.now
+	if len(args) > 0 && scriptString(args[len(args)-1]) == "GMT" {
+		return now.UTC(), args[:len(args)-1]
+	}
+	return now, args
+}
+
+var pacWeekdays = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+
+func pacWeekdayRange(c *pacContext, args []scriptValue) bool {
+	now, args := pacClock(c, args)
+	if len(args) == 0 {
+		return false
+	}
+	from, ok := pacWeekdays[scriptString(args[0])]
+	if !ok {
+		return false
+	}
+	to := from
+	if len(args) > 1 {
+		if to, ok = pacWeekdays[scriptString(args[1])]; !ok {
+			return false
+		}
+	}
+	return pacInRange(int(now.Weekday()), from, to)
+}
+
+// pacInRange checks from <= value <= to, wrapping around if from > to.
+func pacInRange(value, from, to int) bool {
+	if from <= to {
+		return value >= from && value <= to
+	}
+	return value >= from || value <= to
+}
+
+func pacTimeRange(c *pacContext, args []scriptValue) bool {
+	now, args := pacClock(c, args)
+	numbers := make([]int, len(args))
+	for i, arg := range args {
+		numbers[i] = int(scriptNumber(arg))
+	}
+	seconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(numbers) {
+	case 1:
+		return now.Hour() == numbers[0]
+	case 2:
+		return pacInRange(now.Hour(), numbers[0], numbers[1]-1) || numbers[0] == numbers[1] && now.Hour() == numbers[0]
+	case 4:
+		return pacInRange(seconds, numbers[0]*3600+numbers[1]*60, numbers[2]*3600+numbers[3]*60-1)
+	case 6:
+		return pacInRange(seconds, numbers[0]*3600+numbers[1]*60+numbers[2], numbers[3]*3600+numbers[4]*60+numbers[5])
+	}
+	return false
+}
+
+var pacMonths = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+// pacDateRange supports ranges of a single kind: days of the month, months
+// or years, e.g. dateRange(1, 15), dateRange("JAN", "MAR") or
+// dateRange(2022).
+func pacDateRange(c *pacContext, args []scriptValue) bool {
+	now, args := pacClock(c, args)
+	if len(args) == 0 || len(args) > 2 {
+		return false
+	}
+	values := make([]int, len(args))
+	var kind string
+	for i, arg := range args {
+		if month, ok := pacMonths[scriptString(arg)]; ok {
+			values[i] = month
+			kind = "month"
+			continue
+		}
+		number := int(scriptNumber(arg))
+		switch {
+		case number > 31:
+			kind = "year"
+		case kind == "":
+			kind = "day"
+		}
+		values[i] = number
+	}
+	from, to := values[0], values[len(values)-1]
+	switch kind {
+	case "month":
+		return pacInRange(int(now.Month()), from, to)
+	case "year":
+		return now.Year() >= from && now.Year() <= to
+	}
+	return pacInRange(now.Day(), from, to)
+}
+
+// initialize runs the top level statements once, defining the functions and
+// globals.
+func (p *pacProgram) initialize(resolve func(string) string) error {
+	p.globals = newScriptScope(nil)
+	env := newPacEnv(resolve)
+	if _, _, err := execScriptStatements(env, p.globals, p.body); err != nil {
+		return err
+	}
+	if _, ok := p.globals.vars["FindProxyForURL"].(*scriptFunction); !ok {
+		return newError("FindProxyForURL is not defined")
+	}
+	return nil
+}
+
+// findProxy calls FindProxyForURL on a copy of the globals, so calls may run
+// concurrently once the program is initialized.
+func (p *pacProgram) findProxy(url string, host string, resolve func(string) string) (string, error) {
+	env := newPacEnv(resolve)
+	globals := p.globals.clone()
+	result, err := scriptInvoke(env, globals.vars["FindProxyForURL"], []scriptValue{url, host})
+	if err != nil {
+		return "", err
+	}
+	if result, ok := result.(string); ok {
+		return result, nil
+	}
+	return "", newError("FindProxyForURL returned ", scriptTypeOf(result))
+}
@@ -0,0 +1,182 @@
+package libcore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testPacScript = `
+var direct = "DIRECT";
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".local")) {
+		return direct;
+	}
+	if (shExpMatch(url, "https://*.example.com/*")) {
+		return "PROXY example:8080";
+	}
+	if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) {
+		return "SOCKS5 lan:1080";
+	}
+	return "PROXY default:3128; DIRECT";
+}
+`
+
+func testPacResolve(host string) string {
+	if host == "intranet.test" {
+		return "10.0.0.1"
+	}
+	return ""
+}
+
+func TestPacFindProxy(t *testing.T) {
+	program, err := compilePac(testPacScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = program.initialize(testPacResolve); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url, host string
+		want      string
+	}{
+		{"http://printer/", "printer", "DIRECT"},
+		{"http://nas.local/", "nas.local", "DIRECT"},
+		{"https://www.example.com/", "www.example.com", "PROXY example:8080"},
+		{"http://intranet.test/", "intranet.test", "SOCKS5 lan:1080"},
+		{"http://other.test/", "other.test", "PROXY default:3128; DIRECT"},
+	} {
+		got, err := program.findProxy(test.url, test.host, testPacResolve)
+		if err != nil {
+			t.Fatalf("%s: %v", test.url, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestPacInitializeErrors(t *testing.T) {
+	for _, source := range []string{
+		"var a = 1;",
+		"var FindProxyForURL = 'DIRECT';",
+		"while (true) {}",
+	} {
+		program, err := compilePac(source)
+		if err != nil {
+			t.Fatalf("compile %q: %v", source, err)
+		}
+		if err = program.initialize(testPacResolve); err == nil {
+			t.Errorf("%q initialized", source)
+		}
+	}
+}
+
+func TestPacFindProxyResult(t *testing.T) {
+	program, err := compilePac("function FindProxyForURL(url, host) { return 1; }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = program.initialize(testPacResolve); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = program.findProxy("http://a/", "a", testPacResolve); err == nil {
+		t.Fatal("a number was taken as a proxy list")
+	}
+}
+
+func TestPacFindProxyGlobals(t *testing.T) {
+	program, err := compilePac(`
+var calls = [];
+function count() { calls.push(1); return calls.length; }
+function FindProxyForURL(url, host) { return "PROXY p:" + count(); }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = program.initialize(testPacResolve); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := program.findProxy("http://a/", "a", testPacResolve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "PROXY p:1" {
+			t.Fatalf("call %d returned %q, globals are shared", i, got)
+		}
+	}
+}
+
+func TestPacSlowResolve(t *testing.T) {
+	program, err := compilePac(testPacScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = program.initialize(testPacResolve); err != nil {
+		t.Fatal(err)
+	}
+	var lookups int
+	slowResolve := func(host string) string {
+		lookups++
+		time.Sleep(2 * pacTimeout)
+		return testPacResolve(host)
+	}
+	got, err := program.findProxy("http://intranet.test/", "intranet.test", slowResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "SOCKS5 lan:1080" {
+		t.Fatalf("got %q", got)
+	}
+	if lookups != 1 {
+		t.Fatalf("resolved %d times", lookups)
+	}
+}
+
+func TestPacResolveLimit(t *testing.T) {
+	context := newPacContext(testPacResolve)
+	for i := 0; i < pacMaxResolves; i++ {
+		context.resolveHost(strconv.Itoa(i) + ".test")
+	}
+	if ip := context.resolveHost("intranet.test"); ip != "" {
+		t.Fatalf("resolved %s past the limit", ip)
+	}
+}
+
+func TestPacBuiltins(t *testing.T) {
+	context := newPacContext(testPacResolve)
+	for _, test := range []struct {
+		name string
+		args []scriptValue
+		want scriptValue
+	}{
+		{"localHostOrDomainIs", []scriptValue{"www", "www.example.com"}, true},
+		{"localHostOrDomainIs", []scriptValue{"www.other.com", "www.example.com"}, false},
+		{"isResolvable", []scriptValue{"intranet.test"}, true},
+		{"isResolvable", []scriptValue{"other.test"}, false},
+		{"dnsResolve", []scriptValue{"other.test"}, nil},
+		{"convert_addr", []scriptValue{"1.2.3.4"}, float64(0x01020304)},
+		{"dnsDomainLevels", []scriptValue{"a.b.c"}, float64(2)},
+		{"shExpMatch", []scriptValue{"a.b", "a?b"}, true},
+		{"shExpMatch", []scriptValue{"axxb", "a?b"}, false},
+		{"isInNet", []scriptValue{"192.168.1.1", "192.168.0.0", "255.255.0.0"}, true},
+		{"isInNet", []scriptValue{"192.169.1.1", "192.168.0.0", "255.255.0.0"}, false},
+	} {
+		builtin, ok := context.lookup(test.name)
+		if !ok {
+			t.Fatalf("%s is not a builtin", test.name)
+		}
+		got, err := builtin.(scriptBuiltin)(test.args)
+		if err != nil {
+			t.Fatalf("%s%v: %v", test.name, test.args, err)
+		}
+		if got != test.want {
+			t.Errorf("%s%v: got %#v, want %#v", test.name, test.args, got, test.want)
+		}
+	}
+	if _, ok := context.lookup("eval"); ok {
+		t.Fatal("eval is a builtin")
+	}
+}
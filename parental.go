@@ -0,0 +1,171 @@
+package libcore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/v2fly/v2ray-core/v5/app/router"
+)
+
+// ParentalRule blocks the domains of categories for an app, during the
+// schedule if one is set.
+type ParentalRule struct {
+	// Uid is the app, zero applies the rule to every app.
+	Uid int32
+	// Categories are names of categories, separated by commas.
+	Categories string
+	// Schedule is a local time range, e.g. 22:00-07:00, empty means all day.
+	Schedule string
+	// Weekdays restricts the schedule, e.g. mon-fri/sun.
+	Weekdays string
+	// Action is the block action taken, REJECT by default.
+	Action string
+}
+
+type parentalRule struct {
+	uid        uint32
+	categories []string
+	schedule   []ruleCondition
+	action     string
+}
+
+type parentalPolicy struct {
+	access     sync.RWMutex
+	categories map[string]*router.DomainMatcher
+	rules      []*parentalRule
+	active     int32
+}
+
+var parental = new(parentalPolicy)
+
+// parentalAudit records the blocked connections for the app.
+var parentalAudit = &protectAuditor{enabled: true}
+
+// SetParentalCategory defines a category by v2ray style domain rules,
+// separated by commas or lines, e.g. "geosite:category-games" or
+// "domain:example.com". Plain domains match their subdomains too.
+func SetParentalCategory(name string, domains string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return withCode(ErrorCodeInvalidArgument, newError("empty category name"))
+	}
+	matcher, err := newDomainMatcher(splitRules(domains))
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid category ", name).Base(err))
+	}
+	parental.access.Lock()
+	defer parental.access.Unlock()
+	if parental.categories == nil {
+		parental.categories = make(map[string]*router.DomainMatcher)
+	}
+	parental.categories[name] = matcher
+	return nil
+}
+
+func RemoveParentalCategory(name string) {
+	parental.access.Lock()
+	defer parental.access.Unlock()
+	delete(parental.categories, strings.TrimSpace(name))
+}
+
+// AddParentalRule adds a rule, categories may be defined later.
+func AddParentalRule(rule *ParentalRule) error {
+	if rule == nil {
+		return withCode(ErrorCodeInvalidArgument, newError("nil parental rule"))
+	}
+	parsed := &parentalRule{uid: uint32(rule.Uid), action: strings.TrimSpace(rule.Action)}
+	for _, category := range strings.Split(rule.Categories, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			parsed.categories = append(parsed.categories, category)
+		}
+	}
+	if len(parsed.categories) == 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("parental rule without categories"))
+	}
+	switch parsed.action {
+	case "":
+		parsed.action = BlockTagReject
+	case BlockTagReject, BlockTagClose, BlockTagDrop, BlockTagHttp:
+	default:
+		return withCode(ErrorCodeInvalidArgument, newError("invalid parental action ", parsed.action))
+	}
+	if schedule := strings.TrimSpace(rule.Schedule); schedule != "" {
+		condition, err := parseRuleCondition("TIME", schedule, nil)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, err)
+		}
+		parsed.schedule = append(parsed.schedule, condition)
+	}
+	if weekdays := strings.TrimSpace(rule.Weekdays); weekdays != "" {
+		condition, err := parseRuleCondition("WEEKDAY", weekdays, nil)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, err)
+		}
+		parsed.schedule = append(parsed.schedule, condition)
+	}
+	parental.access.Lock()
+	defer parental.access.Unlock()
+	parental.rules = append(parental.rules, parsed)
+	atomic.StoreInt32(&parental.active, 1)
+	return nil
+}
+
+func ClearParentalRules() {
+	parental.access.Lock()
+	defer parental.access.Unlock()
+	parental.rules = nil
+	atomic.StoreInt32(&parental.active, 0)
+}
+
+// GetParentalAuditLog returns the blocked connections, oldest first.
+func GetParentalAuditLog() string {
+	return parentalAudit.log()
+}
+
+func ClearParentalAuditLog() {
+	parentalAudit.clear()
+}
+
+func (p *parentalPolicy) isActive() bool {
+	return atomic.LoadInt32(&p.active) == 1
+}
+
+// match returns the block action for a connection, or an empty string. The
+// domain is the sniffed or fake dns one, connections to plain addresses are
+// not matched.
+func (p *parentalPolicy) match(rc *ruleContext) string {
+	if rc.domain == "" {
+		return ""
+	}
+	p.access.RLock()
+	defer p.access.RUnlock()
+	for _, rule := range p.rules {
+		if rule.uid != 0 && rule.uid != rc.uid {
+			continue
+		}
+		scheduled := true
+		for _, condition := range rule.schedule {
+			if !condition.match(rc) {
+				scheduled = false
+				break
+			}
+		}
+		if !scheduled {
+			continue
+		}
+		for _, category := range rule.categories {
+			matcher := p.categories[category]
+			if matcher == nil || !matcher.Match(rc.domain) {
+				continue
+			}
+			entry := fmt.Sprintf("uid=%d package=%s category=%s domain=%s network=%s action=%s",
+				rc.uid, rc.getPackageName(), category, rc.domain, rc.network, rule.action)
+			parentalAudit.add(entry)
+			newError("[Parental] blocked ", entry).AtInfo().WriteToLog()
+			return rule.action
+		}
+	}
+	return ""
+}
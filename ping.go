@@ -0,0 +1,185 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	pingTimeout     = 5 * time.Second
+	pingPayloadSize = 32
+)
+
+type PingListener interface {
+	// OnPingResult is called for every probe, rtt is in milliseconds and -1
+	// if no reply arrived in time.
+	OnPingResult(seq int32, rtt int32)
+}
+
+// Ping sends count icmp echo requests to address every intervalMs
+// milliseconds through the outbound tagged viaOutbound, or the one the router
+// picks for ping traffic if empty. It returns once every probe got a reply or
+// timed out.
+func (instance *V2RayInstance) Ping(address string, count int32, intervalMs int32, viaOutbound string, listener PingListener) error {
+	if count <= 0 || intervalMs <= 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid ping count or interval"))
+	}
+	if instance.core == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		ips, err := instance.dnsClient.LookupIP(address)
+		if err != nil {
+			return exportError(newError("lookup ", address).Base(err))
+		}
+		if len(ips) == 0 {
+			return withCode(ErrorCodeDnsRcode, newError("no address for ", address))
+		}
+		ip = ips[0]
+	}
+	destination := v2rayNet.Destination{Address: v2rayNet.IPAddress(ip), Port: 7, Network: v2rayNet.Network_UDP}
+
+	ctx := core.WithContext(context.Background(), instance.core)
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: "ping"})
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+	ctx = session.ContextWithContent(ctx, &session.Content{Protocol: "ping"})
+
+	var handler outbound.Handler
+	if viaOutbound != "" {
+		handler = instance.outboundHandler(viaOutbound)
+		if handler == nil {
+			return withCode(ErrorCodeInvalidArgument, newError("non existing tag: ", viaOutbound))
+		}
+	} else {
+		handler = instance.outboundHandler(instance.pickOutbound(ctx, destination))
+		if handler == nil {
+			return withCode(ErrorCodeConfigInvalid, newError("no outbound for ping"))
+		}
+	}
+
+	conn := instance.handleUDP(ctx, handler, destination, time.Duration(count)*time.Duration(intervalMs)*time.Millisecond+pingTimeout)
+	defer conn.Close()
+
+	ipv6 := ip.To4() == nil
+	ident := uint16(rand.Uint32())
+	var access sync.Mutex
+	sent := make(map[uint16]time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			message, _, err := conn.readFrom()
+			if err != nil {
+				return
+			}
+			seq, ok := parseEchoReply(message, ipv6)
+			if !ok {
+				continue
+			}
+			access.Lock()
+			start, ok := sent[seq]
+			delete(sent, seq)
+			access.Unlock()
+			if ok {
+				listener.OnPingResult(int32(seq), int32(time.Since(start).Milliseconds()))
+			}
+		}
+	}()
+
+	addr := &net.UDPAddr{IP: ip, Port: int(destination.Port)}
+	ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for seq := uint16(0); seq < uint16(count); seq++ {
+		if seq > 0 {
+			<-ticker.C
+		}
+		access.Lock()
+		sent[seq] = time.Now()
+		access.Unlock()
+		if _, err := conn.WriteTo(newEchoRequest(ident, seq, ipv6), addr); err != nil {
+			return exportError(newError("failed to send ping request").Base(err))
+		}
+		expirePings(&access, sent, listener)
+	}
+
+	wait := time.NewTicker(100 * time.Millisecond)
+	defer wait.Stop()
+	deadline := time.Now().Add(pingTimeout)
+	for time.Now().Before(deadline) {
+		access.Lock()
+		pending := len(sent)
+		access.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-done:
+			deadline = time.Now()
+		case <-wait.C:
+		}
+	}
+	access.Lock()
+	for seq := range sent {
+		listener.OnPingResult(int32(seq), -1)
+	}
+	access.Unlock()
+	return nil
+}
+
+// expirePings reports probes that waited longer than pingTimeout.
+func expirePings(access *sync.Mutex, sent map[uint16]time.Time, listener PingListener) {
+	access.Lock()
+	defer access.Unlock()
+	for seq, start := range sent {
+		if time.Since(start) > pingTimeout {
+			delete(sent, seq)
+			listener.OnPingResult(int32(seq), -1)
+		}
+	}
+}
+
+// newEchoRequest builds an icmp echo request, the checksum of icmpv6 is left
+// to the kernel as it needs the source address.
+func newEchoRequest(ident uint16, seq uint16, ipv6 bool) []byte {
+	if ipv6 {
+		hdr := header.ICMPv6(make([]byte, header.ICMPv6EchoMinimumSize+pingPayloadSize))
+		hdr.SetType(header.ICMPv6EchoRequest)
+		hdr.SetIdent(ident)
+		hdr.SetSequence(seq)
+		binary.BigEndian.PutUint64(hdr[header.ICMPv6EchoMinimumSize:], uint64(time.Now().UnixNano()))
+		return hdr
+	}
+	hdr := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize+pingPayloadSize))
+	hdr.SetType(header.ICMPv4Echo)
+	hdr.SetIdent(ident)
+	hdr.SetSequence(seq)
+	binary.BigEndian.PutUint64(hdr[header.ICMPv4MinimumSize:], uint64(time.Now().UnixNano()))
+	hdr.SetChecksum(header.ICMPv4Checksum(hdr, 0))
+	return hdr
+}
+
+func parseEchoReply(message []byte, ipv6 bool) (uint16, bool) {
+	if ipv6 {
+		hdr := header.ICMPv6(message)
+		if len(message) < header.ICMPv6EchoMinimumSize || hdr.Type() != header.ICMPv6EchoReply {
+			return 0, false
+		}
+		return hdr.Sequence(), true
+	}
+	hdr := header.ICMPv4(message)
+	if len(message) < header.ICMPv4MinimumSize || hdr.Type() != header.ICMPv4EchoReply {
+		return 0, false
+	}
+	return hdr.Sequence(), true
+}
@@ -0,0 +1,101 @@
+package libcore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+// pingRouteTTL bounds how long a cached ping route is used, routing may
+// depend on state not tracked by the cache, like the network type.
+const pingRouteTTL = time.Minute
+
+// routeCache remembers the outbound picked for a destination, so periodic
+// pings do not run the router for every new ping session. The cache is
+// cleared when the rules or balancer targets change, a new configuration
+// comes with a new cache.
+type routeCache struct {
+	entries sync.Map
+}
+
+type routeCacheEntry struct {
+	tag      string
+	expireAt time.Time
+}
+
+func (c *routeCache) load(key string) (string, bool) {
+	iEntry, ok := c.entries.Load(key)
+	if !ok {
+		return "", false
+	}
+	entry := iEntry.(*routeCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		c.entries.Delete(key)
+		return "", false
+	}
+	return entry.tag, true
+}
+
+func (c *routeCache) store(key string, tag string) {
+	c.entries.Store(key, &routeCacheEntry{tag, time.Now().Add(pingRouteTTL)})
+}
+
+func (c *routeCache) clear() {
+	c.entries.Range(func(key, value interface{}) bool {
+		c.entries.Delete(key)
+		return true
+	})
+}
+
+// pickPingOutbound routes a new ping session, with the cached route of the
+// destination if there is one.
+func (n *tunNic) pickPingOutbound(ctx context.Context, destination v2rayNet.Destination) outbound.Handler {
+	t := n.t
+	var cache *routeCache
+	if router, ok := t.v2ray.router.(*ruleRouter); ok {
+		cache = &router.pingRoutes
+	}
+	cacheKey := n.tag + "-" + destination.Address.String()
+	if cache != nil {
+		if tag, ok := cache.load(cacheKey); ok {
+			if tag == "" {
+				return t.defaultOutboundForPing
+			}
+			if handler := t.v2ray.outboundManager.GetHandler(tag); handler != nil {
+				return handler
+			}
+		}
+	}
+
+	var tag string
+	var handler outbound.Handler
+	if route, err := t.v2ray.router.PickRoute(routing_session.AsRoutingContext(ctx)); err == nil {
+		tag = route.GetOutboundTag()
+		handler = t.v2ray.outboundManager.GetHandler(tag)
+		if handler == nil {
+			newError("non existing tag: ", tag).AtWarning().WriteToLog()
+			return nil
+		}
+		newError("taking detour [", tag, "] for [", destination.Address, "]").WriteToLog()
+	} else if t.defaultOutboundForPing != nil {
+		handler = t.defaultOutboundForPing
+		newError("default route for ", destination.Address).AtWarning().WriteToLog()
+	} else {
+		return nil
+	}
+	if cache != nil {
+		cache.store(cacheKey, tag)
+	}
+	return handler
+}
+
+// ClearRouteCache drops the cached ping routes.
+func (instance *V2RayInstance) ClearRouteCache() {
+	if router, err := instance.getRuleRouter(); err == nil {
+		router.pingRoutes.clear()
+	}
+}
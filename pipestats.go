@@ -0,0 +1,159 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/transport/pipe"
+)
+
+// pipeStallThreshold is how long a write to a connection link has to block
+// to count as a stall.
+const pipeStallThreshold = time.Second
+
+// tcpUplinkBufferSize bounds the data of a tun connection queued for its
+// outbound, a slow outbound then blocks the app instead of growing the queue,
+// which the uplink metrics see as a stall.
+const tcpUplinkBufferSize = 512 * 1024
+
+// linkMeter tracks the writes of one direction of a connection link. The
+// writes of a direction are sequential, so queued is the size of the write
+// currently waiting for the other side to take it.
+type linkMeter struct {
+	blockedSince int64 // unix nanos, 0 between writes; first for 64-bit alignment
+	queued       int64
+	counters     *pipeCounters
+}
+
+// pipeCounters sums the stalls of one direction over the connections of a
+// tun.
+type pipeCounters struct {
+	stalls     int64
+	stallNanos int64
+}
+
+type pipeTotals struct {
+	uplink   pipeCounters
+	downlink pipeCounters
+}
+
+// pipeMeter meters both directions of the link of a tun tcp connection.
+type pipeMeter struct {
+	uplink   *linkMeter
+	downlink *linkMeter
+}
+
+func newPipeMeter(totals *pipeTotals) *pipeMeter {
+	return &pipeMeter{
+		uplink:   &linkMeter{counters: &totals.uplink},
+		downlink: &linkMeter{counters: &totals.downlink},
+	}
+}
+
+func (m *linkMeter) begin(now time.Time, size int32) {
+	atomic.StoreInt64(&m.queued, int64(size))
+	atomic.StoreInt64(&m.blockedSince, now.UnixNano())
+}
+
+func (m *linkMeter) end() {
+	since := atomic.SwapInt64(&m.blockedSince, 0)
+	atomic.StoreInt64(&m.queued, 0)
+	if elapsed := time.Now().UnixNano() - since; elapsed >= int64(pipeStallThreshold) {
+		atomic.AddInt64(&m.counters.stalls, 1)
+		atomic.AddInt64(&m.counters.stallNanos, elapsed)
+	}
+}
+
+// blocked returns how long the current write has been waiting.
+func (m *linkMeter) blocked(now time.Time) time.Duration {
+	since := atomic.LoadInt64(&m.blockedSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Duration(now.UnixNano() - since)
+}
+
+// meteredPipeWriter is the uplink writer of a connection, the outbound reads
+// the pipe.
+type meteredPipeWriter struct {
+	*pipe.Writer
+	meter *linkMeter
+}
+
+func (w *meteredPipeWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.meter.begin(time.Now(), mb.Len())
+	err := w.Writer.WriteMultiBuffer(mb)
+	w.meter.end()
+	return err
+}
+
+type PipeStats struct {
+	// UplinkQueued and DownlinkQueued are the bytes waiting for the outbound
+	// and for the apps to take them.
+	UplinkQueued   int64
+	DownlinkQueued int64
+	// UplinkStalled and DownlinkStalled count the connections blocked for
+	// longer than a second now.
+	UplinkStalled   int32
+	DownlinkStalled int32
+	// LongestStallMs is the longest current block, of the connection to
+	// LongestStallDestination.
+	LongestStallMs          int64
+	LongestStallDestination string
+	// UplinkStalls, DownlinkStalls and their durations sum the blocks longer
+	// than a second that have ended.
+	UplinkStalls    int64
+	UplinkStallMs   int64
+	DownlinkStalls  int64
+	DownlinkStallMs int64
+	// ActiveConnections is the number of tcp connections metered.
+	ActiveConnections int32
+}
+
+// GetPipeStats returns the backpressure of the links between the tcp
+// connections of the tun and their outbounds. A downlink blocked by an app
+// not reading holds the outbound writing to it, which freezes the other
+// connections sharing a mux session.
+func (t *Tun2ray) GetPipeStats() *PipeStats {
+	stats := &PipeStats{
+		UplinkStalls:    atomic.LoadInt64(&t.pipes.uplink.stalls),
+		UplinkStallMs:   atomic.LoadInt64(&t.pipes.uplink.stallNanos) / int64(time.Millisecond),
+		DownlinkStalls:  atomic.LoadInt64(&t.pipes.downlink.stalls),
+		DownlinkStallMs: atomic.LoadInt64(&t.pipes.downlink.stallNanos) / int64(time.Millisecond),
+	}
+	now := time.Now()
+	var longest time.Duration
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+	for item := t.connections.Front(); item != nil; item = item.Next() {
+		conn := item.Value.(*trackedConnection)
+		if conn.pipes == nil {
+			continue
+		}
+		stats.ActiveConnections++
+		uplink := conn.pipes.uplink.blocked(now)
+		downlink := conn.pipes.downlink.blocked(now)
+		stats.UplinkQueued += atomic.LoadInt64(&conn.pipes.uplink.queued)
+		stats.DownlinkQueued += atomic.LoadInt64(&conn.pipes.downlink.queued)
+		if uplink >= pipeStallThreshold {
+			stats.UplinkStalled++
+		}
+		if downlink >= pipeStallThreshold {
+			stats.DownlinkStalled++
+		}
+		if downlink > uplink {
+			uplink = downlink
+		}
+		if uplink > longest {
+			longest = uplink
+			stats.LongestStallDestination = conn.destination.NetAddr()
+		}
+	}
+	if longest >= pipeStallThreshold {
+		stats.LongestStallMs = int64(longest / time.Millisecond)
+	} else {
+		stats.LongestStallDestination = ""
+	}
+	return stats
+}
@@ -0,0 +1,162 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The Android app provides the Protector, the UidDumper and the assets
+// paths. The defaults below stand in for them on desktop Linux, where the
+// package runs as tun2ray for development and integration tests.
+
+// linuxProtector binds sockets to the upstream interface, so they bypass the
+// routes into the tun. The socket mark (SetSocketMark) is the alternative for
+// policy routing.
+type linuxProtector struct {
+	device string
+}
+
+// NewLinuxProtector returns a protector binding sockets to device, which
+// needs CAP_NET_RAW. An empty device protects nothing.
+func NewLinuxProtector(device string) Protector {
+	if device == "" {
+		return noopProtectorInstance
+	}
+	return &linuxProtector{device: device}
+}
+
+func (p *linuxProtector) Protect(fd int32) bool {
+	if err := bindToDevice(int(fd), p.device); err != nil {
+		newError("bind socket to ", p.device).Base(err).AtWarning().WriteToLog()
+		return false
+	}
+	return true
+}
+
+// procUidDumper finds the owner of a connection in /proc/net, the uid info
+// is the local user.
+type procUidDumper struct{}
+
+func (procUidDumper) DumpUid(ipv6 bool, udp bool, srcIp string, srcPort int32, destIp string, destPort int32) (int32, error) {
+	network := "tcp"
+	if udp {
+		network = "udp"
+	}
+	source := net.ParseIP(srcIp)
+	destination := net.ParseIP(destIp)
+	if source == nil || destination == nil {
+		return -1, newError("invalid address ", srcIp, " ", destIp)
+	}
+	// ipv4 sockets may be dual stack ones listed in the ipv6 table
+	files := []string{"/proc/net/" + network + "6"}
+	if !ipv6 {
+		files = append([]string{"/proc/net/" + network}, files...)
+	}
+	for _, file := range files {
+		uid, err := findProcNetUid(file, source, uint16(srcPort), destination, uint16(destPort), udp)
+		if err == nil {
+			return uid, nil
+		}
+	}
+	return -1, newError("connection from ", net.JoinHostPort(srcIp, strconv.Itoa(int(srcPort))), " not found")
+}
+
+func (procUidDumper) GetUidInfo(uid int32) (*UidInfo, error) {
+	u, err := user.LookupId(strconv.Itoa(int(uid)))
+	if err != nil {
+		return nil, err
+	}
+	return &UidInfo{PackageName: u.Username, Label: u.Name}, nil
+}
+
+// findProcNetUid scans a /proc/net table, the remote address of udp sockets
+// is only compared if they are connected.
+func findProcNetUid(file string, source net.IP, sourcePort uint16, destination net.IP, destinationPort uint16, udp bool) (int32, error) {
+	content, err := os.Open(file)
+	if err != nil {
+		return -1, err
+	}
+	defer content.Close()
+	scanner := bufio.NewScanner(content)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		localAddress, localPort, err := parseProcNetAddress(fields[1])
+		if err != nil || localPort != sourcePort || !localAddress.Equal(source) && !localAddress.IsUnspecified() {
+			continue
+		}
+		remoteAddress, remotePort, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		if remotePort != destinationPort || !remoteAddress.Equal(destination) {
+			if !udp || remotePort != 0 {
+				continue
+			}
+		}
+		uid, err := strconv.ParseInt(fields[7], 10, 32)
+		if err != nil {
+			continue
+		}
+		return int32(uid), nil
+	}
+	return -1, newError("not found")
+}
+
+// parseProcNetAddress parses ADDRESS:PORT of /proc/net, the address is
+// written as 32 bit words in host byte order.
+func parseProcNetAddress(field string) (net.IP, uint16, error) {
+	index := strings.IndexByte(field, ':')
+	if index < 0 {
+		return nil, 0, newError("invalid address ", field)
+	}
+	address, err := hex.DecodeString(field[:index])
+	if err != nil || len(address)%4 != 0 {
+		return nil, 0, newError("invalid address ", field)
+	}
+	for i := 0; i < len(address); i += 4 {
+		address[i], address[i+1], address[i+2], address[i+3] = address[i+3], address[i+2], address[i+1], address[i]
+	}
+	port, err := strconv.ParseUint(field[index+1:], 16, 16)
+	if err != nil {
+		return nil, 0, newError("invalid port ", field)
+	}
+	return net.IP(address), uint16(port), nil
+}
+
+type constantBoolFunc bool
+
+func (f constantBoolFunc) Invoke() bool {
+	return bool(f)
+}
+
+// InitializeLinux sets up the package outside Android: the assets are kept in
+// assetsPath (the user cache directory if empty) and connections are
+// attributed to local users with sock_diag or /proc/net, unless SetUidDumper
+// was called.
+func InitializeLinux(assetsPath string) error {
+	if assetsPath == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return exportError(err)
+		}
+		assetsPath = filepath.Join(cacheDir, "tun2ray")
+	}
+	if err := os.MkdirAll(assetsPath, 0o755); err != nil {
+		return exportError(newError("create assets dir").Base(err))
+	}
+	assetsPath = strings.TrimSuffix(assetsPath, "/") + "/"
+	if uidDumper == nil {
+		uidDumper = NewSockDiagUidDumper(procUidDumper{})
+	}
+	return InitializeV2Ray(assetsPath, assetsPath, "", constantBoolFunc(false), constantBoolFunc(true))
+}
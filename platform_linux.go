@@ -0,0 +1,11 @@
+package libcore
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice sends the traffic of the socket through device only, which
+// needs CAP_NET_RAW.
+func bindToDevice(fd int, device string) error {
+	return unix.BindToDevice(fd, device)
+}
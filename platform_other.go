@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+func bindToDevice(fd int, device string) error {
+	return newError("binding sockets to a device is not supported on this platform")
+}
@@ -0,0 +1,220 @@
+package libcore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/serial"
+)
+
+// Statuses of PreflightCheck.
+const (
+	PreflightOk int32 = iota
+	PreflightWarning
+	PreflightError
+)
+
+// preflightMinFiles is the open file limit below which a busy tun runs out
+// of descriptors, preflightLowFiles the one worth a warning.
+const (
+	preflightMinFiles = 256
+	preflightLowFiles = 4096
+)
+
+var (
+	geoipReference   = regexp.MustCompile(`"geoip:!?([A-Za-z0-9_.\-]+)"`)
+	geositeReference = regexp.MustCompile(`"geosite:([A-Za-z0-9_.\-]+)(@[^"]*)?"`)
+)
+
+type PreflightCheck struct {
+	// Name is config, asset:NAME, port:TAG, fd-limit or tun-device.
+	Name    string
+	Status  int32
+	Message string
+	// Hint tells how to fix a failed check.
+	Hint string
+}
+
+type PreflightReport struct {
+	// Passed is whether no check failed, warnings do not prevent starting.
+	Passed bool
+	checks []*PreflightCheck
+}
+
+func (r *PreflightReport) Len() int32 {
+	return int32(len(r.checks))
+}
+
+func (r *PreflightReport) Get(index int32) *PreflightCheck {
+	if index < 0 || int(index) >= len(r.checks) {
+		return nil
+	}
+	return r.checks[index]
+}
+
+func (r *PreflightReport) add(name string, status int32, message string, hint string) {
+	r.checks = append(r.checks, &PreflightCheck{name, status, message, hint})
+	if status == PreflightError {
+		r.Passed = false
+	}
+}
+
+// Preflight checks what starting an instance with config needs: the config
+// loads, the geoip and geosite assets are valid and have the codes the config
+// uses, the ports of the inbounds are free, the open file limit and, for root
+// mode, /dev/net/tun. Ports held by a running instance are reported taken.
+func Preflight(config string) *PreflightReport {
+	report := &PreflightReport{Passed: true}
+	preflightConfig(report, config)
+	preflightAsset(report, geoipDat, geoipReference, config)
+	preflightAsset(report, geositeDat, geositeReference, config)
+	preflightPorts(report, config)
+	preflightFileLimit(report)
+	preflightTun(report)
+	return report
+}
+
+func preflightConfig(report *PreflightReport, config string) {
+	if _, err := serial.LoadJSONConfig(strings.NewReader(config)); err != nil {
+		hint := "fix the config"
+		message := err.Error()
+		switch {
+		case strings.Contains(message, ".dat: no such file or directory"):
+			hint = "extract the assets with InitializeV2Ray or download them"
+		case strings.Contains(message, "not found in geoip.dat"), strings.Contains(message, "not found in geosite.dat"):
+			hint = "update the assets, the config uses a code they do not have"
+		}
+		report.add("config", PreflightError, message, hint)
+		return
+	}
+	report.add("config", PreflightOk, "", "")
+}
+
+// preflightAsset parses the asset and checks the codes the config refers to
+// with reference, assets the config does not use only warn.
+func preflightAsset(report *PreflightReport, name string, reference *regexp.Regexp, config string) {
+	check := "asset:" + name
+	codes := make(map[string]bool)
+	for _, match := range reference.FindAllStringSubmatch(config, -1) {
+		codes[strings.ToUpper(match[1])] = true
+	}
+	failed := PreflightWarning
+	if len(codes) > 0 {
+		failed = PreflightError
+	}
+	status, err := GetAssetStatus(name, false)
+	if err != nil || status.Path == "" {
+		report.add(check, failed, "not found", "extract the assets with InitializeV2Ray or download them")
+		return
+	}
+	content, err := ioutil.ReadFile(status.Path)
+	if err != nil {
+		report.add(check, failed, err.Error(), "check the permissions of "+status.Path)
+		return
+	}
+
+	var available []string
+	if name == geoipDat {
+		var list routercommon.GeoIPList
+		err = proto.Unmarshal(content, &list)
+		for _, entry := range list.Entry {
+			available = append(available, entry.CountryCode)
+		}
+	} else {
+		var list routercommon.GeoSiteList
+		err = proto.Unmarshal(content, &list)
+		for _, entry := range list.Entry {
+			available = append(available, entry.CountryCode)
+		}
+	}
+	if err != nil {
+		report.add(check, failed, "invalid: "+err.Error(), "download "+name+" again")
+		return
+	}
+	for _, code := range available {
+		delete(codes, strings.ToUpper(code))
+	}
+	if len(codes) > 0 {
+		var missing []string
+		for code := range codes {
+			missing = append(missing, strings.ToLower(code))
+		}
+		report.add(check, PreflightError, "missing codes "+strings.Join(missing, ", "), "update "+name+" or remove the rules using them")
+		return
+	}
+	report.add(check, PreflightOk, "version "+status.Version, "")
+}
+
+type preflightInbound struct {
+	Tag      string          `json:"tag"`
+	Listen   string          `json:"listen"`
+	Port     json.RawMessage `json:"port"`
+	Protocol string          `json:"protocol"`
+}
+
+// preflightPorts binds the tcp and udp port of every inbound with a single
+// port, dokodemo-door inbounds of the tun have none.
+func preflightPorts(report *PreflightReport, config string) {
+	var parsed struct {
+		Inbounds []preflightInbound `json:"inbounds"`
+	}
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		return
+	}
+	for index, inbound := range parsed.Inbounds {
+		port, err := strconv.Atoi(strings.Trim(string(inbound.Port), `"`))
+		if err != nil || port <= 0 {
+			continue
+		}
+		name := inbound.Tag
+		if name == "" {
+			name = strconv.Itoa(index)
+		}
+		listen := inbound.Listen
+		if listen == "" {
+			listen = "0.0.0.0"
+		}
+		address := net.JoinHostPort(listen, strconv.Itoa(port))
+		if err = preflightBind(address); err != nil {
+			report.add("port:"+name, PreflightError, err.Error(), "stop the app using port "+strconv.Itoa(port)+" or change the inbound port")
+			continue
+		}
+		report.add("port:"+name, PreflightOk, address, "")
+	}
+}
+
+func preflightBind(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	listener.Close()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// preflightTun opens /dev/net/tun, which only root mode needs, the tun of a
+// VpnService is passed as a descriptor.
+func preflightTun(report *PreflightReport) {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		hint := "root mode needs a kernel with tun support"
+		if os.IsPermission(err) {
+			hint = "root mode needs root or CAP_NET_ADMIN"
+		}
+		report.add("tun-device", PreflightWarning, err.Error(), hint)
+		return
+	}
+	file.Close()
+	report.add("tun-device", PreflightOk, "", "")
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func preflightFileLimit(report *PreflightReport) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		report.add("fd-limit", PreflightWarning, err.Error(), "")
+		return
+	}
+	message := "soft " + strconv.FormatUint(uint64(limit.Cur), 10) + ", hard " + strconv.FormatUint(uint64(limit.Max), 10)
+	switch {
+	case limit.Cur < preflightMinFiles:
+		report.add("fd-limit", PreflightError, message, "raise the open file limit, connections need a descriptor each")
+	case limit.Cur < preflightLowFiles:
+		report.add("fd-limit", PreflightWarning, message, "raise the open file limit for many concurrent connections")
+	default:
+		report.add("fd-limit", PreflightOk, message, "")
+	}
+}
@@ -0,0 +1,6 @@
+package libcore
+
+// preflightFileLimit passes, Windows has no open file limit.
+func preflightFileLimit(report *PreflightReport) {
+	report.add("fd-limit", PreflightOk, "not limited on Windows", "")
+}
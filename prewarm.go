@@ -0,0 +1,354 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	v2rayTls "github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+)
+
+const (
+	prewarmMaxSize       = 4
+	prewarmDefaultIdle   = 30 * time.Second
+	prewarmDialTimeout   = 10 * time.Second
+	prewarmRetryInterval = 30 * time.Second
+)
+
+// warmPool keeps connected sockets to the servers of the tls and websocket
+// outbounds, the protected dialer hands them out instead of dialing. The tls
+// handshake and websocket upgrade still run on them, what is saved is the
+// resolution and the tcp handshake, and with session resumption most of the
+// rest.
+var warmPool = &connectionPool{servers: make(map[string]*warmServer)}
+
+type connectionPool struct {
+	access      sync.Mutex
+	owner       *V2RayInstance
+	size        int
+	idleTimeout time.Duration
+	servers     map[string]*warmServer
+	// generation changes when the idle connections are dropped, dials started
+	// before are discarded
+	generation int
+	done       chan struct{}
+
+	hits    int64
+	misses  int64
+	dialed  int64
+	expired int64
+	failed  int64
+}
+
+type warmServer struct {
+	destination v2rayNet.Destination
+	sockopt     *internet.SocketConfig
+	idle        []warmConn
+	dialing     int
+	lastFailure time.Time
+}
+
+type warmConn struct {
+	net.Conn
+	since time.Time
+}
+
+type prewarmKey struct{}
+
+type PrewarmStats struct {
+	Servers int32
+	Idle    int32
+	// Hits and Misses count the dials to a pooled server that got an idle
+	// connection or found none.
+	Hits    int64
+	Misses  int64
+	Dialed  int64
+	Expired int64
+	Failed  int64
+}
+
+// SetPrewarm keeps size idle connections, at most 4, ready to the server of
+// each tls or websocket outbound of the instance, so the first request after
+// idle skips the resolution and tcp handshake. Connections idle for longer
+// than idleSeconds, 30 if 0, and all of them on NotifyNetworkChange are
+// replaced. The pool is used by the dialer of the tun and belongs to one
+// instance at a time, size 0 disables it.
+func (instance *V2RayInstance) SetPrewarm(size int32, idleSeconds int32) error {
+	if size < 0 || size > prewarmMaxSize || idleSeconds < 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid prewarm size ", size, " or idle timeout ", idleSeconds))
+	}
+	if size == 0 {
+		warmPool.release(instance)
+		return nil
+	}
+	instance.access.Lock()
+	config := instance.config
+	instance.access.Unlock()
+	if config == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	idleTimeout := prewarmDefaultIdle
+	if idleSeconds > 0 {
+		idleTimeout = time.Duration(idleSeconds) * time.Second
+	}
+	warmPool.configure(instance, prewarmServers(config.Outbound), int(size), idleTimeout)
+	return nil
+}
+
+// GetPrewarmStats returns the stats of the pool since SetPrewarm, empty if
+// the pool belongs to another instance.
+func (instance *V2RayInstance) GetPrewarmStats() *PrewarmStats {
+	p := warmPool
+	p.access.Lock()
+	defer p.access.Unlock()
+	stats := new(PrewarmStats)
+	if p.owner != instance {
+		return stats
+	}
+	stats.Servers = int32(len(p.servers))
+	for _, server := range p.servers {
+		stats.Idle += int32(len(server.idle))
+	}
+	stats.Hits, stats.Misses, stats.Dialed, stats.Expired, stats.Failed = p.hits, p.misses, p.dialed, p.expired, p.failed
+	return stats
+}
+
+// prewarmServers returns the servers of the tls and websocket outbounds,
+// outbounds chained through another one are skipped.
+func prewarmServers(outbounds []*core.OutboundHandlerConfig) []*warmServer {
+	var servers []*warmServer
+	for _, outbound := range outbounds {
+		if outbound.ProxySettings == nil || outbound.SenderSettings == nil {
+			continue
+		}
+		senderSettings, err := commonSerial.GetInstanceOf(outbound.SenderSettings)
+		if err != nil {
+			continue
+		}
+		sender, ok := senderSettings.(*proxyman.SenderConfig)
+		if !ok || sender.StreamSettings == nil || sender.ProxySettings.HasTag() {
+			continue
+		}
+		stream := sender.StreamSettings
+		warm := stream.ProtocolName == "websocket"
+		for _, settings := range stream.SecuritySettings {
+			if securityConfig, err := commonSerial.GetInstanceOf(settings); err == nil {
+				if _, ok := securityConfig.(*v2rayTls.Config); ok {
+					warm = true
+				}
+			}
+		}
+		if !warm {
+			continue
+		}
+		proxySettings, err := commonSerial.GetInstanceOf(outbound.ProxySettings)
+		if err != nil {
+			continue
+		}
+		if server, ok := findServerEndpoint(proto.MessageReflect(proxySettings)); ok {
+			servers = append(servers, &warmServer{destination: server, sockopt: stream.SocketSettings})
+		}
+	}
+	return servers
+}
+
+func (p *connectionPool) configure(owner *V2RayInstance, servers []*warmServer, size int, idleTimeout time.Duration) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.closeIdle()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.done = make(chan struct{})
+	go p.loop(p.done, idleTimeout)
+	if p.owner != owner {
+		p.hits, p.misses, p.dialed, p.expired, p.failed = 0, 0, 0, 0, 0
+	}
+	p.owner = owner
+	p.size = size
+	p.idleTimeout = idleTimeout
+	p.servers = make(map[string]*warmServer)
+	for _, server := range servers {
+		p.servers[server.destination.NetAddr()] = server
+	}
+	p.fill()
+}
+
+// release disables the pool if it belongs to owner, on SetPrewarm(0) and when
+// the instance closes.
+func (p *connectionPool) release(owner *V2RayInstance) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner != owner {
+		return
+	}
+	p.closeIdle()
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.owner = nil
+	p.servers = make(map[string]*warmServer)
+}
+
+// refresh replaces the idle connections, which were made over the previous
+// network.
+func (p *connectionPool) refresh() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.owner == nil {
+		return
+	}
+	p.closeIdle()
+	for _, server := range p.servers {
+		server.lastFailure = time.Time{}
+	}
+	p.fill()
+}
+
+func (p *connectionPool) loop(done chan struct{}, idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			p.expire(now)
+		}
+	}
+}
+
+func (p *connectionPool) expire(now time.Time) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, server := range p.servers {
+		idle := server.idle[:0]
+		for _, conn := range server.idle {
+			if now.Sub(conn.since) > p.idleTimeout {
+				p.expired++
+				go conn.Close()
+			} else {
+				idle = append(idle, conn)
+			}
+		}
+		server.idle = idle
+	}
+	p.fill()
+}
+
+// closeIdle drops all idle connections, p.access must be held.
+func (p *connectionPool) closeIdle() {
+	p.generation++
+	for _, server := range p.servers {
+		for _, conn := range server.idle {
+			go conn.Close()
+		}
+		server.idle = nil
+		server.dialing = 0
+	}
+}
+
+// fill dials the missing connections, servers that failed recently are left
+// for a later tick. p.access must be held.
+func (p *connectionPool) fill() {
+	now := time.Now()
+	for _, server := range p.servers {
+		if now.Sub(server.lastFailure) < prewarmRetryInterval {
+			continue
+		}
+		for missing := p.size - len(server.idle) - server.dialing; missing > 0; missing-- {
+			server.dialing++
+			go p.dial(server, p.generation)
+		}
+	}
+}
+
+func (p *connectionPool) dial(server *warmServer, generation int) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), prewarmKey{}, true), prewarmDialTimeout)
+	defer cancel()
+	conn, err := internet.DialSystem(ctx, server.destination, server.sockopt)
+
+	p.access.Lock()
+	defer p.access.Unlock()
+	if generation != p.generation || p.servers[server.destination.NetAddr()] != server {
+		if conn != nil {
+			go conn.Close()
+		}
+		return
+	}
+	server.dialing--
+	if err != nil {
+		p.failed++
+		server.lastFailure = time.Now()
+		newError("prewarm: failed to connect to ", server.destination.NetAddr()).Base(err).AtDebug().WriteToLog()
+		return
+	}
+	p.dialed++
+	server.idle = append(server.idle, warmConn{conn, time.Now()})
+}
+
+// take returns an idle connection to destination matching the socket options
+// of the dial, or nil. Dials with a source address or dscp mark, and those of
+// the pool itself, are not served.
+func (p *connectionPool) take(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) net.Conn {
+	if destination.Network != v2rayNet.Network_TCP || source != nil || ctx.Value(prewarmKey{}) != nil {
+		return nil
+	}
+	if _, hasDscp := dscpFromContext(ctx); hasDscp {
+		return nil
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	server, ok := p.servers[destination.NetAddr()]
+	if !ok || !sameSockopt(server.sockopt, sockopt) {
+		return nil
+	}
+	defer p.fill()
+	for len(server.idle) > 0 {
+		conn := server.idle[len(server.idle)-1]
+		server.idle = server.idle[:len(server.idle)-1]
+		if connAlive(conn.Conn) {
+			p.hits++
+			return conn.Conn
+		}
+		p.expired++
+		go conn.Close()
+	}
+	p.misses++
+	return nil
+}
+
+func sameSockopt(a, b *internet.SocketConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return proto.Equal(a, b)
+}
+
+// connAlive peeks at the socket, an idle connection closed by the server
+// reads eof and one the server wrote to is not idle.
+func connAlive(conn net.Conn) bool {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	err = rawConn.Read(func(fd uintptr) bool {
+		alive = peekIdle(fd)
+		return true
+	})
+	return err == nil && alive
+}
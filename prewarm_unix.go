@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// peekIdle reports whether the socket has nothing to read and is still open.
+func peekIdle(fd uintptr) bool {
+	_, _, err := unix.Recvfrom(int(fd), make([]byte, 1), unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	return err == unix.EAGAIN
+}
@@ -0,0 +1,19 @@
+package libcore
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// fionread is FIONREAD of winsock2.h, missing from x/sys/windows.
+const fionread = 0x4004667f
+
+// peekIdle reports whether the socket has nothing to read, the sockets of the
+// runtime block so the pending bytes are queried instead of peeking. A
+// connection closed by the server is only noticed once used.
+func peekIdle(fd uintptr) bool {
+	var pending, returned uint32
+	err := windows.WSAIoctl(windows.Handle(fd), fionread, nil, 0, (*byte)(unsafe.Pointer(&pending)), 4, &returned, nil, 0)
+	return err == nil && pending == 0
+}
@@ -0,0 +1,247 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	v2rayTls "github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// udpProbeServer is queried through the outbound to test udp relay.
+var udpProbeServer = v2rayNet.UDPDestination(v2rayNet.ParseAddress("8.8.8.8"), 53)
+
+type ServerProbeResult struct {
+	Protocol  string
+	Server    string
+	Transport string
+	Security  string
+	// MuxEnabled is whether the outbound is configured to use mux.
+	MuxEnabled bool
+	ConnectMs  int32
+
+	TlsVersion          string
+	Alpn                string
+	CipherSuite         string
+	CertificateVerified bool
+	CertificateError    string
+
+	UdpRelay bool
+	UdpError string
+}
+
+// ProbeServer connects to the server of the outbound tagged tag and reports
+// the negotiated transport details, the tls handshake is made directly with
+// the configured server name and alpn. UDP relay is tested with a dns query
+// through the outbound.
+func (instance *V2RayInstance) ProbeServer(tag string, timeoutMs int32) (*ServerProbeResult, error) {
+	instance.access.Lock()
+	config := instance.config
+	instance.access.Unlock()
+	if config == nil {
+		return nil, withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	var outboundConfig *core.OutboundHandlerConfig
+	for _, outbound := range config.Outbound {
+		if outbound.Tag == tag {
+			outboundConfig = outbound
+			break
+		}
+	}
+	if outboundConfig == nil {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("non existing tag: ", tag))
+	}
+
+	result := &ServerProbeResult{Security: "none"}
+	proxySettings, err := commonSerial.GetInstanceOf(outboundConfig.ProxySettings)
+	if err != nil {
+		return nil, withCode(ErrorCodeConfigInvalid, err)
+	}
+	result.Protocol = proxyProtocolName(outboundConfig.ProxySettings.TypeUrl)
+	server, ok := findServerEndpoint(proto.MessageReflect(proxySettings))
+	if !ok {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("outbound ", tag, " has no server"))
+	}
+	result.Server = server.NetAddr()
+
+	var tlsConfig *v2rayTls.Config
+	if outboundConfig.SenderSettings != nil {
+		if senderSettings, err := commonSerial.GetInstanceOf(outboundConfig.SenderSettings); err == nil {
+			sender := senderSettings.(*proxyman.SenderConfig)
+			result.MuxEnabled = sender.MultiplexSettings != nil && sender.MultiplexSettings.Enabled
+			if stream := sender.StreamSettings; stream != nil {
+				result.Transport = stream.ProtocolName
+				if stream.SecurityType != "" {
+					result.Security = stream.SecurityType
+				}
+				for _, settings := range stream.SecuritySettings {
+					if securityConfig, err := commonSerial.GetInstanceOf(settings); err == nil {
+						if c, ok := securityConfig.(*v2rayTls.Config); ok {
+							tlsConfig = c
+							result.Security = "tls"
+						}
+					}
+				}
+			}
+		}
+	}
+	if result.Transport == "" {
+		result.Transport = "tcp"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	conn, err := internet.DialSystem(ctx, server, nil)
+	if err != nil {
+		return nil, exportError(newError("failed to connect to ", result.Server).Base(err))
+	}
+	result.ConnectMs = int32(time.Since(start).Milliseconds())
+	if tlsConfig != nil {
+		probeTls(ctx, conn, server, tlsConfig, result)
+	} else {
+		conn.Close()
+	}
+
+	instance.probeUdp(ctx, tag, result)
+	return result, nil
+}
+
+func probeTls(ctx context.Context, conn net.Conn, server v2rayNet.Destination, config *v2rayTls.Config, result *ServerProbeResult) {
+	serverName := config.ServerName
+	if serverName == "" && server.Address.Family().IsDomain() {
+		serverName = server.Address.Domain()
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         config.NextProtocol,
+		InsecureSkipVerify: true,
+		KeyLogWriter:       tlsKeyLogWriter(),
+	})
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		result.CertificateError = err.Error()
+		return
+	}
+	state := tlsConn.ConnectionState()
+	result.TlsVersion = tlsVersionName(state.Version)
+	result.Alpn = state.NegotiatedProtocol
+	result.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		result.CertificateError = err.Error()
+	} else {
+		result.CertificateVerified = true
+	}
+}
+
+func (instance *V2RayInstance) probeUdp(ctx context.Context, tag string, result *ServerProbeResult) {
+	handler := instance.outboundHandler(tag)
+	if handler == nil {
+		result.UdpError = "outbound not started"
+		return
+	}
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.google.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	raw, _ := query.Pack()
+
+	dispatchCtx := core.WithContext(context.Background(), instance.core)
+	dispatchCtx = session.ContextWithOutbound(dispatchCtx, &session.Outbound{Target: udpProbeServer})
+	conn := instance.handleUDP(dispatchCtx, handler, udpProbeServer, pingTimeout)
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	addr := &net.UDPAddr{IP: udpProbeServer.Address.IP(), Port: int(udpProbeServer.Port)}
+	if _, err := conn.WriteTo(raw, addr); err != nil {
+		result.UdpError = err.Error()
+		return
+	}
+	if _, _, err := conn.readFrom(); err != nil {
+		result.UdpError = err.Error()
+		return
+	}
+	result.UdpRelay = true
+}
+
+// findServerEndpoint returns the first message in settings with an address
+// and port, like protocol.ServerEndpoint or the flat configs of some proxies.
+func findServerEndpoint(message protoreflect.Message) (v2rayNet.Destination, bool) {
+	descriptor := message.Descriptor()
+	addressField := descriptor.Fields().ByName("address")
+	portField := descriptor.Fields().ByName("port")
+	if addressField != nil && portField != nil && addressField.Kind() == protoreflect.MessageKind && message.Has(addressField) {
+		if address, ok := message.Get(addressField).Message().Interface().(*v2rayNet.IPOrDomain); ok {
+			port := message.Get(portField)
+			if port, err := strconv.ParseUint(port.String(), 10, 16); err == nil {
+				return v2rayNet.TCPDestination(address.AsAddress(), v2rayNet.Port(port)), true
+			}
+		}
+	}
+
+	var destination v2rayNet.Destination
+	var found bool
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if field.Kind() != protoreflect.MessageKind || field.IsMap() {
+			return true
+		}
+		if field.IsList() {
+			list := value.List()
+			for i := 0; i < list.Len() && !found; i++ {
+				destination, found = findServerEndpoint(list.Get(i).Message())
+			}
+		} else {
+			destination, found = findServerEndpoint(value.Message())
+		}
+		return !found
+	})
+	return destination, found
+}
+
+// proxyProtocolName returns "vmess" for "types.v2fly.org/v2ray.core.proxy.vmess.outbound.Config".
+func proxyProtocolName(typeUrl string) string {
+	name := typeUrl[strings.LastIndex(typeUrl, "/")+1:]
+	if index := strings.Index(name, ".proxy."); index >= 0 {
+		name = name[index+len(".proxy."):]
+		return strings.SplitN(name, ".", 2)[0]
+	}
+	return name
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
@@ -2,20 +2,14 @@ package libcore
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"net"
-	"os"
 	"runtime"
-	"time"
 
 	"github.com/sirupsen/logrus"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
-	"golang.org/x/sys/unix"
-	"libcore/comm"
 )
 
 type Protector interface {
@@ -44,10 +38,13 @@ func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address,
 
 		return nil, newError("invalid destination")
 	}
+	if conn := warmPool.take(ctx, source, destination, sockopt); conn != nil {
+		return conn, nil
+	}
 
 	var ips []net.IP
 	if destination.Address.Family().IsDomain() {
-		ips, err = dialer.resolver(destination.Address.Domain())
+		ips, err = dialer.resolveServer(ctx, destination)
 		if err == nil && len(ips) == 0 {
 			err = dns.ErrEmptyResponse
 		}
@@ -74,90 +71,52 @@ func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address,
 	return conn, err
 }
 
-func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	destIp := destination.Address.IP()
-	ipv6 := len(destIp) != net.IPv4len
-	fd, err := getFd(destination.Network, ipv6)
-	if err != nil {
-		return nil, err
-	}
-
-	if !dialer.protector.Protect(int32(fd)) {
-		return nil, errors.New("protect failed")
-	}
-
-	if sockopt != nil {
-		internet.ApplySockopt(sockopt, destination, uintptr(fd), ctx)
-	}
+// socketSetup is what the socket of a connection is configured with, read
+// from its context before dialing.
+type socketSetup struct {
+	source     v2rayNet.Address
+	sockopt    *internet.SocketConfig
+	dscp       int
+	hasDscp    bool
+	binding    string
+	options    SocketOptions
+	hasOptions bool
+}
 
-	var sockaddr unix.Sockaddr
-	if !ipv6 {
-		socketAddress := &unix.SockaddrInet4{
-			Port: int(destination.Port),
-		}
-		copy(socketAddress.Addr[:], destIp)
-		sockaddr = socketAddress
-	} else {
-		socketAddress := &unix.SockaddrInet6{
-			Port: int(destination.Port),
-		}
-		copy(socketAddress.Addr[:], destIp)
-		sockaddr = socketAddress
-	}
+func newSocketSetup(ctx context.Context, source v2rayNet.Address, sockopt *internet.SocketConfig) *socketSetup {
+	setup := &socketSetup{source: source, sockopt: sockopt}
+	setup.dscp, setup.hasDscp = dscpFromContext(ctx)
+	setup.binding = sourceBindingFromContext(ctx)
+	setup.options, setup.hasOptions = socketOptionsFromContext(ctx)
+	return setup
+}
 
-	err = unix.Connect(fd, sockaddr)
-	if err != nil {
-		return nil, err
+// prepare protects the socket and applies the settings before it connects
+// to destination, the source address is bound by the caller.
+func (dialer protectedDialer) prepare(ctx context.Context, fd int, destination v2rayNet.Destination, ipv6 bool, setup *socketSetup) error {
+	protected := dialer.protector.Protect(int32(fd))
+	protectAudit.record(fd, destination.NetAddr(), protected)
+	if isProxyDial(ctx) {
+		loopGuard.addServer(destination.Address)
 	}
-
-	file := os.NewFile(uintptr(fd), "socket")
-	if file == nil {
-		return nil, errors.New("failed to connect to fd")
+	if !protected {
+		return errProtectFailed
 	}
 
-	switch destination.Network {
-	case v2rayNet.Network_UDP:
-		pc, err := net.FilePacketConn(file)
-		if err == nil {
-			destAddr, err := net.ResolveUDPAddr("udp", destination.NetAddr())
-			if err != nil {
-				return nil, err
-			}
-			conn = &internet.PacketConnWrapper{
-				Conn: pc,
-				Dest: destAddr,
-			}
-		}
-	default:
-		conn, err = net.FileConn(file)
+	applySocketMark(fd)
+	if destination.Network == v2rayNet.Network_TCP {
+		applyTcpKeepAlive(fd)
 	}
-
-	if err != nil {
-		return nil, err
+	if setup.sockopt != nil {
+		internet.ApplySockopt(setup.sockopt, destination, uintptr(fd), ctx)
 	}
-
-	comm.CloseIgnore(file)
-	return conn, nil
-}
-
-func getFd(network v2rayNet.Network, ipv6 bool) (fd int, err error) {
-	var af int
-	if !ipv6 {
-		af = unix.AF_INET
-	} else {
-		af = unix.AF_INET6
+	if setup.hasOptions {
+		setup.options.apply(fd, destination.Network, ipv6)
 	}
-	switch network {
-	case v2rayNet.Network_TCP:
-		fd, err = unix.Socket(af, unix.SOCK_STREAM, unix.IPPROTO_TCP)
-	case v2rayNet.Network_UDP:
-		fd, err = unix.Socket(af, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
-	case v2rayNet.Network_UNIX:
-		fd, err = unix.Socket(af, unix.SOCK_STREAM, 0)
-	default:
-		err = fmt.Errorf("unknow network")
+	if setup.hasDscp {
+		if err := applyDscp(fd, ipv6, setup.dscp); err != nil {
+			logrus.Debug("set dscp: ", err)
+		}
 	}
-	return
+	return nil
 }
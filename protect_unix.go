@@ -0,0 +1,124 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"golang.org/x/sys/unix"
+	"libcore/comm"
+)
+
+func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
+	setup := newSocketSetup(ctx, source, sockopt)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	destIp := destination.Address.IP()
+	ipv6 := len(destIp) != net.IPv4len
+	fd, err := setup.options.socket(destination.Network, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = dialer.prepare(ctx, fd, destination, ipv6, setup); err == nil {
+		err = bindSource(fd, ipv6, setup.source, setup.binding)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	var sockaddr unix.Sockaddr
+	if !ipv6 {
+		socketAddress := &unix.SockaddrInet4{
+			Port: int(destination.Port),
+		}
+		copy(socketAddress.Addr[:], destIp)
+		sockaddr = socketAddress
+	} else {
+		socketAddress := &unix.SockaddrInet6{
+			Port: int(destination.Port),
+		}
+		copy(socketAddress.Addr[:], destIp)
+		sockaddr = socketAddress
+	}
+
+	err = unix.Connect(fd, sockaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), "socket")
+	if file == nil {
+		return nil, errors.New("failed to connect to fd")
+	}
+
+	switch destination.Network {
+	case v2rayNet.Network_UDP:
+		pc, err := net.FilePacketConn(file)
+		if err == nil {
+			destAddr, err := net.ResolveUDPAddr("udp", destination.NetAddr())
+			if err != nil {
+				return nil, err
+			}
+			conn = &internet.PacketConnWrapper{
+				Conn: pc,
+				Dest: destAddr,
+			}
+		}
+	default:
+		conn, err = net.FileConn(file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	comm.CloseIgnore(file)
+	return conn, nil
+}
+
+func getFd(network v2rayNet.Network, ipv6 bool) (fd int, err error) {
+	var af int
+	if !ipv6 {
+		af = unix.AF_INET
+	} else {
+		af = unix.AF_INET6
+	}
+	switch network {
+	case v2rayNet.Network_TCP:
+		fd, err = unix.Socket(af, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	case v2rayNet.Network_UDP:
+		fd, err = unix.Socket(af, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	case v2rayNet.Network_UNIX:
+		fd, err = unix.Socket(af, unix.SOCK_STREAM, 0)
+	default:
+		err = fmt.Errorf("unknow network")
+	}
+	return
+}
+
+// listenUpstreamUDP creates an unconnected udp socket bypassing the tun, for
+// traffic that has to reach the local network directly.
+func listenUpstreamUDP(control func(fd uintptr), ipv6 bool) (net.PacketConn, error) {
+	fd, err := getFd(v2rayNet.Network_UDP, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	control(uintptr(fd))
+	applySocketMark(fd)
+	file := os.NewFile(uintptr(fd), "socket")
+	if file == nil {
+		return nil, errors.New("failed to create packet conn from fd")
+	}
+	defer comm.CloseIgnore(file)
+	return net.FilePacketConn(file)
+}
@@ -0,0 +1,62 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+// dial connects with the sockets of the runtime, which are protected and
+// set up from their control function.
+func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	setup := newSocketSetup(ctx, source, sockopt)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ipv6 := len(destination.Address.IP()) != net.IPv4len
+	control := func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = dialer.prepare(ctx, int(fd), destination, ipv6, setup)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+
+	netDialer := &net.Dialer{Control: control}
+	// the runtime binds the socket itself before connecting
+	ip, err := sourceAddress(ipv6, setup.source, setup.binding)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		if destination.Network == v2rayNet.Network_UDP {
+			netDialer.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			netDialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return netDialer.DialContext(ctx, destination.Network.SystemString(), destination.NetAddr())
+}
+
+// listenUpstreamUDP creates an unconnected udp socket bypassing the tun, for
+// traffic that has to reach the local network directly.
+func listenUpstreamUDP(control func(fd uintptr), ipv6 bool) (net.PacketConn, error) {
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	config := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				control(fd)
+				applySocketMark(int(fd))
+			})
+		},
+	}
+	return config.ListenPacket(context.Background(), network, "")
+}
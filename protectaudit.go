@@ -0,0 +1,118 @@
+package libcore
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+const protectAuditSize = 256
+
+var protectAudit = new(protectAuditor)
+
+// protectAuditor keeps the latest protected sockets and the connections that
+// were made by this process without protection, which loop back into the tun.
+type protectAuditor struct {
+	access  sync.Mutex
+	enabled bool
+	entries []string
+	next    int
+}
+
+func SetProtectAuditEnabled(enabled bool) {
+	protectAudit.access.Lock()
+	protectAudit.enabled = enabled
+	protectAudit.access.Unlock()
+}
+
+// GetProtectAuditLog returns the recorded entries, oldest first.
+func GetProtectAuditLog() string {
+	return protectAudit.log()
+}
+
+func ClearProtectAuditLog() {
+	protectAudit.clear()
+}
+
+func (a *protectAuditor) isEnabled() bool {
+	a.access.Lock()
+	defer a.access.Unlock()
+	return a.enabled
+}
+
+func (a *protectAuditor) log() string {
+	a.access.Lock()
+	defer a.access.Unlock()
+	entries := append(append([]string(nil), a.entries[a.next:]...), a.entries[:a.next]...)
+	return strings.Join(entries, "\n")
+}
+
+func (a *protectAuditor) clear() {
+	a.access.Lock()
+	a.entries = nil
+	a.next = 0
+	a.access.Unlock()
+}
+
+func (a *protectAuditor) add(entry string) {
+	entry = time.Now().Format("15:04:05.000 ") + entry
+	a.access.Lock()
+	defer a.access.Unlock()
+	if len(a.entries) < protectAuditSize {
+		a.entries = append(a.entries, entry)
+		return
+	}
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % protectAuditSize
+}
+
+// record logs a socket passed to the protector, destination may be empty
+// when the socket is not connected by libcore itself.
+func (a *protectAuditor) record(fd int, destination string, protected bool) {
+	if !a.isEnabled() {
+		return
+	}
+	family, sockType := describeSocket(fd)
+	if destination == "" {
+		destination = "-"
+	}
+	entry := fmt.Sprintf("protect fd=%d family=%s type=%s destination=%s ok=%t caller=%s",
+		fd, family, sockType, destination, protected, auditCaller())
+	a.add(entry)
+	if !protected {
+		logrus.Warn("[Audit] ", entry)
+	}
+}
+
+// flagUnprotected records a connection from this process seen on the tun.
+func (a *protectAuditor) flagUnprotected(network string, source v2rayNet.Destination, destination v2rayNet.Destination) {
+	if !a.isEnabled() {
+		return
+	}
+	entry := fmt.Sprintf("UNPROTECTED %s %s ==> %s", network, source.NetAddr(), destination.NetAddr())
+	a.add(entry)
+	logrus.Warn("[Audit] ", entry)
+}
+
+func auditCaller() string {
+	pc := make([]uintptr, 16)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	var callers []string
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "protectAudit") && !strings.HasSuffix(frame.Function, ".func1") {
+			name := frame.Function[strings.LastIndexByte(frame.Function, '/')+1:]
+			callers = append(callers, fmt.Sprint(name, ":", frame.Line))
+		}
+		if !more || len(callers) == 3 {
+			break
+		}
+	}
+	return strings.Join(callers, " < ")
+}
@@ -0,0 +1,38 @@
+package libcore
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// describeSocket returns the family and type names of a socket.
+func describeSocket(fd int) (string, string) {
+	family, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	sockType, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	return socketFamilyName(family), socketTypeName(sockType)
+}
+
+func socketFamilyName(family int) string {
+	switch family {
+	case unix.AF_INET:
+		return "inet"
+	case unix.AF_INET6:
+		return "inet6"
+	case unix.AF_UNIX:
+		return "unix"
+	}
+	return fmt.Sprint(family)
+}
+
+func socketTypeName(sockType int) string {
+	switch sockType {
+	case unix.SOCK_STREAM:
+		return "stream"
+	case unix.SOCK_DGRAM:
+		return "dgram"
+	case unix.SOCK_RAW:
+		return "raw"
+	}
+	return fmt.Sprint(sockType)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+// describeSocket returns the family and type names of a socket, which are
+// only queried on Linux.
+func describeSocket(fd int) (string, string) {
+	return "-", "-"
+}
@@ -0,0 +1,117 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protectBatchTimeout fails the sockets of a batch the protector did not
+// complete in time.
+const protectBatchTimeout = 5 * time.Second
+
+// ProtectorV2 protects sockets in batches, so a burst of connections costs
+// one binder transaction instead of one per socket.
+type ProtectorV2 interface {
+	// ProtectBatch protects the sockets of batch and reports each of them to
+	// batch.Done, which may happen later and on another thread.
+	ProtectBatch(batch *ProtectBatch)
+}
+
+type ProtectBatch struct {
+	fds       []int32
+	results   []chan bool
+	completed []int32
+	remaining int32
+	batcher   *protectBatcher
+	timeout   *time.Timer
+}
+
+func (b *ProtectBatch) Len() int32 {
+	return int32(len(b.fds))
+}
+
+// Get returns the fd at index, -1 if out of range.
+func (b *ProtectBatch) Get(index int32) int32 {
+	if index < 0 || int(index) >= len(b.fds) {
+		return -1
+	}
+	return b.fds[index]
+}
+
+// Done reports whether the socket at index is protected, later reports of
+// the same socket are ignored.
+func (b *ProtectBatch) Done(index int32, protected bool) {
+	if index < 0 || int(index) >= len(b.fds) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&b.completed[index], 0, 1) {
+		return
+	}
+	b.results[index] <- protected
+	if atomic.AddInt32(&b.remaining, -1) == 0 {
+		b.timeout.Stop()
+		b.batcher.next()
+	}
+}
+
+// protectBatcher is a Protector sending a socket to the ProtectorV2 right
+// away if no batch is in flight, and otherwise collecting the sockets into
+// the next batch, sent when the one in flight completes.
+type protectBatcher struct {
+	protector ProtectorV2
+	access    sync.Mutex
+	inFlight  bool
+	pending   *ProtectBatch
+}
+
+func newProtectBatcher(protector ProtectorV2) *protectBatcher {
+	return &protectBatcher{protector: protector}
+}
+
+func (p *protectBatcher) Protect(fd int32) bool {
+	result := make(chan bool, 1)
+	p.access.Lock()
+	if p.pending == nil {
+		p.pending = &ProtectBatch{batcher: p}
+	}
+	p.pending.fds = append(p.pending.fds, fd)
+	p.pending.results = append(p.pending.results, result)
+	var batch *ProtectBatch
+	if !p.inFlight {
+		batch = p.pending
+		p.pending = nil
+		p.inFlight = true
+	}
+	p.access.Unlock()
+	if batch != nil {
+		p.send(batch)
+	}
+	return <-result
+}
+
+func (p *protectBatcher) send(batch *ProtectBatch) {
+	batch.completed = make([]int32, len(batch.fds))
+	batch.remaining = int32(len(batch.fds))
+	batch.timeout = time.AfterFunc(protectBatchTimeout, func() {
+		for i := range batch.fds {
+			batch.Done(int32(i), false)
+		}
+	})
+	if len(batch.fds) > 1 {
+		newError("protecting ", len(batch.fds), " sockets in a batch").AtDebug().WriteToLog()
+	}
+	p.protector.ProtectBatch(batch)
+}
+
+// next sends the collected sockets once the batch in flight completes.
+func (p *protectBatcher) next() {
+	p.access.Lock()
+	batch := p.pending
+	p.pending = nil
+	p.inFlight = batch != nil
+	p.access.Unlock()
+	if batch != nil {
+		go p.send(batch)
+	}
+}
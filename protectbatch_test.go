@@ -0,0 +1,85 @@
+package libcore
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProtectorV2 completes every batch it gets from another goroutine.
+type testProtectorV2 struct {
+	access  sync.Mutex
+	batches []*ProtectBatch
+}
+
+func (p *testProtectorV2) ProtectBatch(batch *ProtectBatch) {
+	p.access.Lock()
+	p.batches = append(p.batches, batch)
+	p.access.Unlock()
+	go func() {
+		for i := int32(0); i < batch.Len(); i++ {
+			batch.Done(i, batch.Get(i)%2 == 0)
+		}
+	}()
+}
+
+func TestProtectBatcher(t *testing.T) {
+	protector := new(testProtectorV2)
+	batcher := newProtectBatcher(protector)
+	const sockets = 32
+	var wg sync.WaitGroup
+	wg.Add(sockets)
+	for fd := int32(0); fd < sockets; fd++ {
+		go func(fd int32) {
+			defer wg.Done()
+			if protected := batcher.Protect(fd); protected != (fd%2 == 0) {
+				t.Errorf("fd %d protected %v", fd, protected)
+			}
+		}(fd)
+	}
+	wg.Wait()
+	// results are sent before the last batch completes
+	for i := 0; ; i++ {
+		batcher.access.Lock()
+		inFlight := batcher.inFlight
+		batcher.access.Unlock()
+		if !inFlight {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the last batch did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	protector.access.Lock()
+	defer protector.access.Unlock()
+	var total int32
+	for _, batch := range protector.batches {
+		total += batch.Len()
+		// the timeout of a completed batch is stopped
+		if batch.timeout.Stop() {
+			t.Error("timeout of a completed batch was still running")
+		}
+	}
+	if total != sockets {
+		t.Fatalf("%d sockets sent, want %d", total, sockets)
+	}
+}
+
+func TestProtectBatchDoneOnce(t *testing.T) {
+	batcher := newProtectBatcher(nil)
+	result := make(chan bool, 2)
+	batch := &ProtectBatch{fds: []int32{1}, results: []chan bool{result}, completed: make([]int32, 1), remaining: 1, batcher: batcher}
+	batcher.inFlight = true
+	batch.timeout = time.AfterFunc(time.Hour, func() {})
+	batch.Done(0, true)
+	batch.Done(0, false)
+	batch.Done(1, false)
+	if len(result) != 1 || !<-result {
+		t.Fatal("socket was reported more than once")
+	}
+	if batcher.inFlight {
+		t.Fatal("batcher still waits for the completed batch")
+	}
+}
@@ -0,0 +1,56 @@
+package libcore
+
+import (
+	"net"
+	"time"
+)
+
+const protectPathTimeout = 3 * time.Second
+
+// protectPathProtector protects sockets over the protect_path protocol of
+// shadowsocks-android and the cores following it: the fd is sent over a
+// unix socket in SCM_RIGHTS, and the app answers one byte, zero if it is
+// protected.
+type protectPathProtector struct {
+	address *net.UnixAddr
+}
+
+// NewProtectPathProtector returns a protector for apps exposing the
+// protect_path unix socket. path is a file path, or an abstract socket name
+// prefixed with @.
+func NewProtectPathProtector(path string) (Protector, error) {
+	if path == "" {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("missing protect path"))
+	}
+	return &protectPathProtector{&net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+func (p *protectPathProtector) Protect(fd int32) bool {
+	if err := p.protect(int(fd)); err != nil {
+		newError("protect socket over ", p.address.Name).Base(err).AtWarning().WriteToLog()
+		return false
+	}
+	return true
+}
+
+func (p *protectPathProtector) protect(fd int) error {
+	conn, err := net.DialUnix("unix", nil, p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(protectPathTimeout)); err != nil {
+		return err
+	}
+	if err = sendFd(conn, fd); err != nil {
+		return err
+	}
+	var result [1]byte
+	if _, err = conn.Read(result[:]); err != nil {
+		return err
+	}
+	if result[0] != 0 {
+		return newError("rejected")
+	}
+	return nil
+}
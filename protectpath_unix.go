@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendFd sends fd in SCM_RIGHTS along with one byte.
+func sendFd(conn *net.UnixConn, fd int) error {
+	_, _, err := conn.WriteMsgUnix([]byte{1}, unix.UnixRights(fd), nil)
+	return err
+}
@@ -0,0 +1,9 @@
+package libcore
+
+import (
+	"net"
+)
+
+func sendFd(conn *net.UnixConn, fd int) error {
+	return newError("passing sockets over unix sockets is not supported on Windows")
+}
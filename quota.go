@@ -0,0 +1,349 @@
+package libcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+	"github.com/v2fly/v2ray-core/v5/features/stats"
+)
+
+const (
+	// QuotaActionNotify only calls the listener once the quota is exceeded.
+	QuotaActionNotify int32 = iota
+	// QuotaActionFallback routes the connections of the outbound to the
+	// fallback outbound instead.
+	QuotaActionFallback
+	// QuotaActionBlock rejects the connections of the outbound.
+	QuotaActionBlock
+)
+
+const (
+	quotaPollInterval = 5 * time.Second
+	quotaSaveInterval = time.Minute
+)
+
+type QuotaListener interface {
+	OnQuotaExceeded(tag string, used int64, quota int64)
+}
+
+type outboundQuota struct {
+	quota    int64
+	action   int32
+	fallback string
+}
+
+type quotaUsage struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+}
+
+// quotaTracker owns the outbound traffic counters of v2ray, it keeps the
+// cumulative usage of every outbound and the deltas not yet read through
+// QueryStats. The counters exist if the policy enables outbound stats.
+type quotaTracker struct {
+	access     sync.RWMutex
+	stats      stats.Manager
+	tags       []string
+	defaultTag string
+	path       string
+	usage      map[string]*quotaUsage
+	pending    map[string]int64
+	quotas     map[string]*outboundQuota
+	exceeded   map[string]bool
+	listener   QuotaListener
+	onChange   func()
+	dirty      bool
+	savedAt    time.Time
+	done       chan struct{}
+}
+
+func newQuotaTracker(manager stats.Manager, tags []string, defaultTag string, onChange func()) *quotaTracker {
+	t := &quotaTracker{
+		stats:      manager,
+		tags:       tags,
+		defaultTag: defaultTag,
+		usage:      make(map[string]*quotaUsage),
+		pending:    make(map[string]int64),
+		quotas:     make(map[string]*outboundQuota),
+		exceeded:   make(map[string]bool),
+		onChange:   onChange,
+		done:       make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func (t *quotaTracker) loop() {
+	ticker := time.NewTicker(quotaPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.poll()
+		}
+	}
+}
+
+func (t *quotaTracker) close() {
+	close(t.done)
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.collectAll()
+	if err := t.save(); err != nil {
+		newError("failed to save outbound usage").Base(err).AtWarning().WriteToLog()
+	}
+}
+
+// collect moves a counter into the usage and the pending deltas, with the
+// lock held.
+func (t *quotaTracker) collect(tag string, direct string) {
+	if t.stats == nil {
+		return
+	}
+	name := fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct)
+	counter := t.stats.GetCounter(name)
+	if counter == nil {
+		return
+	}
+	delta := counter.Set(0)
+	if delta == 0 {
+		return
+	}
+	t.pending[name] += delta
+	usage := t.usage[tag]
+	if usage == nil {
+		usage = new(quotaUsage)
+		t.usage[tag] = usage
+	}
+	if direct == "uplink" {
+		usage.Uplink += delta
+	} else {
+		usage.Downlink += delta
+	}
+	t.dirty = true
+}
+
+func (t *quotaTracker) collectAll() {
+	for _, tag := range t.tags {
+		t.collect(tag, "uplink")
+		t.collect(tag, "downlink")
+	}
+}
+
+func (t *quotaTracker) poll() {
+	type exceededQuota struct {
+		tag   string
+		used  int64
+		quota int64
+	}
+	var exceeded []exceededQuota
+
+	t.access.Lock()
+	t.collectAll()
+	for tag, quota := range t.quotas {
+		if t.exceeded[tag] {
+			continue
+		}
+		used := t.used(tag)
+		if used < quota.quota {
+			continue
+		}
+		t.exceeded[tag] = true
+		exceeded = append(exceeded, exceededQuota{tag, used, quota.quota})
+	}
+	if t.dirty && time.Since(t.savedAt) >= quotaSaveInterval {
+		if err := t.save(); err != nil {
+			newError("failed to save outbound usage").Base(err).AtWarning().WriteToLog()
+		}
+	}
+	listener := t.listener
+	t.access.Unlock()
+
+	if len(exceeded) > 0 && t.onChange != nil {
+		t.onChange()
+	}
+	for _, quota := range exceeded {
+		newError("outbound ", quota.tag, " exceeded its quota: ", quota.used, "/", quota.quota).AtWarning().WriteToLog()
+		if listener != nil {
+			listener.OnQuotaExceeded(quota.tag, quota.used, quota.quota)
+		}
+	}
+}
+
+func (t *quotaTracker) used(tag string) int64 {
+	usage := t.usage[tag]
+	if usage == nil {
+		return 0
+	}
+	return usage.Uplink + usage.Downlink
+}
+
+// take returns the delta of a counter since the last call, for QueryStats.
+func (t *quotaTracker) take(tag string, direct string) int64 {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.collect(tag, direct)
+	name := fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct)
+	delta := t.pending[name]
+	delete(t.pending, name)
+	return delta
+}
+
+// load merges the usage stored at path and saves to it from now on.
+func (t *quotaTracker) load(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stored := make(map[string]*quotaUsage)
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &stored); err != nil {
+			return err
+		}
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	for tag, usage := range stored {
+		if usage == nil {
+			continue
+		}
+		if current := t.usage[tag]; current != nil {
+			current.Uplink += usage.Uplink
+			current.Downlink += usage.Downlink
+		} else {
+			t.usage[tag] = usage
+		}
+	}
+	t.path = path
+	t.dirty = true
+	return nil
+}
+
+// save writes the usage with the lock held.
+func (t *quotaTracker) save() error {
+	if t.path == "" || !t.dirty {
+		return nil
+	}
+	content, err := json.Marshal(t.usage)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(t.path+".tmp", content, 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(t.path+".tmp", t.path); err != nil {
+		return err
+	}
+	t.dirty = false
+	t.savedAt = time.Now()
+	return nil
+}
+
+// redirect applies the action of an exceeded quota to a picked route, a
+// failed pick goes to the default outbound.
+func (t *quotaTracker) redirect(ctx routing.Context, route routing.Route, err error) (routing.Route, error) {
+	tag := t.defaultTag
+	if err == nil {
+		tag = route.GetOutboundTag()
+	}
+	t.access.RLock()
+	quota := t.quotas[tag]
+	exceeded := t.exceeded[tag]
+	t.access.RUnlock()
+	if quota == nil || !exceeded {
+		return route, err
+	}
+	switch quota.action {
+	case QuotaActionFallback:
+		newError("outbound ", tag, " exceeded its quota, taking fallback [", quota.fallback, "]").AtDebug().WriteToLog()
+		return &ruleRoute{ctx, quota.fallback}, nil
+	case QuotaActionBlock:
+		return &ruleRoute{ctx, BlockTagReject}, nil
+	}
+	return route, err
+}
+
+// SetQuotaStore persists the cumulative outbound usage to path, usage stored
+// there before is added to the current one.
+func (instance *V2RayInstance) SetQuotaStore(path string) error {
+	if instance.quotas == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	if err := instance.quotas.load(path); err != nil {
+		return exportError(newError("failed to load outbound usage").Base(err))
+	}
+	return nil
+}
+
+// SetOutboundQuota limits the total traffic of an outbound in bytes, a quota
+// of zero removes the limit. Connections already established are not
+// affected once the quota is exceeded.
+func (instance *V2RayInstance) SetOutboundQuota(tag string, quota int64, action int32, fallback string) error {
+	if instance.quotas == nil {
+		return withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	if action == QuotaActionFallback && (fallback == "" || instance.outboundManager.GetHandler(fallback) == nil) {
+		return withCode(ErrorCodeInvalidArgument, newError("unknown fallback outbound ", fallback))
+	}
+	if action < QuotaActionNotify || action > QuotaActionBlock {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid quota action ", action))
+	}
+	t := instance.quotas
+	t.access.Lock()
+	if quota <= 0 {
+		delete(t.quotas, tag)
+	} else {
+		t.quotas[tag] = &outboundQuota{quota, action, fallback}
+	}
+	delete(t.exceeded, tag)
+	t.access.Unlock()
+	t.poll()
+	t.onChange()
+	return nil
+}
+
+func (instance *V2RayInstance) SetQuotaListener(listener QuotaListener) {
+	if instance.quotas == nil {
+		return
+	}
+	instance.quotas.access.Lock()
+	instance.quotas.listener = listener
+	instance.quotas.access.Unlock()
+}
+
+// GetOutboundUsage returns the cumulative traffic of an outbound in bytes.
+func (instance *V2RayInstance) GetOutboundUsage(tag string) int64 {
+	if instance.quotas == nil {
+		return 0
+	}
+	t := instance.quotas
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.collect(tag, "uplink")
+	t.collect(tag, "downlink")
+	return t.used(tag)
+}
+
+// ResetOutboundUsage starts counting an outbound from zero, e.g. for a new
+// billing period, lifting its exceeded quota.
+func (instance *V2RayInstance) ResetOutboundUsage(tag string) {
+	if instance.quotas == nil {
+		return
+	}
+	t := instance.quotas
+	t.access.Lock()
+	t.collect(tag, "uplink")
+	t.collect(tag, "downlink")
+	delete(t.usage, tag)
+	delete(t.exceeded, tag)
+	t.dirty = true
+	t.access.Unlock()
+	t.onChange()
+}
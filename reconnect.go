@@ -0,0 +1,277 @@
+package libcore
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+// States reported to the ReconnectListener.
+const (
+	// OutboundStateConnected is sent when a probe succeeds after a failure.
+	OutboundStateConnected int32 = iota
+	// OutboundStateReconnecting is sent after each failed probe, with the
+	// delay before the next attempt.
+	OutboundStateReconnecting
+)
+
+const (
+	reconnectDefaultInterval = 30 * time.Second
+	reconnectDefaultInitial  = time.Second
+	reconnectDefaultMax      = time.Minute
+	reconnectDefaultJitter   = 20
+)
+
+type ReconnectConfig struct {
+	// Tags are the supervised outbounds separated by commas, the default
+	// outbound if empty.
+	Tags string
+	// Link is fetched through the outbounds, as by the watchdog.
+	Link       string
+	IntervalMs int32
+	TimeoutMs  int32
+	// InitialBackoffMs is the delay after the first failure, doubled after
+	// each failure up to MaxBackoffMs.
+	InitialBackoffMs int32
+	MaxBackoffMs     int32
+	// JitterPercent randomizes each delay by up to this share, so clients do
+	// not reconnect in step. Negative disables it.
+	JitterPercent int32
+	// FailFast rejects the connections routed to an outbound while it is
+	// reconnecting, instead of letting each of them time out.
+	FailFast bool
+}
+
+type ReconnectListener interface {
+	OnOutboundStateChanged(tag string, state int32, attempt int32, retryInMs int64, message string)
+}
+
+// reconnectSupervisor probes connection oriented outbounds like wireguard
+// and tls tunnels, and recreates them with exponential backoff while their
+// server can not be reached.
+type reconnectSupervisor struct {
+	instance *V2RayInstance
+	config   ReconnectConfig
+	listener ReconnectListener
+	done     chan struct{}
+	// defaultTag is the outbound of the connections matching no rule
+	defaultTag string
+
+	access sync.RWMutex
+	// down holds the tags of the outbounds being reconnected
+	down map[string]bool
+}
+
+// StartReconnect supervises the outbounds until StopReconnect or Close, a
+// running supervisor is replaced.
+func (instance *V2RayInstance) StartReconnect(config *ReconnectConfig, listener ReconnectListener) error {
+	if config == nil {
+		config = new(ReconnectConfig)
+	}
+	s := &reconnectSupervisor{
+		instance: instance,
+		config:   *config,
+		listener: listener,
+		done:     make(chan struct{}),
+		down:     make(map[string]bool),
+	}
+	if s.config.Link == "" {
+		s.config.Link = watchdogDefaultLink
+	}
+	if s.config.IntervalMs <= 0 {
+		s.config.IntervalMs = int32(reconnectDefaultInterval / time.Millisecond)
+	}
+	if s.config.TimeoutMs <= 0 {
+		s.config.TimeoutMs = int32(watchdogDefaultTimeout / time.Millisecond)
+	}
+	if s.config.InitialBackoffMs <= 0 {
+		s.config.InitialBackoffMs = int32(reconnectDefaultInitial / time.Millisecond)
+	}
+	if s.config.MaxBackoffMs < s.config.InitialBackoffMs {
+		s.config.MaxBackoffMs = int32(reconnectDefaultMax / time.Millisecond)
+		if s.config.MaxBackoffMs < s.config.InitialBackoffMs {
+			s.config.MaxBackoffMs = s.config.InitialBackoffMs
+		}
+	}
+	if s.config.JitterPercent == 0 {
+		s.config.JitterPercent = reconnectDefaultJitter
+	} else if s.config.JitterPercent > 100 {
+		s.config.JitterPercent = 100
+	}
+
+	s.defaultTag = instance.defaultOutboundTag()
+	var tags []string
+	for _, tag := range strings.Split(s.config.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		if s.defaultTag == "" {
+			return withCode(ErrorCodeInvalidState, newError("no default outbound"))
+		}
+		tags = append(tags, s.defaultTag)
+	}
+
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return withCode(ErrorCodeInvalidState, newError("not started"))
+	}
+	for _, tag := range tags {
+		if instance.outboundManager.GetHandler(tag) == nil {
+			return withCode(ErrorCodeInvalidArgument, newError("non existing tag: ", tag))
+		}
+	}
+	router, _ := instance.router.(*ruleRouter)
+	if previous := instance.reconnect; previous != nil {
+		previous.stop()
+	}
+	instance.reconnect = s
+	if router != nil {
+		router.reconnect.Store(s)
+	}
+	for _, tag := range tags {
+		go s.supervise(tag)
+	}
+	return nil
+}
+
+func (instance *V2RayInstance) StopReconnect() {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	instance.stopReconnect()
+}
+
+func (instance *V2RayInstance) stopReconnect() {
+	if instance.reconnect == nil {
+		return
+	}
+	instance.reconnect.stop()
+	instance.reconnect = nil
+	if router, ok := instance.router.(*ruleRouter); ok {
+		router.reconnect.Store((*reconnectSupervisor)(nil))
+	}
+}
+
+func (s *reconnectSupervisor) stop() {
+	close(s.done)
+}
+
+func (s *reconnectSupervisor) supervise(tag string) {
+	var attempt int32
+	backoff := time.Duration(s.config.InitialBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(s.config.MaxBackoffMs) * time.Millisecond
+	for {
+		err := s.probe(tag)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		var delay time.Duration
+		if err == nil {
+			if attempt > 0 {
+				newError("reconnect: outbound ", tag, " connected after ", attempt, " attempts").AtInfo().WriteToLog()
+				s.setDown(tag, false)
+				s.emit(tag, OutboundStateConnected, attempt, 0, "")
+			}
+			attempt = 0
+			backoff = time.Duration(s.config.InitialBackoffMs) * time.Millisecond
+			delay = time.Duration(s.config.IntervalMs) * time.Millisecond
+		} else {
+			attempt++
+			if attempt == 1 {
+				newError("reconnect: outbound ", tag, " unreachable").Base(err).AtWarning().WriteToLog()
+				s.setDown(tag, true)
+			} else {
+				newError("reconnect: attempt ", attempt, " through ", tag, " failed").Base(err).AtDebug().WriteToLog()
+			}
+			// a new handler makes a new handshake, stale tunnels and mux
+			// sessions are dropped
+			if err := s.instance.restartOutbound(tag); err != nil {
+				newError("reconnect: failed to recreate outbound ", tag).Base(err).AtWarning().WriteToLog()
+			}
+			delay = s.jitter(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			s.emit(tag, OutboundStateReconnecting, attempt, delay.Milliseconds(), err.Error())
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *reconnectSupervisor) probe(tag string) error {
+	_, err := urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		portNumber, _ := strconv.Atoi(port)
+		return s.instance.dialVia(ctx, host, int32(portNumber), tag)
+	}, s.config.Link, s.config.TimeoutMs)
+	return err
+}
+
+// jitter spreads delay by up to JitterPercent either way.
+func (s *reconnectSupervisor) jitter(delay time.Duration) time.Duration {
+	if s.config.JitterPercent <= 0 {
+		return delay
+	}
+	spread := int64(delay) * int64(s.config.JitterPercent) / 100
+	if spread <= 0 {
+		return delay
+	}
+	return delay + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+func (s *reconnectSupervisor) setDown(tag string, down bool) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if down {
+		s.down[tag] = true
+	} else {
+		delete(s.down, tag)
+	}
+}
+
+// redirect rejects the route to a reconnecting outbound if FailFast is set.
+func (s *reconnectSupervisor) redirect(ctx routing.Context, route routing.Route, err error) (routing.Route, error) {
+	if s == nil || !s.config.FailFast {
+		return route, err
+	}
+	// connections matching no rule go to the default outbound
+	tag := s.defaultTag
+	if err == nil && route != nil {
+		tag = route.GetOutboundTag()
+	}
+	s.access.RLock()
+	down := s.down[tag]
+	s.access.RUnlock()
+	if !down {
+		return route, err
+	}
+	newError("reconnect: outbound ", tag, " is reconnecting, rejecting the connection").AtDebug().WriteToLog()
+	return &ruleRoute{ctx, BlockTagReject}, nil
+}
+
+func (s *reconnectSupervisor) emit(tag string, state int32, attempt int32, retryInMs int64, message string) {
+	if s.listener != nil {
+		s.listener.OnOutboundStateChanged(tag, state, attempt, retryInMs, message)
+	}
+}
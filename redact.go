@@ -0,0 +1,125 @@
+package libcore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Privacy levels of the logs.
+const (
+	// PrivacyOff logs everything.
+	PrivacyOff int32 = iota
+	// PrivacyCredentials masks uuids, keys, passwords and the user info of
+	// urls.
+	PrivacyCredentials
+	// PrivacyStrict also masks the domains and the public ip addresses, the
+	// same host is masked the same way until the process restarts, so
+	// connections can still be followed.
+	PrivacyStrict
+)
+
+var logPrivacy int32
+
+var (
+	uuidPattern     = regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`)
+	keyPattern      = regexp.MustCompile(`\b[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=`)
+	secretPattern   = regexp.MustCompile(`(?i)("?\b(?:password|passwd|pass|psk|secret|token|private_?key|pre_?shared_?key)"?\s*[:=]\s*"?)[^"\s,&}]+`)
+	userInfoPattern = regexp.MustCompile(`(://)[^/\s@]+@`)
+	ipv4Pattern     = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern     = regexp.MustCompile(`\[?(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4}\]?`)
+	domainPattern   = regexp.MustCompile(`\b(?:[a-zA-Z0-9](?:[a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}\b`)
+)
+
+var (
+	redactSaltOnce sync.Once
+	redactSalt     []byte
+)
+
+// SetLogPrivacy masks sensitive data in the logs written from now on, so
+// debug logs can be shared.
+func SetLogPrivacy(level int32) error {
+	if level < PrivacyOff || level > PrivacyStrict {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid privacy level ", level))
+	}
+	atomic.StoreInt32(&logPrivacy, level)
+	logger := logrus.StandardLogger()
+	if _, ok := logger.Formatter.(*redactingFormatter); !ok {
+		logrus.SetFormatter(&redactingFormatter{logger.Formatter})
+	}
+	return nil
+}
+
+// redactingFormatter masks the messages of logrus before the formatter of
+// the platform.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if atomic.LoadInt32(&logPrivacy) != PrivacyOff {
+		redacted := *entry
+		redacted.Message = redactLog(entry.Message)
+		entry = &redacted
+	}
+	return f.Formatter.Format(entry)
+}
+
+// redactLog masks message by the privacy level.
+func redactLog(message string) string {
+	level := atomic.LoadInt32(&logPrivacy)
+	if level == PrivacyOff {
+		return message
+	}
+	message = userInfoPattern.ReplaceAllString(message, "${1}<user>@")
+	message = secretPattern.ReplaceAllString(message, "${1}<secret>")
+	message = uuidPattern.ReplaceAllString(message, "<uuid>")
+	message = keyPattern.ReplaceAllString(message, "<key>")
+	if level < PrivacyStrict {
+		return message
+	}
+	message = ipv4Pattern.ReplaceAllStringFunc(message, redactAddress)
+	message = ipv6Pattern.ReplaceAllStringFunc(message, redactAddress)
+	return domainPattern.ReplaceAllStringFunc(message, func(domain string) string {
+		return "<host-" + redactHash(domain) + ">"
+	})
+}
+
+// redactAddress masks public addresses, those of the tun and the local
+// network tell nothing about the visited sites.
+func redactAddress(address string) string {
+	ip := net.ParseIP(trimBrackets(address))
+	if ip == nil {
+		return address
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return address
+	}
+	return "<ip-" + redactHash(ip.String()) + ">"
+}
+
+func trimBrackets(address string) string {
+	if len(address) > 1 && address[0] == '[' && address[len(address)-1] == ']' {
+		return address[1 : len(address)-1]
+	}
+	return address
+}
+
+// redactHash is a short salted hash of value, the salt is random per
+// process so hashes of known hosts can't be looked up.
+func redactHash(value string) string {
+	redactSaltOnce.Do(func() {
+		redactSalt = make([]byte, 16)
+		_, _ = rand.Read(redactSalt)
+	})
+	hash := sha256.New()
+	hash.Write(redactSalt)
+	hash.Write([]byte(value))
+	return hex.EncodeToString(hash.Sum(nil)[:4])
+}
@@ -19,3 +19,21 @@ func SetWifiSSID(ssid string) {
 		wifiSSID = ssid
 	}
 }
+
+var networkRoaming bool
+
+// NotifyNetworkChange updates the network conditions used by routing rules,
+// networkType is the default network transport (wifi, cellular, ethernet, ...)
+// and ssid the connected wifi network, if any.
+func NotifyNetworkChange(networkType string, ssid string, roaming bool) {
+	SetNetworkType(networkType)
+	SetWifiSSID(ssid)
+	if roaming != networkRoaming {
+		logrus.Debug("updated network roaming: ", roaming)
+		networkRoaming = roaming
+	}
+	warmPool.refresh()
+	dnsPrefetch.flush()
+	resumeUdpSessions()
+	go rediscoverNat64Prefix()
+}
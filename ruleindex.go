@@ -0,0 +1,104 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+)
+
+// ruleIndex finds the first DOMAIN, DOMAIN-SUFFIX, IP-CIDR or IP-CIDR6 rule
+// of a rule set matching a connection by map lookups instead of testing the
+// rules one by one. Values are rule positions.
+type ruleIndex struct {
+	domains  map[string]int
+	suffixes map[string]int
+	networks []*ruleNetworkIndex
+}
+
+// ruleNetworkIndex holds the networks of one prefix length, keyed by their
+// masked address.
+type ruleNetworkIndex struct {
+	mask      net.IPMask
+	positions map[string]int
+}
+
+// add indexes the rule at position if its condition is one of the indexed
+// kinds, keeping the earliest position of equal values.
+func (x *ruleIndex) add(position int, condition ruleCondition) bool {
+	switch c := condition.(type) {
+	case *domainCondition:
+		switch c.kind {
+		case "DOMAIN":
+			x.domains = ruleIndexPut(x.domains, c.value, position)
+			return true
+		case "DOMAIN-SUFFIX":
+			x.suffixes = ruleIndexPut(x.suffixes, c.value, position)
+			return true
+		}
+	case *cidrCondition:
+		ip := c.network.IP
+		if len(ip) == net.IPv6len && ip.To4() != nil {
+			// an ipv4 mapped network never contains an address
+			return false
+		}
+		var networks *ruleNetworkIndex
+		for _, n := range x.networks {
+			if string(n.mask) == string(c.network.Mask) {
+				networks = n
+				break
+			}
+		}
+		if networks == nil {
+			networks = &ruleNetworkIndex{mask: c.network.Mask, positions: make(map[string]int)}
+			x.networks = append(x.networks, networks)
+		}
+		ruleIndexPut(networks.positions, string(ip), position)
+		return true
+	}
+	return false
+}
+
+func ruleIndexPut(positions map[string]int, key string, position int) map[string]int {
+	if positions == nil {
+		positions = make(map[string]int)
+	}
+	if _, ok := positions[key]; !ok {
+		positions[key] = position
+	}
+	return positions
+}
+
+// first returns the position of the first indexed rule matching rc, or -1.
+func (x *ruleIndex) first(rc *ruleContext) int {
+	first := -1
+	found := func(position int, ok bool) {
+		if ok && (first < 0 || position < first) {
+			first = position
+		}
+	}
+	if rc.domain != "" {
+		position, ok := x.domains[rc.domain]
+		found(position, ok)
+		for suffix := rc.domain; ; {
+			position, ok = x.suffixes[suffix]
+			found(position, ok)
+			index := strings.IndexByte(suffix, '.')
+			if index < 0 {
+				break
+			}
+			suffix = suffix[index+1:]
+		}
+	}
+	for _, ip := range rc.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, networks := range x.networks {
+			if len(networks.mask) != len(ip) {
+				continue
+			}
+			position, ok := networks.positions[string(ip.Mask(networks.mask))]
+			found(position, ok)
+		}
+	}
+	return first
+}
@@ -0,0 +1,65 @@
+package libcore
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRuleSetIndex(t *testing.T) {
+	rules, err := parseRules(`
+DOMAIN-KEYWORD,tracker,reject
+DOMAIN,www.example.com,exact
+DOMAIN-SUFFIX,example.com,suffix
+DEST-PORT,22,ssh
+IP-CIDR,10.0.0.0/8,lan
+IP-CIDR,10.1.0.0/16,never
+IP-CIDR6,fd00::/8,ula
+DOMAIN-SUFFIX,com,com
+MATCH,default
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newRuleSet(RuleModeBefore, rules)
+	if len(set.others) != 3 {
+		t.Fatalf("%d rules are not indexed, want 3", len(set.others))
+	}
+	for _, test := range []struct {
+		domain string
+		ip     string
+		port   uint16
+		want   string
+	}{
+		{"www.example.com", "", 443, "exact"},
+		{"a.www.example.com", "", 443, "suffix"},
+		{"example.com", "", 22, "suffix"},
+		{"tracker.example.com", "", 443, "reject"},
+		{"other.com", "", 443, "com"},
+		{"other.com", "", 22, "ssh"},
+		{"notexample.com", "", 443, "com"},
+		{"", "10.1.2.3", 443, "lan"},
+		{"", "::ffff:10.1.2.3", 443, "lan"},
+		{"", "fd00::1", 443, "ula"},
+		{"", "11.0.0.1", 443, "default"},
+		{"other.org", "fe80::1", 22, "ssh"},
+	} {
+		rc := &ruleContext{domain: test.domain, port: test.port}
+		if test.ip != "" {
+			rc.ips = []net.IP{net.ParseIP(test.ip)}
+		}
+		var linear *routingRule
+		for _, rule := range rules {
+			if rule.condition.match(rc) {
+				linear = rule
+				break
+			}
+		}
+		rule := set.match(rc)
+		if rule != linear {
+			t.Errorf("%s %s: indexed match differs from the linear one", test.domain, test.ip)
+		}
+		if rule == nil || rule.outbound != test.want {
+			t.Errorf("%s %s: matched %v, want %s", test.domain, test.ip, rule, test.want)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package libcore
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+const (
+	ruleProviderMaxSize       = 64 * 1024 * 1024
+	ruleProviderFetchTimeout  = 30 * time.Second
+	ruleProviderMinInterval   = 10 * time.Minute
+	ruleProviderRetryInterval = 5 * time.Minute
+)
+
+// RuleProviderConfig describes a clash style rule provider. Behavior is one of
+// domain, ipcidr or classical, Format is yaml or text, Outbound is the tag to
+// download through, or empty for a direct connection. The binary mrs format
+// is not supported: its files are zstd compressed and no zstd decoder builds
+// with the go version of libcore, such providers are rejected by
+// AddRuleProvider.
+type RuleProviderConfig struct {
+	Name      string
+	Url       string
+	Behavior  string
+	Format    string
+	CachePath string
+	Outbound  string
+	Interval  int32
+}
+
+type ruleProvider struct {
+	name      string
+	condition atomic.Value
+
+	access  sync.Mutex
+	config  RuleProviderConfig
+	updated time.Time
+	count   int
+	done    chan struct{}
+}
+
+// providerCondition wraps the compiled condition, atomic.Value needs the
+// same concrete type for every swap.
+type providerCondition struct {
+	ruleCondition
+}
+
+func (p *ruleProvider) match(rc *ruleContext) bool {
+	condition, _ := p.condition.Load().(providerCondition)
+	return condition.ruleCondition != nil && condition.match(rc)
+}
+
+type ruleSetCondition struct {
+	provider *ruleProvider
+}
+
+func (c *ruleSetCondition) match(rc *ruleContext) bool {
+	return c.provider.match(rc)
+}
+
+func (c *ruleSetCondition) String() string {
+	return "RULE-SET," + c.provider.name
+}
+
+// ruleProviders holds the providers by name, rules may refer to a provider
+// before it is added and match nothing until it has loaded.
+type ruleProviders struct {
+	access    sync.Mutex
+	providers map[string]*ruleProvider
+}
+
+func (p *ruleProviders) get(name string) *ruleProvider {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.providers == nil {
+		p.providers = make(map[string]*ruleProvider)
+	}
+	provider, ok := p.providers[name]
+	if !ok {
+		provider = &ruleProvider{name: name}
+		p.providers[name] = provider
+	}
+	return provider
+}
+
+func (p *ruleProviders) lookup(name string) *ruleProvider {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return p.providers[name]
+}
+
+func (p *ruleProviders) closeAll() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, provider := range p.providers {
+		provider.stop()
+	}
+}
+
+func (p *ruleProvider) stop() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+}
+
+// compileRuleProvider parses the payload of a provider into one condition
+// matching any of its entries.
+func compileRuleProvider(content []byte, behavior string, format string) (ruleCondition, int, error) {
+	var entries []string
+	switch strings.ToLower(format) {
+	case "", "yaml":
+		entries = parseRuleProviderYaml(content)
+	case "text":
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "//") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, 0, err
+		}
+	default:
+		return nil, 0, newError("unsupported rule provider format ", format)
+	}
+
+	switch strings.ToLower(behavior) {
+	case "domain":
+		var domains []string
+		for _, entry := range entries {
+			switch {
+			case strings.HasPrefix(entry, "+."):
+				domains = append(domains, "domain:"+entry[2:])
+			case strings.HasPrefix(entry, "*."):
+				domains = append(domains, "regexp:^[^.]+\\."+regexpQuoteDomain(entry[2:])+"$")
+			case strings.HasPrefix(entry, "."):
+				domains = append(domains, "regexp:\\."+regexpQuoteDomain(entry[1:])+"$")
+			default:
+				domains = append(domains, "full:"+entry)
+			}
+		}
+		matcher, err := newDomainMatcher(domains)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &domainSetCondition{matcher}, len(domains), nil
+	case "ipcidr":
+		var cidrs []*routercommon.CIDR
+		for _, entry := range entries {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, 0, newError("invalid cidr ", entry).Base(err)
+			}
+			ones, _ := network.Mask.Size()
+			ip := network.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			cidrs = append(cidrs, &routercommon.CIDR{Ip: ip, Prefix: uint32(ones)})
+		}
+		matcher := new(router.GeoIPMatcher)
+		if err := matcher.Init(cidrs); err != nil {
+			return nil, 0, err
+		}
+		return &ipSetCondition{matcher}, len(cidrs), nil
+	case "classical":
+		condition := &logicCondition{kind: "OR"}
+		for _, entry := range entries {
+			fields := splitRuleFields(entry)
+			if len(fields) < 2 {
+				return nil, 0, newError("invalid rule ", entry)
+			}
+			sub, err := parseRuleCondition(fields[0], fields[1], nil)
+			if err != nil {
+				return nil, 0, newError("invalid rule ", entry).Base(err)
+			}
+			condition.conditions = append(condition.conditions, sub)
+		}
+		return condition, len(condition.conditions), nil
+	}
+	return nil, 0, newError("unsupported rule provider behavior ", behavior)
+}
+
+// parseRuleProviderYaml reads the payload list of a clash rule provider
+// file, which is the only key the format defines.
+func parseRuleProviderYaml(content []byte) []string {
+	var entries []string
+	var inPayload bool
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+			inPayload = strings.HasPrefix(trimmed, "payload:")
+			continue
+		}
+		if !inPayload || !strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		entry := strings.TrimSpace(trimmed[1:])
+		if index := strings.Index(entry, " #"); index >= 0 {
+			entry = strings.TrimSpace(entry[:index])
+		}
+		if unquoted, err := strconv.Unquote(entry); err == nil {
+			entry = unquoted
+		} else if len(entry) >= 2 && entry[0] == '\'' && entry[len(entry)-1] == '\'' {
+			entry = strings.ReplaceAll(entry[1:len(entry)-1], "''", "'")
+		}
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func regexpQuoteDomain(domain string) string {
+	return strings.ReplaceAll(domain, ".", "\\.")
+}
+
+type domainSetCondition struct {
+	matcher *router.DomainMatcher
+}
+
+func (c *domainSetCondition) match(rc *ruleContext) bool {
+	return rc.domain != "" && c.matcher.Match(rc.domain)
+}
+
+func (c *domainSetCondition) String() string {
+	return "DOMAIN-SET"
+}
+
+type ipSetCondition struct {
+	matcher *router.GeoIPMatcher
+}
+
+func (c *ipSetCondition) match(rc *ruleContext) bool {
+	for _, ip := range rc.ips {
+		if c.matcher.Match(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ipSetCondition) String() string {
+	return "IP-SET"
+}
+
+// load compiles content and swaps it into the running matcher.
+func (p *ruleProvider) load(content []byte, updated time.Time) error {
+	p.access.Lock()
+	config := p.config
+	p.access.Unlock()
+	condition, count, err := compileRuleProvider(content, config.Behavior, config.Format)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, newError("rule provider ", p.name).Base(err))
+	}
+	p.condition.Store(providerCondition{condition})
+	p.access.Lock()
+	p.updated = updated
+	p.count = count
+	p.access.Unlock()
+	return nil
+}
+
+func (instance *V2RayInstance) fetchRuleProvider(config RuleProviderConfig) (*downloadResult, error) {
+	result, err := instance.download(downloadRequest{
+		url:      config.Url,
+		outbound: config.Outbound,
+		maxSize:  ruleProviderMaxSize,
+		timeout:  ruleProviderFetchTimeout,
+	})
+	if err != nil {
+		return nil, newError("rule provider ", config.Name).Base(err)
+	}
+	return result, nil
+}
+
+// update downloads the provider, swaps it in and writes the cache file, the
+// cache is left untouched if the new content does not compile.
+func (instance *V2RayInstance) updateRuleProvider(provider *ruleProvider) error {
+	provider.access.Lock()
+	config := provider.config
+	loaded := !provider.updated.IsZero()
+	provider.access.Unlock()
+	result, err := instance.fetchRuleProvider(config)
+	if err != nil {
+		return exportError(err)
+	}
+	if !result.modified && loaded {
+		provider.access.Lock()
+		provider.updated = time.Now()
+		provider.access.Unlock()
+		logrus.Debug("rule provider ", config.Name, " not modified")
+		return nil
+	}
+	content := result.content
+	if err = provider.load(content, time.Now()); err != nil {
+		return err
+	}
+	if config.CachePath != "" {
+		_ = os.MkdirAll(filepath.Dir(config.CachePath), 0o755)
+		temp := config.CachePath + ".tmp"
+		if err = ioutil.WriteFile(temp, content, 0o644); err == nil {
+			err = os.Rename(temp, config.CachePath)
+		}
+		if err != nil {
+			logrus.Warn("write rule provider cache: ", err)
+		}
+	}
+	logrus.Info("updated rule provider ", config.Name)
+	return nil
+}
+
+// refresh calls update every interval after the last update, or only until
+// it succeeds once with an interval of zero, ignoring the age of a cached
+// copy.
+func (p *ruleProvider) refresh(interval time.Duration, done chan struct{}, update func() error) {
+	for {
+		var next time.Duration
+		if interval > 0 {
+			p.access.Lock()
+			next = interval - time.Since(p.updated)
+			p.access.Unlock()
+		}
+		if next <= 0 {
+			if err := update(); err != nil {
+				logrus.Warn("update rule provider ", p.name, ": ", err)
+				next = ruleProviderRetryInterval
+			} else if interval <= 0 {
+				return
+			} else {
+				next = interval
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// AddRuleProvider registers a provider referred to by RULE-SET rules. A
+// cached copy is loaded at once to be used until the download, the provider
+// is then refreshed every Interval seconds, or downloaded only once with an
+// Interval of zero.
+func (instance *V2RayInstance) AddRuleProvider(config *RuleProviderConfig) error {
+	if config == nil || config.Name == "" || config.Url == "" {
+		return withCode(ErrorCodeInvalidArgument, newError("missing rule provider name or url"))
+	}
+	if strings.EqualFold(config.Format, "mrs") {
+		return withCode(ErrorCodeInvalidArgument, newError("mrs rule providers are not supported, use the yaml or text version of ", config.Name))
+	}
+	ruleRouter, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	provider := ruleRouter.providers.get(config.Name)
+	provider.stop()
+	provider.access.Lock()
+	provider.config = *config
+	provider.updated = time.Time{}
+	provider.access.Unlock()
+
+	if config.CachePath != "" {
+		if info, err := os.Stat(config.CachePath); err == nil {
+			content, err := ioutil.ReadFile(config.CachePath)
+			if err == nil {
+				err = provider.load(content, info.ModTime())
+			}
+			if err != nil {
+				logrus.Warn("load rule provider cache: ", err)
+			}
+		}
+	}
+
+	var interval time.Duration
+	if config.Interval > 0 {
+		interval = time.Duration(config.Interval) * time.Second
+		if interval < ruleProviderMinInterval {
+			interval = ruleProviderMinInterval
+		}
+	}
+	done := make(chan struct{})
+	provider.access.Lock()
+	provider.done = done
+	provider.access.Unlock()
+	go provider.refresh(interval, done, func() error {
+		return instance.updateRuleProvider(provider)
+	})
+	return nil
+}
+
+// UpdateRuleProvider downloads the provider now.
+func (instance *V2RayInstance) UpdateRuleProvider(name string) error {
+	ruleRouter, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	provider := ruleRouter.providers.lookup(name)
+	if provider != nil {
+		provider.access.Lock()
+		if provider.config.Url == "" {
+			provider = nil
+		}
+		provider.access.Unlock()
+	}
+	if provider == nil {
+		return withCode(ErrorCodeInvalidArgument, newError("rule provider not found: ", name))
+	}
+	return instance.updateRuleProvider(provider)
+}
+
+// RemoveRuleProvider stops refreshing the provider, rules referring to it
+// match nothing afterwards.
+func (instance *V2RayInstance) RemoveRuleProvider(name string) {
+	ruleRouter, err := instance.getRuleRouter()
+	if err != nil {
+		return
+	}
+	if provider := ruleRouter.providers.lookup(name); provider != nil {
+		provider.stop()
+		provider.condition.Store(providerCondition{})
+		provider.access.Lock()
+		provider.config = RuleProviderConfig{}
+		provider.count = 0
+		provider.access.Unlock()
+	}
+}
+
+// GetRuleProviderInfo returns the entry count and the unix time of the last
+// update of the provider, zero if it has not been loaded.
+func (instance *V2RayInstance) GetRuleProviderInfo(name string) (*RuleProviderInfo, error) {
+	ruleRouter, err := instance.getRuleRouter()
+	if err != nil {
+		return nil, err
+	}
+	provider := ruleRouter.providers.lookup(name)
+	if provider == nil {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("rule provider not found: ", name))
+	}
+	provider.access.Lock()
+	defer provider.access.Unlock()
+	info := &RuleProviderInfo{Count: int32(provider.count)}
+	if !provider.updated.IsZero() {
+		info.UpdatedAt = provider.updated.Unix()
+	}
+	return info, nil
+}
+
+type RuleProviderInfo struct {
+	Count     int32
+	UpdatedAt int64
+}
@@ -0,0 +1,40 @@
+package libcore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleProviderRefreshOnce(t *testing.T) {
+	// a cached copy was just loaded
+	provider := &ruleProvider{name: "test", updated: time.Now()}
+	var updates int
+	provider.refresh(0, make(chan struct{}), func() error {
+		updates++
+		return nil
+	})
+	if updates != 1 {
+		t.Fatalf("updated %d times, want once", updates)
+	}
+}
+
+func TestRuleProviderRefreshInterval(t *testing.T) {
+	provider := &ruleProvider{name: "test", updated: time.Now()}
+	updates := make(chan struct{}, 1)
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		provider.refresh(time.Hour, done, func() error {
+			updates <- struct{}{}
+			return nil
+		})
+		close(returned)
+	}()
+	select {
+	case <-updates:
+		t.Fatal("a fresh cached copy was updated")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(done)
+	<-returned
+}
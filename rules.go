@@ -0,0 +1,821 @@
+package libcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+const (
+	// RuleModeBefore evaluates the rules before v2ray routing, which handles
+	// connections no rule matched.
+	RuleModeBefore int32 = iota
+	// RuleModeInstead replaces v2ray routing, unmatched connections go to the
+	// default outbound.
+	RuleModeInstead
+)
+
+const rulesReloadInterval = 3 * time.Second
+
+// ruleContext is the routing input of a rule evaluation, the package name is
+// only looked up if a rule needs it, with the UidDumper of the tun of the
+// connection if it has one.
+type ruleContext struct {
+	network     string
+	domain      string
+	ips         []net.IP
+	sourcePort  uint16
+	port        uint16
+	uid         uint32
+	protocol    string
+	inbound     string
+	networkType string
+	wifiSsid    string
+	roaming     bool
+	now         time.Time
+	uidDumper   UidDumper
+	packageName *string
+}
+
+func newRuleContext(ctx routing.Context) *ruleContext {
+	rc := &ruleContext{
+		domain:     strings.ToLower(ctx.GetTargetDomain()),
+		ips:        ctx.GetTargetIPs(),
+		sourcePort: uint16(ctx.GetSourcePort()),
+		port:       uint16(ctx.GetTargetPort()),
+		uid:        ctx.GetUid(),
+		protocol:   ctx.GetProtocol(),
+		inbound:    ctx.GetInboundTag(),
+		wifiSsid:   ctx.GetWifiSsid(),
+		roaming:    networkRoaming,
+		uidDumper:  routedUidDumper(ctx),
+	}
+	rc.networkType = strings.ToLower(ctx.GetNetworkType())
+	switch ctx.GetNetwork() {
+	case v2rayNet.Network_TCP:
+		rc.network = "tcp"
+	case v2rayNet.Network_UDP:
+		rc.network = "udp"
+	}
+	return rc
+}
+
+func (rc *ruleContext) getTime() time.Time {
+	if rc.now.IsZero() {
+		rc.now = time.Now()
+	}
+	return rc.now
+}
+
+func (rc *ruleContext) getPackageName() string {
+	if rc.packageName == nil {
+		var name string
+		dumper := rc.uidDumper
+		if dumper == nil {
+			dumper = uidDumper
+		}
+		if dumper != nil && rc.uid > 0 {
+			if info, err := dumper.GetUidInfo(int32(rc.uid)); err == nil && info != nil {
+				name = info.PackageName
+			}
+		}
+		rc.packageName = &name
+	}
+	return *rc.packageName
+}
+
+type ruleCondition interface {
+	match(rc *ruleContext) bool
+	String() string
+}
+
+type domainCondition struct {
+	kind  string
+	value string
+}
+
+func (c *domainCondition) match(rc *ruleContext) bool {
+	if rc.domain == "" {
+		return false
+	}
+	switch c.kind {
+	case "DOMAIN":
+		return rc.domain == c.value
+	case "DOMAIN-SUFFIX":
+		return rc.domain == c.value || strings.HasSuffix(rc.domain, "."+c.value)
+	default:
+		return strings.Contains(rc.domain, c.value)
+	}
+}
+
+func (c *domainCondition) String() string {
+	return c.kind + "," + c.value
+}
+
+type cidrCondition struct {
+	kind    string
+	network *net.IPNet
+}
+
+func (c *cidrCondition) match(rc *ruleContext) bool {
+	for _, ip := range rc.ips {
+		if c.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cidrCondition) String() string {
+	return c.kind + "," + c.network.String()
+}
+
+type portCondition struct {
+	kind   string
+	source bool
+	ports  v2rayNet.MemoryPortList
+}
+
+func (c *portCondition) match(rc *ruleContext) bool {
+	port := rc.port
+	if c.source {
+		port = rc.sourcePort
+	}
+	return c.ports.Contains(v2rayNet.Port(port))
+}
+
+func (c *portCondition) String() string {
+	var ports []string
+	for _, port := range c.ports {
+		if port.From == port.To {
+			ports = append(ports, port.From.String())
+		} else {
+			ports = append(ports, port.From.String()+"-"+port.To.String())
+		}
+	}
+	return c.kind + "," + strings.Join(ports, "/")
+}
+
+type stringCondition struct {
+	kind  string
+	value string
+	get   func(rc *ruleContext) string
+}
+
+func (c *stringCondition) match(rc *ruleContext) bool {
+	return c.get(rc) == c.value
+}
+
+func (c *stringCondition) String() string {
+	return c.kind + "," + c.value
+}
+
+// timeCondition matches local times in [from, to), in minutes of the day, the
+// window wraps around midnight if to is before from.
+type timeCondition struct {
+	value    string
+	from, to int
+}
+
+func (c *timeCondition) match(rc *ruleContext) bool {
+	now := rc.getTime()
+	minute := now.Hour()*60 + now.Minute()
+	if c.from <= c.to {
+		return minute >= c.from && minute < c.to
+	}
+	return minute >= c.from || minute < c.to
+}
+
+func (c *timeCondition) String() string {
+	return "TIME," + c.value
+}
+
+type weekdayCondition struct {
+	value string
+	days  [7]bool
+}
+
+func (c *weekdayCondition) match(rc *ruleContext) bool {
+	return c.days[rc.getTime().Weekday()]
+}
+
+func (c *weekdayCondition) String() string {
+	return "WEEKDAY," + c.value
+}
+
+type logicCondition struct {
+	kind       string
+	conditions []ruleCondition
+}
+
+func (c *logicCondition) match(rc *ruleContext) bool {
+	switch c.kind {
+	case "AND":
+		for _, condition := range c.conditions {
+			if !condition.match(rc) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, condition := range c.conditions {
+			if condition.match(rc) {
+				return true
+			}
+		}
+		return false
+	default:
+		return !c.conditions[0].match(rc)
+	}
+}
+
+func (c *logicCondition) String() string {
+	var conditions []string
+	for _, condition := range c.conditions {
+		conditions = append(conditions, "("+condition.String()+")")
+	}
+	return c.kind + ",(" + strings.Join(conditions, ",") + ")"
+}
+
+type matchAll struct{}
+
+func (matchAll) match(*ruleContext) bool {
+	return true
+}
+
+func (matchAll) String() string {
+	return "MATCH"
+}
+
+type routingRule struct {
+	line      int
+	condition ruleCondition
+	outbound  string
+	dscp      int
+}
+
+type ruleSet struct {
+	mode  int32
+	rules []*routingRule
+	index ruleIndex
+	// others are the positions of the rules not in the index
+	others []int
+}
+
+func newRuleSet(mode int32, rules []*routingRule) *ruleSet {
+	s := &ruleSet{mode: mode, rules: rules}
+	for position, rule := range rules {
+		if !s.index.add(position, rule.condition) {
+			s.others = append(s.others, position)
+		}
+	}
+	return s
+}
+
+// parseRules compiles rules in the form "TYPE,VALUE,OUTBOUND", one per line,
+// lines starting with # or // are comments. Supported types are DOMAIN,
+// DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, IP-CIDR6, GEOIP (a country code,
+// looked up in a country mmdb if loaded, or geoip.dat), DEST-PORT, SRC-PORT,
+// NETWORK, UID, USER-ID and APP-ID (the android user, e.g. a work profile, and
+// the uid within it), PROCESS-NAME (the package name on android), RULE-SET
+// taking the name of a rule provider, the network conditions NETWORK-TYPE,
+// WIFI-SSID and ROAMING, the local time conditions TIME (e.g. 22:00-07:00) and
+// WEEKDAY (e.g. mon-fri/sun), the logical AND, OR and NOT taking parenthesized
+// conditions, e.g. "AND,((DOMAIN-SUFFIX,example.com),(DEST-PORT,443)),proxy",
+// and the final "MATCH,OUTBOUND". The outbound may be one of the built in
+// block actions REJECT, REJECT-CLOSE, REJECT-DROP and REJECT-HTTP. Options may
+// follow the outbound, dscp=N overrides the DSCP marking of matched
+// connections.
+func parseRules(content string, providers *ruleProviders) ([]*routingRule, error) {
+	var rules []*routingRule
+	for index, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		fields := splitRuleFields(line)
+		var condition ruleCondition
+		var err error
+		if strings.EqualFold(fields[0], "MATCH") || strings.EqualFold(fields[0], "FINAL") {
+			if len(fields) < 2 {
+				err = newError("missing outbound")
+			}
+			condition = matchAll{}
+		} else if len(fields) < 3 {
+			err = newError("missing outbound")
+		} else {
+			condition, err = parseRuleCondition(fields[0], fields[1], providers)
+		}
+		if err != nil {
+			return nil, newError("rule line ", index+1, ": ", line).Base(err)
+		}
+		rule := &routingRule{line: index + 1, condition: condition, dscp: -1}
+		options := fields[2:]
+		if _, isFinal := condition.(matchAll); isFinal {
+			options = fields[1:]
+		}
+		rule.outbound = strings.TrimSpace(options[0])
+		for _, option := range options[1:] {
+			// other options like no-resolve are accepted and ignored
+			option = strings.TrimSpace(option)
+			if strings.HasPrefix(option, "dscp=") {
+				if rule.dscp, err = parseDscp(option[5:]); err != nil {
+					return nil, newError("rule line ", index+1, ": ", line).Base(err)
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRuleCondition(kind string, value string, providers *ruleProviders) (ruleCondition, error) {
+	kind = strings.ToUpper(strings.TrimSpace(kind))
+	value = strings.TrimSpace(value)
+	switch kind {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		return &domainCondition{kind, strings.ToLower(strings.TrimSuffix(value, "."))}, nil
+	case "IP-CIDR", "IP-CIDR6":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return &cidrCondition{kind, network}, nil
+	case "GEOIP":
+		if len(value) != 2 {
+			return nil, newError("invalid country code ", value)
+		}
+		return &geoipCondition{strings.ToUpper(value)}, nil
+	case "DEST-PORT", "DST-PORT", "SRC-PORT":
+		condition := &portCondition{kind: kind, source: kind == "SRC-PORT"}
+		for _, port := range strings.Split(value, "/") {
+			portRange, err := parsePortRange(port)
+			if err != nil {
+				return nil, err
+			}
+			condition.ports = append(condition.ports, portRange)
+		}
+		return condition, nil
+	case "NETWORK":
+		value = strings.ToLower(value)
+		if value != "tcp" && value != "udp" {
+			return nil, newError("invalid network ", value)
+		}
+		return &stringCondition{kind, value, func(rc *ruleContext) string {
+			return rc.network
+		}}, nil
+	case "UID":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return nil, err
+		}
+		return &stringCondition{kind, value, func(rc *ruleContext) string {
+			return strconv.FormatUint(uint64(rc.uid), 10)
+		}}, nil
+	case "NETWORK-TYPE":
+		value = strings.ToLower(value)
+		return &stringCondition{kind, value, func(rc *ruleContext) string {
+			return rc.networkType
+		}}, nil
+	case "WIFI-SSID":
+		return &stringCondition{kind, value, func(rc *ruleContext) string {
+			return rc.wifiSsid
+		}}, nil
+	case "ROAMING":
+		roaming, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return &stringCondition{kind, strconv.FormatBool(roaming), func(rc *ruleContext) string {
+			return strconv.FormatBool(rc.roaming)
+		}}, nil
+	case "TIME":
+		window := strings.SplitN(value, "-", 2)
+		if len(window) != 2 {
+			return nil, newError("invalid time window ", value)
+		}
+		from, err := parseMinuteOfDay(window[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseMinuteOfDay(window[1])
+		if err != nil {
+			return nil, err
+		}
+		return &timeCondition{value, from, to}, nil
+	case "WEEKDAY":
+		condition := &weekdayCondition{value: value}
+		for _, days := range strings.Split(value, "/") {
+			dayRange := strings.SplitN(days, "-", 2)
+			from, err := parseWeekday(dayRange[0])
+			if err != nil {
+				return nil, err
+			}
+			to := from
+			if len(dayRange) == 2 {
+				if to, err = parseWeekday(dayRange[1]); err != nil {
+					return nil, err
+				}
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				condition.days[day] = true
+				if day == to {
+					break
+				}
+			}
+		}
+		return condition, nil
+	case "USER-ID", "APP-ID":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return nil, err
+		}
+		userId := kind == "USER-ID"
+		return &stringCondition{kind, value, func(rc *ruleContext) string {
+			if userId {
+				return strconv.Itoa(int(GetUserId(int32(rc.uid))))
+			}
+			return strconv.Itoa(int(GetAppId(int32(rc.uid))))
+		}}, nil
+	case "PROCESS-NAME":
+		return &stringCondition{kind, value, (*ruleContext).getPackageName}, nil
+	case "AND", "OR", "NOT":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return nil, newError("conditions of ", kind, " must be parenthesized")
+		}
+		condition := &logicCondition{kind: kind}
+		for _, item := range splitRuleFields(value[1 : len(value)-1]) {
+			item = strings.TrimSpace(item)
+			if !strings.HasPrefix(item, "(") || !strings.HasSuffix(item, ")") {
+				return nil, newError("invalid condition ", item)
+			}
+			fields := splitRuleFields(item[1 : len(item)-1])
+			if len(fields) != 2 {
+				return nil, newError("invalid condition ", item)
+			}
+			sub, err := parseRuleCondition(fields[0], fields[1], providers)
+			if err != nil {
+				return nil, err
+			}
+			condition.conditions = append(condition.conditions, sub)
+		}
+		if len(condition.conditions) == 0 || kind == "NOT" && len(condition.conditions) != 1 {
+			return nil, newError("invalid condition count for ", kind)
+		}
+		return condition, nil
+	case "RULE-SET":
+		if providers == nil {
+			return nil, newError("RULE-SET is not allowed here")
+		}
+		return &ruleSetCondition{providers.get(value)}, nil
+	}
+	return nil, newError("unknown rule type ", kind)
+}
+
+// parseMinuteOfDay parses a HH:MM local time.
+func parseMinuteOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, newError("invalid time ", value).Base(err)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseWeekday accepts the three letter english name or the number of the
+// day, starting with 0 for sunday.
+func parseWeekday(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for index, day := range weekdays {
+		if value == day {
+			return index, nil
+		}
+	}
+	day, err := strconv.Atoi(value)
+	if err != nil || day < 0 || day > 6 {
+		return 0, newError("invalid weekday ", value)
+	}
+	return day, nil
+}
+
+// splitRuleFields splits s at commas outside of parentheses.
+func splitRuleFields(s string) []string {
+	var fields []string
+	var depth, start int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// match returns the first rule matching rc, only the rules before the first
+// indexed match are tested one by one.
+func (s *ruleSet) match(rc *ruleContext) *routingRule {
+	first := s.index.first(rc)
+	for _, position := range s.others {
+		if first >= 0 && position > first {
+			break
+		}
+		if rule := s.rules[position]; rule.condition.match(rc) {
+			return rule
+		}
+	}
+	if first >= 0 {
+		return s.rules[first]
+	}
+	return nil
+}
+
+type ruleRoute struct {
+	routing.Context
+	outbound string
+}
+
+func (r *ruleRoute) GetOutboundGroupTags() []string {
+	return nil
+}
+
+func (r *ruleRoute) GetOutboundTag() string {
+	return r.outbound
+}
+
+// ruleRouter evaluates the loaded rule set before, or instead of, the v2ray
+// router it wraps.
+type ruleRouter struct {
+	routing.Router
+	rules     atomic.Value
+	script    atomic.Value
+	pac       atomic.Value
+	providers ruleProviders
+
+	pingRoutes routeCache
+	quotas     *quotaTracker
+	reconnect  atomic.Value
+
+	watchAccess sync.Mutex
+	watchDone   chan struct{}
+}
+
+func newRuleRouter(router routing.Router) *ruleRouter {
+	r := &ruleRouter{Router: router}
+	r.rules.Store((*ruleSet)(nil))
+	r.script.Store((*routeScript)(nil))
+	r.pac.Store((*pacRouter)(nil))
+	r.reconnect.Store((*reconnectSupervisor)(nil))
+	return r
+}
+
+func (r *ruleRouter) PickRoute(ctx routing.Context) (routing.Route, error) {
+	setFlowDomain(ctx)
+	route, err := r.pickRoute(ctx)
+	if r.quotas != nil {
+		route, err = r.quotas.redirect(ctx, route, err)
+	}
+	route, err = r.reconnect.Load().(*reconnectSupervisor).redirect(ctx, route, err)
+	if err == nil {
+		setFlowOutbound(ctx, route)
+		setRouteOutbound(ctx, route)
+	}
+	return route, err
+}
+
+func (r *ruleRouter) pickRoute(ctx routing.Context) (routing.Route, error) {
+	rules := r.rules.Load().(*ruleSet)
+	script := r.script.Load().(*routeScript)
+	pac := r.pac.Load().(*pacRouter)
+	if rules == nil && script == nil && pac == nil && !parental.isActive() {
+		return r.Router.PickRoute(ctx)
+	}
+	rc := newRuleContext(ctx)
+	if action := parental.match(rc); action != "" {
+		return &ruleRoute{ctx, action}, nil
+	}
+	if rules == nil && script == nil && pac == nil {
+		return r.Router.PickRoute(ctx)
+	}
+	if rules != nil {
+		if rule := rules.match(rc); rule != nil {
+			newError("rule ", rule.line, " [", rule.condition, "] matched, taking detour [", rule.outbound, "]").AtDebug().WriteToLog()
+			if rule.dscp >= 0 {
+				overrideDscp(ctx, rule.dscp)
+			}
+			return &ruleRoute{ctx, rule.outbound}, nil
+		}
+	}
+	if script != nil {
+		outbound, err := script.run(rc)
+		if err != nil {
+			newError("route script failed").Base(err).AtWarning().WriteToLog()
+		} else if outbound != "" {
+			newError("route script taking detour [", outbound, "]").AtDebug().WriteToLog()
+			return &ruleRoute{ctx, outbound}, nil
+		}
+	}
+	if pac != nil {
+		if outbound := pac.route(rc); outbound != "" {
+			return &ruleRoute{ctx, outbound}, nil
+		}
+	}
+	if rules != nil && rules.mode == RuleModeInstead {
+		return nil, newError("no rule matched")
+	}
+	return r.Router.PickRoute(ctx)
+}
+
+func (r *ruleRouter) SetOverrideTarget(tag string, target string) error {
+	overrider, ok := r.Router.(balancerOverrider)
+	if !ok {
+		return newError("router does not support balancer override")
+	}
+	r.pingRoutes.clear()
+	return overrider.SetOverrideTarget(tag, target)
+}
+
+func (r *ruleRouter) GetOverrideTarget(tag string) (string, error) {
+	overrider, ok := r.Router.(balancerOverrider)
+	if !ok {
+		return "", newError("router does not support balancer override")
+	}
+	return overrider.GetOverrideTarget(tag)
+}
+
+func (r *ruleRouter) storeRules(rules *ruleSet) {
+	r.rules.Store(rules)
+	r.pingRoutes.clear()
+}
+
+func (r *ruleRouter) storeScript(script *routeScript) {
+	r.script.Store(script)
+	r.pingRoutes.clear()
+}
+
+func (r *ruleRouter) storePac(pac *pacRouter) {
+	if old := r.pac.Swap(pac).(*pacRouter); old != nil {
+		old.close()
+	}
+	r.pingRoutes.clear()
+}
+
+func (r *ruleRouter) stopWatch() {
+	r.watchAccess.Lock()
+	defer r.watchAccess.Unlock()
+	if r.watchDone != nil {
+		close(r.watchDone)
+		r.watchDone = nil
+	}
+}
+
+// watch reloads the rule file when its modification time changes, invalid
+// updates are logged and the previous rules kept.
+func (r *ruleRouter) watch(path string, mode int32, modTime time.Time) {
+	r.watchAccess.Lock()
+	done := make(chan struct{})
+	r.watchDone = done
+	r.watchAccess.Unlock()
+	go r.poll(path, mode, modTime, done)
+}
+
+func (r *ruleRouter) poll(path string, mode int32, modTime time.Time, done chan struct{}) {
+	ticker := time.NewTicker(rulesReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.Warn("reload rules: ", err)
+			continue
+		}
+		rules, err := parseRules(string(content), &r.providers)
+		if err != nil {
+			logrus.Warn("reload rules: ", err)
+			continue
+		}
+		r.storeRules(newRuleSet(mode, rules))
+		logrus.Info("reloaded ", len(rules), " rules from ", path)
+	}
+}
+
+// LoadRules compiles rules (see the rule format in parseRules) and routes
+// with them in mode, RuleModeBefore or RuleModeInstead.
+func (instance *V2RayInstance) LoadRules(content string, mode int32) error {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(content, &router.providers)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, err)
+	}
+	router.stopWatch()
+	router.storeRules(newRuleSet(mode, rules))
+	return nil
+}
+
+// LoadRulesFile is LoadRules with the content of path, the file is reloaded
+// when it changes.
+func (instance *V2RayInstance) LoadRulesFile(path string, mode int32) error {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return exportError(newError("open rules").Base(err))
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return exportError(newError("read rules").Base(err))
+	}
+	rules, err := parseRules(string(content), &router.providers)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, err)
+	}
+	router.stopWatch()
+	router.storeRules(newRuleSet(mode, rules))
+	router.watch(path, mode, info.ModTime())
+	return nil
+}
+
+func (instance *V2RayInstance) ClearRules() {
+	if router, err := instance.getRuleRouter(); err == nil {
+		router.stopWatch()
+		router.storeRules(nil)
+	}
+}
+
+// TraceRule evaluates the loaded rules for a connection and returns every
+// rule tried and the result. domain or ip may be empty.
+func (instance *V2RayInstance) TraceRule(network string, domain string, ip string, port int32, uid int32) (string, error) {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return "", err
+	}
+	rules := router.rules.Load().(*ruleSet)
+	if rules == nil {
+		return "no rules loaded", nil
+	}
+	rc := &ruleContext{
+		network:     strings.ToLower(network),
+		domain:      strings.ToLower(domain),
+		port:        uint16(port),
+		uid:         uint32(uid),
+		networkType: strings.ToLower(networkType),
+		wifiSsid:    wifiSSID,
+		roaming:     networkRoaming,
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		rc.ips = []net.IP{parsed}
+	}
+	var builder strings.Builder
+	for _, rule := range rules.rules {
+		if rule.condition.match(rc) {
+			_, _ = fmt.Fprintf(&builder, "line %d: %s => %s (matched)\n", rule.line, rule.condition, rule.outbound)
+			return builder.String(), nil
+		}
+		_, _ = fmt.Fprintf(&builder, "line %d: %s (no match)\n", rule.line, rule.condition)
+	}
+	if rules.mode == RuleModeInstead {
+		builder.WriteString("no rule matched, using the default outbound\n")
+	} else {
+		builder.WriteString("no rule matched, using v2ray routing\n")
+	}
+	return builder.String(), nil
+}
+
+func (instance *V2RayInstance) getRuleRouter() (*ruleRouter, error) {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	router, ok := instance.router.(*ruleRouter)
+	if !ok {
+		return nil, withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	return router, nil
+}
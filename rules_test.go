@@ -0,0 +1,43 @@
+package libcore
+
+import (
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+type testUidDumper struct {
+	packageName string
+}
+
+func (d testUidDumper) DumpUid(bool, bool, string, int32, string, int32) (int32, error) {
+	return 0, newError("not implemented")
+}
+
+func (d testUidDumper) GetUidInfo(int32) (*UidInfo, error) {
+	return &UidInfo{PackageName: d.packageName}, nil
+}
+
+func TestRuleContextPackageName(t *testing.T) {
+	global := uidDumper
+	uidDumper = testUidDumper{"com.global"}
+	defer func() { uidDumper = global }()
+	tun := &Tun2ray{id: "test", uidDumper: testUidDumper{"com.tun"}}
+	tunsById.Store(tun.id, tun)
+	defer tunsById.Delete(tun.id)
+
+	content := new(session.Content)
+	content.SetAttribute(tunAttribute, tun.id)
+	rc := newRuleContext(&routing_session.Context{
+		Inbound: &session.Inbound{Uid: 10001},
+		Content: content,
+	})
+	if name := rc.getPackageName(); name != "com.tun" {
+		t.Errorf("tun connection owned by %q", name)
+	}
+	rc = newRuleContext(&routing_session.Context{Inbound: &session.Inbound{Uid: 10001}})
+	if name := rc.getPackageName(); name != "com.global" {
+		t.Errorf("other connection owned by %q", name)
+	}
+}
@@ -0,0 +1,90 @@
+package libcore
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// gcPercent is the gc percent last set by SetRuntimeOptions, as reading it
+// back from the runtime would mean setting it.
+var (
+	gcAccess  sync.Mutex
+	gcPercent = initialGcPercent()
+)
+
+// initialGcPercent parses GOGC as the runtime does at startup.
+func initialGcPercent() int32 {
+	switch value := os.Getenv("GOGC"); value {
+	case "":
+		return 100
+	case "off":
+		return -1
+	default:
+		if percent, err := strconv.ParseInt(value, 10, 32); err == nil {
+			if percent < 0 {
+				return -1
+			}
+			return int32(percent)
+		}
+		return 100
+	}
+}
+
+type RuntimeOptions struct {
+	// Gogc is the gc percent, -1 if the gc is disabled.
+	Gogc     int32
+	MaxProcs int32
+	// MemoryLimitMB is the soft memory limit, -1 if unlimited or unsupported
+	// by the go version the library is built with.
+	MemoryLimitMB int32
+}
+
+// SetRuntimeOptions tunes the go runtime, zero keeps the current value. A
+// negative gogc disables the gc (only sensible with a memory limit), a
+// negative memoryLimitMB removes the limit.
+func SetRuntimeOptions(gogc int32, maxProcs int32, memoryLimitMB int32) error {
+	if memoryLimitMB != 0 && !memoryLimitSupported {
+		return withCode(ErrorCodeInvalidState, newError("memory limit requires go1.19"))
+	}
+	if maxProcs < 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid max procs ", maxProcs))
+	}
+	if gogc != 0 {
+		if gogc < 0 {
+			gogc = -1
+		}
+		gcAccess.Lock()
+		debug.SetGCPercent(int(gogc))
+		gcPercent = gogc
+		gcAccess.Unlock()
+	}
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(int(maxProcs))
+	}
+	if memoryLimitMB > 0 {
+		setMemoryLimit(int64(memoryLimitMB) << 20)
+	} else if memoryLimitMB < 0 {
+		setMemoryLimit(math.MaxInt64)
+	}
+	return nil
+}
+
+func GetRuntimeOptions() *RuntimeOptions {
+	gcAccess.Lock()
+	gogc := gcPercent
+	gcAccess.Unlock()
+
+	options := &RuntimeOptions{
+		Gogc:          gogc,
+		MaxProcs:      int32(runtime.GOMAXPROCS(0)),
+		MemoryLimitMB: -1,
+	}
+	if limit := setMemoryLimit(-1); limit >= 0 && limit != math.MaxInt64 {
+		options.MemoryLimitMB = int32(limit >> 20)
+	}
+	return options
+}
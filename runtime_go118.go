@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package libcore
+
+const memoryLimitSupported = false
+
+func setMemoryLimit(int64) int64 {
+	return -1
+}
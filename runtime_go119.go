@@ -0,0 +1,13 @@
+//go:build go1.19
+// +build go1.19
+
+package libcore
+
+import "runtime/debug"
+
+const memoryLimitSupported = true
+
+// setMemoryLimit returns the previous limit, a negative limit only queries it.
+func setMemoryLimit(limit int64) int64 {
+	return debug.SetMemoryLimit(limit)
+}
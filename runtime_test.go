@@ -0,0 +1,28 @@
+package libcore
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestRuntimeOptionsGogc(t *testing.T) {
+	previous := GetRuntimeOptions().Gogc
+	defer SetRuntimeOptions(previous, 0, 0)
+
+	for _, gogc := range []int32{50, -5, 200} {
+		if err := SetRuntimeOptions(gogc, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		want := gogc
+		if want < 0 {
+			want = -1
+		}
+		if got := GetRuntimeOptions().Gogc; got != want {
+			t.Fatalf("gogc %d, want %d", got, want)
+		}
+		// reading the options leaves the runtime as it was set
+		if actual := debug.SetGCPercent(int(want)); actual != int(want) {
+			t.Fatalf("runtime gogc %d, want %d", actual, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package libcore
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	routeScriptMaxSteps = 10000
+	routeScriptTimeout  = 5 * time.Millisecond
+)
+
+// routeScript is a compiled routing expression, e.g.
+//
+//	hasSuffix(domain, ".cn") || inCidr(ip, "10.0.0.0/8") ? "direct" :
+//	port in [22, 3389] && package != "" ? "proxy" : ""
+//
+// It evaluates to the outbound tag, or an empty string to leave the connection
+// to the next routing stage. The script is a single expression of the
+// evaluator pac files run on, see scripteval.go, without assignments or
+// functions. Available variables are domain, ip, port, srcPort, uid,
+// network, protocol, inbound, package, networkType, ssid, roaming, hour and
+// weekday (0 is sunday), functions are hasPrefix, hasSuffix, contains,
+// lower, inCidr and match, the last two taking a string literal as their
+// second argument.
+type routeScript struct {
+	source   string
+	root     scriptNode
+	cidrs    map[string]*net.IPNet
+	patterns map[string]*regexp.Regexp
+}
+
+var routeScriptVariables = map[string]func(rc *ruleContext) scriptValue{
+	"domain":      func(rc *ruleContext) scriptValue { return rc.domain },
+	"port":        func(rc *ruleContext) scriptValue { return float64(rc.port) },
+	"srcPort":     func(rc *ruleContext) scriptValue { return float64(rc.sourcePort) },
+	"uid":         func(rc *ruleContext) scriptValue { return float64(rc.uid) },
+	"network":     func(rc *ruleContext) scriptValue { return rc.network },
+	"protocol":    func(rc *ruleContext) scriptValue { return rc.protocol },
+	"inbound":     func(rc *ruleContext) scriptValue { return rc.inbound },
+	"package":     func(rc *ruleContext) scriptValue { return rc.getPackageName() },
+	"networkType": func(rc *ruleContext) scriptValue { return rc.networkType },
+	"ssid":        func(rc *ruleContext) scriptValue { return rc.wifiSsid },
+	"roaming":     func(rc *ruleContext) scriptValue { return rc.roaming },
+	"hour":        func(rc *ruleContext) scriptValue { return float64(rc.getTime().Hour()) },
+	"weekday":     func(rc *ruleContext) scriptValue { return float64(rc.getTime().Weekday()) },
+	"ip": func(rc *ruleContext) scriptValue {
+		if len(rc.ips) == 0 {
+			return ""
+		}
+		return rc.ips[0].String()
+	},
+}
+
+// routeScriptFunctions maps the functions to their number of arguments.
+var routeScriptFunctions = map[string]int{
+	"hasPrefix": 2,
+	"hasSuffix": 2,
+	"contains":  2,
+	"lower":     1,
+	"inCidr":    2,
+	"match":     2,
+}
+
+func compileRouteScript(source string) (*routeScript, error) {
+	s := &routeScript{
+		source:   source,
+		cidrs:    make(map[string]*net.IPNet),
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	root, err := parseScriptExpression(source, s.check)
+	if err != nil {
+		return nil, err
+	}
+	s.root = root
+	return s, nil
+}
+
+// check rejects unknown names and what a routing expression has no use for,
+// and compiles the patterns of inCidr and match.
+func (s *routeScript) check(node scriptNode) error {
+	switch n := node.(type) {
+	case *scriptName:
+		if _, ok := routeScriptVariables[n.name]; ok {
+			return nil
+		}
+		if _, ok := routeScriptFunctions[n.name]; !ok {
+			return newError("unknown identifier ", n.name)
+		}
+	case *scriptCall:
+		name, ok := n.callee.(*scriptName)
+		if !ok {
+			return nil
+		}
+		argc, ok := routeScriptFunctions[name.name]
+		if !ok {
+			return nil
+		}
+		if len(n.args) != argc {
+			return newError(name.name, " takes ", argc, " arguments")
+		}
+		if name.name != "inCidr" && name.name != "match" {
+			return nil
+		}
+		var pattern string
+		if literal, ok := n.args[1].(*scriptLiteral); ok {
+			pattern, _ = literal.value.(string)
+		}
+		if pattern == "" {
+			return newError("second argument of ", name.name, " must be a string literal")
+		}
+		if name.name == "inCidr" {
+			_, cidr, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return err
+			}
+			s.cidrs[pattern] = cidr
+		} else {
+			expression, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+			s.patterns[pattern] = expression
+		}
+	case *scriptAssign, *scriptUpdate:
+		return newError("route scripts can't assign")
+	case *scriptFunctionLiteral:
+		return newError("route scripts can't define functions")
+	}
+	return nil
+}
+
+// lookup provides the variables of rc and the functions to the evaluator.
+func (s *routeScript) lookup(rc *ruleContext) func(name string) (scriptValue, bool) {
+	return func(name string) (scriptValue, bool) {
+		if variable, ok := routeScriptVariables[name]; ok {
+			return variable(rc), true
+		}
+		if _, ok := routeScriptFunctions[name]; !ok {
+			return nil, false
+		}
+		return scriptBuiltin(func(args []scriptValue) (scriptValue, error) {
+			return s.call(name, args)
+		}), true
+	}
+}
+
+func (s *routeScript) call(name string, args []scriptValue) (scriptValue, error) {
+	switch name {
+	case "hasPrefix":
+		return strings.HasPrefix(scriptArg(args, 0), scriptArg(args, 1)), nil
+	case "hasSuffix":
+		return strings.HasSuffix(scriptArg(args, 0), scriptArg(args, 1)), nil
+	case "contains":
+		return strings.Contains(scriptArg(args, 0), scriptArg(args, 1)), nil
+	case "lower":
+		return strings.ToLower(scriptArg(args, 0)), nil
+	case "inCidr":
+		cidr, ok := s.cidrs[scriptArg(args, 1)]
+		if !ok {
+			return nil, newError("inCidr needs a string literal")
+		}
+		ip := net.ParseIP(scriptArg(args, 0))
+		return ip != nil && cidr.Contains(ip), nil
+	default:
+		expression, ok := s.patterns[scriptArg(args, 1)]
+		if !ok {
+			return nil, newError("match needs a string literal")
+		}
+		return expression.MatchString(scriptArg(args, 0)), nil
+	}
+}
+
+// run evaluates the script, the result must be a string.
+func (s *routeScript) run(rc *ruleContext) (string, error) {
+	env := newScriptEnv(routeScriptMaxSteps, routeScriptTimeout, s.lookup(rc))
+	value, err := s.root.eval(env, newScriptScope(nil))
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	}
+	return "", newError("script returned ", scriptString(value), " instead of an outbound tag")
+}
+
+// LoadRouteScript compiles a routing script evaluated for every connection
+// after the rules loaded with LoadRules, see routeScript for the language.
+// An empty script removes it.
+func (instance *V2RayInstance) LoadRouteScript(script string) error {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(script) == "" {
+		router.storeScript(nil)
+		return nil
+	}
+	compiled, err := compileRouteScript(script)
+	if err != nil {
+		return withCode(ErrorCodeConfigInvalid, newError("compile route script").Base(err))
+	}
+	router.storeScript(compiled)
+	return nil
+}
+
+// TestRouteScript evaluates the loaded script for the given connection.
+func (instance *V2RayInstance) TestRouteScript(network string, domain string, ip string, port int32, uid int32, protocol string) (string, error) {
+	router, err := instance.getRuleRouter()
+	if err != nil {
+		return "", err
+	}
+	script := router.script.Load().(*routeScript)
+	if script == nil {
+		return "", withCode(ErrorCodeInvalidState, newError("no route script loaded"))
+	}
+	rc := &ruleContext{
+		network:     strings.ToLower(network),
+		domain:      strings.ToLower(domain),
+		port:        uint16(port),
+		uid:         uint32(uid),
+		protocol:    protocol,
+		networkType: strings.ToLower(networkType),
+		wifiSsid:    wifiSSID,
+		roaming:     networkRoaming,
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		rc.ips = []net.IP{parsed}
+	}
+	outbound, err := script.run(rc)
+	return outbound, exportError(err)
+}
@@ -0,0 +1,73 @@
+package libcore
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteScriptCompileErrors(t *testing.T) {
+	for _, source := range []string{
+		"unknown",
+		"hasPrefix(domain)",
+		"inCidr(ip, cidr)",
+		"inCidr(ip, \"10.0.0.0\")",
+		"match(domain, \"(\")",
+		"domain = \"a\"",
+		"port++",
+		"function () {}",
+		"\"a\"; \"b\"",
+	} {
+		if _, err := compileRouteScript(source); err == nil {
+			t.Errorf("%q compiled", source)
+		}
+	}
+}
+
+func TestRouteScriptRun(t *testing.T) {
+	rc := &ruleContext{
+		network:     "tcp",
+		domain:      "www.example.cn",
+		ips:         []net.IP{net.ParseIP("10.1.2.3")},
+		port:        22,
+		uid:         10001,
+		networkType: "wifi",
+		wifiSsid:    "home",
+		now:         time.Date(2022, 1, 2, 15, 0, 0, 0, time.Local),
+	}
+	for _, test := range []struct {
+		source string
+		want   string
+	}{
+		{`hasSuffix(domain, ".cn") ? "direct" : "proxy"`, "direct"},
+		{`domain.endsWith(".com") ? "direct" : "proxy"`, "proxy"},
+		{`inCidr(ip, "10.0.0.0/8") && "lan"`, "lan"},
+		{`port in [22, 3389] ? "ssh" : ""`, "ssh"},
+		{`match(lower(ssid), "^ho") && network == "tcp" ? "home" : ""`, "home"},
+		{`hour >= 9 && hour < 18 && weekday == 0 ? "work" : ""`, "work"},
+		{`contains(uid, "1000") ? "app" : ""`, "app"},
+		{`hasPrefix(networkType, "cell") ? "cellular" : null`, ""},
+	} {
+		script, err := compileRouteScript(test.source)
+		if err != nil {
+			t.Fatalf("compile %s: %v", test.source, err)
+		}
+		got, err := script.run(rc)
+		if err != nil {
+			t.Fatalf("run %s: %v", test.source, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestRouteScriptNotTag(t *testing.T) {
+	script, err := compileRouteScript("port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = script.run(&ruleContext{port: 80}); err == nil {
+		t.Fatal("a number was taken as an outbound tag")
+	}
+}
@@ -0,0 +1,1595 @@
+package libcore
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// scriptMaxDepth bounds the nesting of parsed scripts and the recursion
+	// of their functions.
+	scriptMaxDepth = 64
+	// scriptMaxString and scriptMaxArray bound the values a script builds,
+	// and every scriptStepBytes allocated count as a step.
+	scriptMaxString = 1024 * 1024
+	scriptMaxArray  = 4096
+	scriptStepBytes = 64
+)
+
+// The sandboxed evaluator below runs both pac files and route scripts. It
+// covers the subset of JavaScript PAC files are written in: function and var
+// declarations, if, for, while, break, continue and return, the usual
+// operators on strings, numbers, booleans and arrays, "in" testing whether an
+// array contains a value, and the string methods toLowerCase, toUpperCase,
+// indexOf, lastIndexOf, substring, substr, charAt, split, startsWith, endsWith,
+// trim and length. Regular expression literals, objects and closures over
+// loop variables are not supported. Names not declared by the script are
+// looked up from the host of the evaluation, and every evaluation is bounded
+// by a step count, which includes the memory it allocates, and a deadline.
+
+type scriptValue interface{}
+
+type scriptArray struct {
+	items []scriptValue
+}
+
+type scriptFunction struct {
+	name   string
+	params []string
+	body   []scriptStatement
+	scope  *scriptScope
+}
+
+type scriptBuiltin func(args []scriptValue) (scriptValue, error)
+
+type scriptScope struct {
+	vars   map[string]scriptValue
+	parent *scriptScope
+}
+
+func newScriptScope(parent *scriptScope) *scriptScope {
+	return &scriptScope{vars: make(map[string]scriptValue), parent: parent}
+}
+
+// clone copies a top level scope for one evaluation, so that evaluations do
+// not share state. Arrays are copied and functions declared in the scope are
+// rebound to the copy.
+func (s *scriptScope) clone() *scriptScope {
+	scope := newScriptScope(s.parent)
+	arrays := make(map[*scriptArray]*scriptArray)
+	functions := make(map[*scriptFunction]*scriptFunction)
+	var copyValue func(value scriptValue) scriptValue
+	copyValue = func(value scriptValue) scriptValue {
+		switch value := value.(type) {
+		case *scriptArray:
+			if copied, ok := arrays[value]; ok {
+				return copied
+			}
+			copied := &scriptArray{items: make([]scriptValue, len(value.items))}
+			arrays[value] = copied
+			for i, item := range value.items {
+				copied.items[i] = copyValue(item)
+			}
+			return copied
+		case *scriptFunction:
+			if value.scope != s {
+				return value
+			}
+			if copied, ok := functions[value]; ok {
+				return copied
+			}
+			copied := *value
+			copied.scope = scope
+			functions[value] = &copied
+			return &copied
+		}
+		return value
+	}
+	for name, value := range s.vars {
+		scope.vars[name] = copyValue(value)
+	}
+	return scope
+}
+
+func (s *scriptScope) lookup(name string) (*scriptScope, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if _, ok := scope.vars[name]; ok {
+			return scope, true
+		}
+	}
+	return nil, false
+}
+
+// scriptEnv is the state of one evaluation. lookup provides the names the
+// script does not declare, such as builtin functions.
+type scriptEnv struct {
+	steps    int
+	maxSteps int
+	depth    int
+	deadline time.Time
+	lookup   func(name string) (scriptValue, bool)
+}
+
+func newScriptEnv(maxSteps int, timeout time.Duration, lookup func(name string) (scriptValue, bool)) *scriptEnv {
+	return &scriptEnv{maxSteps: maxSteps, deadline: time.Now().Add(timeout), lookup: lookup}
+}
+
+// exclude runs f, which waits on the host such as for a dns answer, without
+// counting its duration toward the deadline.
+func (e *scriptEnv) exclude(f func()) {
+	start := time.Now()
+	f()
+	e.deadline = e.deadline.Add(time.Since(start))
+}
+
+// alloc counts size allocated bytes toward the steps.
+func (e *scriptEnv) alloc(size int) error {
+	e.steps += size / scriptStepBytes
+	return e.step()
+}
+
+// newString checks the length of a string the script built.
+func (e *scriptEnv) newString(s string) (scriptValue, error) {
+	if len(s) > scriptMaxString {
+		return nil, newError("string exceeds ", scriptMaxString, " bytes")
+	}
+	return s, e.alloc(len(s))
+}
+
+func (e *scriptEnv) step() error {
+	e.steps++
+	if e.steps > e.maxSteps {
+		return newError("script exceeded ", e.maxSteps, " steps")
+	}
+	if e.steps%100 == 0 && time.Now().After(e.deadline) {
+		return newError("script timed out")
+	}
+	return nil
+}
+
+// tokens
+
+const (
+	scriptTokenEOF = iota
+	scriptTokenName
+	scriptTokenNumber
+	scriptTokenString
+	scriptTokenPunct
+)
+
+type scriptToken struct {
+	kind int
+	text string
+	line int
+}
+
+var scriptPunctuators = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "=", "<", ">", "+", "-", "*", "/", "%", "!",
+}
+
+func tokenizeScript(source string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	line := 1
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return nil, newError("unterminated comment at line ", line)
+			}
+			line += strings.Count(source[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			var value strings.Builder
+			end := i + 1
+			for ; end < len(source) && source[end] != c; end++ {
+				if source[end] == '\n' {
+					return nil, newError("unterminated string at line ", line)
+				}
+				if source[end] != '\\' || end+1 >= len(source) {
+					value.WriteByte(source[end])
+					continue
+				}
+				end++
+				switch source[end] {
+				case 'n':
+					value.WriteByte('\n')
+				case 't':
+					value.WriteByte('\t')
+				case 'r':
+					value.WriteByte('\r')
+				default:
+					value.WriteByte(source[end])
+				}
+			}
+			if end >= len(source) {
+				return nil, newError("unterminated string at line ", line)
+			}
+			tokens = append(tokens, scriptToken{scriptTokenString, value.String(), line})
+			i = end + 1
+		case unicode.IsDigit(rune(c)):
+			end := i
+			for end < len(source) && (unicode.IsDigit(rune(source[end])) || source[end] == '.' || source[end] == 'x' || source[end] == 'X' ||
+				(source[end] >= 'a' && source[end] <= 'f') || (source[end] >= 'A' && source[end] <= 'F')) {
+				end++
+			}
+			tokens = append(tokens, scriptToken{scriptTokenNumber, source[i:end], line})
+			i = end
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(source) && (source[end] == '_' || source[end] == '$' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, scriptToken{scriptTokenName, source[i:end], line})
+			i = end
+		default:
+			var matched string
+			for _, punctuator := range scriptPunctuators {
+				if strings.HasPrefix(source[i:], punctuator) {
+					matched = punctuator
+					break
+				}
+			}
+			if matched == "" {
+				return nil, newError("unexpected character ", string(c), " at line ", line)
+			}
+			tokens = append(tokens, scriptToken{scriptTokenPunct, matched, line})
+			i += len(matched)
+		}
+	}
+	return append(tokens, scriptToken{scriptTokenEOF, "", line}), nil
+}
+
+// statements
+
+const (
+	scriptNormal = iota
+	scriptReturn
+	scriptBreak
+	scriptContinue
+)
+
+type scriptStatement interface {
+	exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error)
+}
+
+type scriptVarStatement struct {
+	names []string
+	inits []scriptNode
+}
+
+func (s *scriptVarStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	for i, name := range s.names {
+		var value scriptValue
+		if s.inits[i] != nil {
+			var err error
+			if value, err = s.inits[i].eval(env, scope); err != nil {
+				return 0, nil, err
+			}
+		} else if _, ok := scope.vars[name]; ok {
+			continue
+		}
+		scope.vars[name] = value
+	}
+	return scriptNormal, nil, env.step()
+}
+
+type scriptFunctionStatement struct {
+	function *scriptFunction
+}
+
+// exec does nothing, functions are declared when their body starts.
+func (s *scriptFunctionStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	return scriptNormal, nil, nil
+}
+
+type scriptExpressionStatement struct {
+	expression scriptNode
+}
+
+func (s *scriptExpressionStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	_, err := s.expression.eval(env, scope)
+	return scriptNormal, nil, err
+}
+
+type scriptIfStatement struct {
+	condition scriptNode
+	then      scriptStatement
+	otherwise scriptStatement
+}
+
+func (s *scriptIfStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	condition, err := s.condition.eval(env, scope)
+	if err != nil {
+		return 0, nil, err
+	}
+	if scriptTruth(condition) {
+		return s.then.exec(env, scope)
+	}
+	if s.otherwise != nil {
+		return s.otherwise.exec(env, scope)
+	}
+	return scriptNormal, nil, nil
+}
+
+type scriptBlockStatement struct {
+	body []scriptStatement
+}
+
+func (s *scriptBlockStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	return execScriptStatements(env, scope, s.body)
+}
+
+type scriptLoopStatement struct {
+	init      scriptStatement
+	condition scriptNode
+	update    scriptNode
+	body      scriptStatement
+}
+
+func (s *scriptLoopStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	if s.init != nil {
+		if _, _, err := s.init.exec(env, scope); err != nil {
+			return 0, nil, err
+		}
+	}
+	for {
+		if err := env.step(); err != nil {
+			return 0, nil, err
+		}
+		if s.condition != nil {
+			condition, err := s.condition.eval(env, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !scriptTruth(condition) {
+				return scriptNormal, nil, nil
+			}
+		}
+		control, value, err := s.body.exec(env, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch control {
+		case scriptReturn:
+			return control, value, nil
+		case scriptBreak:
+			return scriptNormal, nil, nil
+		}
+		if s.update != nil {
+			if _, err = s.update.eval(env, scope); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+}
+
+type scriptReturnStatement struct {
+	value scriptNode
+}
+
+func (s *scriptReturnStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	if s.value == nil {
+		return scriptReturn, nil, nil
+	}
+	value, err := s.value.eval(env, scope)
+	return scriptReturn, value, err
+}
+
+type scriptJumpStatement struct {
+	control int
+}
+
+func (s *scriptJumpStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	return s.control, nil, nil
+}
+
+type scriptEmptyStatement struct{}
+
+func (s *scriptEmptyStatement) exec(env *scriptEnv, scope *scriptScope) (int, scriptValue, error) {
+	return scriptNormal, nil, nil
+}
+
+// execScriptStatements declares the functions of a body before running it, like
+// JavaScript hoisting.
+func execScriptStatements(env *scriptEnv, scope *scriptScope, body []scriptStatement) (int, scriptValue, error) {
+	for _, statement := range body {
+		if declaration, ok := statement.(*scriptFunctionStatement); ok {
+			function := *declaration.function
+			function.scope = scope
+			scope.vars[function.name] = &function
+		}
+	}
+	for _, statement := range body {
+		control, value, err := statement.exec(env, scope)
+		if err != nil || control != scriptNormal {
+			return control, value, err
+		}
+	}
+	return scriptNormal, nil, nil
+}
+
+// expressions
+
+type scriptNode interface {
+	eval(env *scriptEnv, scope *scriptScope) (scriptValue, error)
+}
+
+type scriptLiteral struct {
+	value scriptValue
+}
+
+func (n *scriptLiteral) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	return n.value, env.step()
+}
+
+type scriptName struct {
+	name string
+}
+
+func (n *scriptName) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	if owner, ok := scope.lookup(n.name); ok {
+		return owner.vars[n.name], nil
+	}
+	if value, ok := env.lookup(n.name); ok {
+		return value, nil
+	}
+	return nil, newError(n.name, " is not defined")
+}
+
+type scriptArrayLiteral struct {
+	items []scriptNode
+}
+
+func (n *scriptArrayLiteral) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	array := &scriptArray{items: make([]scriptValue, 0, len(n.items))}
+	for _, item := range n.items {
+		value, err := item.eval(env, scope)
+		if err != nil {
+			return nil, err
+		}
+		array.items = append(array.items, value)
+	}
+	return array, env.step()
+}
+
+type scriptUnary struct {
+	op      string
+	operand scriptNode
+}
+
+func (n *scriptUnary) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	value, err := n.operand.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		return !scriptTruth(value), nil
+	case "-":
+		return -scriptNumber(value), nil
+	case "+":
+		return scriptNumber(value), nil
+	default:
+		return scriptTypeOf(value), nil
+	}
+}
+
+type scriptBinary struct {
+	op          string
+	left, right scriptNode
+}
+
+func (n *scriptBinary) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	left, err := n.left.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&":
+		if !scriptTruth(left) {
+			return left, nil
+		}
+		return n.right.eval(env, scope)
+	case "||":
+		if scriptTruth(left) {
+			return left, nil
+		}
+		return n.right.eval(env, scope)
+	}
+	right, err := n.right.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	return scriptOperate(env, n.op, left, right)
+}
+
+func scriptOperate(env *scriptEnv, op string, left, right scriptValue) (scriptValue, error) {
+	switch op {
+	case "==":
+		return scriptLooseEqual(left, right), nil
+	case "!=":
+		return !scriptLooseEqual(left, right), nil
+	case "===":
+		return scriptStrictEqual(left, right), nil
+	case "!==":
+		return !scriptStrictEqual(left, right), nil
+	case "+":
+		_, leftString := left.(string)
+		_, rightString := right.(string)
+		if leftString || rightString {
+			leftValue, rightValue := scriptString(left), scriptString(right)
+			if len(leftValue)+len(rightValue) > scriptMaxString {
+				return nil, newError("string exceeds ", scriptMaxString, " bytes")
+			}
+			return env.newString(leftValue + rightValue)
+		}
+		return scriptNumber(left) + scriptNumber(right), nil
+	case "-":
+		return scriptNumber(left) - scriptNumber(right), nil
+	case "*":
+		return scriptNumber(left) * scriptNumber(right), nil
+	case "/":
+		return scriptNumber(left) / scriptNumber(right), nil
+	case "%":
+		return math.Mod(scriptNumber(left), scriptNumber(right)), nil
+	case "in":
+		array, ok := right.(*scriptArray)
+		if !ok {
+			return nil, newError("right side of in is not an array")
+		}
+		for _, item := range array.items {
+			if scriptStrictEqual(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	leftString, leftOk := left.(string)
+	rightString, rightOk := right.(string)
+	if leftOk && rightOk {
+		switch op {
+		case "<":
+			return leftString < rightString, nil
+		case "<=":
+			return leftString <= rightString, nil
+		case ">":
+			return leftString > rightString, nil
+		default:
+			return leftString >= rightString, nil
+		}
+	}
+	l, r := scriptNumber(left), scriptNumber(right)
+	switch op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+	return nil, newError("unknown operator ", op)
+}
+
+type scriptConditional struct {
+	condition, then, otherwise scriptNode
+}
+
+func (n *scriptConditional) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	condition, err := n.condition.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	if scriptTruth(condition) {
+		return n.then.eval(env, scope)
+	}
+	return n.otherwise.eval(env, scope)
+}
+
+type scriptMember struct {
+	object scriptNode
+	name   string
+}
+
+func (n *scriptMember) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	object, err := n.object.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	if n.name != "length" {
+		return nil, newError("property ", n.name, " is not supported")
+	}
+	switch v := object.(type) {
+	case string:
+		return float64(len(v)), nil
+	case *scriptArray:
+		return float64(len(v.items)), nil
+	}
+	return nil, newError("length of ", scriptTypeOf(object))
+}
+
+type scriptIndex struct {
+	object scriptNode
+	index  scriptNode
+}
+
+func (n *scriptIndex) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	object, err := n.object.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	position := int(scriptNumber(index))
+	switch v := object.(type) {
+	case string:
+		if position >= 0 && position < len(v) {
+			return v[position : position+1], nil
+		}
+		return nil, nil
+	case *scriptArray:
+		if position >= 0 && position < len(v.items) {
+			return v.items[position], nil
+		}
+		return nil, nil
+	}
+	return nil, newError("cannot index ", scriptTypeOf(object))
+}
+
+type scriptAssign struct {
+	op     string
+	target scriptNode
+	value  scriptNode
+}
+
+func (n *scriptAssign) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	value, err := n.value.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	if n.op != "=" {
+		current, err := n.target.eval(env, scope)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = scriptOperate(env, n.op[:1], current, value); err != nil {
+			return nil, err
+		}
+	}
+	return value, scriptStore(env, scope, n.target, value)
+}
+
+type scriptUpdate struct {
+	delta  float64
+	prefix bool
+	target scriptNode
+}
+
+func (n *scriptUpdate) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	current, err := n.target.eval(env, scope)
+	if err != nil {
+		return nil, err
+	}
+	old := scriptNumber(current)
+	if err = scriptStore(env, scope, n.target, old+n.delta); err != nil {
+		return nil, err
+	}
+	if n.prefix {
+		return old + n.delta, nil
+	}
+	return old, nil
+}
+
+// scriptStore assigns to a name or an array element, undeclared names become
+// globals.
+func scriptStore(env *scriptEnv, scope *scriptScope, target scriptNode, value scriptValue) error {
+	switch t := target.(type) {
+	case *scriptName:
+		owner, ok := scope.lookup(t.name)
+		if !ok {
+			owner = scope
+			for owner.parent != nil {
+				owner = owner.parent
+			}
+		}
+		owner.vars[t.name] = value
+		return nil
+	case *scriptIndex:
+		object, err := t.object.eval(env, scope)
+		if err != nil {
+			return err
+		}
+		index, err := t.index.eval(env, scope)
+		if err != nil {
+			return err
+		}
+		array, ok := object.(*scriptArray)
+		position := int(scriptNumber(index))
+		if !ok || position < 0 || position > len(array.items) || position >= scriptMaxArray {
+			return newError("invalid assignment target")
+		}
+		if position == len(array.items) {
+			array.items = append(array.items, value)
+		} else {
+			array.items[position] = value
+		}
+		return nil
+	}
+	return newError("invalid assignment target")
+}
+
+type scriptCall struct {
+	callee scriptNode
+	args   []scriptNode
+}
+
+func (n *scriptCall) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	var object scriptValue
+	var method string
+	var callee scriptValue
+	var err error
+	if member, ok := n.callee.(*scriptMember); ok {
+		if object, err = member.object.eval(env, scope); err != nil {
+			return nil, err
+		}
+		method = member.name
+	} else if callee, err = n.callee.eval(env, scope); err != nil {
+		return nil, err
+	}
+	args := make([]scriptValue, len(n.args))
+	for i, arg := range n.args {
+		if args[i], err = arg.eval(env, scope); err != nil {
+			return nil, err
+		}
+	}
+	if method != "" {
+		return scriptCallMethod(env, object, method, args)
+	}
+	return scriptInvoke(env, callee, args)
+}
+
+func scriptInvoke(env *scriptEnv, callee scriptValue, args []scriptValue) (scriptValue, error) {
+	switch function := callee.(type) {
+	case scriptBuiltin:
+		return function(args)
+	case *scriptFunction:
+		env.depth++
+		defer func() { env.depth-- }()
+		if env.depth > scriptMaxDepth {
+			return nil, newError("script recursed too deep")
+		}
+		scope := newScriptScope(function.scope)
+		for i, param := range function.params {
+			if i < len(args) {
+				scope.vars[param] = args[i]
+			} else {
+				scope.vars[param] = nil
+			}
+		}
+		_, value, err := execScriptStatements(env, scope, function.body)
+		return value, err
+	}
+	return nil, newError(scriptTypeOf(callee), " is not a function")
+}
+
+func scriptCallMethod(env *scriptEnv, object scriptValue, method string, args []scriptValue) (scriptValue, error) {
+	arg := func(index int) string {
+		if index < len(args) {
+			return scriptString(args[index])
+		}
+		return "undefined"
+	}
+	intArg := func(index int, fallback int) int {
+		if index < len(args) && args[index] != nil {
+			return int(scriptNumber(args[index]))
+		}
+		return fallback
+	}
+	if array, ok := object.(*scriptArray); ok {
+		switch method {
+		case "indexOf":
+			for i, item := range array.items {
+				if len(args) > 0 && scriptStrictEqual(item, args[0]) {
+					return float64(i), nil
+				}
+			}
+			return float64(-1), nil
+		case "join":
+			separator := ","
+			if len(args) > 0 {
+				separator = arg(0)
+			}
+			return env.newString(scriptJoin(array, separator))
+		case "push":
+			if len(array.items)+len(args) > scriptMaxArray {
+				return nil, newError("array exceeds ", scriptMaxArray, " items")
+			}
+			array.items = append(array.items, args...)
+			return float64(len(array.items)), nil
+		}
+		return nil, newError("array method ", method, " is not supported")
+	}
+	s, ok := object.(string)
+	if !ok {
+		return nil, newError("method ", method, " of ", scriptTypeOf(object), " is not supported")
+	}
+	clamp := func(index int) int {
+		if index < 0 {
+			return 0
+		}
+		if index > len(s) {
+			return len(s)
+		}
+		return index
+	}
+	switch method {
+	case "toLowerCase":
+		return env.newString(strings.ToLower(s))
+	case "toUpperCase":
+		return env.newString(strings.ToUpper(s))
+	case "indexOf":
+		from := clamp(intArg(1, 0))
+		index := strings.Index(s[from:], arg(0))
+		if index >= 0 {
+			index += from
+		}
+		return float64(index), nil
+	case "lastIndexOf":
+		return float64(strings.LastIndex(s, arg(0))), nil
+	case "startsWith":
+		return strings.HasPrefix(s, arg(0)), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg(0)), nil
+	case "charAt":
+		index := intArg(0, 0)
+		if index < 0 || index >= len(s) {
+			return "", nil
+		}
+		return s[index : index+1], nil
+	case "substring":
+		start, end := clamp(intArg(0, 0)), clamp(intArg(1, len(s)))
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end], nil
+	case "substr":
+		start := intArg(0, 0)
+		if start < 0 {
+			start += len(s)
+		}
+		start = clamp(start)
+		return s[start:clamp(start+intArg(1, len(s)))], nil
+	case "split":
+		if len(args) == 0 {
+			return &scriptArray{items: []scriptValue{s}}, nil
+		}
+		parts := strings.Split(s, arg(0))
+		if err := env.alloc(len(parts) * scriptStepBytes); err != nil {
+			return nil, err
+		}
+		array := &scriptArray{items: make([]scriptValue, len(parts))}
+		for i, part := range parts {
+			array.items[i] = part
+		}
+		return array, nil
+	case "trim":
+		return strings.TrimSpace(s), nil
+	}
+	return nil, newError("string method ", method, " is not supported")
+}
+
+// values
+
+func scriptTruth(value scriptValue) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case nil:
+		return false
+	}
+	return true
+}
+
+func scriptNumber(value scriptValue) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return 0
+		}
+		if number, err := strconv.ParseFloat(v, 64); err == nil {
+			return number
+		}
+	}
+	return math.NaN()
+}
+
+func scriptString(value scriptValue) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e21 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "undefined"
+	case *scriptArray:
+		return scriptJoin(v, ",")
+	}
+	return "function"
+}
+
+// scriptJoin converts the items of array to strings joined by separator. It
+// stops once the result exceeds scriptMaxString, and writes arrays nested
+// deeper than scriptMaxDepth or containing themselves as empty strings.
+func scriptJoin(array *scriptArray, separator string) string {
+	var builder strings.Builder
+	scriptWriteArray(&builder, array, separator, make(map[*scriptArray]bool), 0)
+	return builder.String()
+}
+
+func scriptWriteArray(builder *strings.Builder, array *scriptArray, separator string, visiting map[*scriptArray]bool, depth int) {
+	if depth > scriptMaxDepth || visiting[array] {
+		return
+	}
+	visiting[array] = true
+	defer delete(visiting, array)
+	for i, item := range array.items {
+		if builder.Len() > scriptMaxString {
+			return
+		}
+		if i > 0 {
+			builder.WriteString(separator)
+		}
+		if nested, ok := item.(*scriptArray); ok {
+			scriptWriteArray(builder, nested, ",", visiting, depth+1)
+		} else {
+			builder.WriteString(scriptString(item))
+		}
+	}
+}
+
+// scriptArg returns the argument at index as a string, or an empty string if
+// there are fewer arguments.
+func scriptArg(args []scriptValue, index int) string {
+	if index < len(args) {
+		return scriptString(args[index])
+	}
+	return ""
+}
+
+func scriptTypeOf(value scriptValue) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "undefined"
+	case *scriptArray:
+		return "object"
+	}
+	return "function"
+}
+
+func scriptStrictEqual(left, right scriptValue) bool {
+	switch l := left.(type) {
+	case string, float64, bool, nil:
+		return left == right
+	case *scriptArray:
+		r, ok := right.(*scriptArray)
+		return ok && l == r
+	}
+	return false
+}
+
+func scriptLooseEqual(left, right scriptValue) bool {
+	if scriptTypeOf(left) == scriptTypeOf(right) {
+		return scriptStrictEqual(left, right)
+	}
+	if left == nil || right == nil {
+		return false
+	}
+	return scriptNumber(left) == scriptNumber(right)
+}
+
+// parser
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+	depth  int
+	check  func(node scriptNode) error
+}
+
+// parseScript parses a program of statements.
+func parseScript(source string) ([]scriptStatement, error) {
+	tokens, err := tokenizeScript(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	var body []scriptStatement
+	for p.peek().kind != scriptTokenEOF {
+		statement, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, statement)
+	}
+	return body, nil
+}
+
+// parseScriptExpression parses a single expression, calling check for every
+// name, call, assignment, update and function in it.
+func parseScriptExpression(source string, check func(node scriptNode) error) (scriptNode, error) {
+	tokens, err := tokenizeScript(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens, check: check}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != scriptTokenEOF {
+		return nil, p.unexpected("expected end of expression")
+	}
+	return expression, nil
+}
+
+// checked passes node to the check of the parser, if any.
+func (p *scriptParser) checked(node scriptNode) (scriptNode, error) {
+	if p.check != nil {
+		if err := p.check(node); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() scriptToken {
+	token := p.tokens[p.pos]
+	if token.kind != scriptTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *scriptParser) is(text string) bool {
+	token := p.peek()
+	return (token.kind == scriptTokenPunct || token.kind == scriptTokenName) && token.text == text
+}
+
+func (p *scriptParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + text)
+	}
+	return nil
+}
+
+func (p *scriptParser) unexpected(message string) error {
+	token := p.peek()
+	if token.kind == scriptTokenEOF {
+		return newError(message, " at end of script")
+	}
+	return newError(message, ", got ", token.text, " at line ", token.line)
+}
+
+func (p *scriptParser) name() (string, error) {
+	token := p.peek()
+	if token.kind != scriptTokenName {
+		return "", p.unexpected("expected name")
+	}
+	p.pos++
+	return token.text, nil
+}
+
+func (p *scriptParser) enter() error {
+	p.depth++
+	if p.depth > scriptMaxDepth {
+		return newError("script nested too deep")
+	}
+	return nil
+}
+
+func (p *scriptParser) parseStatement() (scriptStatement, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	switch {
+	case p.accept(";"):
+		return &scriptEmptyStatement{}, nil
+	case p.accept("{"):
+		block := &scriptBlockStatement{}
+		for !p.accept("}") {
+			if p.peek().kind == scriptTokenEOF {
+				return nil, p.unexpected("expected }")
+			}
+			statement, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			block.body = append(block.body, statement)
+		}
+		return block, nil
+	case p.accept("function"):
+		function, err := p.parseFunction()
+		if err != nil {
+			return nil, err
+		}
+		if function.name == "" {
+			return nil, p.unexpected("expected function name")
+		}
+		return &scriptFunctionStatement{function}, nil
+	case p.is("var") || p.is("let") || p.is("const"):
+		statement, err := p.parseVar()
+		if err != nil {
+			return nil, err
+		}
+		p.accept(";")
+		return statement, nil
+	case p.accept("if"):
+		statement := &scriptIfStatement{}
+		var err error
+		if statement.condition, err = p.parseParenthesized(); err != nil {
+			return nil, err
+		}
+		if statement.then, err = p.parseStatement(); err != nil {
+			return nil, err
+		}
+		if p.accept("else") {
+			if statement.otherwise, err = p.parseStatement(); err != nil {
+				return nil, err
+			}
+		}
+		return statement, nil
+	case p.accept("while"):
+		statement := &scriptLoopStatement{}
+		var err error
+		if statement.condition, err = p.parseParenthesized(); err != nil {
+			return nil, err
+		}
+		statement.body, err = p.parseStatement()
+		return statement, err
+	case p.accept("for"):
+		return p.parseFor()
+	case p.accept("return"):
+		statement := &scriptReturnStatement{}
+		if !p.is(";") && !p.is("}") && p.peek().kind != scriptTokenEOF {
+			var err error
+			if statement.value, err = p.parseExpression(); err != nil {
+				return nil, err
+			}
+		}
+		p.accept(";")
+		return statement, nil
+	case p.accept("break"):
+		p.accept(";")
+		return &scriptJumpStatement{scriptBreak}, nil
+	case p.accept("continue"):
+		p.accept(";")
+		return &scriptJumpStatement{scriptContinue}, nil
+	}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	return &scriptExpressionStatement{expression}, nil
+}
+
+func (p *scriptParser) parseFunction() (*scriptFunction, error) {
+	function := &scriptFunction{}
+	if p.peek().kind == scriptTokenName {
+		function.name = p.next().text
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		param, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		function.params = append(function.params, param)
+		if !p.is(")") {
+			if err = p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.accept("}") {
+		if p.peek().kind == scriptTokenEOF {
+			return nil, p.unexpected("expected }")
+		}
+		statement, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		function.body = append(function.body, statement)
+	}
+	return function, nil
+}
+
+func (p *scriptParser) parseVar() (*scriptVarStatement, error) {
+	p.next()
+	statement := &scriptVarStatement{}
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		var init scriptNode
+		if p.accept("=") {
+			if init, err = p.parseAssignment(); err != nil {
+				return nil, err
+			}
+		}
+		statement.names = append(statement.names, name)
+		statement.inits = append(statement.inits, init)
+		if !p.accept(",") {
+			return statement, nil
+		}
+	}
+}
+
+func (p *scriptParser) parseFor() (scriptStatement, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	statement := &scriptLoopStatement{}
+	var err error
+	if p.is("var") || p.is("let") || p.is("const") {
+		if statement.init, err = p.parseVar(); err != nil {
+			return nil, err
+		}
+	} else if !p.is(";") {
+		expression, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		statement.init = &scriptExpressionStatement{expression}
+	}
+	if err = p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if statement.condition, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if statement.update, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	statement.body, err = p.parseStatement()
+	return statement, err
+}
+
+func (p *scriptParser) parseParenthesized() (scriptNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return expression, p.expect(")")
+}
+
+func (p *scriptParser) parseExpression() (scriptNode, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	return p.parseAssignment()
+}
+
+func (p *scriptParser) parseAssignment() (scriptNode, error) {
+	target, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.accept(op) {
+			switch target.(type) {
+			case *scriptName, *scriptIndex:
+			default:
+				return nil, p.unexpected("invalid assignment target")
+			}
+			value, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return p.checked(&scriptAssign{op, target, value})
+		}
+	}
+	return target, nil
+}
+
+func (p *scriptParser) parseConditional() (scriptNode, error) {
+	condition, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return condition, nil
+	}
+	then, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &scriptConditional{condition, then, otherwise}, nil
+}
+
+var scriptPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *scriptParser) parseBinary(level int) (scriptNode, error) {
+	if level == len(scriptPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		if token := p.peek(); token.kind == scriptTokenPunct || token.kind == scriptTokenName && token.text == "in" {
+			for _, candidate := range scriptPrecedence[level] {
+				if token.text == candidate {
+					op = candidate
+					break
+				}
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &scriptBinary{op, left, right}
+	}
+}
+
+func (p *scriptParser) parseUnary() (scriptNode, error) {
+	for _, op := range []string{"!", "-", "+", "typeof"} {
+		if p.accept(op) {
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			operand, err := p.parseUnary()
+			p.depth--
+			if err != nil {
+				return nil, err
+			}
+			return &scriptUnary{op, operand}, nil
+		}
+	}
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			target, err := p.parsePostfix()
+			if err != nil {
+				return nil, err
+			}
+			delta := float64(1)
+			if op == "--" {
+				delta = -1
+			}
+			return p.checked(&scriptUpdate{delta, true, target})
+		}
+	}
+	return p.parsePostfix()
+}
+
+func (p *scriptParser) parsePostfix() (scriptNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			node = &scriptMember{node, name}
+		case p.accept("["):
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &scriptIndex{node, index}
+		case p.accept("("):
+			call := &scriptCall{callee: node}
+			for !p.accept(")") {
+				arg, err := p.parseAssignment()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				if !p.is(")") {
+					if err = p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if node, err = p.checked(call); err != nil {
+				return nil, err
+			}
+		case p.is("++") || p.is("--"):
+			delta := float64(1)
+			if p.next().text == "--" {
+				delta = -1
+			}
+			return p.checked(&scriptUpdate{delta, false, node})
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *scriptParser) parsePrimary() (scriptNode, error) {
+	token := p.peek()
+	switch token.kind {
+	case scriptTokenEOF:
+		return nil, p.unexpected("unexpected end")
+	case scriptTokenString:
+		p.pos++
+		return &scriptLiteral{token.text}, nil
+	case scriptTokenNumber:
+		p.pos++
+		var value float64
+		if strings.HasPrefix(token.text, "0x") || strings.HasPrefix(token.text, "0X") {
+			number, err := strconv.ParseInt(token.text[2:], 16, 64)
+			if err != nil {
+				return nil, newError("invalid number ", token.text, " at line ", token.line)
+			}
+			value = float64(number)
+		} else {
+			number, err := strconv.ParseFloat(token.text, 64)
+			if err != nil {
+				return nil, newError("invalid number ", token.text, " at line ", token.line)
+			}
+			value = number
+		}
+		return &scriptLiteral{value}, nil
+	case scriptTokenName:
+		p.pos++
+		switch token.text {
+		case "true", "false":
+			return &scriptLiteral{token.text == "true"}, nil
+		case "null", "undefined":
+			return &scriptLiteral{nil}, nil
+		case "function":
+			function, err := p.parseFunction()
+			if err != nil {
+				return nil, err
+			}
+			return p.checked(&scriptFunctionLiteral{function})
+		}
+		return p.checked(&scriptName{token.text})
+	}
+	switch {
+	case p.accept("("):
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case p.accept("["):
+		array := &scriptArrayLiteral{}
+		for !p.accept("]") {
+			item, err := p.parseAssignment()
+			if err != nil {
+				return nil, err
+			}
+			array.items = append(array.items, item)
+			if !p.is("]") {
+				if err = p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return array, nil
+	}
+	return nil, p.unexpected("unexpected token")
+}
+
+type scriptFunctionLiteral struct {
+	function *scriptFunction
+}
+
+func (n *scriptFunctionLiteral) eval(env *scriptEnv, scope *scriptScope) (scriptValue, error) {
+	function := *n.function
+	function.scope = scope
+	return &function, env.step()
+}
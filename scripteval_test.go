@@ -0,0 +1,216 @@
+package libcore
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evalTestScript runs source as a program and returns the value of its
+// result variable.
+func evalTestScript(t *testing.T, source string) scriptValue {
+	t.Helper()
+	body, err := parseScript(source)
+	if err != nil {
+		t.Fatalf("parse %q: %v", source, err)
+	}
+	scope := newScriptScope(nil)
+	env := newScriptEnv(pacMaxSteps, time.Second, func(string) (scriptValue, bool) { return nil, false })
+	if _, _, err = execScriptStatements(env, scope, body); err != nil {
+		t.Fatalf("run %q: %v", source, err)
+	}
+	return scope.vars["result"]
+}
+
+func TestScriptTokenize(t *testing.T) {
+	tokens, err := tokenizeScript("a === 'b\\n' // comment\n/* block */ 0x1f >= 1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []scriptToken{
+		{scriptTokenName, "a", 1},
+		{scriptTokenPunct, "===", 1},
+		{scriptTokenString, "b\n", 1},
+		{scriptTokenNumber, "0x1f", 2},
+		{scriptTokenPunct, ">=", 2},
+		{scriptTokenNumber, "1.5", 2},
+		{scriptTokenEOF, "", 2},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("tokens %v, want %v", tokens, want)
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Errorf("token %d is %v, want %v", i, tokens[i], want[i])
+		}
+	}
+}
+
+func TestScriptParseErrors(t *testing.T) {
+	for _, source := range []string{
+		"var = 1",
+		"if (a {}",
+		"function () {}",
+		"a = ",
+		"1 = 2",
+		"'unterminated",
+		"/* unterminated",
+		"a @ b",
+		"{",
+		"f(a b)",
+		strings.Repeat("(", scriptMaxDepth+1) + "1" + strings.Repeat(")", scriptMaxDepth+1),
+		strings.Repeat("!", scriptMaxDepth+1) + "1",
+	} {
+		if _, err := parseScript(source); err == nil {
+			t.Errorf("%q parsed", source)
+		}
+	}
+}
+
+func TestScriptParseExpression(t *testing.T) {
+	if _, err := parseScriptExpression("1 + 2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseScriptExpression("1 + 2; 3", nil); err == nil {
+		t.Fatal("trailing statement parsed")
+	}
+	var names []string
+	_, err := parseScriptExpression("a + f(b)", func(node scriptNode) error {
+		if name, ok := node.(*scriptName); ok {
+			names = append(names, name.name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a,f,b" {
+		t.Fatalf("checked names %v", names)
+	}
+}
+
+func TestScriptEval(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   scriptValue
+	}{
+		{"result = 1 + 2 * 3 - 4 / 2", float64(5)},
+		{"result = 7 % 3", float64(1)},
+		{"result = 'a' + 1", "a1"},
+		{"result = '2' == 2", true},
+		{"result = '2' === 2", false},
+		{"result = null == undefined", true},
+		{"result = 'b' > 'a'", true},
+		{"result = 0 || 'x'", "x"},
+		{"result = 1 && 'y'", "y"},
+		{"result = !''", true},
+		{"result = -'3'", float64(-3)},
+		{"result = typeof 'a'", "string"},
+		{"result = 1 ? 'then' : 'else'", "then"},
+		{"result = 443 in [80, 443]", true},
+		{"result = '443' in [80, 443]", false},
+		{"result = 'abc'.length", float64(3)},
+		{"result = 'abc'[1]", "b"},
+		{"result = 'Hello'.toLowerCase()", "hello"},
+		{"result = 'a.b.c'.split('.').join('-')", "a-b-c"},
+		{"result = 'a.b.c'.lastIndexOf('.')", float64(3)},
+		{"result = 'abcdef'.substring(4, 1)", "bcd"},
+		{"result = 'abcdef'.substr(-2)", "ef"},
+		{"result = ' x '.trim()", "x"},
+		{"result = 'www.example.com'.endsWith('.com')", true},
+		{"var a = [1]; a.push(2); a[2] = 3; result = a.join()", "1,2,3"},
+		{"var i = 0; var s = 0; while (i < 5) { s += i; i++; } result = s", float64(10)},
+		{"var s = ''; for (var i = 0; i < 5; i++) { if (i == 1) continue; if (i == 3) break; s += i; } result = s", "02"},
+		{"function f(n) { return n < 2 ? n : f(n - 1) + f(n - 2); } result = f(10)", float64(55)},
+		{"result = g(); function g() { return 'hoisted'; }", "hoisted"},
+		{"var f = function (a, b) { return b; }; result = f(1)", nil},
+		{"var x = 1; var x; result = x", float64(1)},
+		{"result = 0x10", float64(16)},
+	} {
+		if got := evalTestScript(t, test.source); got != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestScriptEvalErrors(t *testing.T) {
+	for _, source := range []string{
+		"undefinedName",
+		"(1)()",
+		"'a'.unknown()",
+		"1 in 'a'",
+		"null[0]",
+		"function f() { return f(); } f()",
+		"while (true) {}",
+		"var s = 'x'; while (true) { s = s + s; }",
+		"var s = 'x'; while (true) { s += s; }",
+		"var a = ['x']; while (true) { a = [a.join(a.join())]; }",
+		"var a = []; while (true) { a.push(1); }",
+		"var a = []; a[" + strconv.Itoa(scriptMaxArray) + "] = 1",
+	} {
+		body, err := parseScript(source)
+		if err != nil {
+			t.Fatalf("parse %q: %v", source, err)
+		}
+		env := newScriptEnv(pacMaxSteps, time.Second, func(string) (scriptValue, bool) { return nil, false })
+		if _, _, err = execScriptStatements(env, newScriptScope(nil), body); err == nil {
+			t.Errorf("%q ran", source)
+		}
+	}
+}
+
+func TestScriptJoinCycle(t *testing.T) {
+	if got := evalTestScript(t, "var a = [1, 2]; a.push(a); result = a.join('-')"); got != "1-2-" {
+		t.Fatalf("got %#v", got)
+	}
+}
+
+func TestScriptAllocSteps(t *testing.T) {
+	body, err := parseScript("var s = 'x'; for (var i = 0; i < 16; i++) { s += s; }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newScriptEnv(1000, time.Second, func(string) (scriptValue, bool) { return nil, false })
+	_, _, err = execScriptStatements(env, newScriptScope(nil), body)
+	if err == nil || !strings.Contains(err.Error(), "steps") {
+		t.Fatalf("error %v, want the steps exceeded", err)
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	body, err := parseScript("while (true) {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newScriptEnv(1<<30, 0, func(string) (scriptValue, bool) { return nil, false })
+	_, _, err = execScriptStatements(env, newScriptScope(nil), body)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+}
+
+func TestScriptLookup(t *testing.T) {
+	body, err := parseScript("result = double(value)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := newScriptScope(nil)
+	env := newScriptEnv(pacMaxSteps, time.Second, func(name string) (scriptValue, bool) {
+		switch name {
+		case "value":
+			return float64(21), true
+		case "double":
+			return scriptBuiltin(func(args []scriptValue) (scriptValue, error) {
+				return scriptNumber(args[0]) * 2, nil
+			}), true
+		}
+		return nil, false
+	})
+	if _, _, err = execScriptStatements(env, scope, body); err != nil {
+		t.Fatal(err)
+	}
+	if scope.vars["result"] != float64(42) {
+		t.Fatalf("result %v", scope.vars["result"])
+	}
+}
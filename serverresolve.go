@@ -0,0 +1,154 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+// Strategies to resolve the server addresses of outbounds.
+const (
+	// DomainStrategyAsIs keeps the addresses in the order of the resolver.
+	DomainStrategyAsIs int32 = iota
+	// DomainStrategyUseIP prefers ipv4 addresses, then ipv6 ones.
+	DomainStrategyUseIP
+	DomainStrategyUseIPv4
+	DomainStrategyUseIPv6
+)
+
+type serverResolve struct {
+	strategy int32
+	// upstream is nil for the v2ray dns
+	upstream dnsUpstream
+}
+
+var serverResolves struct {
+	access sync.RWMutex
+	// byTag maps outbound tags, or * for all outbounds, to how their server
+	// addresses are resolved
+	byTag map[string]serverResolve
+}
+
+// SetServerResolve sets how the server hostnames of the outbound tag, or of
+// the outbounds without their own setting if tag is *, are resolved.
+// resolver is "local" (the platform resolver), "remote" or empty (the v2ray
+// dns, the default), "https+local://..." (direct DoH), "udp://ip:port" or
+// "tcp://ip:port". DoH through the proxy is refused since it needs the
+// server address being resolved. An empty tag clears all settings.
+func SetServerResolve(tag string, strategy int32, resolver string) error {
+	if tag == "" {
+		serverResolves.access.Lock()
+		serverResolves.byTag = nil
+		serverResolves.access.Unlock()
+		return nil
+	}
+	if strategy < DomainStrategyAsIs || strategy > DomainStrategyUseIPv6 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid domain strategy ", strategy))
+	}
+	upstream, err := parseDnsUpstream(resolver)
+	if err != nil {
+		return withCode(ErrorCodeInvalidArgument, err)
+	}
+	if doh, ok := upstream.(*dnsHTTPSUpstream); ok && !doh.local {
+		return withCode(ErrorCodeInvalidArgument, newError("doh through the proxy can not resolve servers, use https+local://"))
+	}
+	serverResolves.access.Lock()
+	defer serverResolves.access.Unlock()
+	if serverResolves.byTag == nil {
+		serverResolves.byTag = make(map[string]serverResolve)
+	}
+	serverResolves.byTag[tag] = serverResolve{strategy, upstream}
+	return nil
+}
+
+func serverResolveFromContext(ctx context.Context) (serverResolve, bool) {
+	serverResolves.access.RLock()
+	defer serverResolves.access.RUnlock()
+	if len(serverResolves.byTag) == 0 {
+		return serverResolve{}, false
+	}
+	if content := session.ContentFromContext(ctx); content != nil {
+		if resolve, ok := serverResolves.byTag[content.Attribute(outboundAttribute)]; ok {
+			return resolve, true
+		}
+	}
+	resolve, ok := serverResolves.byTag["*"]
+	return resolve, ok
+}
+
+// resolveServer resolves the server of an outbound connection, with the
+// default resolver of the dialer unless the outbound has its own.
+func (dialer protectedDialer) resolveServer(ctx context.Context, destination v2rayNet.Destination) ([]net.IP, error) {
+	domain := destination.Address.Domain()
+	resolve, ok := serverResolveFromContext(ctx)
+	if !ok {
+		return dialer.resolveDefault(ctx, destination, "ip")
+	}
+	network := "ip"
+	switch resolve.strategy {
+	case DomainStrategyUseIPv4:
+		network = "ip4"
+	case DomainStrategyUseIPv6:
+		network = "ip6"
+	}
+
+	var ips []net.IP
+	var err error
+	switch upstream := resolve.upstream.(type) {
+	case nil, dnsProxyUpstream:
+		ips, err = dialer.resolveDefault(ctx, destination, network)
+	case *dnsLocalUpstream:
+		var result *ResolveResult
+		result, ok, err = resolveLocal(ctx, network, domain)
+		if err == nil && !ok {
+			err = newError("no local resolver")
+		}
+		if err == nil {
+			ips, err = result.ips(), result.err()
+		}
+	default:
+		ips, err = exchangeLookup(ctx, nil, upstream, network, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resolve.strategy != DomainStrategyAsIs {
+		var ipv4, ipv6 []net.IP
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip)
+			} else {
+				ipv6 = append(ipv6, ip)
+			}
+		}
+		switch resolve.strategy {
+		case DomainStrategyUseIPv4:
+			ips = ipv4
+		case DomainStrategyUseIPv6:
+			ips = ipv6
+		default:
+			ips = append(ipv4, ipv6...)
+		}
+		if len(ips) == 0 {
+			return nil, dns.ErrEmptyResponse
+		}
+	}
+	return ips, nil
+}
+
+// resolveDefault resolves proxy and dns servers with the bootstrap dns if
+// set, falling back to the resolver of the dialer.
+func (dialer protectedDialer) resolveDefault(ctx context.Context, destination v2rayNet.Destination, network string) ([]net.IP, error) {
+	domain := destination.Address.Domain()
+	if isServerDial(ctx, destination) {
+		if ips, ok, err := lookupBootstrap(ctx, network, domain); ok && err == nil {
+			return ips, nil
+		}
+	}
+	return dialer.resolver(domain)
+}
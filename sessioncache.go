@@ -0,0 +1,241 @@
+package libcore
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	_ "unsafe"
+
+	_ "github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+)
+
+// v2rayTlsSessionCache is the client session cache shared by the tls configs
+// of v2ray, which has no option to set it.
+//
+//go:linkname v2rayTlsSessionCache github.com/v2fly/v2ray-core/v5/transport/internet/tls.globalSessionCache
+var v2rayTlsSessionCache tls.ClientSessionCache
+
+const (
+	tlsSessionCacheSize = 128
+	tlsSessionSaveDelay = 5 * time.Second
+)
+
+var tlsSessions = &tlsSessionStore{entries: make(map[string]*list.Element)}
+
+// tlsSessionStore replaces the session cache of v2ray with an lru cache of
+// the same size that is saved to a file, encrypted, a few seconds after it
+// changes.
+type tlsSessionStore struct {
+	access    sync.Mutex
+	installed bool
+	path      string
+	aead      cipher.AEAD
+	entries   map[string]*list.Element
+	order     list.List // of *tlsSessionEntry, the latest used first
+	saveTimer *time.Timer
+
+	writeAccess sync.Mutex
+}
+
+type tlsSessionEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+type savedTlsSession struct {
+	Key    string `json:"key"`
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// SetTlsSessionStore saves the tls sessions of the outbounds to path,
+// encrypted with a key derived from key, and loads the sessions saved there,
+// so connections after a restart resume them instead of a full handshake.
+// Only outbounds with session resumption enabled use them, quic ones save
+// their 0-RTT parameters along. It has to be called before the instance
+// starts, an empty path stops saving.
+func SetTlsSessionStore(path string, key []byte) error {
+	if path != "" && len(key) == 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("missing tls session store key"))
+	}
+	return tlsSessions.open(path, key)
+}
+
+// FlushTlsSessionStore saves the tls sessions now, e.g. before the process
+// is stopped.
+func FlushTlsSessionStore() error {
+	return tlsSessions.save()
+}
+
+func (s *tlsSessionStore) open(path string, key []byte) error {
+	var aead cipher.AEAD
+	if path != "" {
+		sum := sha256.Sum256(key)
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return exportError(err)
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return exportError(err)
+		}
+	}
+
+	s.access.Lock()
+	if !s.installed {
+		v2rayTlsSessionCache = s
+		s.installed = true
+	}
+	s.path = path
+	s.aead = aead
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+	s.access.Unlock()
+	if path == "" {
+		return nil
+	}
+	if !tlsSessionSaveSupported {
+		newError("tls sessions can't be saved by this build").AtWarning().WriteToLog()
+		return nil
+	}
+	s.load(path, aead)
+	return nil
+}
+
+// load adds the sessions saved at path, a file that can't be read or
+// decrypted, e.g. after the key changed, is ignored.
+func (s *tlsSessionStore) load(path string, aead cipher.AEAD) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			newError("failed to read tls sessions").Base(err).AtWarning().WriteToLog()
+		}
+		return
+	}
+	if len(content) < aead.NonceSize() {
+		newError("invalid tls session store ", path).AtWarning().WriteToLog()
+		return
+	}
+	nonce, sealed := content[:aead.NonceSize()], content[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		newError("failed to decrypt tls sessions, discarding them").Base(err).AtWarning().WriteToLog()
+		return
+	}
+	var saved []savedTlsSession
+	if err = json.Unmarshal(plain, &saved); err != nil {
+		newError("invalid tls session store ", path).Base(err).AtWarning().WriteToLog()
+		return
+	}
+
+	s.access.Lock()
+	defer s.access.Unlock()
+	// saved in lru order, the latest used first
+	for i := len(saved) - 1; i >= 0; i-- {
+		state, err := unmarshalTlsSession(saved[i].Ticket, saved[i].State)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.entries[saved[i].Key]; !ok {
+			s.put(saved[i].Key, state)
+		}
+	}
+}
+
+// Get implements tls.ClientSessionCache.
+func (s *tlsSessionStore) Get(key string) (*tls.ClientSessionState, bool) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*tlsSessionEntry).state, true
+}
+
+// Put implements tls.ClientSessionCache, a nil state removes the session.
+func (s *tlsSessionStore) Put(key string, state *tls.ClientSessionState) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if state == nil {
+		if element, ok := s.entries[key]; ok {
+			s.order.Remove(element)
+			delete(s.entries, key)
+		}
+	} else {
+		s.put(key, state)
+	}
+	if s.path != "" && tlsSessionSaveSupported && s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(tlsSessionSaveDelay, func() {
+			if err := s.save(); err != nil {
+				newError("failed to save tls sessions").Base(err).AtWarning().WriteToLog()
+			}
+		})
+	}
+}
+
+// put adds or updates a session, s.access must be held.
+func (s *tlsSessionStore) put(key string, state *tls.ClientSessionState) {
+	if element, ok := s.entries[key]; ok {
+		element.Value.(*tlsSessionEntry).state = state
+		s.order.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.order.PushFront(&tlsSessionEntry{key, state})
+	if s.order.Len() > tlsSessionCacheSize {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*tlsSessionEntry).key)
+	}
+}
+
+func (s *tlsSessionStore) save() error {
+	s.access.Lock()
+	s.saveTimer = nil
+	path, aead := s.path, s.aead
+	if path == "" || !tlsSessionSaveSupported {
+		s.access.Unlock()
+		return nil
+	}
+	saved := make([]savedTlsSession, 0, s.order.Len())
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*tlsSessionEntry)
+		ticket, state, err := marshalTlsSession(entry.state)
+		if err != nil {
+			continue
+		}
+		saved = append(saved, savedTlsSession{entry.key, ticket, state})
+	}
+	s.access.Unlock()
+
+	plain, err := json.Marshal(saved)
+	if err != nil {
+		return exportError(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return exportError(err)
+	}
+	content := aead.Seal(nonce, nonce, plain, nil)
+
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	temp := path + ".tmp"
+	if err = ioutil.WriteFile(temp, content, 0o600); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		return exportError(newError("failed to write tls sessions").Base(err))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+//go:build !go1.21
+// +build !go1.21
+
+package libcore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"reflect"
+	"time"
+	"unsafe"
+)
+
+// clientSessionState mirrors tls.ClientSessionState, whose fields can't be
+// read before go1.21, as qtls does. Sessions of quic outbounds are created
+// by qtls in the same layout.
+type clientSessionState struct {
+	sessionTicket      []uint8
+	vers               uint16
+	cipherSuite        uint16
+	masterSecret       []byte
+	serverCertificates []*x509.Certificate
+	verifiedChains     [][]*x509.Certificate
+	receivedAt         time.Time
+	ocspResponse       []byte
+	scts               [][]byte
+
+	nonce  []byte
+	useBy  time.Time
+	ageAdd uint32
+}
+
+// tlsSessionSaveSupported is whether the layout of tls.ClientSessionState
+// of this build matches clientSessionState.
+var tlsSessionSaveSupported = tlsSessionLayoutMatches()
+
+func tlsSessionLayoutMatches() bool {
+	actual := reflect.TypeOf(tls.ClientSessionState{})
+	mirror := reflect.TypeOf(clientSessionState{})
+	if actual.Size() != mirror.Size() || actual.NumField() != mirror.NumField() {
+		return false
+	}
+	for i := 0; i < actual.NumField(); i++ {
+		a, m := actual.Field(i), mirror.Field(i)
+		if a.Name != m.Name || a.Type != m.Type || a.Offset != m.Offset {
+			return false
+		}
+	}
+	return true
+}
+
+// savedSessionState is the state of a session besides its ticket, with the
+// certificates in DER.
+type savedSessionState struct {
+	Version            uint16     `json:"version"`
+	CipherSuite        uint16     `json:"cipher_suite"`
+	MasterSecret       []byte     `json:"master_secret"`
+	ServerCertificates [][]byte   `json:"server_certificates"`
+	VerifiedChains     [][][]byte `json:"verified_chains"`
+	ReceivedAt         time.Time  `json:"received_at"`
+	OcspResponse       []byte     `json:"ocsp_response,omitempty"`
+	Scts               [][]byte   `json:"scts,omitempty"`
+	Nonce              []byte     `json:"nonce,omitempty"`
+	UseBy              time.Time  `json:"use_by"`
+	AgeAdd             uint32     `json:"age_add"`
+}
+
+func marshalTlsSession(session *tls.ClientSessionState) (ticket []byte, state []byte, err error) {
+	if !tlsSessionSaveSupported {
+		return nil, nil, newError("tls sessions can't be saved by this build")
+	}
+	s := (*clientSessionState)(unsafe.Pointer(session))
+	if len(s.sessionTicket) == 0 {
+		return nil, nil, newError("empty tls session")
+	}
+	saved := savedSessionState{
+		Version:            s.vers,
+		CipherSuite:        s.cipherSuite,
+		MasterSecret:       s.masterSecret,
+		ServerCertificates: rawCertificates(s.serverCertificates),
+		ReceivedAt:         s.receivedAt,
+		OcspResponse:       s.ocspResponse,
+		Scts:               s.scts,
+		Nonce:              s.nonce,
+		UseBy:              s.useBy,
+		AgeAdd:             s.ageAdd,
+	}
+	for _, chain := range s.verifiedChains {
+		saved.VerifiedChains = append(saved.VerifiedChains, rawCertificates(chain))
+	}
+	state, err = json.Marshal(saved)
+	return s.sessionTicket, state, err
+}
+
+func unmarshalTlsSession(ticket []byte, state []byte) (*tls.ClientSessionState, error) {
+	if !tlsSessionSaveSupported {
+		return nil, newError("tls sessions can't be loaded by this build")
+	}
+	var saved savedSessionState
+	if err := json.Unmarshal(state, &saved); err != nil {
+		return nil, err
+	}
+	s := &clientSessionState{
+		sessionTicket: ticket,
+		vers:          saved.Version,
+		cipherSuite:   saved.CipherSuite,
+		masterSecret:  saved.MasterSecret,
+		receivedAt:    saved.ReceivedAt,
+		ocspResponse:  saved.OcspResponse,
+		scts:          saved.Scts,
+		nonce:         saved.Nonce,
+		useBy:         saved.UseBy,
+		ageAdd:        saved.AgeAdd,
+	}
+	var err error
+	if s.serverCertificates, err = parseCertificates(saved.ServerCertificates); err != nil {
+		return nil, err
+	}
+	for _, chain := range saved.VerifiedChains {
+		certificates, err := parseCertificates(chain)
+		if err != nil {
+			return nil, err
+		}
+		s.verifiedChains = append(s.verifiedChains, certificates)
+	}
+	return (*tls.ClientSessionState)(unsafe.Pointer(s)), nil
+}
+
+func rawCertificates(certificates []*x509.Certificate) [][]byte {
+	raw := make([][]byte, 0, len(certificates))
+	for _, certificate := range certificates {
+		raw = append(raw, certificate.Raw)
+	}
+	return raw
+}
+
+func parseCertificates(raw [][]byte) ([]*x509.Certificate, error) {
+	certificates := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
@@ -0,0 +1,28 @@
+//go:build go1.21
+// +build go1.21
+
+package libcore
+
+import "crypto/tls"
+
+const tlsSessionSaveSupported = true
+
+func marshalTlsSession(session *tls.ClientSessionState) (ticket []byte, state []byte, err error) {
+	ticket, sessionState, err := session.ResumptionState()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sessionState == nil {
+		return nil, nil, newError("empty tls session")
+	}
+	state, err = sessionState.Bytes()
+	return ticket, state, err
+}
+
+func unmarshalTlsSession(ticket []byte, state []byte) (*tls.ClientSessionState, error) {
+	sessionState, err := tls.ParseSessionState(state)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(ticket, sessionState)
+}
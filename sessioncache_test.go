@@ -0,0 +1,161 @@
+package libcore
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSessionServerName = "session.test"
+
+// newTestSessionStore returns a store that is not installed into v2ray.
+func newTestSessionStore(t *testing.T, path string, key []byte) *tlsSessionStore {
+	store := &tlsSessionStore{entries: make(map[string]*list.Element), installed: true}
+	if err := store.open(path, key); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// startSessionServer serves tls 1.3 with session tickets, writing a byte to
+// every client so they receive the tickets.
+func startSessionServer(t *testing.T) (address string, roots *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testSessionServerName},
+		DNSNames:     []string{testSessionServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(certificate)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte{1})
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return listener.Addr().String(), roots
+}
+
+// dialSession connects with cache and returns whether the session was
+// resumed.
+func dialSession(t *testing.T, address string, roots *x509.CertPool, cache tls.ClientSessionCache) bool {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         testSessionServerName,
+		RootCAs:            roots,
+		ClientSessionCache: cache,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the tickets arrive after the handshake
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+func TestTlsSessionStoreResumesAfterRestart(t *testing.T) {
+	if !tlsSessionSaveSupported {
+		t.Skip("tls sessions can't be saved by this build")
+	}
+	address, roots := startSessionServer(t)
+	path := filepath.Join(t.TempDir(), "sessions")
+	key := []byte("session store key")
+
+	store := newTestSessionStore(t, path, key)
+	if dialSession(t, address, roots, store) {
+		t.Fatal("first connection resumed")
+	}
+	if err := store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestSessionStore(t, path, key)
+	if restarted.order.Len() == 0 {
+		t.Fatal("no session was loaded")
+	}
+	if !dialSession(t, address, roots, restarted) {
+		t.Fatal("connection after the restart did not resume")
+	}
+}
+
+func TestTlsSessionStoreDiscardsWithOtherKey(t *testing.T) {
+	if !tlsSessionSaveSupported {
+		t.Skip("tls sessions can't be saved by this build")
+	}
+	address, roots := startSessionServer(t)
+	path := filepath.Join(t.TempDir(), "sessions")
+
+	store := newTestSessionStore(t, path, []byte("first key"))
+	dialSession(t, address, roots, store)
+	if err := store.save(); err != nil {
+		t.Fatal(err)
+	}
+	if other := newTestSessionStore(t, path, []byte("second key")); other.order.Len() != 0 {
+		t.Fatal("sessions were loaded with another key")
+	}
+}
+
+func TestTlsSessionStoreLru(t *testing.T) {
+	store := newTestSessionStore(t, "", nil)
+	for i := 0; i <= tlsSessionCacheSize; i++ {
+		store.Put(fmt.Sprint("server", i), new(tls.ClientSessionState))
+	}
+	if store.order.Len() != tlsSessionCacheSize {
+		t.Fatalf("%d sessions cached, want %d", store.order.Len(), tlsSessionCacheSize)
+	}
+	store.Put("kept", new(tls.ClientSessionState))
+	if _, ok := store.Get("kept"); !ok {
+		t.Fatal("latest session was evicted")
+	}
+	store.Put("kept", nil)
+	if _, ok := store.Get("kept"); ok {
+		t.Fatal("nil state did not remove the session")
+	}
+}
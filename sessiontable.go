@@ -0,0 +1,118 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionSweepInterval limits how often opening a session scans the table
+// for idle ones.
+const sessionSweepInterval = 10 * time.Second
+
+// sessionTable is the nat table of the udp and ping flows of the tun. The
+// first packet of a flow dials its session, packets of the flow arriving
+// meanwhile wait for the dial and are then written to the same session.
+// Sessions idle for longer than their timeout are closed by the table, by
+// the clock in now, which tests replace along with the dialer passed to open.
+// There is no timer, the table is swept when a session is opened, at most
+// every sessionSweepInterval, so idle sessions outlive their timeout until
+// the next flow starts.
+type sessionTable struct {
+	access    sync.Mutex
+	sessions  map[string]*tableSession
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tableSession struct {
+	// ready is closed once the dial has finished, conn and err are set
+	// before
+	ready      chan struct{}
+	conn       packetConn
+	err        error
+	timeout    time.Duration
+	lastActive time.Time
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[string]*tableSession), now: time.Now}
+}
+
+// sessionDialer dials the session of a flow and returns the idle timeout
+// after which the table closes it.
+type sessionDialer func() (conn packetConn, timeout time.Duration, err error)
+
+// open returns the session of key, dialing it if there is none. created is
+// only true for the caller that dialed, it owns the session and removes it
+// when done. Callers that waited for a failed dial get its error.
+func (t *sessionTable) open(key string, dial sessionDialer) (conn packetConn, created bool, err error) {
+	t.access.Lock()
+	now := t.now()
+	if now.Sub(t.lastSweep) > sessionSweepInterval {
+		t.sweep(now)
+	}
+	session, ok := t.sessions[key]
+	if ok {
+		session.lastActive = now
+		t.access.Unlock()
+		<-session.ready
+		return session.conn, false, session.err
+	}
+	session = &tableSession{ready: make(chan struct{}), lastActive: now}
+	t.sessions[key] = session
+	t.access.Unlock()
+
+	conn, timeout, err := dial()
+	t.access.Lock()
+	session.conn, session.timeout, session.err = conn, timeout, err
+	if err != nil && t.sessions[key] == session {
+		delete(t.sessions, key)
+	}
+	t.access.Unlock()
+	close(session.ready)
+	return conn, err == nil, err
+}
+
+// load returns the session of key if it has been dialed.
+func (t *sessionTable) load(key string) (packetConn, bool) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	session, ok := t.sessions[key]
+	if !ok || session.conn == nil {
+		return nil, false
+	}
+	session.lastActive = t.now()
+	return session.conn, true
+}
+
+// touch marks the session of key active, for replies.
+func (t *sessionTable) touch(key string) {
+	t.access.Lock()
+	if session, ok := t.sessions[key]; ok {
+		session.lastActive = t.now()
+	}
+	t.access.Unlock()
+}
+
+// remove deletes the session of key if it is still conn, a newer session of
+// the key is kept.
+func (t *sessionTable) remove(key string, conn packetConn) {
+	t.access.Lock()
+	if session, ok := t.sessions[key]; ok && session.conn == conn {
+		delete(t.sessions, key)
+	}
+	t.access.Unlock()
+}
+
+// sweep closes the idle sessions, their owners remove them once their reads
+// fail. Sessions still dialing are skipped.
+func (t *sessionTable) sweep(now time.Time) {
+	t.lastSweep = now
+	for key, session := range t.sessions {
+		if session.conn == nil || session.timeout <= 0 || now.Sub(session.lastActive) <= session.timeout {
+			continue
+		}
+		delete(t.sessions, key)
+		go session.conn.Close()
+	}
+}
@@ -0,0 +1,270 @@
+package libcore
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testPacketConn struct {
+	net.PacketConn
+	closed int32
+}
+
+func (c *testPacketConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *testPacketConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func (c *testPacketConn) readFrom() ([]byte, net.Addr, error) {
+	return nil, nil, errors.New("not implemented")
+}
+
+// testClock is the now of a table, advanced by the tests.
+type testClock struct {
+	access sync.Mutex
+	time   time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.time
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.access.Lock()
+	c.time = c.time.Add(d)
+	c.access.Unlock()
+}
+
+func newTestSessionTable() (*sessionTable, *testClock) {
+	clock := &testClock{time: time.Unix(1600000000, 0)}
+	table := newSessionTable()
+	table.now = clock.now
+	return table, clock
+}
+
+func dialTestConn(conn *testPacketConn, timeout time.Duration) sessionDialer {
+	return func() (packetConn, time.Duration, error) {
+		return conn, timeout, nil
+	}
+}
+
+// waitClosed waits for the close the sweep runs in a goroutine.
+func waitClosed(conn *testPacketConn) bool {
+	for i := 0; i < 100; i++ {
+		if conn.isClosed() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSessionTableReuse(t *testing.T) {
+	table, _ := newTestSessionTable()
+	conn := new(testPacketConn)
+	got, created, err := table.open("a", dialTestConn(conn, time.Minute))
+	if err != nil || !created || got != conn {
+		t.Fatalf("open = %v, %v, %v", got, created, err)
+	}
+	got, created, err = table.open("a", func() (packetConn, time.Duration, error) {
+		t.Fatal("dialed an existing session")
+		return nil, 0, nil
+	})
+	if err != nil || created || got != conn {
+		t.Fatalf("second open = %v, %v, %v", got, created, err)
+	}
+	if got, ok := table.load("a"); !ok || got != conn {
+		t.Fatal("load missed the session")
+	}
+}
+
+func TestSessionTableConcurrentFirstPacket(t *testing.T) {
+	table, _ := newTestSessionTable()
+	conn := new(testPacketConn)
+	release := make(chan struct{})
+	var dials int32
+	dial := func() (packetConn, time.Duration, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		return conn, time.Minute, nil
+	}
+
+	const packets = 16
+	var created int32
+	var wg sync.WaitGroup
+	wg.Add(packets)
+	for i := 0; i < packets; i++ {
+		go func() {
+			defer wg.Done()
+			got, isCreated, err := table.open("a", dial)
+			if err != nil || got != conn {
+				t.Errorf("open = %v, %v", got, err)
+			}
+			if isCreated {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	// packets arriving during the dial wait for it
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := table.load("a"); ok {
+		t.Error("load returned a session still dialing")
+	}
+	close(release)
+	wg.Wait()
+
+	if dials != 1 {
+		t.Errorf("dialed %d times", dials)
+	}
+	if created != 1 {
+		t.Errorf("%d callers own the session", created)
+	}
+}
+
+func TestSessionTableFailedDial(t *testing.T) {
+	table, _ := newTestSessionTable()
+	failure := errors.New("dial failed")
+	release := make(chan struct{})
+	dial := func() (packetConn, time.Duration, error) {
+		<-release
+		return nil, 0, failure
+	}
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, _, err := table.open("a", dial)
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, _, err := table.open("a", dial)
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-waiter; err != failure {
+			t.Fatalf("open error %v, want %v", err, failure)
+		}
+	}
+
+	conn := new(testPacketConn)
+	if _, created, err := table.open("a", dialTestConn(conn, time.Minute)); err != nil || !created {
+		t.Fatal("failed session was kept")
+	}
+}
+
+func TestSessionTableIdleTimeout(t *testing.T) {
+	table, clock := newTestSessionTable()
+	idle := new(testPacketConn)
+	active := new(testPacketConn)
+	if _, _, err := table.open("idle", dialTestConn(idle, 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.open("active", dialTestConn(active, 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(20 * time.Second)
+	table.touch("active")
+	clock.advance(20 * time.Second)
+
+	// the sweep only runs when a session is opened
+	if idle.isClosed() {
+		t.Fatal("swept without opening a session")
+	}
+	if _, _, err := table.open("other", dialTestConn(new(testPacketConn), 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(idle) {
+		t.Fatal("idle session was not closed")
+	}
+	if _, ok := table.load("idle"); ok {
+		t.Fatal("idle session was not removed")
+	}
+	if active.isClosed() {
+		t.Fatal("active session was closed")
+	}
+	if _, ok := table.load("active"); !ok {
+		t.Fatal("active session was removed")
+	}
+}
+
+func TestSessionTableSweepInterval(t *testing.T) {
+	table, clock := newTestSessionTable()
+	conn := new(testPacketConn)
+	if _, _, err := table.open("a", dialTestConn(conn, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Second)
+	// the first open swept at the start, the next sweep waits for the interval
+	if _, _, err := table.open("b", dialTestConn(new(testPacketConn), time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.isClosed() {
+		t.Fatal("swept before the interval")
+	}
+	clock.advance(sessionSweepInterval)
+	if _, _, err := table.open("c", dialTestConn(new(testPacketConn), time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(conn) {
+		t.Fatal("idle session was not closed after the interval")
+	}
+}
+
+func TestSessionTableEviction(t *testing.T) {
+	table, _ := newTestSessionTable()
+	first := new(testPacketConn)
+	second := new(testPacketConn)
+	if _, _, err := table.open("a", dialTestConn(first, time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	table.remove("a", first)
+	if _, created, err := table.open("a", dialTestConn(second, time.Minute)); err != nil || !created {
+		t.Fatal("removed session was reused")
+	}
+	// the owner of the previous session must not remove the newer one
+	table.remove("a", first)
+	if got, ok := table.load("a"); !ok || got != second {
+		t.Fatal("stale remove evicted the newer session")
+	}
+	table.remove("a", second)
+	if _, ok := table.load("a"); ok {
+		t.Fatal("session was not removed")
+	}
+}
+
+func TestSessionTableSweepSkipsDialing(t *testing.T) {
+	table, clock := newTestSessionTable()
+	release := make(chan struct{})
+	conn := new(testPacketConn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = table.open("a", func() (packetConn, time.Duration, error) {
+			<-release
+			return conn, time.Second, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	clock.advance(time.Minute)
+	if _, _, err := table.open("b", dialTestConn(new(testPacketConn), time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+	if got, ok := table.load("a"); !ok || got != conn {
+		t.Fatal("session still dialing was swept")
+	}
+}
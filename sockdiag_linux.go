@@ -0,0 +1,162 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockDiag looks up the owner of sockets with NETLINK_SOCK_DIAG, a single
+// request for the exact 4-tuple instead of a scan of /proc/net or a binder
+// call to the app. SELinux denies it to apps on recent Android, which the
+// probe finds out.
+type sockDiag struct {
+	access sync.Mutex
+	fd     int
+	seq    uint32
+
+	probeOnce sync.Once
+	supported bool
+}
+
+var kernelUids = &sockDiag{fd: -1}
+
+const (
+	sockDiagByFamily = 20
+	// the size of struct inet_diag_req_v2 and the offset of idiag_uid in
+	// struct inet_diag_msg
+	inetDiagRequestSize = 56
+	inetDiagUidOffset   = 64
+	sockDiagTimeout     = time.Second
+)
+
+// probe checks that the kernel answers a lookup of a socket of our own.
+func (d *sockDiag) probe() bool {
+	d.probeOnce.Do(func() {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer listener.Close()
+		conn, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		local := conn.LocalAddr().(*net.TCPAddr)
+		remote := conn.RemoteAddr().(*net.TCPAddr)
+		uid, err := d.lookup(false, false, local.IP, uint16(local.Port), remote.IP, uint16(remote.Port))
+		if err != nil {
+			newError("kernel uid lookup unavailable").Base(err).AtDebug().WriteToLog()
+			return
+		}
+		d.supported = int(uid) == os.Getuid()
+		if d.supported {
+			newError("using kernel uid lookup").AtDebug().WriteToLog()
+		}
+	})
+	return d.supported
+}
+
+// lookup returns the uid of the socket bound to source and sending to
+// destination. ipv4 sockets may be dual stack ones, found by the ipv4 mapped
+// addresses.
+func (d *sockDiag) lookup(ipv6 bool, udp bool, source net.IP, sourcePort uint16, destination net.IP, destinationPort uint16) (int32, error) {
+	if !ipv6 {
+		if uid, err := d.query(unix.AF_INET, udp, source.To4(), sourcePort, destination.To4(), destinationPort); err == nil {
+			return uid, nil
+		}
+	}
+	return d.query(unix.AF_INET6, udp, source.To16(), sourcePort, destination.To16(), destinationPort)
+}
+
+func (d *sockDiag) query(family uint8, udp bool, source net.IP, sourcePort uint16, destination net.IP, destinationPort uint16) (int32, error) {
+	if source == nil || destination == nil {
+		return -1, newError("invalid address")
+	}
+	protocol := uint8(unix.IPPROTO_TCP)
+	if udp {
+		protocol = unix.IPPROTO_UDP
+	}
+
+	d.access.Lock()
+	defer d.access.Unlock()
+	if d.fd < 0 {
+		fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+		if err != nil {
+			return -1, newError("open sock_diag").Base(err)
+		}
+		timeout := unix.NsecToTimeval(int64(sockDiagTimeout))
+		_ = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+		d.fd = fd
+	}
+	d.seq++
+
+	// netlink headers are in host byte order, little endian on every abi
+	// android supports
+	request := make([]byte, unix.SizeofNlMsghdr+inetDiagRequestSize)
+	binary.LittleEndian.PutUint32(request[0:], uint32(len(request)))
+	binary.LittleEndian.PutUint16(request[4:], sockDiagByFamily)
+	binary.LittleEndian.PutUint16(request[6:], unix.NLM_F_REQUEST)
+	binary.LittleEndian.PutUint32(request[8:], d.seq)
+	body := request[unix.SizeofNlMsghdr:]
+	body[0] = family
+	body[1] = protocol
+	binary.LittleEndian.PutUint32(body[4:], 0xFFFFFFFF)
+	// struct inet_diag_sockid, ports and addresses in network byte order
+	binary.BigEndian.PutUint16(body[8:], sourcePort)
+	binary.BigEndian.PutUint16(body[10:], destinationPort)
+	copy(body[12:28], source)
+	copy(body[28:44], destination)
+	// INET_DIAG_NOCOOKIE
+	binary.LittleEndian.PutUint64(body[48:], 0xFFFFFFFFFFFFFFFF)
+
+	if err := unix.Sendto(d.fd, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		d.reset()
+		return -1, newError("send sock_diag request").Base(err)
+	}
+	response := make([]byte, 4096)
+	for {
+		n, _, err := unix.Recvfrom(d.fd, response, 0)
+		if err != nil {
+			d.reset()
+			return -1, newError("read sock_diag response").Base(err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(response[:n])
+		if err != nil {
+			return -1, newError("invalid sock_diag response").Base(err)
+		}
+		for _, message := range messages {
+			if message.Header.Seq != d.seq {
+				// a late answer to a request that timed out
+				continue
+			}
+			switch message.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) >= 4 {
+					if errno := int32(binary.LittleEndian.Uint32(message.Data)); errno != 0 {
+						return -1, newError("sock_diag lookup failed").Base(unix.Errno(-errno))
+					}
+				}
+				return -1, newError("socket not found")
+			case sockDiagByFamily:
+				if len(message.Data) < inetDiagUidOffset+4 {
+					return -1, newError("invalid sock_diag response")
+				}
+				return int32(binary.LittleEndian.Uint32(message.Data[inetDiagUidOffset:])), nil
+			}
+		}
+	}
+}
+
+func (d *sockDiag) reset() {
+	if d.fd >= 0 {
+		unix.Close(d.fd)
+		d.fd = -1
+	}
+}
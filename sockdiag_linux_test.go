@@ -0,0 +1,80 @@
+package libcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+// failingUidDumper fails every lookup, so results come from the kernel.
+type failingUidDumper struct{}
+
+func (failingUidDumper) DumpUid(bool, bool, string, int32, string, int32) (int32, error) {
+	return -1, errors.New("no fallback")
+}
+
+func (failingUidDumper) GetUidInfo(int32) (*UidInfo, error) {
+	return nil, errors.New("no fallback")
+}
+
+// loopbackTCP returns the addresses of a connected loopback tcp socket of
+// this process.
+func loopbackTCP(t testing.TB, network, address string) (source, destination *net.TCPAddr) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+}
+
+func TestSockDiagUidDumper(t *testing.T) {
+	if !kernelUids.probe() {
+		t.Skip("sock_diag is not available")
+	}
+	dumper := NewSockDiagUidDumper(failingUidDumper{})
+	for _, test := range []struct {
+		network, address string
+		ipv6             bool
+	}{
+		{"tcp4", "127.0.0.1:0", false},
+		{"tcp6", "[::1]:0", true},
+	} {
+		source, destination := loopbackTCP(t, test.network, test.address)
+		uid, err := dumper.DumpUid(test.ipv6, false, source.IP.String(), int32(source.Port), destination.IP.String(), int32(destination.Port))
+		if err != nil {
+			t.Fatalf("%s: %v", test.network, err)
+		}
+		if uid != int32(os.Getuid()) {
+			t.Fatalf("%s: uid %d, want %d", test.network, uid, os.Getuid())
+		}
+	}
+}
+
+func TestSockDiagUidDumperFallback(t *testing.T) {
+	dumper := NewSockDiagUidDumper(failingUidDumper{})
+	// no socket uses port 1 of the documentation address
+	if _, err := dumper.DumpUid(false, false, "192.0.2.1", 1, "192.0.2.2", 1); err == nil {
+		t.Fatal("lookup of an unknown connection succeeded")
+	}
+}
+
+func BenchmarkSockDiagLookup(b *testing.B) {
+	if !kernelUids.probe() {
+		b.Skip("sock_diag is not available")
+	}
+	source, destination := loopbackTCP(b, "tcp4", "127.0.0.1:0")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := kernelUids.lookup(false, false, source.IP, uint16(source.Port), destination.IP, uint16(destination.Port)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
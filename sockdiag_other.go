@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+import "net"
+
+// sockDiag is only available on Linux.
+type sockDiag struct{}
+
+var kernelUids = &sockDiag{}
+
+func (d *sockDiag) probe() bool {
+	return false
+}
+
+func (d *sockDiag) lookup(ipv6 bool, udp bool, source net.IP, sourcePort uint16, destination net.IP, destinationPort uint16) (int32, error) {
+	return -1, newError("kernel uid lookup is not supported on this platform")
+}
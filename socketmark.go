@@ -0,0 +1,104 @@
+package libcore
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+var socketMarkAccess sync.RWMutex
+
+var (
+	socketMark          uint32
+	outboundSocketMarks map[string]uint32
+)
+
+// SetSocketMark sets SO_MARK on every protected socket, for policy routing
+// with ip rules on rooted devices. Zero disables it, setting a mark needs
+// CAP_NET_ADMIN.
+func SetSocketMark(mark int32) {
+	socketMarkAccess.Lock()
+	defer socketMarkAccess.Unlock()
+	socketMark = uint32(mark)
+}
+
+// SetOutboundSocketMarks sets "tag=mark" pairs, separated by commas or lines,
+// marking the sockets of the tagged outbounds instead of the global mark. It
+// applies to configurations loaded afterwards.
+func SetOutboundSocketMarks(marks string) error {
+	var parsed map[string]uint32
+	for _, pair := range splitRules(marks) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		index := strings.LastIndexByte(pair, '=')
+		if index <= 0 {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid socket mark ", pair))
+		}
+		mark, err := strconv.ParseUint(strings.TrimSpace(pair[index+1:]), 0, 32)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid socket mark ", pair).Base(err))
+		}
+		if parsed == nil {
+			parsed = make(map[string]uint32)
+		}
+		parsed[strings.TrimSpace(pair[:index])] = uint32(mark)
+	}
+	socketMarkAccess.Lock()
+	defer socketMarkAccess.Unlock()
+	outboundSocketMarks = parsed
+	return nil
+}
+
+// applyOutboundSocketMarks writes the per outbound marks into the socket
+// settings of the outbounds, which v2ray applies when dialing.
+func applyOutboundSocketMarks(config *core.Config) {
+	socketMarkAccess.RLock()
+	defer socketMarkAccess.RUnlock()
+	if len(outboundSocketMarks) == 0 {
+		return
+	}
+	for _, outbound := range config.Outbound {
+		mark, ok := outboundSocketMarks[outbound.Tag]
+		if !ok {
+			continue
+		}
+		sender := new(proxyman.SenderConfig)
+		if outbound.SenderSettings != nil {
+			instance, err := commonSerial.GetInstanceOf(outbound.SenderSettings)
+			if err != nil {
+				continue
+			}
+			if sender, ok = instance.(*proxyman.SenderConfig); !ok {
+				continue
+			}
+		}
+		if sender.StreamSettings == nil {
+			sender.StreamSettings = new(internet.StreamConfig)
+		}
+		if sender.StreamSettings.SocketSettings == nil {
+			sender.StreamSettings.SocketSettings = new(internet.SocketConfig)
+		}
+		sender.StreamSettings.SocketSettings.Mark = mark
+		outbound.SenderSettings = commonSerial.ToTypedMessage(sender)
+	}
+}
+
+func applySocketMark(fd int) {
+	socketMarkAccess.RLock()
+	mark := socketMark
+	socketMarkAccess.RUnlock()
+	if mark == 0 {
+		return
+	}
+	if err := setSocketMark(fd, mark); err != nil {
+		logrus.Warn("set socket mark: ", err)
+	}
+}
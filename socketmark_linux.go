@@ -0,0 +1,9 @@
+package libcore
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setSocketMark(fd int, mark uint32) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
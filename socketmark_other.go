@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+func setSocketMark(fd int, mark uint32) error {
+	return newError("socket marks are not supported on this platform")
+}
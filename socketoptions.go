@@ -0,0 +1,118 @@
+package libcore
+
+import (
+	"context"
+	"sync"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+)
+
+// SocketOptions are applied to the sockets of an outbound, options the
+// kernel or the platform do not support are skipped. tcp fast open and mptcp
+// are only supported on Linux.
+type SocketOptions struct {
+	// TcpFastOpen sends the first data in the syn of tcp connections.
+	TcpFastOpen bool
+	// Mptcp opens multipath tcp connections, falling back to tcp.
+	Mptcp     bool
+	ReuseAddr bool
+	// Ttl is the ttl or hop limit of the packets, zero keeps the default.
+	Ttl int32
+}
+
+type SocketCapabilities struct {
+	TcpFastOpen bool
+	Mptcp       bool
+}
+
+var socketOptions struct {
+	access sync.RWMutex
+	// byTag maps outbound tags, or * for all outbounds, to their options
+	byTag map[string]SocketOptions
+}
+
+var socketCapabilities struct {
+	once        sync.Once
+	tcpFastOpen bool
+	mptcp       bool
+}
+
+// SetOutboundSocketOptions sets the socket options of the outbound tag, or of
+// the outbounds without options of their own if tag is *. nil options
+// remove them.
+func SetOutboundSocketOptions(tag string, options *SocketOptions) error {
+	if tag == "" {
+		return withCode(ErrorCodeInvalidArgument, newError("missing outbound tag"))
+	}
+	if options != nil && (options.Ttl < 0 || options.Ttl > 255) {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid ttl ", options.Ttl))
+	}
+	socketOptions.access.Lock()
+	defer socketOptions.access.Unlock()
+	if options == nil {
+		delete(socketOptions.byTag, tag)
+		return nil
+	}
+	if socketOptions.byTag == nil {
+		socketOptions.byTag = make(map[string]SocketOptions)
+	}
+	socketOptions.byTag[tag] = *options
+	return nil
+}
+
+// GetSocketCapabilities reports the socket options the kernel supports.
+func GetSocketCapabilities() *SocketCapabilities {
+	probeSocketCapabilities()
+	return &SocketCapabilities{
+		TcpFastOpen: socketCapabilities.tcpFastOpen,
+		Mptcp:       socketCapabilities.mptcp,
+	}
+}
+
+func probeSocketCapabilities() {
+	socketCapabilities.once.Do(func() {
+		socketCapabilities.tcpFastOpen, socketCapabilities.mptcp = probeSocketOptions()
+		newError("socket capabilities: tfo ", socketCapabilities.tcpFastOpen, ", mptcp ", socketCapabilities.mptcp).AtDebug().WriteToLog()
+	})
+}
+
+// socketOptionsFromContext returns the options for the outbound of the
+// connection.
+func socketOptionsFromContext(ctx context.Context) (SocketOptions, bool) {
+	socketOptions.access.RLock()
+	defer socketOptions.access.RUnlock()
+	if len(socketOptions.byTag) == 0 {
+		return SocketOptions{}, false
+	}
+	if content := session.ContentFromContext(ctx); content != nil {
+		if options, ok := socketOptions.byTag[content.Attribute(outboundAttribute)]; ok {
+			return options, true
+		}
+	}
+	options, ok := socketOptions.byTag["*"]
+	return options, ok
+}
+
+// apply sets the options before the socket connects, failures are logged
+// and ignored.
+func (o SocketOptions) apply(fd int, network v2rayNet.Network, ipv6 bool) {
+	if o.ReuseAddr {
+		if err := setReuseAddr(fd); err != nil {
+			newError("set SO_REUSEADDR").Base(err).AtDebug().WriteToLog()
+		}
+	}
+	if o.TcpFastOpen && network == v2rayNet.Network_TCP {
+		probeSocketCapabilities()
+		if socketCapabilities.tcpFastOpen {
+			if err := setTcpFastOpenConnect(fd); err != nil {
+				newError("set TCP_FASTOPEN_CONNECT").Base(err).AtDebug().WriteToLog()
+			}
+		}
+	}
+	if o.Ttl > 0 {
+		if err := setTtl(fd, ipv6, int(o.Ttl)); err != nil {
+			newError("set ttl").Base(err).AtDebug().WriteToLog()
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package libcore
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ipprotoMptcp is IPPROTO_MPTCP of Linux 5.6, missing from x/sys/unix.
+const ipprotoMptcp = 262
+
+// probeSocketOptions reports whether the kernel supports tcp fast open and
+// mptcp.
+func probeSocketOptions() (tcpFastOpen bool, mptcp bool) {
+	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, ipprotoMptcp); err == nil {
+		mptcp = true
+		unix.Close(fd)
+	}
+	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP); err == nil {
+		tcpFastOpen = setTcpFastOpenConnect(fd) == nil
+		unix.Close(fd)
+	}
+	return
+}
+
+func openMptcpSocket(ipv6 bool) (int, error) {
+	af := unix.AF_INET
+	if ipv6 {
+		af = unix.AF_INET6
+	}
+	return unix.Socket(af, unix.SOCK_STREAM, ipprotoMptcp)
+}
+
+func setTcpFastOpenConnect(fd int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+// probeSocketOptions reports tcp fast open and mptcp as unsupported, the
+// options are skipped on this platform.
+func probeSocketOptions() (tcpFastOpen bool, mptcp bool) {
+	return false, false
+}
+
+func openMptcpSocket(ipv6 bool) (int, error) {
+	return -1, newError("mptcp is not supported on this platform")
+}
+
+func setTcpFastOpenConnect(fd int) error {
+	return newError("tcp fast open is not supported on this platform")
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+)
+
+// socket opens the socket of a connection, an mptcp one if requested and
+// supported.
+func (o SocketOptions) socket(network v2rayNet.Network, ipv6 bool) (int, error) {
+	if o.Mptcp && network == v2rayNet.Network_TCP {
+		probeSocketCapabilities()
+		if socketCapabilities.mptcp {
+			if fd, err := openMptcpSocket(ipv6); err == nil {
+				return fd, nil
+			}
+		}
+	}
+	return getFd(network, ipv6)
+}
+
+func setReuseAddr(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
+func setTtl(fd int, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+}
+
+// setTos sets the traffic class or type of service byte of the packets.
+func setTos(fd int, ipv6 bool, tos int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
+
+func setMulticastHops(fd int, ipv6 bool, hops int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, hops)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, hops)
+}
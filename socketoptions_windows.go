@@ -0,0 +1,34 @@
+package libcore
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// ipv6TClass is IPV6_TCLASS of ws2ipdef.h, missing from x/sys/windows.
+const ipv6TClass = 39
+
+func setReuseAddr(fd int) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+}
+
+func setTtl(fd int, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, windows.IPV6_UNICAST_HOPS, ttl)
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_TTL, ttl)
+}
+
+// setTos sets the traffic class or type of service byte of the packets.
+func setTos(fd int, ipv6 bool, tos int) error {
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, ipv6TClass, tos)
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_TOS, tos)
+}
+
+func setMulticastHops(fd int, ipv6 bool, hops int) error {
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, windows.IPV6_MULTICAST_HOPS, hops)
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_MULTICAST_TTL, hops)
+}
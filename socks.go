@@ -0,0 +1,586 @@
+package libcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/common/task"
+	"libcore/comm"
+)
+
+const (
+	socksVersion5        = 5
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksAuthUnavailable = 0xff
+
+	socksCommandConnect      = 1
+	socksCommandUdpAssociate = 3
+
+	socksAddressIPv4   = 1
+	socksAddressDomain = 3
+	socksAddressIPv6   = 4
+
+	socksReplySuccess             = 0
+	socksReplyFailure             = 1
+	socksReplyCommandUnsupported  = 7
+	socksReplyAddressUnsupported  = 8
+	socksFragmentEnd              = 0x80
+	socksHandshakeTimeout         = 30 * time.Second
+	socksUdpTimeout               = 5 * time.Minute
+	socksReassemblyTimeout        = 5 * time.Second
+	socksReassemblyMaxSize        = 65535
+	socksDefaultListen            = "127.0.0.1"
+	socksHttpProxyAuthenticate    = "Basic realm=\"libcore\""
+	socksHttpProxyAuthRequiredMsg = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: " + socksHttpProxyAuthenticate + "\r\nContent-Length: 0\r\n\r\n"
+)
+
+// SocksInboundConfig configures the mixed inbound for apps using the proxy
+// directly instead of the tun, it accepts socks5, with UDP ASSOCIATE, and http
+// proxy requests on the same port.
+type SocksInboundConfig struct {
+	// Listen is the local address, 127.0.0.1 if empty.
+	Listen string
+	Port   int32
+	Tag    string
+	// Username and Password are required from clients if set.
+	Username string
+	Password string
+	Sniff    bool
+}
+
+type socksInbound struct {
+	instance *V2RayInstance
+	config   SocksInboundConfig
+	listener net.Listener
+	done     chan struct{}
+	// forward is the fixed destination of a loopback bridge, which relays
+	// connections without a handshake if it is set.
+	forward v2rayNet.Destination
+}
+
+// StartSocksInbound listens on the configured port until StopSocksInbound or
+// Close, connections are routed with the inbound tag Tag.
+func (instance *V2RayInstance) StartSocksInbound(config *SocksInboundConfig) error {
+	if config == nil || config.Port <= 0 || config.Port > 65535 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid socks inbound port"))
+	}
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return withCode(ErrorCodeInvalidState, newError("not started"))
+	}
+	if instance.socksInbound != nil {
+		return withCode(ErrorCodeInvalidState, newError("socks inbound already started"))
+	}
+	listen := config.Listen
+	if listen == "" {
+		listen = socksDefaultListen
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(listen, strconv.Itoa(int(config.Port))))
+	if err != nil {
+		return exportError(newError("listen socks inbound").Base(err))
+	}
+	s := &socksInbound{instance: instance, config: *config, listener: listener, done: make(chan struct{})}
+	go s.loop()
+	instance.socksInbound = s
+	logrus.Info("socks inbound started at ", listener.Addr())
+	return nil
+}
+
+func (instance *V2RayInstance) StopSocksInbound() {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if instance.socksInbound != nil {
+		instance.socksInbound.close()
+		instance.socksInbound = nil
+	}
+}
+
+func (s *socksInbound) close() {
+	close(s.done)
+	comm.CloseIgnore(s.listener)
+}
+
+func (s *socksInbound) loop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				newError("socks inbound stopped").Base(err).AtWarning().WriteToLog()
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socksInbound) newContext(source v2rayNet.Destination) context.Context {
+	ctx := core.WithContext(context.Background(), s.instance.core)
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:      source,
+		Tag:         s.config.Tag,
+		NetworkType: networkType,
+		WifiSSID:    wifiSSID,
+	})
+	content := new(session.Content)
+	if s.config.Sniff {
+		content.SniffingRequest = session.SniffingRequest{Enabled: true, RouteOnly: true}
+	}
+	return session.ContextWithContent(ctx, content)
+}
+
+func (s *socksInbound) handle(conn net.Conn) {
+	defer comm.CloseIgnore(conn)
+	if s.forward.IsValid() {
+		if err := s.handleForward(conn); err != nil {
+			newError("[LOOPBACK] connection from ", conn.RemoteAddr(), " finished").Base(err).AtDebug().WriteToLog()
+		}
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if version[0] == socksVersion5 {
+		err = s.handleSocks(conn, reader)
+	} else {
+		err = s.handleHttp(conn, reader)
+	}
+	if err != nil {
+		newError("[SOCKS] connection from ", conn.RemoteAddr(), " finished").Base(err).AtDebug().WriteToLog()
+	}
+}
+
+func (s *socksInbound) handleSocks(conn net.Conn, reader *bufio.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	method := byte(socksAuthNone)
+	if s.config.Username != "" {
+		method = socksAuthPassword
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		_, _ = conn.Write([]byte{socksVersion5, socksAuthUnavailable})
+		return newError("no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return err
+	}
+	if method == socksAuthPassword {
+		if err := s.authenticate(conn, reader); err != nil {
+			return err
+		}
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return err
+	}
+	destination, err := readSocksAddress(reader)
+	if err != nil {
+		s.reply(conn, socksReplyAddressUnsupported, nil)
+		return err
+	}
+	source := v2rayNet.DestinationFromAddr(conn.RemoteAddr())
+	switch request[1] {
+	case socksCommandConnect:
+		destination.Network = v2rayNet.Network_TCP
+		return s.handleConnect(conn, reader, source, destination)
+	case socksCommandUdpAssociate:
+		return s.handleAssociate(conn, reader, source, destination)
+	}
+	s.reply(conn, socksReplyCommandUnsupported, nil)
+	return newError("unsupported command ", request[1])
+}
+
+// authenticate reads a username/password request of RFC 1929.
+func (s *socksInbound) authenticate(conn net.Conn, reader *bufio.Reader) error {
+	readField := func() (string, error) {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, length)
+		_, err = io.ReadFull(reader, field)
+		return string(field), err
+	}
+	if _, err := reader.ReadByte(); err != nil {
+		return err
+	}
+	username, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+	if username != s.config.Username || password != s.config.Password {
+		_, _ = conn.Write([]byte{1, 1})
+		return newError("invalid credentials for ", username)
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+func (s *socksInbound) reply(conn net.Conn, code byte, bound net.Addr) {
+	address := v2rayNet.AnyIP
+	var port v2rayNet.Port
+	if bound != nil {
+		destination := v2rayNet.DestinationFromAddr(bound)
+		address, port = destination.Address, destination.Port
+	}
+	response := []byte{socksVersion5, code, 0}
+	response = appendSocksAddress(response, v2rayNet.Destination{Address: address, Port: port})
+	_, _ = conn.Write(response)
+}
+
+func (s *socksInbound) handleConnect(conn net.Conn, reader *bufio.Reader, source, destination v2rayNet.Destination) error {
+	ctx := s.newContext(source)
+	link, err := s.instance.dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		s.reply(conn, socksReplyFailure, nil)
+		return newError("dispatch failed").Base(err)
+	}
+	s.reply(conn, socksReplySuccess, nil)
+	_ = conn.SetDeadline(time.Time{})
+	return s.relay(ctx, conn, reader, link.Reader, link.Writer)
+}
+
+func (s *socksInbound) relay(ctx context.Context, conn net.Conn, reader io.Reader, linkReader buf.Reader, linkWriter buf.Writer) error {
+	requestDone := func() error {
+		return buf.Copy(buf.NewReader(reader), linkWriter)
+	}
+	responseDone := func() error {
+		return buf.Copy(linkReader, buf.NewWriter(conn))
+	}
+	if err := task.Run(ctx, task.OnSuccess(requestDone, task.Close(linkWriter)), responseDone); err != nil {
+		common.Interrupt(linkReader)
+		common.Interrupt(linkWriter)
+		return err
+	}
+	return nil
+}
+
+// socksAssociation relays the datagrams of one UDP ASSOCIATE request, it ends
+// with the control connection.
+type socksAssociation struct {
+	inbound *socksInbound
+	relay   *net.UDPConn
+	ctx     context.Context
+
+	access      sync.Mutex
+	client      *net.UDPAddr
+	conn        *dispatcherConn
+	destination v2rayNet.Destination
+
+	// fragments being reassembled, see section 7 of RFC 1928
+	fragments   []byte
+	fragment    byte
+	fragmentTo  v2rayNet.Destination
+	fragmentsAt time.Time
+}
+
+func (s *socksInbound) handleAssociate(conn net.Conn, reader *bufio.Reader, source, expected v2rayNet.Destination) error {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		s.reply(conn, socksReplyFailure, nil)
+		return newError("listen udp relay").Base(err)
+	}
+	defer comm.CloseIgnore(relay)
+	association := &socksAssociation{inbound: s, relay: relay, ctx: s.newContext(source)}
+	// clients may announce the address they send from
+	if expected.Address.Family().IsIP() && !expected.Address.IP().IsUnspecified() && expected.Port != 0 {
+		association.client = &net.UDPAddr{IP: expected.Address.IP(), Port: int(expected.Port)}
+	}
+	s.reply(conn, socksReplySuccess, relay.LocalAddr())
+	_ = conn.SetDeadline(time.Time{})
+	go association.loop()
+	defer association.close()
+
+	// the association lasts until the control connection is closed
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+func (a *socksAssociation) close() {
+	a.access.Lock()
+	defer a.access.Unlock()
+	if a.conn != nil {
+		comm.CloseIgnore(a.conn)
+	}
+}
+
+func (a *socksAssociation) loop() {
+	buffer := make([]byte, 65535)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		a.access.Lock()
+		if a.client == nil {
+			a.client = from
+		} else if !a.client.IP.Equal(from.IP) || a.client.Port != from.Port {
+			a.access.Unlock()
+			continue
+		}
+		a.access.Unlock()
+		if err = a.handlePacket(buffer[:n]); err != nil {
+			newError("[SOCKS] dropped udp packet from ", from).Base(err).AtDebug().WriteToLog()
+		}
+	}
+}
+
+func (a *socksAssociation) handlePacket(packet []byte) error {
+	if len(packet) < 4 {
+		return newError("short packet")
+	}
+	fragment := packet[2]
+	reader := bytes.NewReader(packet[3:])
+	destination, err := readSocksAddress(reader)
+	if err != nil {
+		return err
+	}
+	destination.Network = v2rayNet.Network_UDP
+	payload := packet[len(packet)-reader.Len():]
+
+	a.access.Lock()
+	if fragment == 0 {
+		// a standalone datagram abandons the reassembly
+		a.fragments = nil
+		a.fragment = 0
+		a.access.Unlock()
+		return a.write(destination, payload)
+	}
+	position := fragment &^ socksFragmentEnd
+	if a.fragments != nil && (position <= a.fragment || time.Since(a.fragmentsAt) > socksReassemblyTimeout) {
+		a.fragments = nil
+	}
+	if a.fragments == nil {
+		a.fragmentTo = destination
+		a.fragmentsAt = time.Now()
+		a.fragments = make([]byte, 0, len(payload))
+	}
+	a.fragment = position
+	if len(a.fragments)+len(payload) > socksReassemblyMaxSize {
+		a.fragments = nil
+		a.fragment = 0
+		a.access.Unlock()
+		return newError("reassembled datagram too large")
+	}
+	a.fragments = append(a.fragments, payload...)
+	if fragment&socksFragmentEnd == 0 {
+		a.access.Unlock()
+		return nil
+	}
+	datagram, to := a.fragments, a.fragmentTo
+	a.fragments = nil
+	a.fragment = 0
+	a.access.Unlock()
+	return a.write(to, datagram)
+}
+
+func (a *socksAssociation) write(destination v2rayNet.Destination, payload []byte) error {
+	a.access.Lock()
+	conn := a.conn
+	if conn == nil {
+		packetConn, err := a.inbound.instance.dialUDP(a.ctx, destination, socksUdpTimeout)
+		if err != nil {
+			a.access.Unlock()
+			return newError("dial udp failed").Base(err)
+		}
+		conn = packetConn.(*dispatcherConn)
+		a.conn = conn
+		a.destination = destination
+		go a.readReplies(conn)
+	}
+	a.access.Unlock()
+	// the payload is released by the link, it must not alias the read buffer
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	_, err := conn.writeToDestination(data, destination)
+	return err
+}
+
+func (a *socksAssociation) readReplies(conn *dispatcherConn) {
+	defer func() {
+		a.access.Lock()
+		if a.conn == conn {
+			a.conn = nil
+		}
+		a.access.Unlock()
+		comm.CloseIgnore(conn)
+	}()
+	for {
+		payload, addr, err := conn.readFrom()
+		if err != nil {
+			return
+		}
+		from := v2rayNet.DestinationFromAddr(addr)
+		a.access.Lock()
+		client := a.client
+		if from.Address == nil || from.Address.IP() == nil {
+			from = a.destination
+		}
+		a.access.Unlock()
+		packet := appendSocksAddress([]byte{0, 0, 0}, from)
+		packet = append(packet, payload...)
+		if _, err = a.relay.WriteToUDP(packet, client); err != nil {
+			return
+		}
+	}
+}
+
+type socksReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readSocksAddress(reader socksReader) (v2rayNet.Destination, error) {
+	var destination v2rayNet.Destination
+	addressType, err := reader.ReadByte()
+	if err != nil {
+		return destination, err
+	}
+	var address []byte
+	switch addressType {
+	case socksAddressIPv4:
+		address = make([]byte, 4)
+	case socksAddressIPv6:
+		address = make([]byte, 16)
+	case socksAddressDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return destination, err
+		}
+		address = make([]byte, length)
+	default:
+		return destination, newError("unknown address type ", addressType)
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(reader, address); err != nil {
+		return destination, err
+	}
+	if _, err = io.ReadFull(reader, port); err != nil {
+		return destination, err
+	}
+	if addressType == socksAddressDomain {
+		destination.Address = v2rayNet.ParseAddress(string(address))
+	} else {
+		destination.Address = v2rayNet.IPAddress(address)
+	}
+	destination.Port = v2rayNet.Port(binary.BigEndian.Uint16(port))
+	return destination, nil
+}
+
+func appendSocksAddress(b []byte, destination v2rayNet.Destination) []byte {
+	switch destination.Address.Family() {
+	case v2rayNet.AddressFamilyIPv4:
+		b = append(b, socksAddressIPv4)
+		b = append(b, destination.Address.IP().To4()...)
+	case v2rayNet.AddressFamilyIPv6:
+		b = append(b, socksAddressIPv6)
+		b = append(b, destination.Address.IP().To16()...)
+	default:
+		domain := destination.Address.Domain()
+		b = append(b, socksAddressDomain, byte(len(domain)))
+		b = append(b, domain...)
+	}
+	return append(b, byte(destination.Port>>8), byte(destination.Port))
+}
+
+// handleHttp serves CONNECT and absolute form http proxy requests, the
+// connection is relayed as is after the first request.
+func (s *socksInbound) handleHttp(conn net.Conn, reader *bufio.Reader) error {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	if s.config.Username != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.config.Username+":"+s.config.Password))
+		if request.Header.Get("Proxy-Authorization") != expected {
+			_, _ = io.WriteString(conn, socksHttpProxyAuthRequiredMsg)
+			return newError("http proxy authentication required")
+		}
+	}
+	host := request.Host
+	if request.Method != http.MethodConnect && request.URL.Host != "" {
+		host = request.URL.Host
+	}
+	if _, _, err = net.SplitHostPort(host); err != nil {
+		if request.Method == http.MethodConnect || request.URL.Scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	destination, err := v2rayNet.ParseDestination("tcp:" + host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return newError("invalid http proxy host ", host).Base(err)
+	}
+
+	ctx := s.newContext(v2rayNet.DestinationFromAddr(conn.RemoteAddr()))
+	link, err := s.instance.dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return newError("dispatch failed").Base(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if request.Method == http.MethodConnect {
+		if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			common.Interrupt(link.Writer)
+			return err
+		}
+	} else {
+		request.Header.Del("Proxy-Authorization")
+		request.Header.Del("Proxy-Connection")
+		// later requests on the connection would reach the same server
+		request.Close = true
+		request.Header.Set("Connection", "close")
+		request.RequestURI = ""
+		writer := buf.NewBufferedWriter(link.Writer)
+		if err = request.Write(writer); err == nil {
+			err = writer.SetBuffered(false)
+		}
+		if err != nil {
+			common.Interrupt(link.Writer)
+			return err
+		}
+	}
+	return s.relay(ctx, conn, reader, link.Reader, link.Writer)
+}
@@ -0,0 +1,110 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+// outboundAttribute carries the outbound a connection is routed to in the
+// session content, for the dialer to pick its source binding.
+const outboundAttribute = "libcore.outbound"
+
+var sourceBindings struct {
+	access sync.RWMutex
+	// byTag maps outbound tags, or * for all outbounds, to a local address
+	// or an interface name
+	byTag map[string]string
+}
+
+// SetSourceBindings binds the sockets of outbounds to a local address or to
+// the address of an interface, for devices with several upstreams like usb
+// tethering and Wi-Fi, given as "tag=address" or "tag=interface" pairs
+// separated by commas or lines. The tag * applies to the outbounds without a
+// binding of their own. The sendThrough address of an outbound is used if it
+// has no binding.
+func SetSourceBindings(bindings string) error {
+	var parsed map[string]string
+	for _, pair := range splitRules(bindings) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		index := strings.IndexByte(pair, '=')
+		if index <= 0 || strings.TrimSpace(pair[index+1:]) == "" {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid source binding ", pair))
+		}
+		if parsed == nil {
+			parsed = make(map[string]string)
+		}
+		parsed[strings.TrimSpace(pair[:index])] = strings.TrimSpace(pair[index+1:])
+	}
+	sourceBindings.access.Lock()
+	sourceBindings.byTag = parsed
+	sourceBindings.access.Unlock()
+	return nil
+}
+
+// setRouteOutbound records the outbound of a routed connection, the
+// attributes of the routing context are those of the session content.
+func setRouteOutbound(ctx routing.Context, route routing.Route) {
+	if attributes := ctx.GetAttributes(); attributes != nil && route != nil {
+		attributes[outboundAttribute] = route.GetOutboundTag()
+	}
+}
+
+// sourceBindingFromContext returns the binding for the outbound of the
+// connection, empty if none.
+func sourceBindingFromContext(ctx context.Context) string {
+	sourceBindings.access.RLock()
+	defer sourceBindings.access.RUnlock()
+	if len(sourceBindings.byTag) == 0 {
+		return ""
+	}
+	if content := session.ContentFromContext(ctx); content != nil {
+		if binding, ok := sourceBindings.byTag[content.Attribute(outboundAttribute)]; ok {
+			return binding
+		}
+	}
+	return sourceBindings.byTag["*"]
+}
+
+// sourceAddress returns the address of binding, or the sendThrough address
+// source if there is no binding, nil if the socket is left unbound. Addresses
+// of the other family are skipped.
+func sourceAddress(ipv6 bool, source v2rayNet.Address, binding string) (net.IP, error) {
+	var ip net.IP
+	if binding != "" {
+		ip = net.ParseIP(binding)
+		if ip == nil {
+			iface, err := net.InterfaceByName(binding)
+			if err != nil {
+				return nil, newError("source interface ", binding).Base(err)
+			}
+			addresses, err := iface.Addrs()
+			if err != nil {
+				return nil, newError("addresses of ", binding).Base(err)
+			}
+			for _, address := range addresses {
+				if network, ok := address.(*net.IPNet); ok && (network.IP.To4() == nil) == ipv6 && !network.IP.IsLinkLocalUnicast() {
+					ip = network.IP
+					break
+				}
+			}
+			if ip == nil {
+				return nil, newError("no usable address on ", binding)
+			}
+		}
+	} else if source != nil && source.Family().IsIP() {
+		ip = source.IP()
+	}
+	if ip == nil || ip.IsUnspecified() || (ip.To4() == nil) != ipv6 {
+		return nil, nil
+	}
+	return ip, nil
+}
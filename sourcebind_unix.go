@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package libcore
+
+import (
+	"net"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+)
+
+// bindSource binds a socket to its source address, see sourceAddress.
+func bindSource(fd int, ipv6 bool, source v2rayNet.Address, binding string) error {
+	ip, err := sourceAddress(ipv6, source, binding)
+	if err != nil || ip == nil {
+		return err
+	}
+	if err = bindAddress(fd, ip); err != nil {
+		return newError("bind to ", ip).Base(err)
+	}
+	return nil
+}
+
+func bindAddress(fd int, ip net.IP) error {
+	var sockaddr unix.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		address := &unix.SockaddrInet4{}
+		copy(address.Addr[:], ip4)
+		sockaddr = address
+	} else {
+		address := &unix.SockaddrInet6{}
+		copy(address.Addr[:], ip.To16())
+		sockaddr = address
+	}
+	return unix.Bind(fd, sockaddr)
+}
@@ -0,0 +1,70 @@
+package libcore
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// speedSmoothing is the time constant of the moving average.
+const speedSmoothing = 2 * time.Second
+
+type SpeedSample struct {
+	// Uplink and Downlink are in bytes per second.
+	Uplink   int64
+	Downlink int64
+}
+
+// speedSampler computes smoothed rates from monotonic counters fed by the
+// stats connections, so resetting app stats does not affect it.
+type speedSampler struct {
+	uplink   uint64
+	downlink uint64
+
+	access       sync.Mutex
+	lastSample   time.Time
+	lastUplink   uint64
+	lastDownlink uint64
+	uplinkRate   float64
+	downlinkRate float64
+}
+
+func (s *speedSampler) sample() *SpeedSample {
+	uplink := atomic.LoadUint64(&s.uplink)
+	downlink := atomic.LoadUint64(&s.downlink)
+	now := time.Now()
+
+	s.access.Lock()
+	defer s.access.Unlock()
+	if !s.lastSample.IsZero() {
+		elapsed := now.Sub(s.lastSample)
+		if elapsed <= 0 {
+			return s.export()
+		}
+		// the weight depends on the elapsed time, so irregular polling
+		// still converges to the same average
+		alpha := 1 - math.Exp(-float64(elapsed)/float64(speedSmoothing))
+		seconds := elapsed.Seconds()
+		s.uplinkRate += alpha * (float64(uplink-s.lastUplink)/seconds - s.uplinkRate)
+		s.downlinkRate += alpha * (float64(downlink-s.lastDownlink)/seconds - s.downlinkRate)
+	}
+	s.lastSample = now
+	s.lastUplink = uplink
+	s.lastDownlink = downlink
+	return s.export()
+}
+
+func (s *speedSampler) export() *SpeedSample {
+	return &SpeedSample{
+		Uplink:   int64(math.Round(s.uplinkRate)),
+		Downlink: int64(math.Round(s.downlinkRate)),
+	}
+}
+
+// GetSpeedSample returns the current total rates, smoothed with an
+// exponential moving average. The first call only starts sampling. Requires
+// traffic stats.
+func (t *Tun2ray) GetSpeedSample() *SpeedSample {
+	return t.speed.sample()
+}
@@ -0,0 +1,167 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+)
+
+const (
+	startReadyDefaultTimeout = 5 * time.Second
+	startReadyRetryInterval  = 200 * time.Millisecond
+)
+
+// StartSequence is what StartAll starts, in order.
+type StartSequence struct {
+	Instance *V2RayInstance
+	Tun      *TunConfig
+	// WaitOutbounds are the tags of the outbounds, separated by commas, whose
+	// server must accept a tcp connection before the tun is attached. Empty
+	// waits for the default outbound.
+	WaitOutbounds string
+	// PreResolve resolves the server addresses of all outbounds before the
+	// tun is attached, so the first connections do not wait on dns.
+	PreResolve bool
+	// ReadyTimeoutMs bounds the wait for the outbounds, the tun is attached
+	// anyway once it passes. Zero is 5 seconds.
+	ReadyTimeoutMs int32
+}
+
+// StartAll starts the instance if it is not started, waits for the outbounds
+// of the sequence to become ready, then attaches the tun, instead of letting
+// the first connections fail while the servers are still being resolved and
+// connected during the service start.
+func StartAll(sequence *StartSequence) (*Tun2ray, error) {
+	if sequence == nil || sequence.Instance == nil || sequence.Tun == nil {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("missing instance or tun"))
+	}
+	instance := sequence.Instance
+	if sequence.Tun.V2Ray == nil {
+		sequence.Tun.V2Ray = instance
+	} else if sequence.Tun.V2Ray != instance {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("tun attached to another instance"))
+	}
+
+	instance.access.Lock()
+	started := instance.started
+	instance.access.Unlock()
+	if !started {
+		if err := instance.Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := startReadyDefaultTimeout
+	if sequence.ReadyTimeoutMs > 0 {
+		timeout = time.Duration(sequence.ReadyTimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	start := time.Now()
+	err := instance.waitReady(ctx, sequence)
+	cancel()
+	if err != nil {
+		newError("outbounds not ready after ", time.Since(start), ", attaching the tun anyway").Base(err).AtWarning().WriteToLog()
+	} else {
+		newError("outbounds ready after ", time.Since(start)).AtInfo().WriteToLog()
+	}
+
+	return NewTun2ray(sequence.Tun)
+}
+
+// waitReady pre-resolves the servers if requested, then retries connecting
+// to the servers of the waited outbounds until all of them accepted once.
+func (instance *V2RayInstance) waitReady(ctx context.Context, sequence *StartSequence) error {
+	instance.access.Lock()
+	config := instance.config
+	dnsClient := instance.dnsClient
+	instance.access.Unlock()
+	if config == nil {
+		return newError("not initialized")
+	}
+
+	// the tun may already be up, the sockets are protected as the tun will
+	// protect them
+	protector := sequence.Tun.Protector
+	if !sequence.Tun.Protect {
+		protector = noopProtectorInstance
+	} else if sequence.Tun.ProtectorV2 != nil {
+		protector = newProtectBatcher(sequence.Tun.ProtectorV2)
+	} else if protector == nil {
+		protector = noopProtectorInstance
+	}
+	dialer := protectedDialer{
+		protector: protector,
+		resolver: func(domain string) ([]net.IP, error) {
+			return dnsClient.LookupIP(domain)
+		},
+	}
+
+	servers := make(map[string]v2rayNet.Destination)
+	for _, outbound := range config.Outbound {
+		if server, ok := outboundServer(outbound); ok {
+			servers[outbound.Tag] = server
+		}
+	}
+
+	if sequence.PreResolve {
+		for tag, server := range servers {
+			if !server.Address.Family().IsDomain() {
+				continue
+			}
+			if _, err := dialer.resolveServer(ctx, server); err != nil {
+				newError("failed to pre-resolve ", server.Address, " of ", tag).Base(err).AtWarning().WriteToLog()
+			}
+		}
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(sequence.WaitOutbounds, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 && len(config.Outbound) > 0 {
+		tags = append(tags, config.Outbound[0].Tag)
+	}
+
+	for _, tag := range tags {
+		server, ok := servers[tag]
+		if !ok {
+			// freedom, blackhole and the like are ready as soon as started
+			continue
+		}
+		for {
+			conn, err := dialer.Dial(ctx, nil, server, nil)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			newError("server ", server.NetAddr(), " of ", tag, " not ready").Base(err).AtDebug().WriteToLog()
+			select {
+			case <-ctx.Done():
+				return newError("server ", server.NetAddr(), " of ", tag).Base(err)
+			case <-time.After(startReadyRetryInterval):
+			}
+		}
+	}
+	return nil
+}
+
+// outboundServer returns the server endpoint of an outbound, ok is false for
+// the outbounds without a server.
+func outboundServer(outbound *core.OutboundHandlerConfig) (v2rayNet.Destination, bool) {
+	if outbound.ProxySettings == nil {
+		return v2rayNet.Destination{}, false
+	}
+	proxySettings, err := commonSerial.GetInstanceOf(outbound.ProxySettings)
+	if err != nil {
+		return v2rayNet.Destination{}, false
+	}
+	return findServerEndpoint(proto.MessageReflect(proxySettings))
+}
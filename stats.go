@@ -8,6 +8,7 @@ import (
 
 type AppStats struct {
 	Uid          int32
+	UserId       int32
 	TcpConn      int32
 	UdpConn      int32
 	TcpConnTotal int32
@@ -18,6 +19,9 @@ type AppStats struct {
 	UplinkTotal   int64
 	DownlinkTotal int64
 
+	DnsBlocked      int64
+	DnsBlockedTotal int64
+
 	DeactivateAt int32
 }
 
@@ -34,9 +38,35 @@ type appStats struct {
 	uplinkTotal   uint64
 	downlinkTotal uint64
 
+	dnsBlocked      uint64
+	dnsBlockedTotal uint64
+
 	deactivateAt int64
 }
 
+func (t *Tun2ray) getAppStats(uid uint32) *appStats {
+	if iStats, exists := t.appStats.Load(uid); exists {
+		return iStats.(*appStats)
+	}
+	iCond, loaded := t.lockTable.LoadOrStore(uid, sync.NewCond(&sync.Mutex{}))
+	cond := iCond.(*sync.Cond)
+	if loaded {
+		cond.L.Lock()
+		defer cond.L.Unlock()
+		cond.Wait()
+		iStats, exists := t.appStats.Load(uid)
+		if !exists {
+			panic("unexpected sync read failed")
+		}
+		return iStats.(*appStats)
+	}
+	stats := &appStats{}
+	t.appStats.Store(uid, stats)
+	t.lockTable.Delete(uid)
+	cond.Broadcast()
+	return stats
+}
+
 type TrafficListener interface {
 	UpdateStats(t *AppStats)
 }
@@ -50,9 +80,9 @@ func (t *Tun2ray) ResetAppTraffics() {
 		return
 	}
 
-	var toDel []uint16
+	var toDel []uint32
 	t.appStats.Range(func(key, value interface{}) bool {
-		uid := key.(uint16)
+		uid := key.(uint32)
 		toDel = append(toDel, uid)
 
 		stats := value.(*appStats)
@@ -62,6 +92,8 @@ func (t *Tun2ray) ResetAppTraffics() {
 	for _, uid := range toDel {
 		t.appStats.Delete(uid)
 	}
+	t.domainStats.reset()
+	t.dnsQueries.reset()
 }
 
 func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
@@ -69,13 +101,42 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 		return nil
 	}
 
+	for _, stat := range t.collectAppStats(nil) {
+		listener.UpdateStats(stat)
+	}
+
+	return nil
+}
+
+// ReadUserTraffics is ReadAppTraffics for the apps of one android user.
+func (t *Tun2ray) ReadUserTraffics(userId int32, listener TrafficListener) error {
+	if !t.trafficStats {
+		return nil
+	}
+
+	for _, stat := range t.collectAppStats(func(uid uint32) bool {
+		return GetUserId(int32(uid)) == userId
+	}) {
+		listener.UpdateStats(stat)
+	}
+
+	return nil
+}
+
+// collectAppStats exports the stats of the apps accepted by filter, or all
+// apps if it is nil, moving the pending deltas into the totals.
+func (t *Tun2ray) collectAppStats(filter func(uid uint32) bool) []*AppStats {
 	var stats []*AppStats
 
 	t.appStats.Range(func(key, value interface{}) bool {
-		uid := key.(uint16)
+		uid := key.(uint32)
+		if filter != nil && !filter(uid) {
+			return true
+		}
 		stat := value.(*appStats)
 		export := &AppStats{
 			Uid:          int32(uid),
+			UserId:       GetUserId(int32(uid)),
 			TcpConn:      stat.tcpConn,
 			UdpConn:      stat.udpConn,
 			TcpConnTotal: int32(stat.tcpConnTotal),
@@ -93,32 +154,42 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 		export.Downlink = int64(downlink)
 		export.DownlinkTotal = int64(downlinkTotal)
 
+		dnsBlocked := atomic.SwapUint64(&stat.dnsBlocked, 0)
+		dnsBlockedTotal := atomic.AddUint64(&stat.dnsBlockedTotal, dnsBlocked)
+		export.DnsBlocked = int64(dnsBlocked)
+		export.DnsBlockedTotal = int64(dnsBlockedTotal)
+
 		stats = append(stats, export)
 		return true
 	})
 
-	for _, stat := range stats {
-		listener.UpdateStats(stat)
-	}
-
-	return nil
+	return stats
 }
 
 type statsConn struct {
 	net.Conn
 	uplink   *uint64
 	downlink *uint64
+	flow     *domainFlow
+	reporter *statsReporter
+	speed    *speedSampler
 }
 
 func (c *statsConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
 	defer atomic.AddUint64(c.uplink, uint64(n))
+	atomic.AddUint64(&c.flow.uplink, uint64(n))
+	atomic.AddUint64(&c.speed.uplink, uint64(n))
+	c.reporter.add(n)
 	return
 }
 
 func (c *statsConn) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
 	defer atomic.AddUint64(c.downlink, uint64(n))
+	atomic.AddUint64(&c.flow.downlink, uint64(n))
+	atomic.AddUint64(&c.speed.downlink, uint64(n))
+	c.reporter.add(n)
 	return
 }
 
@@ -126,12 +197,18 @@ type statsPacketConn struct {
 	packetConn
 	uplink   *uint64
 	downlink *uint64
+	flow     *domainFlow
+	reporter *statsReporter
+	speed    *speedSampler
 }
 
 func (c statsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	n, addr, err = c.packetConn.ReadFrom(p)
 	if err == nil {
 		atomic.AddUint64(c.downlink, uint64(n))
+		atomic.AddUint64(&c.flow.downlink, uint64(n))
+		atomic.AddUint64(&c.speed.downlink, uint64(n))
+		c.reporter.add(n)
 	}
 	return
 }
@@ -140,6 +217,9 @@ func (c statsPacketConn) readFrom() (p []byte, addr net.Addr, err error) {
 	p, addr, err = c.packetConn.readFrom()
 	if err == nil {
 		atomic.AddUint64(c.downlink, uint64(len(p)))
+		atomic.AddUint64(&c.flow.downlink, uint64(len(p)))
+		atomic.AddUint64(&c.speed.downlink, uint64(len(p)))
+		c.reporter.add(len(p))
 	}
 	return
 }
@@ -148,6 +228,9 @@ func (c statsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	n, err = c.packetConn.WriteTo(p, addr)
 	if err == nil {
 		atomic.AddUint64(c.uplink, uint64(n))
+		atomic.AddUint64(&c.flow.uplink, uint64(n))
+		atomic.AddUint64(&c.speed.uplink, uint64(n))
+		c.reporter.add(n)
 	}
 	return
 }
@@ -0,0 +1,187 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsEventLimit caps the connection events queued between two reports,
+// older ones are dropped and counted.
+const statsEventLimit = 1024
+
+type ConnectionEvent struct {
+	Uid         int32
+	Network     string
+	Destination string
+	Opened      bool
+	// Timestamp is in unix milliseconds.
+	Timestamp int64
+}
+
+// StatsBatch is everything that changed since the previous report, it is
+// delivered in a single call to limit jni overhead.
+type StatsBatch struct {
+	DroppedEvents int32
+
+	stats  []*AppStats
+	events []*ConnectionEvent
+}
+
+func (b *StatsBatch) GetStatsCount() int32 {
+	return int32(len(b.stats))
+}
+
+func (b *StatsBatch) GetStats(index int32) *AppStats {
+	return b.stats[index]
+}
+
+func (b *StatsBatch) GetEventCount() int32 {
+	return int32(len(b.events))
+}
+
+func (b *StatsBatch) GetEvent(index int32) *ConnectionEvent {
+	return b.events[index]
+}
+
+type StatsBatchListener interface {
+	OnStats(batch *StatsBatch)
+}
+
+// statsReporter pushes traffic deltas and connection events to a listener,
+// so the app does not need to wake up and poll ReadAppTraffics.
+type statsReporter struct {
+	pending   int64
+	threshold int64
+
+	t        *Tun2ray
+	access   sync.Mutex
+	listener StatsBatchListener
+	events   []*ConnectionEvent
+	dropped  int32
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// SetStatsListener reports to listener every intervalMs milliseconds, or
+// earlier once thresholdBytes were transferred if it is positive. Reports are
+// skipped while nothing changed. A nil listener stops reporting. Deltas are
+// shared with ReadAppTraffics, use one or the other.
+func (t *Tun2ray) SetStatsListener(listener StatsBatchListener, intervalMs int32, thresholdBytes int64) error {
+	if !t.trafficStats {
+		return withCode(ErrorCodeInvalidState, newError("traffic stats disabled"))
+	}
+	if listener != nil && intervalMs <= 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid stats interval ", intervalMs))
+	}
+	r := t.statsReporter
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	r.listener = listener
+	atomic.StoreInt64(&r.threshold, thresholdBytes)
+	r.events = nil
+	r.dropped = 0
+	if listener != nil {
+		r.done = make(chan struct{})
+		go r.loop(time.Duration(intervalMs)*time.Millisecond, r.done)
+	}
+	return nil
+}
+
+func newStatsReporter(t *Tun2ray) *statsReporter {
+	return &statsReporter{
+		t:    t,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (r *statsReporter) loop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		r.flush()
+	}
+}
+
+// add counts transferred bytes and wakes the loop once the threshold is hit.
+func (r *statsReporter) add(n int) {
+	if n <= 0 {
+		return
+	}
+	threshold := atomic.LoadInt64(&r.threshold)
+	if atomic.AddInt64(&r.pending, int64(n)) >= threshold && threshold > 0 {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *statsReporter) event(uid uint32, network string, destination string, opened bool) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.listener == nil {
+		return
+	}
+	if len(r.events) >= statsEventLimit {
+		r.events = r.events[1:]
+		r.dropped++
+	}
+	r.events = append(r.events, &ConnectionEvent{
+		Uid:         int32(uid),
+		Network:     network,
+		Destination: destination,
+		Opened:      opened,
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (r *statsReporter) flush() {
+	atomic.StoreInt64(&r.pending, 0)
+	r.access.Lock()
+	listener := r.listener
+	batch := &StatsBatch{
+		DroppedEvents: r.dropped,
+		events:        r.events,
+	}
+	r.events = nil
+	r.dropped = 0
+	r.access.Unlock()
+	if listener == nil {
+		return
+	}
+
+	changed := make(map[int32]bool)
+	for _, event := range batch.events {
+		changed[event.Uid] = true
+	}
+	for _, stats := range r.t.collectAppStats(nil) {
+		if stats.Uplink != 0 || stats.Downlink != 0 || stats.DnsBlocked != 0 || changed[stats.Uid] {
+			batch.stats = append(batch.stats, stats)
+		}
+	}
+	if len(batch.stats) == 0 && len(batch.events) == 0 && batch.DroppedEvents == 0 {
+		return
+	}
+	listener.OnStats(batch)
+}
+
+func (r *statsReporter) close() {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	r.listener = nil
+}
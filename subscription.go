@@ -0,0 +1,611 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	subscriptionMinInterval   = 15 * time.Minute
+	subscriptionRetryInterval = 5 * time.Minute
+	subscriptionMaxSize       = 16 * 1024 * 1024
+	subscriptionUserAgent     = "libcore"
+)
+
+// SubscriptionConfig is a subscription group of the app. Url is a share
+// link list, a SIP008 document or an ooc:// token of Open Online Config.
+// Headers are extra request headers, one "Name: value" per line, Outbound is
+// the tag to fetch through, or empty for a direct connection, and Interval
+// the seconds between updates, 0 for manual updates only.
+type SubscriptionConfig struct {
+	Id        int64
+	Url       string
+	UserAgent string
+	Username  string
+	Password  string
+	Headers   string
+	Outbound  string
+	Interval  int32
+	// CertSha256 pins the hex sha256 of the certificate of the provider,
+	// ooc tokens carry their own.
+	CertSha256 string
+}
+
+// SubscriptionNode is a profile of a subscription, Link is its share link.
+type SubscriptionNode struct {
+	// Key identifies the node across updates, it is the protocol and the
+	// name, or the server if the node has no name.
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int32  `json:"port"`
+	Link     string `json:"link"`
+}
+
+type SubscriptionNodeList struct {
+	nodes []*SubscriptionNode
+}
+
+func (l *SubscriptionNodeList) Len() int32 {
+	return int32(len(l.nodes))
+}
+
+func (l *SubscriptionNodeList) Get(index int32) *SubscriptionNode {
+	if index < 0 || int(index) >= len(l.nodes) {
+		return nil
+	}
+	return l.nodes[index]
+}
+
+// SubscriptionUpdate is the difference of an update to the previous node
+// list, Changed nodes have the key of a previous node and another link. The
+// traffic fields are from the Subscription-Userinfo header, or the online
+// config, which only tells the bytes used as Download. They are -1 if absent.
+type SubscriptionUpdate struct {
+	Id        int64
+	Added     *SubscriptionNodeList
+	Removed   *SubscriptionNodeList
+	Changed   *SubscriptionNodeList
+	Total     int32
+	UpdatedAt int64
+	// Username is the account of an online config provider.
+	Username string
+
+	Upload   int64
+	Download int64
+	Quota    int64
+	// ExpireAt is in unix seconds.
+	ExpireAt int64
+}
+
+type SubscriptionListener interface {
+	// OnSubscriptionUpdated is called after every successful update, also
+	// when nothing changed.
+	OnSubscriptionUpdated(update *SubscriptionUpdate)
+	OnSubscriptionFailed(id int64, message string)
+}
+
+// SubscriptionManager fetches the subscription groups on their own
+// intervals and reports the nodes that were added, removed or changed. The
+// groups and their last node lists are kept in the state file.
+type SubscriptionManager struct {
+	access    sync.Mutex
+	statePath string
+	listener  SubscriptionListener
+	instance  *V2RayInstance
+	groups    map[int64]*subscriptionGroup
+	// updating serializes the updates, so the diffs of a group never
+	// interleave.
+	updating sync.Mutex
+}
+
+type subscriptionGroup struct {
+	Config    SubscriptionConfig  `json:"config"`
+	Nodes     []*SubscriptionNode `json:"nodes"`
+	UpdatedAt int64               `json:"updated_at"`
+
+	done chan struct{}
+}
+
+func NewSubscriptionManager(statePath string, listener SubscriptionListener) (*SubscriptionManager, error) {
+	m := &SubscriptionManager{
+		statePath: statePath,
+		listener:  listener,
+		groups:    make(map[int64]*subscriptionGroup),
+	}
+	if statePath == "" {
+		return m, nil
+	}
+	content, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, exportError(newError("read subscription state").Base(err))
+	}
+	var groups []*subscriptionGroup
+	if err = json.Unmarshal(content, &groups); err != nil {
+		logrus.Warn("invalid subscription state, starting over: ", err)
+		return m, nil
+	}
+	for _, group := range groups {
+		m.groups[group.Config.Id] = group
+		m.schedule(group)
+	}
+	return m, nil
+}
+
+// SetInstance sets the instance whose outbounds the subscriptions are
+// fetched through, without one only direct fetches work.
+func (m *SubscriptionManager) SetInstance(instance *V2RayInstance) {
+	m.access.Lock()
+	m.instance = instance
+	m.access.Unlock()
+}
+
+// AddSubscription adds or replaces the group with the id of config, its node
+// list is kept if the url did not change.
+func (m *SubscriptionManager) AddSubscription(config *SubscriptionConfig) error {
+	if config == nil || config.Url == "" {
+		return withCode(ErrorCodeInvalidArgument, newError("missing subscription url"))
+	}
+	if _, _, err := config.apiUrl(); err != nil {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid subscription url").Base(err))
+	}
+	m.access.Lock()
+	group := &subscriptionGroup{Config: *config}
+	if previous, ok := m.groups[config.Id]; ok {
+		previous.stop()
+		if previous.Config.Url == config.Url {
+			group.Nodes = previous.Nodes
+			group.UpdatedAt = previous.UpdatedAt
+		}
+	}
+	m.groups[config.Id] = group
+	m.schedule(group)
+	m.access.Unlock()
+	return m.save()
+}
+
+func (m *SubscriptionManager) RemoveSubscription(id int64) error {
+	m.access.Lock()
+	if group, ok := m.groups[id]; ok {
+		group.stop()
+		delete(m.groups, id)
+	}
+	m.access.Unlock()
+	return m.save()
+}
+
+// GetNodes returns the node list of the last update of the group.
+func (m *SubscriptionManager) GetNodes(id int64) (*SubscriptionNodeList, error) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	group, ok := m.groups[id]
+	if !ok {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("subscription not found: ", id))
+	}
+	return &SubscriptionNodeList{group.Nodes}, nil
+}
+
+// UpdateSubscription fetches the group now, the listener is called as for
+// scheduled updates.
+func (m *SubscriptionManager) UpdateSubscription(id int64) (*SubscriptionUpdate, error) {
+	update, err := m.update(id)
+	if err != nil {
+		if m.listener != nil {
+			m.listener.OnSubscriptionFailed(id, err.Error())
+		}
+		return nil, exportError(err)
+	}
+	return update, nil
+}
+
+// Close stops the scheduled updates.
+func (m *SubscriptionManager) Close() {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, group := range m.groups {
+		group.stop()
+	}
+}
+
+func (g *subscriptionGroup) stop() {
+	if g.done != nil {
+		close(g.done)
+		g.done = nil
+	}
+}
+
+// schedule starts the updates of group if it has an interval, m.access must
+// be held.
+func (m *SubscriptionManager) schedule(group *subscriptionGroup) {
+	if group.Config.Interval <= 0 {
+		return
+	}
+	interval := time.Duration(group.Config.Interval) * time.Second
+	if interval < subscriptionMinInterval {
+		interval = subscriptionMinInterval
+	}
+	group.done = make(chan struct{})
+	go m.loop(group.Config.Id, time.Unix(group.UpdatedAt, 0), interval, group.done)
+}
+
+func (m *SubscriptionManager) loop(id int64, updatedAt time.Time, interval time.Duration, done chan struct{}) {
+	next := interval - time.Since(updatedAt)
+	for {
+		if next > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(next):
+			}
+		}
+		if _, err := m.UpdateSubscription(id); err != nil {
+			logrus.Warn("update subscription ", id, ": ", err)
+			next = subscriptionRetryInterval
+		} else {
+			next = interval
+		}
+	}
+}
+
+func (m *SubscriptionManager) update(id int64) (*SubscriptionUpdate, error) {
+	m.updating.Lock()
+	defer m.updating.Unlock()
+
+	m.access.Lock()
+	group, ok := m.groups[id]
+	instance := m.instance
+	m.access.Unlock()
+	if !ok {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("subscription not found: ", id))
+	}
+	config := group.Config
+	if config.Outbound != "" && instance == nil {
+		return nil, withCode(ErrorCodeInvalidState, newError("no instance to fetch subscription ", id, " through ", config.Outbound))
+	}
+
+	api, pin, err := config.apiUrl()
+	if err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	result, err := instance.download(downloadRequest{
+		url:        api,
+		outbound:   config.Outbound,
+		headers:    config.headers(),
+		maxSize:    subscriptionMaxSize,
+		certSha256: pin,
+	})
+	if err != nil {
+		return nil, newError("fetch subscription ", id).Base(err)
+	}
+	content, err := parseSubscription(result.content)
+	if err != nil {
+		return nil, withCode(ErrorCodeConfigInvalid, newError("subscription ", id).Base(err))
+	}
+	if len(content.nodes) == 0 && content.protocols == nil {
+		return nil, withCode(ErrorCodeConfigInvalid, newError("subscription ", id, " has no nodes"))
+	}
+	if content.upload < 0 && content.download < 0 {
+		content.upload, content.download, content.quota, content.expire = parseSubscriptionUserinfo(result.header.Get("Subscription-Userinfo"))
+	}
+
+	m.access.Lock()
+	if m.groups[id] != group {
+		m.access.Unlock()
+		return nil, newError("subscription ", id, " was replaced while updating")
+	}
+	nodes := content.nodes
+	if content.protocols != nil {
+		// a partial update keeps the nodes of the protocols it does not carry
+		var kept []*SubscriptionNode
+		for _, node := range group.Nodes {
+			if !content.protocols[node.Protocol] {
+				kept = append(kept, node)
+			}
+		}
+		nodes = append(kept, nodes...)
+	}
+	update := diffSubscription(group.Nodes, nodes)
+	group.Nodes = nodes
+	group.UpdatedAt = time.Now().Unix()
+	m.access.Unlock()
+
+	update.Id = id
+	update.UpdatedAt = group.UpdatedAt
+	update.Username = content.username
+	update.Upload, update.Download, update.Quota, update.ExpireAt = content.upload, content.download, content.quota, content.expire
+	if err = m.save(); err != nil {
+		logrus.Warn("save subscription state: ", err)
+	}
+	logrus.Info("updated subscription ", id, ": ", update.Added.Len(), " added, ", update.Removed.Len(), " removed, ", update.Changed.Len(), " changed")
+	if m.listener != nil {
+		m.listener.OnSubscriptionUpdated(update)
+	}
+	return update, nil
+}
+
+// apiUrl returns the url to fetch and the certificate pin.
+func (c *SubscriptionConfig) apiUrl() (string, string, error) {
+	if strings.HasPrefix(c.Url, "ooc://") {
+		api, pin, err := parseOocToken(c.Url)
+		if err != nil {
+			return "", "", err
+		}
+		if pin == "" {
+			pin = c.CertSha256
+		}
+		return api, pin, nil
+	}
+	if _, err := url.Parse(c.Url); err != nil {
+		return "", "", err
+	}
+	return c.Url, c.CertSha256, nil
+}
+
+func (c *SubscriptionConfig) headers() map[string]string {
+	headers := map[string]string{"User-Agent": subscriptionUserAgent}
+	if c.UserAgent != "" {
+		headers["User-Agent"] = c.UserAgent
+	}
+	if c.Username != "" || c.Password != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	}
+	scanner := bufio.NewScanner(strings.NewReader(c.Headers))
+	for scanner.Scan() {
+		if index := strings.IndexByte(scanner.Text(), ':'); index > 0 {
+			headers[strings.TrimSpace(scanner.Text()[:index])] = strings.TrimSpace(scanner.Text()[index+1:])
+		}
+	}
+	return headers
+}
+
+func (m *SubscriptionManager) save() error {
+	if m.statePath == "" {
+		return nil
+	}
+	m.access.Lock()
+	groups := make([]*subscriptionGroup, 0, len(m.groups))
+	for _, group := range m.groups {
+		groups = append(groups, group)
+	}
+	content, err := json.Marshal(groups)
+	m.access.Unlock()
+	if err != nil {
+		return newError("encode subscription state").Base(err)
+	}
+	temp := m.statePath + ".tmp"
+	if err = ioutil.WriteFile(temp, content, 0o600); err == nil {
+		err = os.Rename(temp, m.statePath)
+	}
+	if err != nil {
+		return exportError(newError("write subscription state").Base(err))
+	}
+	return nil
+}
+
+func diffSubscription(previous []*SubscriptionNode, nodes []*SubscriptionNode) *SubscriptionUpdate {
+	update := &SubscriptionUpdate{
+		Added:   new(SubscriptionNodeList),
+		Removed: new(SubscriptionNodeList),
+		Changed: new(SubscriptionNodeList),
+		Total:   int32(len(nodes)),
+	}
+	known := make(map[string]*SubscriptionNode, len(previous))
+	for _, node := range previous {
+		known[node.Key] = node
+	}
+	for _, node := range nodes {
+		old, ok := known[node.Key]
+		switch {
+		case !ok:
+			update.Added.nodes = append(update.Added.nodes, node)
+		case old.Link != node.Link:
+			update.Changed.nodes = append(update.Changed.nodes, node)
+		}
+		delete(known, node.Key)
+	}
+	for _, node := range previous {
+		if _, ok := known[node.Key]; ok {
+			update.Removed.nodes = append(update.Removed.nodes, node)
+		}
+	}
+	return update
+}
+
+// subscriptionContent is a parsed subscription.
+type subscriptionContent struct {
+	nodes []*SubscriptionNode
+	// protocols are those a partial update carries, nil if it replaces all
+	// nodes.
+	protocols map[string]bool
+	username  string
+
+	upload   int64
+	download int64
+	quota    int64
+	expire   int64
+}
+
+// parseSubscription reads an online config, or a list of share links, plain
+// or base64 encoded, of which lines that are not links are skipped.
+func parseSubscription(content []byte) (*subscriptionContent, error) {
+	text := strings.TrimSpace(string(content))
+	if strings.HasPrefix(text, "{") {
+		parsed, err := parseOnlineConfig(content)
+		if err != nil {
+			return nil, err
+		}
+		assignNodeKeys(parsed.nodes)
+		return parsed, nil
+	}
+	if !strings.Contains(text, "://") {
+		if decoded, err := decodeBase64(text); err == nil {
+			text = string(decoded)
+		}
+	}
+	var nodes []*SubscriptionNode
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(nil, subscriptionMaxSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.Contains(line, "://") {
+			continue
+		}
+		node, err := parseShareLink(line)
+		if err != nil {
+			newError("skipped subscription link").Base(err).AtDebug().WriteToLog()
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	assignNodeKeys(nodes)
+	return &subscriptionContent{nodes: nodes, upload: -1, download: -1, quota: -1, expire: -1}, nil
+}
+
+// assignNodeKeys sets the keys of the nodes without one, nodes sharing a key
+// are told apart by their order.
+func assignNodeKeys(nodes []*SubscriptionNode) {
+	keys := make(map[string]int)
+	for _, node := range nodes {
+		if node.Key == "" {
+			if node.Name != "" {
+				node.Key = node.Protocol + "|" + node.Name
+			} else {
+				node.Key = node.Protocol + "|" + net.JoinHostPort(node.Address, strconv.Itoa(int(node.Port)))
+			}
+		}
+		keys[node.Key]++
+		if count := keys[node.Key]; count > 1 {
+			node.Key += "|" + strconv.Itoa(count)
+		}
+	}
+}
+
+// parseShareLink reads the protocol, name and server of a share link, the
+// link itself is passed on as is.
+func parseShareLink(link string) (*SubscriptionNode, error) {
+	node := &SubscriptionNode{Link: link}
+	index := strings.Index(link, "://")
+	if index < 0 {
+		return nil, newError("not a share link")
+	}
+	node.Protocol = strings.ToLower(link[:index])
+	body := link[index+3:]
+
+	switch node.Protocol {
+	case "vmess":
+		if decoded, err := decodeBase64(body); err == nil {
+			var v2rayN struct {
+				Name    string      `json:"ps"`
+				Address string      `json:"add"`
+				Port    json.Number `json:"port"`
+			}
+			if err = json.Unmarshal(decoded, &v2rayN); err != nil {
+				return nil, newError("invalid vmess link").Base(err)
+			}
+			port, _ := v2rayN.Port.Int64()
+			node.Name, node.Address, node.Port = v2rayN.Name, v2rayN.Address, int32(port)
+			return node, nil
+		}
+	case "ssr":
+		// host:port:protocol:method:obfs:password/?remarks=...
+		decoded, err := decodeBase64(body)
+		if err != nil {
+			return nil, newError("invalid ssr link").Base(err)
+		}
+		server := string(decoded)
+		var query string
+		if index := strings.Index(server, "/?"); index >= 0 {
+			server, query = server[:index], server[index+2:]
+		}
+		parts := strings.Split(server, ":")
+		if len(parts) < 6 {
+			return nil, newError("invalid ssr link")
+		}
+		port, _ := strconv.Atoi(parts[len(parts)-5])
+		node.Address, node.Port = strings.Join(parts[:len(parts)-5], ":"), int32(port)
+		if values, err := url.ParseQuery(query); err == nil {
+			if remarks, err := decodeBase64(values.Get("remarks")); err == nil {
+				node.Name = string(remarks)
+			}
+		}
+		return node, nil
+	case "ss":
+		// the legacy form encodes method:password@host:port as a whole
+		server := body
+		if index := strings.IndexByte(server, '#'); index >= 0 {
+			server = server[:index]
+		}
+		if !strings.Contains(server, "@") {
+			if decoded, err := decodeBase64(server); err == nil {
+				link = "ss://" + string(decoded) + body[len(server):]
+			}
+		}
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(u.Port())
+	node.Name, node.Address, node.Port = u.Fragment, u.Hostname(), int32(port)
+	if node.Address == "" {
+		return nil, newError("no server in ", node.Protocol, " link")
+	}
+	return node, nil
+}
+
+func decodeBase64(text string) ([]byte, error) {
+	text = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.TrimRight(text, "=")
+	if decoded, err := base64.RawStdEncoding.DecodeString(text); err == nil {
+		return decoded, nil
+	}
+	return base64.RawURLEncoding.DecodeString(text)
+}
+
+// parseSubscriptionUserinfo reads "upload=1; download=2; total=3; expire=4",
+// fields that are absent are -1.
+func parseSubscriptionUserinfo(header string) (upload, download, quota, expire int64) {
+	upload, download, quota, expire = -1, -1, -1, -1
+	for _, field := range strings.Split(header, ";") {
+		index := strings.IndexByte(field, '=')
+		if index < 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(field[index+1:]), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(field[:index]) {
+		case "upload":
+			upload = value
+		case "download":
+			download = value
+		case "total":
+			quota = value
+		case "expire":
+			expire = value
+		}
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+// TcpPing returns the milliseconds taken to connect to host:port, directly
+// with a protected socket if viaOutbound is empty. Most outbounds report the
+// connection before the proxy server reached the destination, prefer TlsPing
+// for those.
+func (instance *V2RayInstance) TcpPing(host string, port int32, viaOutbound string, timeoutMs int32) (int32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	conn, err := instance.dialVia(ctx, host, port, viaOutbound)
+	if err != nil {
+		return 0, exportError(err)
+	}
+	conn.Close()
+	return int32(time.Since(start).Milliseconds()), nil
+}
+
+// TlsPing returns the milliseconds taken to connect to host:port and
+// complete a tls handshake with sni, the certificate is not verified.
+func (instance *V2RayInstance) TlsPing(host string, port int32, sni string, viaOutbound string, timeoutMs int32) (int32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	if sni == "" {
+		sni = host
+	}
+	start := time.Now()
+	conn, err := instance.dialVia(ctx, host, port, viaOutbound)
+	if err != nil {
+		return 0, exportError(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+		KeyLogWriter:       tlsKeyLogWriter(),
+	})
+	defer tlsConn.Close()
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return 0, exportError(newError("tls handshake failed").Base(err))
+	}
+	return int32(time.Since(start).Milliseconds()), nil
+}
+
+// dialVia dials host:port through the outbound tagged tag, or with the
+// system dialer, which protects its sockets while the tun is running.
+func (instance *V2RayInstance) dialVia(ctx context.Context, host string, port int32, tag string) (net.Conn, error) {
+	destination, err := v2rayNet.ParseDestination("tcp:" + net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, withCode(ErrorCodeInvalidArgument, err)
+	}
+	if tag == "" {
+		return internet.DialSystem(ctx, destination, nil)
+	}
+	if instance.core == nil {
+		return nil, withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	handler := instance.outboundHandler(tag)
+	if handler == nil {
+		return nil, withCode(ErrorCodeInvalidArgument, newError("non existing tag: ", tag))
+	}
+
+	ctx, cancel := context.WithCancel(core.WithContext(context.Background(), instance.core))
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+	inboundLink, outboundLink := getLink(ctx)
+	go handler.Dispatch(ctx, outboundLink)
+	conn := buf.NewConnection(
+		buf.ConnectionInputMulti(inboundLink.Writer),
+		buf.ConnectionOutputMulti(inboundLink.Reader),
+		buf.ConnectionOnClose(closerFunc(cancel)),
+	)
+	return conn, nil
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,22 @@
+package libcore
+
+const (
+	// TransparentModeTProxy takes tcp and udp redirected with the iptables
+	// TPROXY target, the original destination is the local address.
+	TransparentModeTProxy int32 = iota
+	// TransparentModeRedirect takes tcp redirected with the nat REDIRECT
+	// target, read back with SO_ORIGINAL_DST.
+	TransparentModeRedirect
+)
+
+// TransparentProxyConfig configures the transparent proxy inbound for rooted
+// devices, which replaces the VpnService tun. Connections are routed with the
+// inbound tag Tag and attributed to the uid of the local app.
+type TransparentProxyConfig struct {
+	Port    int32
+	Mode    int32
+	Tag     string
+	IPv6    bool
+	Sniff   bool
+	DumpUid bool
+}
@@ -0,0 +1,470 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/common/task"
+	"golang.org/x/sys/unix"
+	"libcore/comm"
+)
+
+const (
+	transparentUdpTimeout = 5 * time.Minute
+	transparentRouteMark  = 0x2d0
+	transparentRouteTable = 233
+	ip6tSoOriginalDst     = 80
+)
+
+type transparentProxy struct {
+	instance *V2RayInstance
+	config   TransparentProxyConfig
+	tcp      *net.TCPListener
+	udp      *net.UDPConn
+	sessions sync.Map
+	done     chan struct{}
+}
+
+type transparentUdpSession struct {
+	conn    packetConn
+	replies sync.Map
+}
+
+// StartTransparentProxy listens on the configured port, see
+// GetTransparentProxyRules for the matching iptables setup.
+func (instance *V2RayInstance) StartTransparentProxy(config *TransparentProxyConfig) error {
+	if config == nil || config.Port <= 0 || config.Port > 65535 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid transparent proxy port"))
+	}
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return withCode(ErrorCodeInvalidState, newError("not started"))
+	}
+	if instance.transparentProxy != nil {
+		return withCode(ErrorCodeInvalidState, newError("transparent proxy already started"))
+	}
+	p := &transparentProxy{instance: instance, config: *config, done: make(chan struct{})}
+	network := "tcp4"
+	address := fmt.Sprint("127.0.0.1:", config.Port)
+	if config.IPv6 {
+		network = "tcp"
+		address = fmt.Sprint("[::]:", config.Port)
+	}
+	transparent := config.Mode == TransparentModeTProxy
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return controlTransparent(c, transparent, false)
+	}}
+	if transparent && !config.IPv6 {
+		address = fmt.Sprint("0.0.0.0:", config.Port)
+	}
+	listener, err := listenConfig.Listen(context.Background(), network, address)
+	if err != nil {
+		return exportError(newError("listen transparent tcp").Base(err))
+	}
+	p.tcp = listener.(*net.TCPListener)
+	if transparent {
+		listenConfig.Control = func(network, address string, c syscall.RawConn) error {
+			return controlTransparent(c, true, true)
+		}
+		packetConn, err := listenConfig.ListenPacket(context.Background(), strings.Replace(network, "tcp", "udp", 1), address)
+		if err != nil {
+			comm.CloseIgnore(p.tcp)
+			return exportError(newError("listen transparent udp").Base(err))
+		}
+		p.udp = packetConn.(*net.UDPConn)
+		go p.loopUDP()
+	}
+	go p.loopTCP()
+	instance.transparentProxy = p
+	logrus.Info("transparent proxy started at ", listener.Addr())
+	return nil
+}
+
+func (instance *V2RayInstance) StopTransparentProxy() {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if instance.transparentProxy != nil {
+		instance.transparentProxy.close()
+		instance.transparentProxy = nil
+	}
+}
+
+func controlTransparent(c syscall.RawConn, transparent bool, udp bool) error {
+	var innerErr error
+	err := c.Control(func(fd uintptr) {
+		if innerErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); innerErr != nil {
+			return
+		}
+		if !transparent {
+			return
+		}
+		if innerErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); innerErr != nil {
+			return
+		}
+		// fails on ipv4 only sockets
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if udp {
+			if innerErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); innerErr != nil {
+				return
+			}
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return innerErr
+}
+
+func (p *transparentProxy) close() {
+	close(p.done)
+	comm.CloseIgnore(p.tcp)
+	if p.udp != nil {
+		comm.CloseIgnore(p.udp)
+	}
+	p.sessions.Range(func(key, value interface{}) bool {
+		comm.CloseIgnore(value.(*transparentUdpSession).conn)
+		return true
+	})
+}
+
+func (p *transparentProxy) newContext(source v2rayNet.Destination, destination v2rayNet.Destination) context.Context {
+	inbound := &session.Inbound{
+		Source:      source,
+		Tag:         p.config.Tag,
+		NetworkType: networkType,
+		WifiSSID:    wifiSSID,
+	}
+	if p.config.DumpUid && uidDumper != nil {
+		uid, err := dumpUid(destination.Address.Family().IsIPv6(), destination.Network == v2rayNet.Network_UDP,
+			source.Address.IP().String(), int32(source.Port), destination.Address.IP().String(), int32(destination.Port))
+		if err == nil {
+			inbound.Uid = uint32(uid)
+		}
+	}
+	ctx := core.WithContext(context.Background(), p.instance.core)
+	ctx = session.ContextWithInbound(ctx, inbound)
+	content := new(session.Content)
+	if p.config.Sniff {
+		content.SniffingRequest = session.SniffingRequest{Enabled: true, RouteOnly: true}
+	}
+	return session.ContextWithContent(ctx, content)
+}
+
+func (p *transparentProxy) loopTCP() {
+	for {
+		conn, err := p.tcp.AcceptTCP()
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				newError("transparent proxy stopped").Base(err).AtWarning().WriteToLog()
+			}
+			return
+		}
+		go p.handleTCP(conn)
+	}
+}
+
+func (p *transparentProxy) handleTCP(conn *net.TCPConn) {
+	defer comm.CloseIgnore(conn)
+	source := v2rayNet.DestinationFromAddr(conn.RemoteAddr())
+	var destination v2rayNet.Destination
+	if p.config.Mode == TransparentModeTProxy {
+		destination = v2rayNet.DestinationFromAddr(conn.LocalAddr())
+	} else {
+		address, err := originalDestination(conn)
+		if err != nil {
+			newError("[TPROXY] read original destination").Base(err).AtWarning().WriteToLog()
+			return
+		}
+		destination = v2rayNet.DestinationFromAddr(address)
+	}
+	if address := destination.Address.IP(); address.IsLoopback() && destination.Port == v2rayNet.Port(p.config.Port) {
+		newError("[TPROXY] dropped connection to itself from ", source).AtWarning().WriteToLog()
+		return
+	}
+
+	ctx := p.newContext(source, destination)
+	link, err := p.instance.dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		newError("[TPROXY] dispatch failed").Base(err).WriteToLog()
+		return
+	}
+	requestDone := func() error {
+		return buf.Copy(buf.NewReader(conn), link.Writer)
+	}
+	responseDone := func() error {
+		return buf.Copy(link.Reader, buf.NewWriter(conn))
+	}
+	if err = task.Run(ctx, task.OnSuccess(requestDone, task.Close(link.Writer)), responseDone); err != nil {
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+		newError("[TPROXY] connection finished").Base(err).AtDebug().WriteToLog()
+	}
+}
+
+// originalDestination reads the destination of a connection redirected by
+// the nat table.
+func originalDestination(conn *net.TCPConn) (net.Addr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var address net.Addr
+	var innerErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if !ipv6 {
+			var sockaddr unix.RawSockaddrInet4
+			size := uint32(unsafe.Sizeof(sockaddr))
+			innerErr = getsockopt(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sockaddr), &size)
+			address = &net.TCPAddr{IP: net.IP(sockaddr.Addr[:]), Port: int(ntohs(sockaddr.Port))}
+		} else {
+			var sockaddr unix.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sockaddr))
+			innerErr = getsockopt(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sockaddr), &size)
+			address = &net.TCPAddr{IP: net.IP(sockaddr.Addr[:]), Port: int(ntohs(sockaddr.Port))}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return address, innerErr
+}
+
+func getsockopt(fd int, level int, name int, value unsafe.Pointer, size *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(value), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ntohs(port uint16) uint16 {
+	var bytes [2]byte
+	*(*uint16)(unsafe.Pointer(&bytes[0])) = port
+	return binary.BigEndian.Uint16(bytes[:])
+}
+
+func (p *transparentProxy) loopUDP() {
+	buffer := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, source, err := p.udp.ReadMsgUDP(buffer, oob)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				newError("transparent proxy stopped").Base(err).AtWarning().WriteToLog()
+			}
+			return
+		}
+		destination, err := parseOriginalDestination(oob[:oobn])
+		if err != nil {
+			newError("[TPROXY] read original destination").Base(err).AtWarning().WriteToLog()
+			continue
+		}
+		if ip4 := source.IP.To4(); ip4 != nil {
+			source.IP = ip4
+		}
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		p.handleUDP(source, destination, data)
+	}
+}
+
+func parseOriginalDestination(oob []byte) (*net.UDPAddr, error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		switch {
+		case message.Header.Level == unix.SOL_IP && message.Header.Type == unix.IP_ORIGDSTADDR:
+			sockaddr := (*unix.RawSockaddrInet4)(unsafe.Pointer(&message.Data[0]))
+			return &net.UDPAddr{IP: net.IP(sockaddr.Addr[:]), Port: int(ntohs(sockaddr.Port))}, nil
+		case message.Header.Level == unix.SOL_IPV6 && message.Header.Type == unix.IPV6_ORIGDSTADDR:
+			sockaddr := (*unix.RawSockaddrInet6)(unsafe.Pointer(&message.Data[0]))
+			ip := net.IP(sockaddr.Addr[:])
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			return &net.UDPAddr{IP: ip, Port: int(ntohs(sockaddr.Port))}, nil
+		}
+	}
+	return nil, newError("missing original destination")
+}
+
+func (p *transparentProxy) handleUDP(source *net.UDPAddr, destination *net.UDPAddr, data []byte) {
+	key := source.String()
+	target := v2rayNet.DestinationFromAddr(destination)
+	if iSession, ok := p.sessions.Load(key); ok {
+		if _, err := iSession.(*transparentUdpSession).conn.WriteTo(data, destination); err != nil {
+			newError("[TPROXY] write udp").Base(err).AtDebug().WriteToLog()
+		}
+		return
+	}
+	ctx := p.newContext(v2rayNet.DestinationFromAddr(source), target)
+	conn, err := p.instance.dialUDP(ctx, target, transparentUdpTimeout)
+	if err != nil {
+		newError("[TPROXY] dial udp failed").Base(err).WriteToLog()
+		return
+	}
+	s := &transparentUdpSession{conn: conn}
+	p.sessions.Store(key, s)
+	if _, err = conn.WriteTo(data, destination); err != nil {
+		newError("[TPROXY] write udp").Base(err).AtDebug().WriteToLog()
+	}
+	go func() {
+		defer func() {
+			p.sessions.Delete(key)
+			comm.CloseIgnore(conn)
+			s.replies.Range(func(key, value interface{}) bool {
+				comm.CloseIgnore(value)
+				return true
+			})
+		}()
+		for {
+			buffer, addr, err := conn.readFrom()
+			if err != nil {
+				return
+			}
+			from, ok := addr.(*net.UDPAddr)
+			if !ok || from == nil {
+				from = destination
+			}
+			reply, err := s.replyConn(from)
+			if err != nil {
+				newError("[TPROXY] create reply socket for ", from).Base(err).AtWarning().WriteToLog()
+				return
+			}
+			if _, err = reply.WriteToUDP(buffer, source); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// replyConn returns a socket bound to the non-local address from, so replies
+// reach the app with the address it sent to.
+func (s *transparentUdpSession) replyConn(from *net.UDPAddr) (*net.UDPConn, error) {
+	if conn, ok := s.replies.Load(from.String()); ok {
+		return conn.(*net.UDPConn), nil
+	}
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return controlTransparent(c, true, false)
+	}}
+	network := "udp4"
+	if from.IP.To4() == nil {
+		network = "udp6"
+	}
+	packetConn, err := listenConfig.ListenPacket(context.Background(), network, from.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := packetConn.(*net.UDPConn)
+	s.replies.Store(from.String(), conn)
+	return conn, nil
+}
+
+var transparentPrivateNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+}
+
+var transparentPrivateNetworks6 = []string{
+	"::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// GetTransparentProxyRules returns the shell commands setting up, or tearing
+// down, the iptables rules for the transparent proxy. Sockets of this process
+// are excluded by uid and by socketMark, if not zero (see SetSocketMark).
+func GetTransparentProxyRules(config *TransparentProxyConfig, socketMark int32, setup bool) string {
+	var builder strings.Builder
+	write := func(format string, args ...interface{}) {
+		builder.WriteString(fmt.Sprintf(format, args...))
+		builder.WriteByte('\n')
+	}
+	tools := []string{"iptables"}
+	if config.IPv6 {
+		tools = append(tools, "ip6tables")
+	}
+	uid := os.Getuid()
+	for _, tool := range tools {
+		private := transparentPrivateNetworks
+		ip := "ip"
+		if tool == "ip6tables" {
+			private = transparentPrivateNetworks6
+			ip = "ip -6"
+		}
+		if config.Mode == TransparentModeRedirect {
+			if !setup {
+				write("%s -t nat -D OUTPUT -p tcp -j LIBCORE", tool)
+				write("%s -t nat -F LIBCORE", tool)
+				write("%s -t nat -X LIBCORE", tool)
+				continue
+			}
+			write("%s -t nat -N LIBCORE", tool)
+			write("%s -t nat -A LIBCORE -m owner --uid-owner %d -j RETURN", tool, uid)
+			if socketMark != 0 {
+				write("%s -t nat -A LIBCORE -m mark --mark %d -j RETURN", tool, socketMark)
+			}
+			for _, network := range private {
+				write("%s -t nat -A LIBCORE -d %s -j RETURN", tool, network)
+			}
+			write("%s -t nat -A LIBCORE -p tcp -j REDIRECT --to-ports %d", tool, config.Port)
+			write("%s -t nat -A OUTPUT -p tcp -j LIBCORE", tool)
+			continue
+		}
+		if !setup {
+			write("%s -t mangle -D PREROUTING -j LIBCORE", tool)
+			write("%s -t mangle -D OUTPUT -j LIBCORE_LOCAL", tool)
+			write("%s -t mangle -F LIBCORE", tool)
+			write("%s -t mangle -X LIBCORE", tool)
+			write("%s -t mangle -F LIBCORE_LOCAL", tool)
+			write("%s -t mangle -X LIBCORE_LOCAL", tool)
+			write("%s rule del fwmark %d table %d", ip, transparentRouteMark, transparentRouteTable)
+			write("%s route del local default dev lo table %d", ip, transparentRouteTable)
+			continue
+		}
+		write("%s rule add fwmark %d table %d", ip, transparentRouteMark, transparentRouteTable)
+		write("%s route add local default dev lo table %d", ip, transparentRouteTable)
+		write("%s -t mangle -N LIBCORE", tool)
+		for _, network := range private {
+			write("%s -t mangle -A LIBCORE -d %s -j RETURN", tool, network)
+		}
+		for _, protocol := range []string{"tcp", "udp"} {
+			write("%s -t mangle -A LIBCORE -p %s -j TPROXY --on-port %d --tproxy-mark %d", tool, protocol, config.Port, transparentRouteMark)
+		}
+		write("%s -t mangle -A PREROUTING -j LIBCORE", tool)
+		write("%s -t mangle -N LIBCORE_LOCAL", tool)
+		write("%s -t mangle -A LIBCORE_LOCAL -m owner --uid-owner %d -j RETURN", tool, uid)
+		if socketMark != 0 {
+			write("%s -t mangle -A LIBCORE_LOCAL -m mark --mark %d -j RETURN", tool, socketMark)
+		}
+		for _, network := range private {
+			write("%s -t mangle -A LIBCORE_LOCAL -d %s -j RETURN", tool, network)
+		}
+		for _, protocol := range []string{"tcp", "udp"} {
+			write("%s -t mangle -A LIBCORE_LOCAL -p %s -j MARK --set-mark %d", tool, protocol, transparentRouteMark)
+		}
+		write("%s -t mangle -A OUTPUT -j LIBCORE_LOCAL", tool)
+	}
+	return builder.String()
+}
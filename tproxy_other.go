@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package libcore
+
+// transparentProxy needs iptables, the transparent proxy is only supported
+// on Linux.
+type transparentProxy struct{}
+
+func (p *transparentProxy) close() {
+}
+
+func (instance *V2RayInstance) StartTransparentProxy(config *TransparentProxyConfig) error {
+	return withCode(ErrorCodeInvalidState, newError("transparent proxy is not supported on this platform"))
+}
+
+func (instance *V2RayInstance) StopTransparentProxy() {
+}
+
+func GetTransparentProxyRules(config *TransparentProxyConfig, socketMark int32, setup bool) string {
+	return ""
+}
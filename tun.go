@@ -3,14 +3,12 @@ package libcore
 import (
 	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,39 +25,63 @@ import (
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
 	"github.com/v2fly/v2ray-core/v5/features/outbound"
-	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
 	"github.com/v2fly/v2ray-core/v5/proxy/wireguard"
 	"github.com/v2fly/v2ray-core/v5/transport"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
 	"github.com/v2fly/v2ray-core/v5/transport/pipe"
 	"libcore/comm"
 	"libcore/gvisor"
-	"libcore/nat"
 	"libcore/tun"
 )
 
 var _ tun.Handler = (*Tun2ray)(nil)
 
 type Tun2ray struct {
-	dev                 tun.Tun
-	router              string
+	nicsLock            sync.Mutex
+	nics                []*tunNic
 	v2ray               *V2RayInstance
 	sniffing            bool
 	overrideDestination bool
 	debug               bool
 
-	dumpUid      bool
-	trafficStats bool
-	pcap         bool
-
-	udpTable  sync.Map
-	appStats  sync.Map
-	lockTable sync.Map
+	id              string
+	dumpUid         bool
+	uidDumper       UidDumper
+	trafficStats    bool
+	pcap            bool
+	icmpUnreachable bool
+
+	captureStreamCount int32
+	captureAccess      sync.RWMutex
+	captureStreams     map[*CaptureStream]struct{}
+	pcapFilter         atomic.Value
+	captureUidAccess   sync.Mutex
+	captureUids        map[string]captureUid
+
+	udpTable    *sessionTable
+	appStats    sync.Map
+	domainStats domainStatsTable
+	dnsQueries  dnsQueryLog
+	lockTable   sync.Map
 
 	connectionsLock sync.Mutex
 	connections     list.List
 
 	defaultOutboundForPing outbound.Handler
+	bindUpstream           func(fd uintptr)
+	multicastDnsMode       int32
+	multicastMode          int32
+	errorHandler           ErrorHandler
+
+	voip         *voipTracker
+	voipSessions sync.Map
+
+	statsReporter *statsReporter
+	speed         *speedSampler
+	pipes         *pipeTotals
+	lifecycle     *lifecycle
+	killSwitch    killSwitch
+	uidExclusion  atomic.Value
 }
 
 type TunConfig struct {
@@ -73,70 +95,134 @@ type TunConfig struct {
 	BindUpstream        Protector
 	IPv6Mode            int32
 	Implementation      int32
+	DeviceName          string
+	PacketFlow          PacketFlow
 	Sniffing            bool
 	OverrideDestination bool
 	Debug               bool
 	DumpUID             bool
 	TrafficStats        bool
 	PCap                bool
+	PCapFilter          *PcapFilter
 	ErrorHandler        ErrorHandler
 	LocalResolver       LocalResolver
+	LocalResolverV2     LocalResolverV2
+	MulticastDnsMode    int32
+	MulticastMode       int32
+	InboundTag          string
+	DnsInboundTag       string
+	InboundAttributes   string
+	IcmpUnreachable     bool
+	// UidDumper replaces the one of SetUidDumper for the connections of this
+	// tun, e.g. NewSockDiagUidDumper.
+	UidDumper UidDumper
+	// PerformanceMode turns off Sniffing, Debug, DumpUID, TrafficStats and
+	// PCap whatever they are set to, so connections skip uid dumping and the
+	// stats wrappers, for raw throughput on low-end devices.
+	PerformanceMode bool
+	// TcpKeepAlive is the idle seconds before keepalive probes are sent on
+	// the tcp connections of all outbounds, for mobile networks dropping idle
+	// NAT mappings. Zero disables it.
+	TcpKeepAlive int32
+	// RouterAdvertisement sends IPv6 router advertisements and answers
+	// DHCPv6 information requests from the gvisor stack, for guests sharing
+	// the tun which configure themselves by SLAAC. AdvertisedPrefix defaults
+	// to the /64 of Gateway6 and AdvertisedDns, comma separated, to Gateway6.
+	RouterAdvertisement bool
+	AdvertisedPrefix    string
+	AdvertisedDns       string
+	// StateListener receives the state changes of the tun from its start.
+	StateListener StateListener
+	// ProtectorV2 protects the sockets in batches, it is preferred over
+	// Protector if both are set.
+	ProtectorV2 ProtectorV2
+	// KillSwitch keeps reading the tun and rejects all connections, udp with
+	// an icmp administratively prohibited, once the instance stops or fails,
+	// until the tun is closed.
+	KillSwitch bool
 }
 
 type ErrorHandler interface {
 	HandleError(err string)
 }
 
+// LocalResolver is the legacy platform resolver, returning comma separated
+// ips. LocalResolverV2 is preferred if both are set.
 type LocalResolver interface {
 	LookupIP(network string, domain string) (string, error)
 }
 
 func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
-	if config.Debug {
+	performance := config.PerformanceMode
+	debug := config.Debug && !performance
+	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	} else {
 		logrus.SetLevel(logrus.WarnLevel)
 	}
 	t := &Tun2ray{
-		router:              config.Gateway4,
 		v2ray:               config.V2Ray,
-		sniffing:            config.Sniffing,
+		sniffing:            !performance && config.V2Ray.options.sniffingEnabled(config.Sniffing),
 		overrideDestination: config.OverrideDestination,
-		debug:               config.Debug,
-		dumpUid:             config.DumpUID,
-		trafficStats:        config.TrafficStats,
+		debug:               debug,
+		dumpUid:             config.DumpUID && !performance,
+		uidDumper:           config.UidDumper,
+		trafficStats:        config.TrafficStats && !performance,
+		multicastDnsMode:    config.MulticastDnsMode,
+		multicastMode:       config.MulticastMode,
+		pcap:                config.PCap && !performance,
+		icmpUnreachable:     config.IcmpUnreachable,
+		errorHandler:        config.ErrorHandler,
+		udpTable:            newSessionTable(),
+		lifecycle:           newLifecycle(config.StateListener),
+		killSwitch:          killSwitch{enabled: config.KillSwitch},
 	}
-
-	var err error
-	switch config.Implementation {
-	case comm.TunImplementationGVisor:
-		var pcapFile *os.File
-		if config.PCap {
-			path := time.Now().UTC().String()
-			path = externalAssetsPath + "/pcap/" + path + ".pcap"
-			err = os.MkdirAll(filepath.Dir(path), 0o755)
-			if err != nil {
-				return nil, newError("unable to create pcap dir").Base(err)
-			}
-			pcapFile, err = os.Create(path)
-			if err != nil {
-				return nil, newError("unable to create pcap file").Base(err)
-			}
-		}
-
-		t.dev, err = gvisor.New(config.FileDescriptor, config.MTU, t, gvisor.DefaultNIC, config.PCap, pcapFile, math.MaxUint32, config.IPv6Mode)
-	case comm.TunImplementationSystem:
-		t.dev, err = nat.New(config.FileDescriptor, config.MTU, t, config.IPv6Mode, config.ErrorHandler.HandleError)
+	t.lifecycle.set(StateStarting, nil)
+	if err := t.SetPcapFilter(config.PCapFilter); err != nil {
+		t.lifecycle.set(StateFailed, err)
+		return nil, err
+	}
+	t.statsReporter = newStatsReporter(t)
+	t.speed = new(speedSampler)
+	t.pipes = new(pipeTotals)
+	if config.Sniffing && !performance {
+		t.voip = newVoipTracker()
+	}
+	if t.uidDumper != nil {
+		t.id = strconv.FormatUint(atomic.AddUint64(&tunIds, 1), 10)
+		tunsById.Store(t.id, t)
 	}
 
+	err := t.addNic(&TunDeviceConfig{
+		FileDescriptor: config.FileDescriptor,
+		MTU:            config.MTU,
+		Gateway4:       config.Gateway4,
+		Gateway6:       config.Gateway6,
+		IPv6Mode:       config.IPv6Mode,
+		Implementation: config.Implementation,
+		DeviceName:     config.DeviceName,
+		PacketFlow:     config.PacketFlow,
+		InboundTag:     config.InboundTag,
+		DnsInboundTag:  config.DnsInboundTag,
+		Attributes:     config.InboundAttributes,
+
+		RouterAdvertisement: config.RouterAdvertisement,
+		AdvertisedPrefix:    config.AdvertisedPrefix,
+		AdvertisedDns:       config.AdvertisedDns,
+	})
 	if err != nil {
-		return nil, err
+		tunsById.Delete(t.id)
+		t.lifecycle.set(StateFailed, err)
+		return nil, exportError(err)
 	}
 
 	if !config.Protect {
 		config.Protector = noopProtectorInstance
+	} else if config.ProtectorV2 != nil {
+		config.Protector = newProtectBatcher(config.ProtectorV2)
 	}
 
+	setTcpKeepAlive(config.TcpKeepAlive)
 	dc := config.V2Ray.dnsClient
 	internet.UseAlternativeSystemDialer(&protectedDialer{
 		protector: config.Protector,
@@ -145,15 +231,16 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 		},
 	})
 	if config.BindUpstream != nil {
-		pingproto.ControlFunc = func(fd uintptr) {
-			config.BindUpstream.Protect(int32(fd))
+		t.bindUpstream = func(fd uintptr) {
+			protectAudit.record(int(fd), "", config.BindUpstream.Protect(int32(fd)))
 		}
 	} else {
-		pingproto.ControlFunc = func(fd uintptr) {
-			config.Protector.Protect(int32(fd))
+		t.bindUpstream = func(fd uintptr) {
+			protectAudit.record(int(fd), "", config.Protector.Protect(int32(fd)))
 			bindToUpstream(fd)
 		}
 	}
+	pingproto.ControlFunc = t.bindUpstream
 	if defaultOutbound, ok := t.v2ray.outboundManager.GetDefaultHandler().(*appOutbound.Handler); ok {
 		if _, isWireGuard := defaultOutbound.GetOutbound().(*wireguard.Client); isWireGuard {
 			t.defaultOutboundForPing = defaultOutbound
@@ -161,28 +248,34 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 	}
 
 	if !config.Protect {
+		setLocalResolver(nil)
 		localdns.SetLookupFunc(nil)
 	} else {
+		if config.LocalResolverV2 != nil {
+			setLocalResolver(config.LocalResolverV2)
+		} else if config.LocalResolver != nil {
+			setLocalResolver(legacyResolver{config.LocalResolver})
+		}
 		localdns.SetLookupFunc(func(network, host string) ([]v2rayNet.IP, error) {
-			response, err := config.LocalResolver.LookupIP(network, host)
-			if err != nil {
-				errStr := err.Error()
-				if strings.HasPrefix(errStr, "rcode") {
-					r, _ := strconv.Atoi(strings.Split(errStr, " ")[1])
-					return nil, dns.RCodeError(r)
+			if ips, alias, ok := hosts.lookupIP(host, network); ok {
+				if alias == "" {
+					if len(ips) == 0 {
+						return nil, dns.ErrEmptyResponse
+					}
+					return ips, nil
 				}
-				return nil, err
+				host = alias
 			}
-			addrs := strings.Split(response, ",")
-			ips := make([]v2rayNet.IP, len(addrs))
-			for i, addr := range addrs {
-				ips[i] = net.ParseIP(addr)
+			if ips, ok, err := t.v2ray.lookupRouted(network, host); ok {
+				return ips, err
 			}
-			if len(ips) == 0 {
-				return nil, dns.ErrEmptyResponse
-			} else {
-				return ips, nil
+			result, ok, err := resolveLocal(context.Background(), network, host)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, newError("no local resolver")
 			}
+			return result.ips(), result.err()
 		})
 	}
 
@@ -194,47 +287,99 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 	})
 
 	net.DefaultResolver.Dial = t.dialDNS
+	t.v2ray.tunnels.Store(t, nil)
+	t.lifecycle.set(StateStarted, nil)
 	return t, nil
 }
 
 func (t *Tun2ray) Close() {
+	t.lifecycle.set(StateStopping, nil)
 	net.DefaultResolver.Dial = nil
 	pingproto.ControlFunc = nil
 	localdns.SetLookupFunc(nil)
-
-	comm.CloseIgnore(t.dev)
+	setLocalResolver(nil)
+	t.v2ray.tunnels.Delete(t)
+	tunsById.Delete(t.id)
+	t.statsReporter.close()
+
+	t.nicsLock.Lock()
+	for _, nic := range t.nics {
+		comm.CloseIgnore(nic.dev, nic.capture)
+	}
+	t.nicsLock.Unlock()
+	t.closeCaptures()
 	t.connectionsLock.Lock()
 	for item := t.connections.Front(); item != nil; item = item.Next() {
 		common.Close(item.Value)
 	}
 	t.connectionsLock.Unlock()
+	t.lifecycle.set(StateStopped, nil)
+}
+
+// DumpEndpoints lists the live tcp endpoints of the gvisor stack, it is empty
+// for the system stack.
+func (t *Tun2ray) DumpEndpoints() string {
+	t.nicsLock.Lock()
+	defer t.nicsLock.Unlock()
+	var dump string
+	for _, nic := range t.nics {
+		if stack, ok := nic.dev.(*gvisor.GVisor); ok {
+			dump += stack.DumpEndpoints()
+		}
+	}
+	return dump
 }
 
 func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNet.Destination, conn net.Conn) {
+	t.primaryNic().NewConnection(source, destination, conn)
+}
+
+func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	t.primaryNic().NewPacket(source, destination, data, writeBack, closer)
+}
+
+func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNet.Destination, message []byte, writeBack func([]byte) error) bool {
+	return t.primaryNic().NewPingPacket(source, destination, message, writeBack)
+}
+
+func (n *tunNic) NewConnection(source v2rayNet.Destination, destination v2rayNet.Destination, conn net.Conn) {
+	n.NewConnectionWithTrafficClass(source, destination, 0, conn)
+}
+
+func (n *tunNic) NewConnectionWithTrafficClass(source v2rayNet.Destination, destination v2rayNet.Destination, tos uint8, conn net.Conn) {
+	t := n.t
+	if leakProbes.observe(v2rayNet.Network_TCP, destination) || t.blocking() {
+		comm.CloseIgnore(conn)
+		return
+	}
+	rawConn := conn
 	inbound := &session.Inbound{
 		Source:      source,
-		Tag:         "tun",
+		Tag:         n.tag,
 		NetworkType: networkType,
 		WifiSSID:    wifiSSID,
 	}
 
-	isDns := destination.Address.String() == t.router
+	isDns := destination.Address.String() == n.router
 	if isDns {
-		inbound.Tag = "dns-in"
+		inbound.Tag = n.dnsTag
 	}
 
-	var uid uint16
+	var uid uint32
 	var self bool
 
-	if t.dumpUid || t.trafficStats {
-		u, err := uidDumper.DumpUid(destination.Address.Family().IsIPv6(), false, source.Address.IP().String(), int32(source.Port), destination.Address.IP().String(), int32(destination.Port))
+	if t.dumpUid || t.trafficStats || protectAudit.isEnabled() || t.uidExclusionActive() {
+		u, err := t.lookupUid(destination.Address.Family().IsIPv6(), false, source.Address.IP().String(), int32(source.Port), destination.Address.IP().String(), int32(destination.Port))
 		if err == nil {
-			uid = uint16(u)
+			uid = uint32(u)
 			var info *UidInfo
 			self = uid > 0 && int(uid) == os.Getuid()
+			if self {
+				protectAudit.flagUnprotected("tcp", source, destination)
+			}
 			if t.debug && !self && uid >= 10000 {
 				if err == nil {
-					info, _ = uidDumper.GetUidInfo(int32(uid))
+					info, _ = t.getUidInfo(int32(uid))
 				}
 				if info == nil {
 					logrus.Infof("[TCP] %s ==> %s", source.NetAddr(), destination.NetAddr())
@@ -243,17 +388,23 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 				}
 			}
 
-			if uid < 10000 {
-				uid = 1000
-			}
+			uid = normalizeUid(uid)
 
-			inbound.Uid = uint32(uid)
+			inbound.Uid = uid
 		}
 	}
 
+	if err := loopGuard.check(n, "tcp", source, destination, self, isDns); err != nil {
+		newError("[TCP] connection dropped").Base(err).AtWarning().WriteToLog()
+		comm.CloseIgnore(conn)
+		return
+	}
+
 	ctx := core.WithContext(context.Background(), t.v2ray.core)
 	ctx = session.ContextWithInbound(ctx, inbound)
 
+	content := n.newContent()
+	setTrafficClass(content, tos)
 	if !isDns && t.sniffing {
 		req := session.SniffingRequest{
 			Enabled:   true,
@@ -262,54 +413,55 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 		if t.sniffing {
 			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "http", "tls")
 		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
+		content.SniffingRequest = req
 	}
+	var flow *domainFlow
+	if t.trafficStats && !self && !isDns {
+		flow = t.domainStats.newFlow(content, source, destination, uid)
+		defer t.domainStats.closeFlow(flow)
+	}
+	ctx = session.ContextWithContent(ctx, content)
+	tracker := new(failureTracker)
+	ctx = session.TrackedConnectionError(ctx, tracker)
 
-	var stats *appStats
 	if t.trafficStats && !self && !isDns {
-		if iStats, exists := t.appStats.Load(uid); exists {
-			stats = iStats.(*appStats)
-		} else {
-			iCond, loaded := t.lockTable.LoadOrStore(uid, sync.NewCond(&sync.Mutex{}))
-			cond := iCond.(*sync.Cond)
-			if loaded {
-				cond.L.Lock()
-				cond.Wait()
-				iStats, exists = t.appStats.Load(uid)
-				if !exists {
-					panic("unexpected sync read failed")
-				}
-				stats = iStats.(*appStats)
-				cond.L.Unlock()
-			} else {
-				stats = &appStats{}
-				t.appStats.Store(uid, stats)
-				t.lockTable.Delete(uid)
-				cond.Broadcast()
-			}
-		}
+		stats := t.getAppStats(uid)
 		atomic.AddInt32(&stats.tcpConn, 1)
 		atomic.AddUint32(&stats.tcpConnTotal, 1)
 		atomic.StoreInt64(&stats.deactivateAt, 0)
+		t.statsReporter.event(uid, "tcp", destination.NetAddr(), true)
 		defer func() {
 			if atomic.AddInt32(&stats.tcpConn, -1)+atomic.LoadInt32(&stats.udpConn) == 0 {
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
+			t.statsReporter.event(uid, "tcp", destination.NetAddr(), false)
 		}()
-		conn = &statsConn{conn, &stats.uplink, &stats.downlink}
+		conn = &statsConn{conn, &stats.uplink, &stats.downlink, flow, t.statsReporter, t.speed}
 	}
 
+	pipes := newPipeMeter(t.pipes)
 	t.connectionsLock.Lock()
-	element := t.connections.PushBack(conn)
+	element := t.connections.PushBack(&trackedConnection{conn, ctx, destination, pipes})
 	t.connectionsLock.Unlock()
 
-	reader, input := pipe.New()
-	link := &transport.Link{Reader: reader, Writer: connWriter{conn, buf.NewWriter(conn)}}
-	err := t.v2ray.dispatcher.DispatchLink(ctx, destination, link)
+	reader, uplink := pipe.New(pipe.WithSizeLimit(tcpUplinkBufferSize))
+	input := &meteredPipeWriter{uplink, pipes.uplink}
+	writer := newConnWriter(rawConn, conn, pipes.downlink)
+	link := &transport.Link{Reader: reader, Writer: writer}
+	var err error
+	if !isDns && !self && t.isUidExcluded(uid) {
+		var handler outbound.Handler
+		if handler, err = t.v2ray.excludedHandler(); err == nil {
+			go handler.Dispatch(excludedContext(ctx, content, destination), link)
+		}
+	} else {
+		err = t.v2ray.dispatcher.DispatchLink(ctx, destination, link)
+	}
 	if err != nil {
 		newError("[TCP] dispatchLink failed: ", err).WriteToLog()
+		if !isDns && !self {
+			recentFailures.record(destination, uid, content, flow, err)
+		}
 		return
 	}
 
@@ -319,181 +471,360 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 		comm.CloseIgnore(conn, link.Reader, link.Writer)
 		newError("connection finished: ", err).AtDebug().WriteToLog()
 	} else {
+		// the app closed its side, keep receiving until the response ends
+		comm.CloseIgnore(input)
+		writer.wait(tcpHalfCloseTimeout)
 		comm.CloseIgnore(conn, link.Writer, link.Reader)
 	}
+	if !isDns && !self && atomic.LoadInt32(&writer.written) == 0 {
+		recentFailures.record(destination, uid, content, flow, tracker.error())
+	}
 
 	t.connectionsLock.Lock()
 	t.connections.Remove(element)
 	t.connectionsLock.Unlock()
 }
 
+// tcpHalfCloseTimeout closes connections half closed by the app once the
+// response has been idle this long, and connections half closed by the
+// outbound once they have been this long.
+const tcpHalfCloseTimeout = 2 * time.Minute
+
+// connWriter writes the response to the app, closing it is forwarded as a fin
+// and interrupting it as a reset.
 type connWriter struct {
+	lastWrite int64 // first for 64-bit alignment on 32-bit platforms
+	written   int32
+
 	net.Conn
 	buf.Writer
+	raw      net.Conn
+	meter    *linkMeter
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
-func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
-	natKey := source.NetAddr()
+func newConnWriter(raw net.Conn, conn net.Conn, meter *linkMeter) *connWriter {
+	return &connWriter{
+		Conn:      conn,
+		Writer:    buf.NewWriter(conn),
+		raw:       raw,
+		meter:     meter,
+		done:      make(chan struct{}),
+		lastWrite: time.Now().UnixNano(),
+	}
+}
 
-	sendTo := func() bool {
-		iConn, ok := t.udpTable.Load(natKey)
-		if !ok {
-			return false
-		}
-		conn := iConn.(net.PacketConn)
-		_, err := conn.WriteTo(data, &net.UDPAddr{
-			IP:   destination.Address.IP(),
-			Port: int(destination.Port),
-		})
-		if err != nil {
-			_ = conn.Close()
+func (w *connWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	now := time.Now()
+	atomic.StoreInt64(&w.lastWrite, now.UnixNano())
+	atomic.StoreInt32(&w.written, 1)
+	w.meter.begin(now, mb.Len())
+	err := w.Writer.WriteMultiBuffer(mb)
+	w.meter.end()
+	return err
+}
+
+func (w *connWriter) Close() error {
+	if closeWriter, ok := w.raw.(interface{ CloseWrite() error }); ok {
+		_ = closeWriter.CloseWrite()
+	}
+	// the app may never close its side, do not read from it forever
+	_ = w.raw.SetReadDeadline(time.Now().Add(tcpHalfCloseTimeout))
+	w.doneOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *connWriter) Interrupt() {
+	if lingerSetter, ok := w.raw.(interface{ SetLinger(sec int) error }); ok {
+		_ = lingerSetter.SetLinger(0)
+	}
+	_ = w.raw.Close()
+	w.doneOnce.Do(func() { close(w.done) })
+}
+
+func (w *connWriter) wait(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&w.lastWrite))) > timeout {
+				return
+			}
 		}
-		return true
 	}
+}
 
-	var cond *sync.Cond
+func (n *tunNic) NewPacket(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	n.NewPacketWithTrafficClass(source, destination, 0, data, writeBack, closer)
+}
 
-	if sendTo() {
+func (n *tunNic) NewPacketWithTrafficClass(source v2rayNet.Destination, destination v2rayNet.Destination, tos uint8, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	t := n.t
+	if leakProbes.observe(v2rayNet.Network_UDP, destination) {
 		comm.CloseIgnore(closer)
 		return
-	} else {
-		iCond, loaded := t.lockTable.LoadOrStore(natKey, sync.NewCond(&sync.Mutex{}))
-		cond = iCond.(*sync.Cond)
-		if loaded {
-			cond.L.Lock()
-			cond.Wait()
-			sendTo()
-			cond.L.Unlock()
+	}
+	if t.blocking() {
+		writeUnreachable(closer, errBlocked)
+		comm.CloseIgnore(closer)
+		return
+	}
+	natKey := n.natKey(source.NetAddr())
+	isDns := destination.Address.String() == n.router
 
+	if t.multicastDnsMode != MulticastDnsModeDisabled && isMulticastDns(destination) {
+		n.handleMulticastDns(source, destination, data, writeBack, closer)
+		return
+	}
+
+	if isDns {
+		if response := t.hijackDns(source, destination, data); response != nil {
+			if _, err := writeBack(clampDnsTtl(response), nil); err != nil {
+				newError("[DNS] failed to write response").Base(err).WriteToLog()
+			}
 			comm.CloseIgnore(closer)
 			return
 		}
+		if dnsInflight.join(data, writeBack, closer) {
+			return
+		}
 	}
 
-	inbound := &session.Inbound{
-		Source:      source,
-		Tag:         "tun",
-		NetworkType: networkType,
-		WifiSSID:    wifiSSID,
+	isSip := t.voip != nil && !isDns && isSipMessage(data)
+	if isSip {
+		if tag, ok := t.voipSessions.Load(natKey); ok {
+			t.voip.inspect(data, source, tag.(string), true)
+		}
 	}
-	isDns := destination.Address.String() == t.router
 
-	if isDns {
-		inbound.Tag = "dns-in"
+	sendTo := func(conn packetConn) {
+		_, err := conn.WriteTo(data, &net.UDPAddr{
+			IP:   destination.Address.IP(),
+			Port: int(destination.Port),
+		})
+		if err != nil {
+			_ = conn.Close()
+		}
 	}
 
-	var uid uint16
-	var self bool
+	if conn, ok := t.udpTable.load(natKey); ok {
+		sendTo(conn)
+		comm.CloseIgnore(closer)
+		return
+	}
 
-	if t.dumpUid || t.trafficStats {
+	var (
+		ctx         context.Context
+		content     *session.Content
+		tracker     *failureTracker
+		flow        *domainFlow
+		stats       *appStats
+		uid         uint32
+		self        bool
+		sipOutbound string
+	)
+	conn, created, err := t.udpTable.open(natKey, func() (packetConn, time.Duration, error) {
+		inbound := &session.Inbound{
+			Source:      source,
+			Tag:         n.tag,
+			NetworkType: networkType,
+			WifiSSID:    wifiSSID,
+		}
 
-		u, err := uidDumper.DumpUid(source.Address.Family().IsIPv6(), true, source.Address.String(), int32(source.Port), destination.Address.String(), int32(destination.Port))
-		if err == nil {
-			uid = uint16(u)
-			var info *UidInfo
-			self = uid > 0 && int(uid) == os.Getuid()
+		if isDns {
+			inbound.Tag = n.dnsTag
+		}
 
-			if t.debug && !self && uid >= 1000 {
-				if err == nil {
-					info, _ = uidDumper.GetUidInfo(int32(uid))
-				}
-				var tag string
-				if !isDns {
-					tag = "UDP"
-				} else {
-					tag = "DNS"
+		if t.dumpUid || t.trafficStats || protectAudit.isEnabled() || t.uidExclusionActive() {
+
+			u, err := t.lookupUid(source.Address.Family().IsIPv6(), true, source.Address.String(), int32(source.Port), destination.Address.String(), int32(destination.Port))
+			if err == nil {
+				uid = uint32(u)
+				var info *UidInfo
+				self = uid > 0 && int(uid) == os.Getuid()
+				if self {
+					protectAudit.flagUnprotected("udp", source, destination)
 				}
 
-				if info == nil {
-					logrus.Infof("[%s] %s ==> %s", tag, source.NetAddr(), destination.NetAddr())
-				} else {
-					logrus.Infof("[%s][%s (%d/%s)] %s ==> %s", tag, info.Label, uid, info.PackageName, source.NetAddr(), destination.NetAddr())
+				if t.debug && !self && uid >= 1000 {
+					if err == nil {
+						info, _ = t.getUidInfo(int32(uid))
+					}
+					var tag string
+					if !isDns {
+						tag = "UDP"
+					} else {
+						tag = "DNS"
+					}
+
+					if info == nil {
+						logrus.Infof("[%s] %s ==> %s", tag, source.NetAddr(), destination.NetAddr())
+					} else {
+						logrus.Infof("[%s][%s (%d/%s)] %s ==> %s", tag, info.Label, uid, info.PackageName, source.NetAddr(), destination.NetAddr())
+					}
 				}
-			}
 
-			if uid < 10000 {
-				uid = 1000
+				uid = normalizeUid(uid)
+
+				inbound.Uid = uid
 			}
 
-			inbound.Uid = uint32(uid)
 		}
 
-	}
+		if err := loopGuard.check(n, "udp", source, destination, self, isDns); err != nil {
+			newError("[UDP] session dropped").Base(err).AtWarning().WriteToLog()
+			return nil, 0, err
+		}
 
-	ctx := core.WithContext(context.Background(), t.v2ray.core)
-	ctx = session.ContextWithInbound(ctx, inbound)
+		ctx = core.WithContext(context.Background(), t.v2ray.core)
+		ctx = session.ContextWithInbound(ctx, inbound)
 
-	if !isDns && t.sniffing {
-		req := session.SniffingRequest{
-			Enabled:   true,
-			RouteOnly: !t.overrideDestination,
+		content = n.newContent()
+		setTrafficClass(content, tos)
+		if !isDns && t.sniffing {
+			req := session.SniffingRequest{
+				Enabled:   true,
+				RouteOnly: !t.overrideDestination,
+			}
+			if t.sniffing {
+				req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "quic")
+			}
+			content.SniffingRequest = req
 		}
-		if t.sniffing {
-			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "quic")
+		if t.trafficStats && !self && !isDns {
+			flow = t.domainStats.newFlow(content, source, destination, uid)
+		}
+		ctx = session.ContextWithContent(ctx, content)
+		tracker = new(failureTracker)
+		ctx = session.TrackedConnectionError(ctx, tracker)
+
+		timeout := time.Minute * 5
+		var handler outbound.Handler
+		if isSip {
+			sipOutbound = t.v2ray.pickOutbound(ctx, destination)
+			t.voipSessions.Store(natKey, sipOutbound)
+			t.voip.inspect(data, source, sipOutbound, true)
+			timeout = voipTimeout
+		} else if !isDns && !self && t.isUidExcluded(uid) {
+			if handler, _ = t.v2ray.excludedHandler(); handler != nil {
+				ctx = excludedContext(ctx, content, destination)
+			}
+		} else if t.voip != nil && !isDns {
+			if pin, ok := t.voip.match(source, destination); ok {
+				handler = t.v2ray.outboundHandler(pin.outbound)
+				timeout = voipTimeout
+			}
 		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
-	}
-
-	conn, err := t.v2ray.dialUDP(ctx, destination, time.Minute*5)
-	if err != nil {
-		logrus.Errorf("[UDP] dial failed: %s", err.Error())
-		return
-	}
 
-	var stats *appStats
-	if t.trafficStats && !self && !isDns {
-		if iStats, exists := t.appStats.Load(uid); exists {
-			stats = iStats.(*appStats)
+		var conn packetConn
+		if handler != nil {
+			conn = t.v2ray.handleUDP(ctx, handler, destination, timeout)
 		} else {
-			iCond, loaded := t.lockTable.LoadOrStore(uid, sync.NewCond(&sync.Mutex{}))
-			cond := iCond.(*sync.Cond)
-			if loaded {
-				cond.L.Lock()
-				cond.Wait()
-				iStats, exists = t.appStats.Load(uid)
-				if !exists {
-					panic("unexpected sync read failed")
+			var err error
+			conn, err = t.v2ray.dialUDP(ctx, destination, timeout)
+			if err != nil {
+				logrus.Errorf("[UDP] dial failed: %s", err.Error())
+				if !isDns && !self {
+					recentFailures.record(destination, uid, content, flow, err)
+				}
+				if t.icmpUnreachable {
+					writeUnreachable(closer, err)
 				}
-				stats = iStats.(*appStats)
-				cond.L.Unlock()
-			} else {
-				stats = &appStats{}
-				t.appStats.Store(uid, stats)
-				t.lockTable.Delete(uid)
-				cond.Broadcast()
+				if flow != nil {
+					t.domainStats.closeFlow(flow)
+				}
+				return nil, 0, err
 			}
 		}
-		atomic.AddInt32(&stats.udpConn, 1)
-		atomic.AddUint32(&stats.udpConnTotal, 1)
-		atomic.StoreInt64(&stats.deactivateAt, 0)
+		if !isDns && udpResumeEnabled() {
+			conn = newResumableConn(conn, func() (packetConn, error) {
+				if handler == nil {
+					return t.v2ray.dialUDP(ctx, destination, timeout)
+				}
+				// the handler may have been recreated meanwhile
+				pinned := t.v2ray.outboundHandler(handler.Tag())
+				if pinned == nil {
+					return nil, newError("outbound ", handler.Tag(), " removed")
+				}
+				return t.v2ray.handleUDP(ctx, pinned, destination, timeout), nil
+			})
+		}
+
+		if t.trafficStats && !self && !isDns {
+			stats = t.getAppStats(uid)
+			atomic.AddInt32(&stats.udpConn, 1)
+			atomic.AddUint32(&stats.udpConnTotal, 1)
+			atomic.StoreInt64(&stats.deactivateAt, 0)
+			t.statsReporter.event(uid, "udp", destination.NetAddr(), true)
+			conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink, flow, t.statsReporter, t.speed}
+		}
+
+		if rule := udpKeepAlives.match(destination.Port); rule != nil && !isDns {
+			keepAlive := &keepAliveConn{packetConn: conn, lastWrite: time.Now().UnixNano()}
+			conn = keepAlive
+			go keepAlive.loop(rule, destination)
+		}
+		return conn, timeout, nil
+	})
+	if err != nil || !created {
+		if err == nil {
+			sendTo(conn)
+		}
+		comm.CloseIgnore(closer)
+		return
+	}
+
+	if flow != nil {
+		defer t.domainStats.closeFlow(flow)
+	}
+	if stats != nil {
 		defer func() {
 			if atomic.AddInt32(&stats.udpConn, -1)+atomic.LoadInt32(&stats.tcpConn) == 0 {
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
+			t.statsReporter.event(uid, "udp", destination.NetAddr(), false)
 		}()
-		conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink}
 	}
 
 	t.connectionsLock.Lock()
-	element := t.connections.PushBack(conn)
+	element := t.connections.PushBack(&trackedConnection{conn, ctx, destination, nil})
 	t.connectionsLock.Unlock()
 
-	t.udpTable.Store(natKey, conn)
-
-	go sendTo()
-
-	t.lockTable.Delete(natKey)
-	cond.Broadcast()
+	go sendTo(conn)
 
+	var received bool
 	for {
 		buffer, addr, err := conn.readFrom()
 		if err != nil {
+			if !received {
+				switch content.Attribute(blockAttribute) {
+				case BlockTagReject:
+					writeUnreachable(closer, errBlocked)
+				case "":
+					if t.icmpUnreachable {
+						writeUnreachable(closer, err)
+					}
+				}
+				if !isDns && !self {
+					recentFailures.record(destination, uid, content, flow, tracker.error())
+				}
+			}
 			break
 		}
+		received = true
+		t.udpTable.touch(natKey)
 		if isDns {
 			addr = nil
+			dnsNegative.record(buffer)
+			buffer = clampDnsTtl(buffer)
+			dnsInflight.complete(buffer)
+		}
+		if isSip && isSipMessage(buffer) {
+			t.voip.inspect(buffer, source, sipOutbound, false)
 		}
 		if addr, ok := addr.(*net.UDPAddr); ok {
 			_, err = writeBack(buffer, addr)
@@ -506,22 +837,28 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 	}
 	// close
 	comm.CloseIgnore(conn, closer)
-	t.udpTable.Delete(natKey)
+	t.udpTable.remove(natKey, conn)
+	if isSip {
+		t.voipSessions.Delete(natKey)
+	}
 
 	t.connectionsLock.Lock()
 	t.connections.Remove(element)
 	t.connectionsLock.Unlock()
 }
 
-func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNet.Destination, message []byte, writeBack func([]byte) error) bool {
-	natKey := fmt.Sprint(source.Address, "-", destination.Address)
+// errPingUnhandled fails the ping sessions no outbound takes, the stack
+// answers them itself.
+var errPingUnhandled = errors.New("ping unhandled")
 
-	sendTo := func() bool {
-		iConn, ok := t.udpTable.Load(natKey)
-		if !ok {
-			return false
-		}
-		conn := iConn.(net.PacketConn)
+func (n *tunNic) NewPingPacket(source v2rayNet.Destination, destination v2rayNet.Destination, message []byte, writeBack func([]byte) error) bool {
+	t := n.t
+	if t.blocking() {
+		return true
+	}
+	natKey := n.natKey(fmt.Sprint(source.Address, "-", destination.Address))
+
+	sendTo := func(conn packetConn) {
 		_, err := conn.WriteTo(message, &net.UDPAddr{
 			IP:   destination.Address.IP(),
 			Port: int(destination.Port),
@@ -530,68 +867,49 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 			_ = conn.Close()
 			newError("failed to write ping request to ", destination.Address).Base(err).WriteToLog()
 		}
-		return true
 	}
 
-	var cond *sync.Cond
-
-	if sendTo() {
+	if conn, ok := t.udpTable.load(natKey); ok {
+		sendTo(conn)
 		return true
-	} else {
-		iCond, loaded := t.lockTable.LoadOrStore(natKey, sync.NewCond(&sync.Mutex{}))
-		cond = iCond.(*sync.Cond)
-		if loaded {
-			cond.L.Lock()
-			cond.Wait()
-			sendTo()
-			cond.L.Unlock()
-
-			return true
-		}
 	}
 
-	defer func() {
-		t.lockTable.Delete(natKey)
-		cond.Broadcast()
-	}()
-
-	ctx := core.WithContext(context.Background(), t.v2ray.core)
-	ctx = session.ContextWithInbound(ctx, &session.Inbound{
-		Source:      source,
-		Tag:         "tun",
-		NetworkType: networkType,
-		WifiSSID:    wifiSSID,
-	})
-	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
-	ctx = session.ContextWithContent(ctx, &session.Content{Protocol: "ping"})
-
-	var handler outbound.Handler
-	if route, err := t.v2ray.router.PickRoute(routing_session.AsRoutingContext(ctx)); err == nil {
-		tag := route.GetOutboundTag()
-		handler = t.v2ray.outboundManager.GetHandler(tag)
-		if handler != nil {
-			newError("taking detour [", tag, "] for [", destination.Address, "]").WriteToLog()
-		} else {
-			newError("non existing tag: ", tag).AtWarning().WriteToLog()
-			return false
+	var ctx context.Context
+	conn, created, err := t.udpTable.open(natKey, func() (packetConn, time.Duration, error) {
+		ctx = core.WithContext(context.Background(), t.v2ray.core)
+		ctx = session.ContextWithInbound(ctx, &session.Inbound{
+			Source:      source,
+			Tag:         n.tag,
+			NetworkType: networkType,
+			WifiSSID:    wifiSSID,
+		})
+		ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+		content := n.newContent()
+		content.Protocol = "ping"
+		ctx = session.ContextWithContent(ctx, content)
+
+		handler := n.pickPingOutbound(ctx, destination)
+		if handler == nil {
+			return nil, 0, errPingUnhandled
 		}
-	} else if t.defaultOutboundForPing != nil {
-		handler = t.defaultOutboundForPing
-		newError("default route for ", destination.Address).AtWarning().WriteToLog()
-
-	} else {
+		timeout := time.Second * 30
+		return t.v2ray.handleUDP(ctx, handler, destination, timeout), timeout, nil
+	})
+	if err == errPingUnhandled {
 		return false
 	}
-
-	conn := t.v2ray.handleUDP(ctx, handler, destination, time.Second*30)
+	if err != nil || !created {
+		if err == nil {
+			sendTo(conn)
+		}
+		return true
+	}
 
 	t.connectionsLock.Lock()
-	element := t.connections.PushBack(conn)
+	element := t.connections.PushBack(&trackedConnection{conn, ctx, destination, nil})
 	t.connectionsLock.Unlock()
 
-	t.udpTable.Store(natKey, conn)
-
-	go sendTo()
+	go sendTo(conn)
 
 	go func() {
 		for {
@@ -600,6 +918,7 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 				newError("failed to read ping response from ", destination.Address).Base(err).WriteToLog()
 				break
 			}
+			t.udpTable.touch(natKey)
 			err = writeBack(buffer)
 			if err != nil {
 				newError("failed to write ping response back").Base(err).WriteToLog()
@@ -608,7 +927,7 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 		}
 		// close
 		comm.CloseIgnore(conn)
-		t.udpTable.Delete(natKey)
+		t.udpTable.remove(natKey, conn)
 
 		t.connectionsLock.Lock()
 		t.connections.Remove(element)
@@ -620,10 +939,10 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 
 func (t *Tun2ray) dialDNS(ctx context.Context, _, _ string) (conn net.Conn, err error) {
 	conn, err = t.v2ray.dialContext(session.ContextWithInbound(ctx, &session.Inbound{
-		Tag: "dns-in",
+		Tag: t.primaryNic().dnsTag,
 	}), v2rayNet.Destination{
 		Network: v2rayNet.Network_UDP,
-		Address: v2rayNet.ParseAddress(t.router),
+		Address: v2rayNet.ParseAddress(t.primaryNic().router),
 		Port:    53,
 	})
 	if err == nil {
@@ -0,0 +1,12 @@
+package tun
+
+import "io"
+
+// Device is a tun device on platforms without a file descriptor the stacks
+// can read directly, such as wintun and utun. Read and Write transfer one IP
+// packet without any platform header.
+type Device interface {
+	io.ReadWriteCloser
+	Name() string
+	MTU() int
+}
@@ -15,3 +15,32 @@ type Handler interface {
 	NewPacket(source net.Destination, destination net.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer)
 	NewPingPacket(source net.Destination, destination net.Destination, message []byte, writeBack func([]byte) error) bool
 }
+
+// TrafficClassHandler is implemented by handlers that take the traffic class
+// (the DSCP and ECN bits) of the first packet of a flow, stacks that can read
+// it call these methods instead of the Handler ones.
+type TrafficClassHandler interface {
+	NewConnectionWithTrafficClass(source net.Destination, destination net.Destination, tos uint8, conn net.Conn)
+	NewPacketWithTrafficClass(source net.Destination, destination net.Destination, tos uint8, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer)
+}
+
+const (
+	UnreachableHost = iota
+	UnreachablePort
+	UnreachableProhibited
+)
+
+// UnreachableWriter is implemented by the closer passed to NewPacket when the
+// stack can answer the packet with an ICMP destination unreachable, code is
+// one of the Unreachable constants.
+type UnreachableWriter interface {
+	WriteUnreachable(code int) error
+}
+
+// PacketCapture receives the raw IP packets passing a tun device, inbound
+// ones were read from the device. Stacks check Capturing before copying a
+// packet out.
+type PacketCapture interface {
+	Capturing() bool
+	CapturePacket(packet []byte, inbound bool)
+}
@@ -0,0 +1,129 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	utunControlName = "com.apple.net.utun_control"
+	utunOptIfname   = 2
+	sysprotoControl = 2
+	utunHeaderSize  = 4
+)
+
+var _ Device = (*utun)(nil)
+
+// utun is a macOS utun interface, its packets carry the address family in a
+// four byte header.
+type utun struct {
+	file *os.File
+	name string
+	mtu  int
+	// buffer is only used by Read, which the stack calls from one goroutine
+	buffer []byte
+}
+
+// OpenUtun creates the utun interface name, e.g. utun7, or the next free one
+// if name is empty.
+func OpenUtun(name string, mtu int) (Device, error) {
+	unit := uint32(0)
+	if name != "" {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, "utun"))
+		if err != nil || !strings.HasPrefix(name, "utun") {
+			return nil, fmt.Errorf("invalid utun name %s", name)
+		}
+		unit = uint32(index) + 1
+	}
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, err
+	}
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], utunControlName)
+	if err = unix.IoctlCtlInfo(fd, info); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("get utun control: %w", err)
+	}
+	if err = unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: unit}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("create utun: %w", err)
+	}
+	if name, err = unix.GetsockoptString(fd, sysprotoControl, utunOptIfname); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = setUtunMTU(name, mtu); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &utun{file: os.NewFile(uintptr(fd), name), name: name, mtu: mtu}, nil
+}
+
+func setUtunMTU(name string, mtu int) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifreq := &unix.IfreqMTU{MTU: int32(mtu)}
+	copy(ifreq.Name[:], name)
+	if err = unix.IoctlSetIfreqMTU(fd, ifreq); err != nil {
+		return fmt.Errorf("set utun mtu: %w", err)
+	}
+	return nil
+}
+
+func (t *utun) Name() string {
+	return t.name
+}
+
+func (t *utun) MTU() int {
+	return t.mtu
+}
+
+func (t *utun) Read(p []byte) (int, error) {
+	if len(t.buffer) < utunHeaderSize+len(p) {
+		t.buffer = make([]byte, utunHeaderSize+len(p))
+	}
+	n, err := t.file.Read(t.buffer[:utunHeaderSize+len(p)])
+	if n <= utunHeaderSize {
+		return 0, err
+	}
+	return copy(p, t.buffer[utunHeaderSize:n]), err
+}
+
+func (t *utun) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	family := uint32(unix.AF_INET)
+	switch p[0] >> 4 {
+	case 4:
+	case 6:
+		family = unix.AF_INET6
+	default:
+		return 0, errors.New("unknown ip version")
+	}
+	packet := make([]byte, utunHeaderSize+len(p))
+	binary.BigEndian.PutUint32(packet, family)
+	copy(packet[utunHeaderSize:], p)
+	if _, err := t.file.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *utun) Close() error {
+	return t.file.Close()
+}
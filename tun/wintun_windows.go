@@ -0,0 +1,155 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	wintunTunnelType   = "libcore"
+	wintunRingCapacity = 0x800000
+)
+
+var (
+	wintunDll                  = windows.NewLazyDLL("wintun.dll")
+	wintunCreateAdapter        = wintunDll.NewProc("WintunCreateAdapter")
+	wintunCloseAdapter         = wintunDll.NewProc("WintunCloseAdapter")
+	wintunStartSession         = wintunDll.NewProc("WintunStartSession")
+	wintunEndSession           = wintunDll.NewProc("WintunEndSession")
+	wintunGetReadWaitEvent     = wintunDll.NewProc("WintunGetReadWaitEvent")
+	wintunReceivePacket        = wintunDll.NewProc("WintunReceivePacket")
+	wintunReleaseReceivePacket = wintunDll.NewProc("WintunReleaseReceivePacket")
+	wintunAllocateSendPacket   = wintunDll.NewProc("WintunAllocateSendPacket")
+	wintunSendPacket           = wintunDll.NewProc("WintunSendPacket")
+)
+
+var _ Device = (*wintun)(nil)
+
+// wintun is an adapter of the wintun driver, wintun.dll must be next to the
+// executable. The client configures its addresses and MTU, like on other
+// platforms.
+type wintun struct {
+	name      string
+	mtu       int
+	adapter   uintptr
+	session   uintptr
+	readEvent windows.Handle
+	closed    windows.Handle
+
+	// access keeps the session alive while packets are read or written
+	access    sync.RWMutex
+	isClosed  bool
+	closeOnce sync.Once
+}
+
+// OpenWintun creates the wintun adapter name, it is removed on Close.
+func OpenWintun(name string, mtu int) (Device, error) {
+	if err := wintunDll.Load(); err != nil {
+		return nil, fmt.Errorf("load wintun.dll: %w", err)
+	}
+	name16, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	type16, err := windows.UTF16PtrFromString(wintunTunnelType)
+	if err != nil {
+		return nil, err
+	}
+	adapter, _, err := wintunCreateAdapter.Call(uintptr(unsafe.Pointer(name16)), uintptr(unsafe.Pointer(type16)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("create wintun adapter: %w", err)
+	}
+	session, _, err := wintunStartSession.Call(adapter, wintunRingCapacity)
+	if session == 0 {
+		_, _, _ = wintunCloseAdapter.Call(adapter)
+		return nil, fmt.Errorf("start wintun session: %w", err)
+	}
+	readEvent, _, _ := wintunGetReadWaitEvent.Call(session)
+	closed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		_, _, _ = wintunEndSession.Call(session)
+		_, _, _ = wintunCloseAdapter.Call(adapter)
+		return nil, err
+	}
+	return &wintun{
+		name:      name,
+		mtu:       mtu,
+		adapter:   adapter,
+		session:   session,
+		readEvent: windows.Handle(readEvent),
+		closed:    closed,
+	}, nil
+}
+
+func (t *wintun) Name() string {
+	return t.name
+}
+
+func (t *wintun) MTU() int {
+	return t.mtu
+}
+
+func (t *wintun) Read(p []byte) (int, error) {
+	for {
+		t.access.RLock()
+		if t.isClosed {
+			t.access.RUnlock()
+			return 0, windows.ERROR_HANDLE_EOF
+		}
+		var size uint32
+		packet, _, err := wintunReceivePacket.Call(t.session, uintptr(unsafe.Pointer(&size)))
+		if packet != 0 {
+			n := copy(p, unsafe.Slice(*(**byte)(unsafe.Pointer(&packet)), size))
+			_, _, _ = wintunReleaseReceivePacket.Call(t.session, packet)
+			t.access.RUnlock()
+			return n, nil
+		}
+		t.access.RUnlock()
+		if !errors.Is(err, windows.ERROR_NO_MORE_ITEMS) {
+			return 0, fmt.Errorf("read wintun: %w", err)
+		}
+		event, err := windows.WaitForMultipleObjects([]windows.Handle{t.readEvent, t.closed}, false, windows.INFINITE)
+		if err != nil {
+			return 0, err
+		}
+		if event == windows.WAIT_OBJECT_0+1 {
+			return 0, windows.ERROR_HANDLE_EOF
+		}
+	}
+}
+
+func (t *wintun) Write(p []byte) (int, error) {
+	t.access.RLock()
+	defer t.access.RUnlock()
+	if t.isClosed {
+		return 0, windows.ERROR_HANDLE_EOF
+	}
+	packet, _, err := wintunAllocateSendPacket.Call(t.session, uintptr(len(p)))
+	if packet == 0 {
+		// the ring is full, drop the packet like a busy link would
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			return len(p), nil
+		}
+		return 0, fmt.Errorf("write wintun: %w", err)
+	}
+	copy(unsafe.Slice(*(**byte)(unsafe.Pointer(&packet)), len(p)), p)
+	_, _, _ = wintunSendPacket.Call(t.session, packet)
+	return len(p), nil
+}
+
+func (t *wintun) Close() error {
+	t.closeOnce.Do(func() {
+		_ = windows.SetEvent(t.closed)
+		t.access.Lock()
+		defer t.access.Unlock()
+		t.isClosed = true
+		_, _, _ = wintunEndSession.Call(t.session)
+		_, _, _ = wintunCloseAdapter.Call(t.adapter)
+		_ = windows.CloseHandle(t.closed)
+	})
+	return nil
+}
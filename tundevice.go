@@ -0,0 +1,12 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package libcore
+
+import (
+	"libcore/tun"
+)
+
+func openTunDevice(implementation int32, name string, mtu int) (tun.Device, error) {
+	return nil, newError("tun implementation ", implementation, " is not supported on this platform")
+}
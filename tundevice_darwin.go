@@ -0,0 +1,16 @@
+//go:build darwin && !ios
+// +build darwin,!ios
+
+package libcore
+
+import (
+	"libcore/comm"
+	"libcore/tun"
+)
+
+func openTunDevice(implementation int32, name string, mtu int) (tun.Device, error) {
+	if implementation != comm.TunImplementationUtun {
+		return nil, newError("tun implementation ", implementation, " is not supported on macOS")
+	}
+	return tun.OpenUtun(name, mtu)
+}
@@ -0,0 +1,11 @@
+package libcore
+
+import (
+	"libcore/tun"
+)
+
+// openTunDevice fails on iOS, where the NetworkExtension sandbox only offers
+// the packet flow implementation.
+func openTunDevice(implementation int32, name string, mtu int) (tun.Device, error) {
+	return nil, newError("tun implementation ", implementation, " is not supported on iOS, use the packet flow")
+}
@@ -0,0 +1,16 @@
+package libcore
+
+import (
+	"libcore/comm"
+	"libcore/tun"
+)
+
+func openTunDevice(implementation int32, name string, mtu int) (tun.Device, error) {
+	if implementation != comm.TunImplementationWintun {
+		return nil, newError("tun implementation ", implementation, " is not supported on Windows")
+	}
+	if name == "" {
+		name = "libcore"
+	}
+	return tun.OpenWintun(name, mtu)
+}
@@ -0,0 +1,230 @@
+package libcore
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/session"
+
+	"libcore/comm"
+	"libcore/gvisor"
+	"libcore/nat"
+	"libcore/tun"
+)
+
+var _ tun.Handler = (*tunNic)(nil)
+
+// TunDeviceConfig describes a tun device driven by a Tun2ray, connections
+// from it use its own gateway and inbound tags ("tun" and "dns-in" if empty).
+// Attributes are "key=value" pairs separated by commas or lines, attached to
+// every connection for attrs routing rules.
+type TunDeviceConfig struct {
+	FileDescriptor int32
+	MTU            int32
+	Gateway4       string
+	Gateway6       string
+	IPv6Mode       int32
+	Implementation int32
+	// DeviceName is the interface created by the wintun and utun
+	// implementations, which take no FileDescriptor.
+	DeviceName    string
+	InboundTag    string
+	DnsInboundTag string
+	Attributes    string
+
+	RouterAdvertisement bool
+	AdvertisedPrefix    string
+	AdvertisedDns       string
+
+	// PacketFlow is used by the packet flow implementation, which takes no
+	// FileDescriptor either.
+	PacketFlow PacketFlow
+}
+
+type tunNic struct {
+	t          *Tun2ray
+	index      int
+	dev        tun.Tun
+	flow       *packetFlowDevice
+	capture    *nicCapture
+	router     string
+	router6    string
+	tag        string
+	dnsTag     string
+	ipv6Mode   int32
+	attributes map[string]string
+}
+
+// AddTun starts handling another tun device, e.g. a separate IPv6 fd or the
+// vpn of a work profile. It shares connections and stats with the first one.
+func (t *Tun2ray) AddTun(config *TunDeviceConfig) error {
+	return exportError(t.addNic(config))
+}
+
+func (t *Tun2ray) addNic(config *TunDeviceConfig) error {
+	attributes, err := parseAttributes(config.Attributes)
+	if err != nil {
+		return err
+	}
+
+	t.nicsLock.Lock()
+	defer t.nicsLock.Unlock()
+
+	nic := &tunNic{
+		t:          t,
+		index:      len(t.nics),
+		router:     config.Gateway4,
+		router6:    config.Gateway6,
+		tag:        config.InboundTag,
+		dnsTag:     config.DnsInboundTag,
+		ipv6Mode:   config.IPv6Mode,
+		attributes: attributes,
+	}
+	if nic.tag == "" {
+		nic.tag = "tun"
+	}
+	if nic.dnsTag == "" {
+		nic.dnsTag = "dns-in"
+	}
+
+	var pcapFile *os.File
+	if t.pcap {
+		path := time.Now().UTC().String()
+		if nic.index > 0 {
+			path += "-" + strconv.Itoa(nic.index)
+		}
+		path = externalAssetsPath + "/pcap/" + path + ".pcap"
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return newError("unable to create pcap dir").Base(err)
+		}
+		pcapFile, err = os.Create(path)
+		if err != nil {
+			return newError("unable to create pcap file").Base(err)
+		}
+	}
+	nic.capture, err = newNicCapture(t, nic.index, pcapFile)
+	if err != nil {
+		comm.CloseIgnore(pcapFile)
+		return newError("unable to write pcap file").Base(err)
+	}
+
+	var advertisement *gvisor.RouterAdvertisement
+	if config.RouterAdvertisement && config.Implementation != comm.TunImplementationSystem {
+		advertisement, err = newRouterAdvertisement(config)
+		if err != nil {
+			comm.CloseIgnore(nic.capture)
+			return err
+		}
+	}
+	switch config.Implementation {
+	case comm.TunImplementationGVisor:
+		nic.dev, err = gvisor.New(config.FileDescriptor, config.MTU, nic, gvisor.DefaultNIC, nic.capture, config.IPv6Mode, advertisement)
+	case comm.TunImplementationSystem:
+		nic.dev, err = nat.New(config.FileDescriptor, config.MTU, nic, config.IPv6Mode, t.multicastMode, func(fd uintptr) {
+			t.bindUpstream(fd)
+		}, t.errorHandler.HandleError, nic.capture)
+	case comm.TunImplementationPacketFlow:
+		if config.PacketFlow == nil {
+			err = newError("missing packet flow")
+			break
+		}
+		nic.flow = newPacketFlowDevice(config.PacketFlow, int(config.MTU))
+		nic.dev, err = gvisor.NewWithDevice(nic.flow, nic, gvisor.DefaultNIC, nic.capture, config.IPv6Mode, advertisement)
+	case comm.TunImplementationWintun, comm.TunImplementationUtun:
+		var device tun.Device
+		device, err = openTunDevice(config.Implementation, config.DeviceName, int(config.MTU))
+		if err == nil {
+			nic.dev, err = gvisor.NewWithDevice(device, nic, gvisor.DefaultNIC, nic.capture, config.IPv6Mode, advertisement)
+			if err != nil {
+				comm.CloseIgnore(device)
+			}
+		}
+	default:
+		err = newError("unknown tun implementation ", config.Implementation)
+	}
+	if err != nil {
+		comm.CloseIgnore(nic.capture)
+		return err
+	}
+
+	t.nics = append(t.nics, nic)
+	return nil
+}
+
+func newRouterAdvertisement(config *TunDeviceConfig) (*gvisor.RouterAdvertisement, error) {
+	advertisement := &gvisor.RouterAdvertisement{MTU: uint32(config.MTU)}
+	gateway := net.ParseIP(config.Gateway6)
+	if config.AdvertisedPrefix != "" {
+		_, prefix, err := net.ParseCIDR(config.AdvertisedPrefix)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, newError("invalid advertised prefix ", config.AdvertisedPrefix)
+		}
+		advertisement.Prefix = prefix
+	} else if gateway != nil {
+		advertisement.Prefix = &net.IPNet{IP: gateway.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	}
+	for _, dns := range strings.Split(config.AdvertisedDns, ",") {
+		if dns = strings.TrimSpace(dns); dns == "" {
+			continue
+		}
+		ip := net.ParseIP(dns)
+		if ip == nil || ip.To4() != nil {
+			return nil, newError("invalid advertised dns ", dns)
+		}
+		advertisement.Dns = append(advertisement.Dns, ip)
+	}
+	if len(advertisement.Dns) == 0 && gateway != nil {
+		advertisement.Dns = []net.IP{gateway}
+	}
+	return advertisement, nil
+}
+
+func (t *Tun2ray) primaryNic() *tunNic {
+	t.nicsLock.Lock()
+	defer t.nicsLock.Unlock()
+	return t.nics[0]
+}
+
+// natKey keeps the udp sessions of devices with overlapping addresses apart.
+func (n *tunNic) natKey(key string) string {
+	if n.index == 0 {
+		return key
+	}
+	return strconv.Itoa(n.index) + "/" + key
+}
+
+// newContent returns a session content carrying the device attributes.
+func (n *tunNic) newContent() *session.Content {
+	content := new(session.Content)
+	for name, value := range n.attributes {
+		content.SetAttribute(name, value)
+	}
+	if n.t.id != "" {
+		content.SetAttribute(tunAttribute, n.t.id)
+	}
+	return content
+}
+
+func parseAttributes(content string) (map[string]string, error) {
+	var attributes map[string]string
+	for _, attribute := range splitRules(content) {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+		index := strings.IndexByte(attribute, '=')
+		if index <= 0 {
+			return nil, newError("invalid inbound attribute ", attribute)
+		}
+		if attributes == nil {
+			attributes = make(map[string]string)
+		}
+		attributes[strings.TrimSpace(attribute[:index])] = strings.TrimSpace(attribute[index+1:])
+	}
+	return attributes, nil
+}
@@ -0,0 +1,136 @@
+package libcore
+
+import (
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// udpKeepAliveIdleLimit stops keep-alive frames once the app itself has been
+// silent this long, so abandoned sessions can still expire.
+const udpKeepAliveIdleLimit = 5 * time.Minute
+
+var udpKeepAlives = new(udpKeepAliveRules)
+
+type udpKeepAliveRule struct {
+	ports    v2rayNet.MemoryPortList
+	interval time.Duration
+	payload  []byte
+}
+
+type udpKeepAliveRules struct {
+	access sync.RWMutex
+	rules  []*udpKeepAliveRule
+}
+
+// AddUdpKeepAlive sends payload (hex encoded) through udp sessions to the
+// given destination ports (e.g. "51820,27015-27030") whenever the app has not
+// sent anything for interval seconds. v2ray drops empty datagrams, so an empty
+// payload sends a single zero byte.
+func AddUdpKeepAlive(ports string, interval int32, payload string) error {
+	if interval <= 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid keep-alive interval ", interval))
+	}
+	rule := &udpKeepAliveRule{interval: time.Duration(interval) * time.Second}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		portRange, err := parsePortRange(port)
+		if err != nil {
+			return err
+		}
+		rule.ports = append(rule.ports, portRange)
+	}
+	if len(rule.ports) == 0 {
+		return withCode(ErrorCodeInvalidArgument, newError("empty keep-alive ports"))
+	}
+	if payload == "" {
+		rule.payload = []byte{0}
+	} else {
+		data, err := hex.DecodeString(payload)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid keep-alive payload").Base(err))
+		}
+		rule.payload = data
+	}
+	udpKeepAlives.access.Lock()
+	udpKeepAlives.rules = append(udpKeepAlives.rules, rule)
+	udpKeepAlives.access.Unlock()
+	return nil
+}
+
+func ClearUdpKeepAlive() {
+	udpKeepAlives.access.Lock()
+	udpKeepAlives.rules = nil
+	udpKeepAlives.access.Unlock()
+}
+
+func parsePortRange(port string) (v2rayNet.MemoryPortRange, error) {
+	from, to := port, port
+	if index := strings.IndexByte(port, '-'); index > 0 {
+		from, to = port[:index], port[index+1:]
+	}
+	fromPort, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return v2rayNet.MemoryPortRange{}, newError("invalid port ", port).Base(err)
+	}
+	toPort, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || toPort < fromPort {
+		return v2rayNet.MemoryPortRange{}, newError("invalid port range ", port)
+	}
+	return v2rayNet.MemoryPortRange{From: v2rayNet.Port(fromPort), To: v2rayNet.Port(toPort)}, nil
+}
+
+func (r *udpKeepAliveRules) match(port v2rayNet.Port) *udpKeepAliveRule {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	for _, rule := range r.rules {
+		if rule.ports.Contains(port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// keepAliveConn records the last write of the app to a udp session.
+type keepAliveConn struct {
+	packetConn
+	lastWrite int64
+}
+
+func (c *keepAliveConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.packetConn.WriteTo(p, addr)
+	if err == nil {
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	}
+	return
+}
+
+func (c *keepAliveConn) loop(rule *udpKeepAliveRule, destination v2rayNet.Destination) {
+	ticker := time.NewTicker(rule.interval)
+	defer ticker.Stop()
+	addr := &net.UDPAddr{
+		IP:   destination.Address.IP(),
+		Port: int(destination.Port),
+	}
+	for range ticker.C {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastWrite)))
+		if idle > udpKeepAliveIdleLimit {
+			return
+		}
+		if idle < rule.interval {
+			continue
+		}
+		if _, err := c.packetConn.WriteTo(rule.payload, addr); err != nil {
+			return
+		}
+	}
+}
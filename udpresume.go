@@ -0,0 +1,232 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpResumeMaxGrace      = 60 * time.Second
+	udpResumeRetryInterval = 500 * time.Millisecond
+)
+
+var udpResume struct {
+	access sync.RWMutex
+	grace  time.Duration
+	// changedAt is when the network last changed
+	changedAt time.Time
+	conns     map[*resumableConn]struct{}
+}
+
+// SetUdpResumeGrace keeps the udp sessions of the tun open for graceMs, at
+// most 60000, when the network changes, and dials their outbound again in
+// the meantime, so calls survive switches between Wi-Fi and cellular. The
+// app keeps its socket and nat mapping, only the datagrams sent during the
+// switch are lost. Zero, the default, disables it.
+func SetUdpResumeGrace(graceMs int32) error {
+	if graceMs < 0 || time.Duration(graceMs)*time.Millisecond > udpResumeMaxGrace {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid udp resume grace ", graceMs))
+	}
+	udpResume.access.Lock()
+	udpResume.grace = time.Duration(graceMs) * time.Millisecond
+	udpResume.access.Unlock()
+	return nil
+}
+
+func udpResumeEnabled() bool {
+	udpResume.access.RLock()
+	defer udpResume.access.RUnlock()
+	return udpResume.grace > 0
+}
+
+// resumeUdpSessions dials the outbound of every resumable session again, on
+// network changes.
+func resumeUdpSessions() {
+	udpResume.access.Lock()
+	grace := udpResume.grace
+	udpResume.changedAt = time.Now()
+	conns := make([]*resumableConn, 0, len(udpResume.conns))
+	for conn := range udpResume.conns {
+		conns = append(conns, conn)
+	}
+	udpResume.access.Unlock()
+	if grace <= 0 || len(conns) == 0 {
+		return
+	}
+	newError("resuming ", len(conns), " udp sessions").AtDebug().WriteToLog()
+	for _, conn := range conns {
+		go conn.resume(grace)
+	}
+}
+
+// resumableConn is the outbound of a udp session that is dialed again when
+// the network changes, its readers and writers move to the new connection.
+type resumableConn struct {
+	access sync.Mutex
+	conn   packetConn
+	dial   func() (packetConn, error)
+	closed bool
+	// resuming is closed once the connection is dialed again, nil if no
+	// dial is running
+	resuming chan struct{}
+}
+
+var _ packetConn = (*resumableConn)(nil)
+
+func newResumableConn(conn packetConn, dial func() (packetConn, error)) *resumableConn {
+	c := &resumableConn{conn: conn, dial: dial}
+	udpResume.access.Lock()
+	if udpResume.conns == nil {
+		udpResume.conns = make(map[*resumableConn]struct{})
+	}
+	udpResume.conns[c] = struct{}{}
+	udpResume.access.Unlock()
+	return c
+}
+
+// resume dials the outbound again until it succeeds or grace passes, the old
+// connection is closed once the new one is in place.
+func (c *resumableConn) resume(grace time.Duration) {
+	c.access.Lock()
+	if c.closed || c.resuming != nil {
+		c.access.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	c.resuming = done
+	c.access.Unlock()
+
+	deadline := time.Now().Add(grace)
+	var conn packetConn
+	for {
+		var err error
+		conn, err = c.dial()
+		if err == nil {
+			break
+		}
+		if time.Now().Add(udpResumeRetryInterval).After(deadline) {
+			newError("failed to resume udp session").Base(err).AtDebug().WriteToLog()
+			break
+		}
+		time.Sleep(udpResumeRetryInterval)
+		c.access.Lock()
+		closed := c.closed
+		c.access.Unlock()
+		if closed {
+			break
+		}
+	}
+
+	c.access.Lock()
+	var old packetConn
+	if conn != nil && !c.closed {
+		old, c.conn = c.conn, conn
+		conn = nil
+	}
+	c.resuming = nil
+	c.access.Unlock()
+	close(done)
+	if conn != nil {
+		conn.Close()
+	}
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (c *resumableConn) current() packetConn {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.conn
+}
+
+func (c *resumableConn) readFrom() (p []byte, addr net.Addr, err error) {
+	for {
+		conn := c.current()
+		p, addr, err = conn.readFrom()
+		if err == nil {
+			return
+		}
+		c.access.Lock()
+		closed, replaced, resuming := c.closed, c.conn != conn, c.resuming
+		c.access.Unlock()
+		if closed {
+			return
+		}
+		if replaced {
+			continue
+		}
+		if resuming == nil {
+			// the connection broke before the change was notified
+			udpResume.access.RLock()
+			grace := udpResume.grace
+			recent := time.Since(udpResume.changedAt) < grace
+			udpResume.access.RUnlock()
+			if !recent {
+				return
+			}
+			c.resume(grace)
+		} else {
+			<-resuming
+		}
+		if c.current() == conn {
+			return
+		}
+	}
+}
+
+func (c *resumableConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buffer, addr, err := c.readFrom()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, buffer), addr, nil
+}
+
+// WriteTo drops the datagrams that fail while the connection is dialed
+// again, so the session is not closed.
+func (c *resumableConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	conn := c.current()
+	n, err = conn.WriteTo(p, addr)
+	if err != nil {
+		c.access.Lock()
+		resuming := c.resuming != nil || c.conn != conn
+		c.access.Unlock()
+		if resuming {
+			return len(p), nil
+		}
+	}
+	return
+}
+
+func (c *resumableConn) Close() error {
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	c.access.Unlock()
+	udpResume.access.Lock()
+	delete(udpResume.conns, c)
+	udpResume.access.Unlock()
+	return conn.Close()
+}
+
+func (c *resumableConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *resumableConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *resumableConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *resumableConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
@@ -1,7 +1,23 @@
 package libcore
 
+import (
+	"net"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
 var uidDumper UidDumper
 
+// tunAttribute identifies the tun of a connection in the session content, so
+// the router looks package names up with the UidDumper of that tun.
+const tunAttribute = "libcore.tun"
+
+var (
+	tunIds   uint64
+	tunsById sync.Map
+)
+
 type UidInfo struct {
 	PackageName string
 	Label       string
@@ -15,3 +31,114 @@ type UidDumper interface {
 func SetUidDumper(dumper UidDumper) {
 	uidDumper = dumper
 }
+
+// IsKernelUidLookupSupported is whether the kernel answers socket
+// diagnostics, so a NewSockDiagUidDumper finds connection owners without its
+// fallback. SELinux denies it to apps on Android 10 and later.
+func IsKernelUidLookupSupported() bool {
+	return kernelUids.probe()
+}
+
+// sockDiagUidDumper finds connection owners with sock_diag, asking fallback
+// if the kernel does not know the connection. It is the only path to the
+// kernel lookup, apps opt in by setting it as their UidDumper.
+type sockDiagUidDumper struct {
+	fallback UidDumper
+}
+
+// NewSockDiagUidDumper returns a UidDumper asking the kernel with sock_diag
+// for the exact connection, and fallback if that fails or the kernel denies
+// it. A nil fallback scans /proc/net. The uid info comes from fallback.
+func NewSockDiagUidDumper(fallback UidDumper) UidDumper {
+	if fallback == nil {
+		fallback = procUidDumper{}
+	}
+	return &sockDiagUidDumper{fallback}
+}
+
+func (d *sockDiagUidDumper) DumpUid(ipv6 bool, udp bool, srcIp string, srcPort int32, destIp string, destPort int32) (int32, error) {
+	source, destination := net.ParseIP(srcIp), net.ParseIP(destIp)
+	if source != nil && destination != nil && kernelUids.probe() {
+		if uid, err := kernelUids.lookup(ipv6, udp, source, uint16(srcPort), destination, uint16(destPort)); err == nil {
+			return uid, nil
+		}
+	}
+	return d.fallback.DumpUid(ipv6, udp, srcIp, srcPort, destIp, destPort)
+}
+
+func (d *sockDiagUidDumper) GetUidInfo(uid int32) (*UidInfo, error) {
+	return d.fallback.GetUidInfo(uid)
+}
+
+// dumpUid finds the owner of a connection with the UidDumper.
+func dumpUid(ipv6 bool, udp bool, srcIp string, srcPort int32, destIp string, destPort int32) (int32, error) {
+	return uidLookupCache.dump(udp, srcIp, srcPort, func() (int32, error) {
+		if uidDumper == nil {
+			return -1, newError("no uid dumper")
+		}
+		return uidDumper.DumpUid(ipv6, udp, srcIp, srcPort, destIp, destPort)
+	})
+}
+
+// perUserRange is the size of the uid range of each android user, the uid of
+// an app is its app id offset by the user id times this range.
+const perUserRange = 100000
+
+const (
+	firstApplicationUid = 10000
+	systemUid           = 1000
+)
+
+// GetUserId returns the android user, e.g. a work profile, owning uid.
+func GetUserId(uid int32) int32 {
+	return uid / perUserRange
+}
+
+// GetAppId returns uid without its user offset, the same for an app in
+// every user.
+func GetAppId(uid int32) int32 {
+	return uid % perUserRange
+}
+
+// normalizeUid folds the system uids of a user into its system uid, keeping
+// app uids of secondary users intact.
+func normalizeUid(uid uint32) uint32 {
+	if uid%perUserRange < firstApplicationUid {
+		return uid/perUserRange*perUserRange + systemUid
+	}
+	return uid
+}
+
+// lookupUid finds the owner of a tun connection with the UidDumper of the tun
+// if it has one.
+func (t *Tun2ray) lookupUid(ipv6 bool, udp bool, srcIp string, srcPort int32, destIp string, destPort int32) (int32, error) {
+	if t.uidDumper != nil {
+		return uidLookupCache.dump(udp, srcIp, srcPort, func() (int32, error) {
+			return t.uidDumper.DumpUid(ipv6, udp, srcIp, srcPort, destIp, destPort)
+		})
+	}
+	return dumpUid(ipv6, udp, srcIp, srcPort, destIp, destPort)
+}
+
+// routedUidDumper returns the UidDumper of the tun a routed connection came
+// from, or nil if it has none.
+func routedUidDumper(ctx routing.Context) UidDumper {
+	attributes := ctx.GetAttributes()
+	if attributes == nil || attributes[tunAttribute] == "" {
+		return nil
+	}
+	if t, ok := tunsById.Load(attributes[tunAttribute]); ok {
+		return t.(*Tun2ray).uidDumper
+	}
+	return nil
+}
+
+func (t *Tun2ray) getUidInfo(uid int32) (*UidInfo, error) {
+	if t.uidDumper != nil {
+		return t.uidDumper.GetUidInfo(uid)
+	}
+	if uidDumper == nil {
+		return nil, newError("no uid dumper")
+	}
+	return uidDumper.GetUidInfo(uid)
+}
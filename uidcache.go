@@ -0,0 +1,143 @@
+package libcore
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	uidCacheMaxTTL     = 60 * 1000
+	uidCacheMaxEntries = 4096
+)
+
+type UidCacheStats struct {
+	Hits int64
+	// NegativeHits are lookups answered by a cached failure.
+	NegativeHits int64
+	Misses       int64
+	// Coalesced are lookups that waited for an identical one in progress.
+	Coalesced int64
+	Size      int32
+}
+
+// uidCache keeps the owners of local ports, a port belongs to one socket at
+// a time so the destination is not part of the key. Concurrent lookups of a
+// port share one call to the dumper.
+type uidCache struct {
+	access      sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]*uidCacheEntry
+
+	hits         int64
+	negativeHits int64
+	misses       int64
+	coalesced    int64
+}
+
+type uidCacheEntry struct {
+	done      chan struct{}
+	uid       int32
+	err       error
+	expiresAt time.Time
+}
+
+var uidLookupCache = new(uidCache)
+
+// SetUidCachePolicy caches connection owners by local port for ttlMs, and
+// failed lookups for negativeTtlMs, so parallel connections of an app do not
+// each call the UidDumper. Ports are soon reused by other apps, so the ttls
+// should be a few seconds at most. Zero ttlMs disables the cache.
+func SetUidCachePolicy(ttlMs int32, negativeTtlMs int32) error {
+	if ttlMs < 0 || ttlMs > uidCacheMaxTTL || negativeTtlMs < 0 || negativeTtlMs > ttlMs {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid uid cache ttls ", ttlMs, " ", negativeTtlMs))
+	}
+	uidLookupCache.access.Lock()
+	uidLookupCache.ttl = time.Duration(ttlMs) * time.Millisecond
+	uidLookupCache.negativeTTL = time.Duration(negativeTtlMs) * time.Millisecond
+	uidLookupCache.entries = nil
+	uidLookupCache.access.Unlock()
+	return nil
+}
+
+func GetUidCacheStats() *UidCacheStats {
+	uidLookupCache.access.Lock()
+	size := len(uidLookupCache.entries)
+	uidLookupCache.access.Unlock()
+	return &UidCacheStats{
+		Hits:         atomic.LoadInt64(&uidLookupCache.hits),
+		NegativeHits: atomic.LoadInt64(&uidLookupCache.negativeHits),
+		Misses:       atomic.LoadInt64(&uidLookupCache.misses),
+		Coalesced:    atomic.LoadInt64(&uidLookupCache.coalesced),
+		Size:         int32(size),
+	}
+}
+
+// dump returns the cached owner of the local port or calls lookup.
+func (c *uidCache) dump(udp bool, srcIp string, srcPort int32, lookup func() (int32, error)) (int32, error) {
+	c.access.Lock()
+	if c.ttl == 0 {
+		c.access.Unlock()
+		return lookup()
+	}
+	key := srcIp + "/" + strconv.Itoa(int(srcPort))
+	if udp {
+		key = "udp:" + key
+	}
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok {
+		select {
+		case <-entry.done:
+			if now.Before(entry.expiresAt) {
+				c.access.Unlock()
+				if entry.err != nil {
+					atomic.AddInt64(&c.negativeHits, 1)
+				} else {
+					atomic.AddInt64(&c.hits, 1)
+				}
+				return entry.uid, entry.err
+			}
+		default:
+			c.access.Unlock()
+			atomic.AddInt64(&c.coalesced, 1)
+			<-entry.done
+			return entry.uid, entry.err
+		}
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*uidCacheEntry)
+	} else if len(c.entries) >= uidCacheMaxEntries {
+		c.evict(now)
+	}
+	entry := &uidCacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	ttl, negativeTTL := c.ttl, c.negativeTTL
+	c.access.Unlock()
+
+	atomic.AddInt64(&c.misses, 1)
+	entry.uid, entry.err = lookup()
+	if entry.err != nil {
+		ttl = negativeTTL
+	}
+	entry.expiresAt = time.Now().Add(ttl)
+	close(entry.done)
+	return entry.uid, entry.err
+}
+
+// evict drops the expired entries, or all of them if none expired.
+func (c *uidCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		select {
+		case <-entry.done:
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+	if len(c.entries) >= uidCacheMaxEntries {
+		c.entries = make(map[string]*uidCacheEntry)
+	}
+}
@@ -0,0 +1,116 @@
+package libcore
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/proxy/freedom"
+)
+
+// Modes of SetUidExclusion.
+const (
+	UidExclusionDisabled int32 = iota
+	// UidExclusionDeny sends the listed uids direct.
+	UidExclusionDeny
+	// UidExclusionAllow sends all uids but the listed ones direct.
+	UidExclusionAllow
+)
+
+// UidExclusionTag is the outbound registered for the connections of excluded
+// apps, a freedom one whose sockets are protected.
+const UidExclusionTag = "uid-excluded"
+
+type uidExclusion struct {
+	mode int32
+	uids map[uint32]bool
+}
+
+// SetUidExclusion splits the traffic by app within the tun, for when the
+// app list of the vpn can not change without restarting it: the connections
+// of the excluded uids go direct through protected sockets, skipping the
+// routing. uids are separated by commas or lines, the system uids below
+// 10000 of a user match as its uid 1000. DNS queries to the gateway are not
+// excluded. It applies to new connections.
+func (t *Tun2ray) SetUidExclusion(mode int32, uids string) error {
+	if mode < UidExclusionDisabled || mode > UidExclusionAllow {
+		return withCode(ErrorCodeInvalidArgument, newError("invalid uid exclusion mode ", mode))
+	}
+	exclusion := &uidExclusion{mode: mode, uids: make(map[uint32]bool)}
+	for _, uid := range splitRules(uids) {
+		if uid = strings.TrimSpace(uid); uid == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			return withCode(ErrorCodeInvalidArgument, newError("invalid uid ", uid))
+		}
+		exclusion.uids[normalizeUid(uint32(value))] = true
+	}
+	if mode != UidExclusionDisabled {
+		if _, err := t.v2ray.excludedHandler(); err != nil {
+			return exportError(err)
+		}
+	}
+	t.uidExclusion.Store(exclusion)
+	return nil
+}
+
+// uidExclusionActive is whether connections need their uid for the
+// exclusion.
+func (t *Tun2ray) uidExclusionActive() bool {
+	exclusion, _ := t.uidExclusion.Load().(*uidExclusion)
+	return exclusion != nil && exclusion.mode != UidExclusionDisabled
+}
+
+// isUidExcluded is whether the connections of uid go direct, unknown uids
+// (0) are never excluded.
+func (t *Tun2ray) isUidExcluded(uid uint32) bool {
+	exclusion, _ := t.uidExclusion.Load().(*uidExclusion)
+	if exclusion == nil || uid == 0 {
+		return false
+	}
+	switch exclusion.mode {
+	case UidExclusionDeny:
+		return exclusion.uids[uid]
+	case UidExclusionAllow:
+		return !exclusion.uids[uid]
+	}
+	return false
+}
+
+// excludedHandler returns the direct outbound of the excluded apps,
+// registering it on first use.
+func (instance *V2RayInstance) excludedHandler() (outbound.Handler, error) {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if instance.core == nil {
+		return nil, withCode(ErrorCodeInvalidState, newError("not initialized"))
+	}
+	if handler := instance.outboundManager.GetHandler(UidExclusionTag); handler != nil {
+		return handler, nil
+	}
+	handler, err := core.CreateObject(instance.core, &core.OutboundHandlerConfig{
+		Tag:           UidExclusionTag,
+		ProxySettings: serial.ToTypedMessage(&freedom.Config{}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = instance.outboundManager.AddHandler(context.Background(), handler.(outbound.Handler)); err != nil {
+		return nil, err
+	}
+	return handler.(outbound.Handler), nil
+}
+
+// excludedContext sends a connection of an excluded app to destination,
+// recording its outbound as the router would.
+func excludedContext(ctx context.Context, content *session.Content, destination net.Destination) context.Context {
+	content.SetAttribute(outboundAttribute, UidExclusionTag)
+	return session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+}
@@ -0,0 +1,59 @@
+package libcore
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+
+	"libcore/tun"
+)
+
+// unreachableCode maps the error ending a udp session to the icmp error for
+// the app, ok is false if the error does not mean the destination refused or
+// can not be reached.
+func unreachableCode(err error) (code int, ok bool) {
+	if errors.Is(err, errBlocked) {
+		return tun.UnreachableProhibited, true
+	}
+	walkError(err, func(err error) bool {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			switch errno {
+			case syscall.ECONNREFUSED:
+				code, ok = tun.UnreachablePort, true
+			case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+				code, ok = tun.UnreachableHost, true
+			}
+		}
+		return ok
+	})
+	if ok {
+		return
+	}
+	// errors passed through pipes keep only the messages of their causes
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "connection refused"):
+		return tun.UnreachablePort, true
+	case strings.Contains(message, "network is unreachable"), strings.Contains(message, "no route to host"):
+		return tun.UnreachableHost, true
+	}
+	return 0, false
+}
+
+// writeUnreachable answers the packet of a failed udp session with an icmp
+// destination unreachable, if the stack supports it.
+func writeUnreachable(closer io.Closer, err error) {
+	writer, ok := closer.(tun.UnreachableWriter)
+	if !ok {
+		return
+	}
+	code, ok := unreachableCode(err)
+	if !ok {
+		return
+	}
+	if err = writer.WriteUnreachable(code); err != nil {
+		newError("[UDP] write unreachable").Base(err).AtDebug().WriteToLog()
+	}
+}
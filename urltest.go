@@ -13,11 +13,11 @@ import (
 )
 
 func urlTest(dialContext func(ctx context.Context, network, addr string) (net.Conn, error), link string, timeout int32) (int32, error) {
-	transport := &http.Transport{
+	transport := withTlsKeyLog(&http.Transport{
 		TLSHandshakeTimeout: time.Duration(timeout) * time.Millisecond,
 		DisableKeepAlives:   true,
 		DialContext:         dialContext,
-	}
+	})
 	req, err := http.NewRequestWithContext(context.Background(), "GET", link, nil)
 	req.Header.Set("User-Agent", fmt.Sprintf("curl/7.%d.%d", rand.Int()%54, rand.Int()%2))
 	if err != nil {
@@ -38,7 +38,7 @@ func urlTest(dialContext func(ctx context.Context, network, addr string) (net.Co
 }
 
 func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32) (int32, error) {
-	return urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+	latency, err := urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
 		dest, err := net.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
 		if err != nil {
 			return nil, err
@@ -48,4 +48,5 @@ func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32
 		}
 		return core.Dial(ctx, instance.core, dest)
 	}, link, timeout)
+	return latency, exportError(err)
 }
@@ -3,7 +3,6 @@ package libcore
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"strings"
 	"sync"
@@ -21,6 +20,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/extension"
 	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/features/policy"
 	"github.com/v2fly/v2ray-core/v5/features/routing"
 	"github.com/v2fly/v2ray-core/v5/features/stats"
 	"github.com/v2fly/v2ray-core/v5/infra/conf/serial"
@@ -40,16 +40,29 @@ type V2RayInstance struct {
 	access          sync.Mutex
 	started         bool
 	core            *core.Instance
+	config          *core.Config
 	dispatcher      *dispatcher.DefaultDispatcher
 	router          routing.Router
 	outboundManager outbound.Manager
 	statsManager    stats.Manager
 	observatory     features.TaggedFeatures
 	dnsClient       dns.Client
+	tunnels         sync.Map
+	exitIps         sync.Map
+	quotas          *quotaTracker
+	watchdog        *watchdog
+	reconnect       *reconnectSupervisor
+
+	transparentProxy *transparentProxy
+	socksInbound     *socksInbound
+	loopbacks        map[int32]*socksInbound
+
+	options   *InstanceOptions
+	lifecycle *lifecycle
 }
 
 func NewV2rayInstance() *V2RayInstance {
-	return &V2RayInstance{}
+	return &V2RayInstance{lifecycle: newLifecycle(nil)}
 }
 
 func (instance *V2RayInstance) LoadConfig(content string) error {
@@ -112,17 +125,42 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 	}
 
 	if err != nil {
-		return err
+		instance.lifecycle.set(StateFailed, err)
+		return exportError(withConfigCode(err))
 	}
+	if instance.options != nil {
+		if err = instance.options.apply(config); err != nil {
+			instance.lifecycle.set(StateFailed, err)
+			return withCode(ErrorCodeInvalidArgument, err)
+		}
+	}
+	applyOutboundSocketMarks(config)
 	c, err := core.New(config)
 	if err != nil {
-		return err
+		instance.lifecycle.set(StateFailed, err)
+		return exportError(withConfigCode(err))
 	}
 	instance.core = c
+	instance.config = config
 	instance.statsManager = c.GetFeature(stats.ManagerType()).(stats.Manager)
-	instance.router = c.GetFeature(routing.RouterType()).(routing.Router)
 	instance.outboundManager = c.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	registerBlockHandlers(instance.outboundManager)
 	instance.dispatcher = c.GetFeature(routing.DispatcherType()).(routing.Dispatcher).(*dispatcher.DefaultDispatcher)
+
+	router := newRuleRouter(c.GetFeature(routing.RouterType()).(routing.Router))
+	instance.router = router
+	policyManager := c.GetFeature(policy.ManagerType()).(policy.Manager)
+	_ = instance.dispatcher.Init(nil, instance.outboundManager, router, policyManager, instance.statsManager)
+	var tags []string
+	for _, outbound := range config.Outbound {
+		tags = append(tags, outbound.Tag)
+	}
+	var defaultTag string
+	if handler := instance.outboundManager.GetDefaultHandler(); handler != nil {
+		defaultTag = handler.Tag()
+	}
+	instance.quotas = newQuotaTracker(instance.statsManager, tags, defaultTag, router.pingRoutes.clear)
+	router.quotas = instance.quotas
 	instance.dnsClient = c.GetFeature(dns.ClientType()).(dns.Client)
 
 	o := c.GetFeature(extension.ObservatoryType())
@@ -136,36 +174,70 @@ func (instance *V2RayInstance) Start() error {
 	instance.access.Lock()
 	defer instance.access.Unlock()
 	if instance.started {
-		return errors.New("already started")
+		return withCode(ErrorCodeInvalidState, errors.New("already started"))
 	}
 	if instance.core == nil {
-		return errors.New("not initialized")
+		return withCode(ErrorCodeInvalidState, errors.New("not initialized"))
 	}
+	instance.lifecycle.set(StateStarting, nil)
 	err := instance.core.Start()
 	if err != nil {
-		return err
+		instance.lifecycle.set(StateFailed, err)
+		return exportError(err)
 	}
 	instance.started = true
+	instance.lifecycle.set(StateStarted, nil)
 	return nil
 }
 
 func (instance *V2RayInstance) QueryStats(tag string, direct string) int64 {
-	if instance.statsManager == nil {
+	if instance.quotas == nil {
 		return 0
 	}
-	counter := instance.statsManager.GetCounter(fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct))
-	if counter == nil {
-		return 0
-	}
-	return counter.Set(0)
+	return instance.quotas.take(tag, direct)
 }
 
 func (instance *V2RayInstance) Close() error {
 	instance.access.Lock()
 	defer instance.access.Unlock()
+	instance.lifecycle.set(StateStopping, nil)
+	if router, ok := instance.router.(*ruleRouter); ok {
+		router.stopWatch()
+		router.providers.closeAll()
+	}
+	if instance.watchdog != nil {
+		instance.watchdog.stop()
+		instance.watchdog = nil
+	}
+	instance.stopReconnect()
+	warmPool.release(instance)
+	dnsPrefetch.release(instance)
+	if err := tlsSessions.save(); err != nil {
+		newError("failed to save tls sessions").Base(err).AtWarning().WriteToLog()
+	}
+	if instance.quotas != nil {
+		instance.quotas.close()
+		instance.quotas = nil
+	}
+	if instance.transparentProxy != nil {
+		instance.transparentProxy.close()
+		instance.transparentProxy = nil
+	}
+	if instance.socksInbound != nil {
+		instance.socksInbound.close()
+		instance.socksInbound = nil
+	}
+	for port, loopback := range instance.loopbacks {
+		loopback.close()
+		delete(instance.loopbacks, port)
+	}
 	if instance.started {
-		return instance.core.Close()
+		if err := instance.core.Close(); err != nil {
+			instance.lifecycle.set(StateFailed, err)
+			return exportError(err)
+		}
 	}
+	instance.lifecycle.set(StateStopped, nil)
 	return nil
 }
 
@@ -318,8 +390,14 @@ func (c *dispatcherConn) readFrom() (p []byte, addr net.Addr, err error) {
 }
 
 func (c *dispatcherConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.writeToDestination(p, net.DestinationFromAddr(addr))
+}
+
+// writeToDestination writes to a destination which may be a domain, as sent
+// by socks clients.
+func (c *dispatcherConn) writeToDestination(p []byte, endpoint net.Destination) (n int, err error) {
 	buffer := buf.FromBytes(p)
-	endpoint := net.DestinationFromAddr(addr)
+	endpoint.Network = net.Network_UDP
 	buffer.Endpoint = &endpoint
 	err = c.link.Writer.WriteMultiBuffer(buf.MultiBuffer{buffer})
 	if err == nil {
@@ -0,0 +1,150 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+)
+
+// voipTimeout is the udp session timeout for sip signaling and the rtp flows
+// it negotiates, registrations and calls are often silent for minutes.
+const voipTimeout = 30 * time.Minute
+
+var sipResponse = []byte("SIP/2.0 ")
+
+var sipMethods = [][]byte{
+	[]byte("INVITE "),
+	[]byte("ACK "),
+	[]byte("BYE "),
+	[]byte("CANCEL "),
+	[]byte("REGISTER "),
+	[]byte("OPTIONS "),
+	[]byte("PRACK "),
+	[]byte("UPDATE "),
+	[]byte("INFO "),
+	[]byte("SUBSCRIBE "),
+	[]byte("NOTIFY "),
+	[]byte("REFER "),
+	[]byte("MESSAGE "),
+}
+
+func isSipMessage(data []byte) bool {
+	if bytes.HasPrefix(data, sipResponse) {
+		return true
+	}
+	for _, method := range sipMethods {
+		if bytes.HasPrefix(data, method) {
+			line := data
+			if index := bytes.IndexByte(line, '\n'); index >= 0 {
+				line = line[:index]
+			}
+			return bytes.Contains(line, []byte(" SIP/2.0"))
+		}
+	}
+	return false
+}
+
+type voipPin struct {
+	outbound string
+	expire   time.Time
+}
+
+// voipTracker remembers the rtp endpoints announced in sip sdp bodies, so
+// their flows get the sip timeout and the outbound the signaling went through.
+type voipTracker struct {
+	access sync.Mutex
+	pins   map[string]*voipPin
+}
+
+func newVoipTracker() *voipTracker {
+	return &voipTracker{pins: make(map[string]*voipPin)}
+}
+
+// inspect records the media endpoints of a sip message, local is true for
+// messages sent by the app, whose sdp announces its own rtp ports.
+func (v *voipTracker) inspect(data []byte, local v2rayNet.Destination, outboundTag string, fromApp bool) {
+	index := bytes.Index(data, []byte("\r\n\r\n"))
+	if index < 0 {
+		return
+	}
+	body := string(data[index+4:])
+	if !strings.Contains(body, "m=") {
+		return
+	}
+
+	var address string
+	var ports []int
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "c=IN ") {
+			if fields := strings.Fields(line[5:]); len(fields) == 2 {
+				address = fields[1]
+			}
+		} else if strings.HasPrefix(line, "m=") {
+			if fields := strings.Fields(line[2:]); len(fields) >= 2 {
+				if port, err := strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0]); err == nil && port > 0 {
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+	if fromApp {
+		// the sdp may carry a stun mapped address, the app sends from the tun one
+		address = local.Address.String()
+	}
+	if address == "" || net.ParseIP(address) == nil {
+		return
+	}
+
+	expire := time.Now().Add(voipTimeout)
+	v.access.Lock()
+	defer v.access.Unlock()
+	for _, port := range ports {
+		// rtp and rtcp
+		for _, p := range []int{port, port + 1} {
+			v.pins[net.JoinHostPort(address, strconv.Itoa(p))] = &voipPin{outboundTag, expire}
+		}
+	}
+	for key, pin := range v.pins {
+		if pin.expire.Before(time.Now()) {
+			delete(v.pins, key)
+		}
+	}
+}
+
+func (v *voipTracker) match(source v2rayNet.Destination, destination v2rayNet.Destination) (*voipPin, bool) {
+	v.access.Lock()
+	defer v.access.Unlock()
+	for _, key := range []string{source.NetAddr(), destination.NetAddr()} {
+		if pin, ok := v.pins[key]; ok && pin.expire.After(time.Now()) {
+			return pin, true
+		}
+	}
+	return nil, false
+}
+
+// pickOutbound returns the tag of the outbound the router selects for ctx.
+func (instance *V2RayInstance) pickOutbound(ctx context.Context, destination v2rayNet.Destination) string {
+	route := instance.routeOf(ctx, destination)
+	if route == nil {
+		if handler := instance.outboundManager.GetDefaultHandler(); handler != nil {
+			return handler.Tag()
+		}
+		return ""
+	}
+	return route.GetOutboundTag()
+}
+
+func (instance *V2RayInstance) outboundHandler(tag string) outbound.Handler {
+	if tag == "" {
+		return nil
+	}
+	return instance.outboundManager.GetHandler(tag)
+}
@@ -0,0 +1,233 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+)
+
+// Events reported to the WatchdogListener.
+const (
+	// WatchdogEventStalled is sent once the probes failed Failures times in a
+	// row.
+	WatchdogEventStalled int32 = iota
+	// WatchdogEventRestarted is sent after the default outbound was
+	// recreated.
+	WatchdogEventRestarted
+	// WatchdogEventRecovered is sent on the first successful probe after a
+	// stall.
+	WatchdogEventRecovered
+)
+
+const (
+	watchdogDefaultLink     = "https://www.gstatic.com/generate_204"
+	watchdogDefaultInterval = 30 * time.Second
+	watchdogDefaultTimeout  = 5 * time.Second
+	watchdogDefaultFailures = 3
+)
+
+type WatchdogConfig struct {
+	// Link is fetched through the default outbound, it must answer 200 or 204.
+	Link       string
+	IntervalMs int32
+	TimeoutMs  int32
+	// Failures is the number of consecutive failed probes considered a stall.
+	Failures int32
+	// Restart recreates the default outbound on a stall and resets the tun
+	// connections going through it, which drops stale mux sessions.
+	Restart bool
+}
+
+type WatchdogListener interface {
+	OnWatchdogEvent(event int32, failures int32, message string)
+}
+
+type watchdog struct {
+	instance *V2RayInstance
+	config   WatchdogConfig
+	listener WatchdogListener
+	failures int32
+	stalled  bool
+	done     chan struct{}
+}
+
+// StartWatchdog probes the data path periodically until StopWatchdog or
+// Close, a running watchdog is replaced.
+func (instance *V2RayInstance) StartWatchdog(config *WatchdogConfig, listener WatchdogListener) error {
+	if config == nil {
+		config = new(WatchdogConfig)
+	}
+	w := &watchdog{
+		instance: instance,
+		config:   *config,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	if w.config.Link == "" {
+		w.config.Link = watchdogDefaultLink
+	}
+	if w.config.IntervalMs <= 0 {
+		w.config.IntervalMs = int32(watchdogDefaultInterval / time.Millisecond)
+	}
+	if w.config.TimeoutMs <= 0 {
+		w.config.TimeoutMs = int32(watchdogDefaultTimeout / time.Millisecond)
+	}
+	if w.config.Failures <= 0 {
+		w.config.Failures = watchdogDefaultFailures
+	}
+
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return withCode(ErrorCodeInvalidState, newError("not started"))
+	}
+	if instance.watchdog != nil {
+		instance.watchdog.stop()
+	}
+	instance.watchdog = w
+	go w.loop()
+	return nil
+}
+
+func (instance *V2RayInstance) StopWatchdog() {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if instance.watchdog != nil {
+		instance.watchdog.stop()
+		instance.watchdog = nil
+	}
+}
+
+func (w *watchdog) stop() {
+	close(w.done)
+}
+
+func (w *watchdog) loop() {
+	ticker := time.NewTicker(time.Duration(w.config.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *watchdog) check() {
+	tag := w.instance.defaultOutboundTag()
+	if tag == "" {
+		return
+	}
+	_, err := urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		portNumber, _ := strconv.Atoi(port)
+		return w.instance.dialVia(ctx, host, int32(portNumber), tag)
+	}, w.config.Link, w.config.TimeoutMs)
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	if err == nil {
+		if w.stalled {
+			newError("watchdog: outbound ", tag, " recovered").AtInfo().WriteToLog()
+			w.emit(WatchdogEventRecovered, "")
+		}
+		w.failures = 0
+		w.stalled = false
+		return
+	}
+	w.failures++
+	newError("watchdog: probe through ", tag, " failed (", w.failures, ")").Base(err).AtDebug().WriteToLog()
+	if w.failures < w.config.Failures || w.stalled {
+		return
+	}
+	w.stalled = true
+	newError("watchdog: outbound ", tag, " stalled").Base(err).AtWarning().WriteToLog()
+	w.emit(WatchdogEventStalled, err.Error())
+	if !w.config.Restart {
+		return
+	}
+	if err = w.instance.restartOutbound(tag); err != nil {
+		newError("watchdog: failed to restart outbound ", tag).Base(err).AtWarning().WriteToLog()
+		return
+	}
+	w.emit(WatchdogEventRestarted, "")
+}
+
+func (w *watchdog) emit(event int32, message string) {
+	if w.listener != nil {
+		w.listener.OnWatchdogEvent(event, w.failures, message)
+	}
+}
+
+func (instance *V2RayInstance) defaultOutboundTag() string {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if instance.outboundManager == nil {
+		return ""
+	}
+	if handler := instance.outboundManager.GetDefaultHandler(); handler != nil {
+		return handler.Tag()
+	}
+	return ""
+}
+
+// restartOutbound replaces the handler of tag with a new one created from the
+// config, the manager closes the old handler, and resets the tun
+// connections routed to it.
+func (instance *V2RayInstance) restartOutbound(tag string) error {
+	instance.access.Lock()
+	var outboundConfig *core.OutboundHandlerConfig
+	for _, config := range instance.config.Outbound {
+		if config.Tag == tag {
+			outboundConfig = config
+			break
+		}
+	}
+	if outboundConfig == nil {
+		instance.access.Unlock()
+		return newError("outbound ", tag, " not found in config")
+	}
+	handler, err := core.CreateObject(instance.core, outboundConfig)
+	if err == nil {
+		err = instance.outboundManager.AddHandler(context.Background(), handler.(outbound.Handler))
+	}
+	instance.access.Unlock()
+	if err != nil {
+		return err
+	}
+
+	isDefault := tag == instance.defaultOutboundTag()
+	var affected []io.Closer
+	instance.tunnels.Range(func(key, _ interface{}) bool {
+		t := key.(*Tun2ray)
+		t.connectionsLock.Lock()
+		for item := t.connections.Front(); item != nil; item = item.Next() {
+			conn := item.Value.(*trackedConnection)
+			// connections matching no rule go to the default outbound
+			route := instance.routeOf(conn.ctx, conn.destination)
+			if route == nil && isDefault || route != nil && route.GetOutboundTag() == tag {
+				affected = append(affected, conn)
+			}
+		}
+		t.connectionsLock.Unlock()
+		return true
+	})
+	for _, conn := range affected {
+		_ = conn.Close()
+	}
+	newError("watchdog: restarted outbound ", tag, ", reset ", len(affected), " connections").AtInfo().WriteToLog()
+	return nil
+}